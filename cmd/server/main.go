@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"hls-accelerator/internal/config"
+	"hls-accelerator/internal/downloader"
 	"hls-accelerator/internal/proxy"
 )
 
+// shutdownTimeout bounds how long running proxy responses may take to finish
+// on SIGINT/SIGTERM.
+const shutdownTimeout = 5 * time.Second
+
 func main() {
 	// Optional: Load config from file if exists
 	if err := config.LoadConfig("config.json"); err != nil {
@@ -19,12 +28,45 @@ func main() {
 		log.Fatalf("Failed to create cache directory: %v", err)
 	}
 
+	// Start the managed aria2c before the server connects to it
+	var aria2 *downloader.Aria2Process
+	if config.GlobalConfig.Aria2Managed {
+		var err error
+		if aria2, err = downloader.NewAria2Process(); err != nil {
+			log.Fatalf("Failed to configure aria2c: %v", err)
+		}
+		if err := aria2.Start(); err != nil {
+			log.Fatalf("Failed to start aria2c: %v", err)
+		}
+	}
+	stopAria2 := func() {
+		if aria2 != nil {
+			aria2.Stop()
+		}
+	}
+
 	server, err := proxy.NewServer()
 	if err != nil {
+		stopAria2()
 		log.Fatalf("Failed to create server: %v", err)
 	}
 
-	if err := server.Start(); err != nil {
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.Start() }()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		stopAria2()
 		log.Fatal(err)
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down", sig)
+		// Running responses still need aria2, so it is stopped last.
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("HTTP server shutdown: %v", err)
+		}
+		cancel()
+		stopAria2()
 	}
 }
@@ -3,6 +3,16 @@
 
 set -e
 
+# ARIA2_MANAGED=true 时由 hls-accel 自己拉起并守护 aria2c；hls-accel 读取同一个变量覆盖 aria2_managed。
+# 没设置 ARIA2_MANAGED 时按 config.json 的 aria2_managed 决定，两边始终一致
+if [ -z "${ARIA2_MANAGED:-}" ] && grep -Eq '"aria2_managed"[[:space:]]*:[[:space:]]*true' /app/config.json 2>/dev/null; then
+    ARIA2_MANAGED=true
+fi
+if [ "${ARIA2_MANAGED:-}" = "true" ]; then
+    echo "Starting hls-accel with managed aria2c..."
+    exec /app/hls-accel
+fi
+
 # 启动 Aria2 RPC 服务器（后台运行）
 # 如果设置了 ARIA2_SECRET 环境变量，则使用它
 echo "Starting Aria2 RPC server..."
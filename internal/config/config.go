@@ -1,8 +1,13 @@
 package config
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 type Config struct {
@@ -13,8 +18,108 @@ type Config struct {
 	ProxyPort    int               `json:"proxy_port"`
 	CacheDir     string            `json:"cache_dir"`
 	M3U8StoreDir string            `json:"m3u8_store_dir"`
+
+	// Downloader is the download backend, "aria2" (default) or "http" for the
+	// built-in Go downloader, which runs up to HTTPDownloadConcurrency
+	// downloads at once and needs no aria2c.
+	Downloader              string `json:"downloader"`
+	HTTPDownloadConcurrency int    `json:"http_download_concurrency"`
+
+	// Aria2Endpoints spreads downloads over several aria2 instances that
+	// share CacheDir, e.g. over NFS. When empty, Aria2RPCUrl and Aria2Secret
+	// name the only instance.
+	Aria2Endpoints []Aria2Endpoint `json:"aria2_endpoints"`
+
+	// Aria2Managed has the server run aria2c (Aria2Path) itself and restart
+	// it when it exits. It is started with the options of Aria2ConfPath and
+	// Aria2Options, plus the port of Aria2RPCUrl, Aria2Secret and CacheDir.
+	Aria2Managed  bool              `json:"aria2_managed"`
+	Aria2Path     string            `json:"aria2_path"`
+	Aria2ConfPath string            `json:"aria2_conf_path"`
+	Aria2Options  map[string]string `json:"aria2_options"`
+
+	// PublicBaseURL is the address clients reach the proxy with, such as
+	// "https://media.example.com". Empty takes it from each request, and the
+	// files in M3U8StoreDir then use ProxyHost (default localhost).
+	PublicBaseURL string `json:"public_base_url"`
+
+	// TrustedProxies are the addresses and CIDR ranges of reverse proxies
+	// whose X-Forwarded-Proto, -Host and -Prefix headers name the proxy
+	// address when PublicBaseURL is empty. Other clients cannot set them.
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// Automatic per-item retry. RetryMaxAttempts counts the first download too,
+	// so 1 disables automatic retries.
+	RetryMaxAttempts int     `json:"retry_max_attempts"`
+	RetryBaseDelayMs int     `json:"retry_base_delay_ms"`
+	RetryMaxDelayMs  int     `json:"retry_max_delay_ms"`
+	RetryJitter      float64 `json:"retry_jitter"`
+
+	// A player asking the proxy for a segment that is not downloaded yet moves
+	// it and the items of this many following segments to the front of the
+	// aria2 queue; 0 keeps the manifest order.
+	PlaybackPrefetchSegments int `json:"playback_prefetch_segments"`
+
+	// Playlists fetched through /proxy/m3u8/ are reused for this long; 0 only
+	// shares requests that run at the same time.
+	PlaylistCacheTTLMs int `json:"playlist_cache_ttl_ms"`
+
+	// Upper bound for recording a live playlist; 0 records until EXT-X-ENDLIST
+	// or a manual stop.
+	LiveMaxDurationSec int `json:"live_max_duration_sec"`
+
+	// Default variant choice for master playlists; a task may bring its own.
+	VariantMaxHeight    int      `json:"variant_max_height"`
+	VariantMinHeight    int      `json:"variant_min_height"`
+	VariantMaxBandwidth uint32   `json:"variant_max_bandwidth"`
+	VariantCodecs       []string `json:"variant_codecs"`
+
+	// Languages of the EXT-X-MEDIA audio and subtitle renditions to download
+	// with the variant; "*" takes all of them, none takes the default one.
+	RenditionLanguages []string `json:"rendition_languages"`
+
+	// Completed tasks are merged into one file below ExportDir, on demand or,
+	// with ExportOnComplete, as soon as they finish. ExportFormat is the
+	// default file format, "ts" or "mp4"; a task may bring its own.
+	ExportDir        string `json:"export_dir"`
+	ExportOnComplete bool   `json:"export_on_complete"`
+	ExportFormat     string `json:"export_format"`
+
+	// Declarative ad filter rules, applied at startup and replaceable at runtime.
+	AdFilterRules []AdFilterRule `json:"ad_filter_rules"`
+
+	// AdHeuristic drops discontinuity blocks that stand out from the rest of a
+	// playlist on hosts no rule or code filter covers. A block is dropped when
+	// its score reaches AdHeuristicThreshold, between 0 and 1.
+	AdHeuristic          bool    `json:"ad_heuristic"`
+	AdHeuristicThreshold float64 `json:"ad_heuristic_threshold"`
+}
+
+// Aria2Endpoint is one aria2 instance of a pool. Name (default aria2-<n>)
+// prefixes the GIDs of its downloads; Weight (default 1) is its share of new
+// downloads.
+type Aria2Endpoint struct {
+	Name   string `json:"name"`
+	RPCUrl string `json:"rpc_url"`
+	Secret string `json:"secret"`
+	Weight int    `json:"weight"`
+}
+
+// AdFilterRule mirrors m3u8.AdRule; see there for the meaning of the fields.
+type AdFilterRule struct {
+	Name                  string    `json:"name"`
+	Match                 string    `json:"match"`
+	DiscontinuitySegments []int     `json:"discontinuity_segments,omitempty"`
+	PathPrefixOutlier     bool      `json:"path_prefix_outlier,omitempty"`
+	Durations             []float64 `json:"durations,omitempty"`
+	DurationTolerance     float64   `json:"duration_tolerance,omitempty"`
+	URLRegex              string    `json:"url_regex,omitempty"`
 }
 
+// configPath is the file LoadConfig read; settings changed at runtime are
+// read from and written back to it.
+var configPath string
+
 var GlobalConfig = Config{
 	Headers: map[string]string{
 		"User-Agent": "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
@@ -24,9 +129,32 @@ var GlobalConfig = Config{
 	ProxyPort:    8084,
 	CacheDir:     "./cache",
 	M3U8StoreDir: "",
+
+	Downloader:              "aria2",
+	HTTPDownloadConcurrency: 8,
+
+	Aria2Path:     "aria2c",
+	Aria2ConfPath: "aria2.conf",
+
+	RetryMaxAttempts: 4,
+	RetryBaseDelayMs: 5000,
+	RetryMaxDelayMs:  120000,
+	RetryJitter:      0.2,
+
+	PlaybackPrefetchSegments: 10,
+	PlaylistCacheTTLMs:       2000,
+
+	LiveMaxDurationSec: 6 * 60 * 60,
+
+	ExportDir:    "./exports",
+	ExportFormat: "ts",
+
+	AdHeuristicThreshold: 0.5,
 }
 
 func LoadConfig(path string) error {
+	configPath = path
+	defer applyEnv()
 	data, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -36,3 +164,130 @@ func LoadConfig(path string) error {
 	}
 	return json.Unmarshal(data, &GlobalConfig)
 }
+
+// applyEnv lets environment variables override the config file. The Docker
+// entrypoint leaves aria2c to the server exactly when ARIA2_MANAGED is "true",
+// so a set ARIA2_MANAGED decides aria2_managed the same way.
+func applyEnv() {
+	if value, ok := os.LookupEnv("ARIA2_MANAGED"); ok && value != "" {
+		GlobalConfig.Aria2Managed = value == "true"
+	}
+}
+
+// PublicBaseURL returns the configured public base URL without a trailing slash.
+func PublicBaseURL() string {
+	return strings.TrimRight(strings.TrimSpace(GlobalConfig.PublicBaseURL), "/")
+}
+
+// ReadAdFilterRules reads the ad filter rules from the config file again.
+func ReadAdFilterRules() ([]AdFilterRule, error) {
+	if configPath == "" {
+		return GlobalConfig.AdFilterRules, nil
+	}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var file struct {
+		AdFilterRules []AdFilterRule `json:"ad_filter_rules"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	return file.AdFilterRules, nil
+}
+
+// SaveAdFilterRules writes the ad filter rules into the config file. Only the
+// ad_filter_rules value is replaced; the rest of the file is kept byte for
+// byte.
+func SaveAdFilterRules(rules []AdFilterRule) error {
+	if configPath == "" {
+		return errors.New("no config file loaded")
+	}
+	data, err := os.ReadFile(configPath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if rules == nil {
+		rules = []AdFilterRule{}
+	}
+	encoded, err := json.MarshalIndent(rules, "  ", "  ")
+	if err != nil {
+		return err
+	}
+	out, err := setTopLevelField(data, "ad_filter_rules", encoded)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(configPath), ".config-*.json")
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(configPath); err == nil {
+		_ = tmp.Chmod(info.Mode().Perm())
+	}
+	if _, err := tmp.Write(out); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), configPath)
+}
+
+// setTopLevelField returns the JSON object in data with the value of key
+// replaced by value, or with key appended when the object lacks it. Bytes
+// outside that value are left as they are.
+func setTopLevelField(data []byte, key string, value []byte) ([]byte, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return fmt.Appendf(nil, "{\n  %q: %s\n}\n", key, value), nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil {
+		return nil, err
+	} else if tok != json.Delim('{') {
+		return nil, errors.New("config file is not a JSON object")
+	}
+	valueStart, valueEnd := -1, -1
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		afterKey := int(dec.InputOffset())
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		if tok == key {
+			// The last one wins, as when the file is loaded.
+			valueEnd = int(dec.InputOffset())
+			valueStart = afterKey + bytes.IndexByte(data[afterKey:], ':') + 1
+			valueStart += len(data[valueStart:valueEnd]) - len(bytes.TrimLeft(data[valueStart:valueEnd], " \t\r\n"))
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	closing := int(dec.InputOffset()) - 1
+
+	var out []byte
+	if valueStart >= 0 {
+		out = append(out, data[:valueStart]...)
+		out = append(out, value...)
+		return append(out, data[valueEnd:]...), nil
+	}
+	last := len(bytes.TrimRight(data[:closing], " \t\r\n"))
+	out = append(out, data[:last]...)
+	if data[last-1] != '{' {
+		out = append(out, ',')
+	}
+	out = fmt.Appendf(out, "\n  %q: %s\n", key, value)
+	return append(out, data[closing:]...), nil
+}
@@ -8,6 +8,7 @@ import (
 	"hls-accelerator/internal/config"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -15,12 +16,23 @@ type Aria2Client struct {
 	RPCUrl string
 	Secret string
 	Client *http.Client
+
+	// pingInterval overrides wsPingInterval for the notification connection.
+	pingInterval time.Duration
+
+	sessionMu sync.Mutex
+	sessionID string
+	listened  bool
 }
 
 func NewClient() *Aria2Client {
+	return newAria2Client(config.GlobalConfig.Aria2RPCUrl, config.GlobalConfig.Aria2Secret)
+}
+
+func newAria2Client(rpcURL, secret string) *Aria2Client {
 	return &Aria2Client{
-		RPCUrl: config.GlobalConfig.Aria2RPCUrl,
-		Secret: config.GlobalConfig.Aria2Secret,
+		RPCUrl: rpcURL,
+		Secret: secret,
 		Client: &http.Client{
 			Timeout: 10 * time.Second,
 			Transport: &http.Transport{
@@ -48,6 +60,10 @@ type JsonRpcError struct {
 	Message string `json:"message"`
 }
 
+func (e *JsonRpcError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
 type rpcMethodCall struct {
 	methodName string
 	params     []interface{}
@@ -59,6 +75,26 @@ type AddURIRequest struct {
 	Dir      string
 	Filename string
 	Headers  map[string]string
+	// Options are extra per-download aria2 options, e.g. "split".
+	Options map[string]string
+}
+
+func (r AddURIRequest) aria2Options() map[string]interface{} {
+	opts := map[string]interface{}{
+		"dir": r.Dir,
+		"out": r.Filename,
+	}
+	if len(r.Headers) > 0 {
+		headers := make([]string, 0, len(r.Headers))
+		for key, value := range r.Headers {
+			headers = append(headers, fmt.Sprintf("%s: %s", key, value))
+		}
+		opts["header"] = headers
+	}
+	for key, value := range r.Options {
+		opts[key] = value
+	}
+	return opts
 }
 
 type StatusFile struct {
@@ -71,6 +107,7 @@ type StatusDetail struct {
 	Dir             string       `json:"dir"`
 	CompletedLength string       `json:"completedLength"`
 	TotalLength     string       `json:"totalLength"`
+	ErrorCode       string       `json:"errorCode"`
 	ErrorMessage    string       `json:"errorMessage"`
 	Files           []StatusFile `json:"files"`
 }
@@ -107,7 +144,7 @@ func (c *Aria2Client) Call(method string, params ...interface{}) (interface{}, e
 	}
 
 	if rpcResp.Error != nil {
-		return nil, fmt.Errorf("rpc error %d: %s", rpcResp.Error.Code, rpcResp.Error.Message)
+		return nil, rpcResp.Error
 	}
 
 	return rpcResp.Result, nil
@@ -196,6 +233,28 @@ func (c *Aria2Client) TellActive() ([]Aria2Status, error) {
 	return statuses, nil
 }
 
+// GetVersion asks aria2 for its version, which also tells whether it answers.
+func (c *Aria2Client) GetVersion() (string, error) {
+	res, err := c.Call("aria2.getVersion")
+	if err != nil {
+		return "", err
+	}
+	info, _ := res.(map[string]interface{})
+	version, _ := info["version"].(string)
+	return version, nil
+}
+
+// GetSessionID returns the session ID aria2 generates each time it starts.
+func (c *Aria2Client) GetSessionID() (string, error) {
+	res, err := c.Call("aria2.getSessionInfo")
+	if err != nil {
+		return "", err
+	}
+	info, _ := res.(map[string]interface{})
+	sessionID, _ := info["sessionId"].(string)
+	return sessionID, nil
+}
+
 func (c *Aria2Client) Remove(gid string) error {
 	_, err := c.Call("aria2.remove", gid)
 	return err
@@ -454,7 +513,11 @@ func (c *Aria2Client) taskQueueGIDs(dir string) ([]string, error) {
 	if c == nil || dir == "" {
 		return nil, nil
 	}
+	return c.queueGIDs(func(statusDir string) bool { return statusDir == dir })
+}
 
+// queueGIDs lists the active and waiting downloads whose dir is kept.
+func (c *Aria2Client) queueGIDs(keep func(dir string) bool) ([]string, error) {
 	statuses, err := c.TellActive()
 	if err != nil {
 		return nil, err
@@ -462,7 +525,7 @@ func (c *Aria2Client) taskQueueGIDs(dir string) ([]string, error) {
 
 	gids := make([]string, 0, len(statuses))
 	for _, status := range statuses {
-		if status.Dir == dir {
+		if keep(status.Dir) {
 			gids = append(gids, status.Gid)
 		}
 	}
@@ -474,7 +537,7 @@ func (c *Aria2Client) taskQueueGIDs(dir string) ([]string, error) {
 			return nil, err
 		}
 		for _, status := range waiting {
-			if status.Dir == dir {
+			if keep(status.Dir) {
 				gids = append(gids, status.Gid)
 			}
 		}
@@ -563,6 +626,29 @@ func (c *Aria2Client) BatchUnpause(gids []string) error {
 	return c.batchSimpleCall("aria2.unpause", gids, c.Call)
 }
 
+// MoveToFront moves waiting downloads to the head of the aria2 queue so they
+// start next in the given order. Downloads that are already active cannot be
+// moved and are skipped.
+func (c *Aria2Client) MoveToFront(gids []string) error {
+	if c == nil {
+		return nil
+	}
+	gids = normalizeGIDs(gids)
+	if len(gids) == 0 {
+		return nil
+	}
+	// Every call puts its download at position 0, so the last one goes first.
+	calls := make([]rpcMethodCall, 0, len(gids))
+	for i := len(gids) - 1; i >= 0; i-- {
+		calls = append(calls, rpcMethodCall{
+			methodName: "aria2.changePosition",
+			params:     c.innerRPCParams(gids[i], 0, "POS_SET"),
+		})
+	}
+	_, err := c.multiCallRaw(calls)
+	return err
+}
+
 func (c *Aria2Client) batchSimpleCall(method string, gids []string, fallback func(string, ...interface{}) (interface{}, error)) error {
 	if c == nil {
 		return nil
@@ -604,22 +690,9 @@ func (c *Aria2Client) BatchAddURIs(requests []AddURIRequest) ([]string, error) {
 
 	calls := make([]rpcMethodCall, 0, len(requests))
 	for _, request := range requests {
-		opts := map[string]interface{}{
-			"dir": request.Dir,
-			"out": request.Filename,
-		}
-		if len(request.Headers) > 0 {
-			headers := make([]string, 0, len(request.Headers))
-			for key, value := range request.Headers {
-				headers = append(headers, fmt.Sprintf("%s: %s", key, value))
-			}
-			opts["header"] = headers
-		}
-
-		req := request
 		calls = append(calls, rpcMethodCall{
 			methodName: "aria2.addUri",
-			params:     c.innerRPCParams([]string{req.URI}, opts),
+			params:     c.innerRPCParams([]string{request.URI}, request.aria2Options()),
 			fallback:   nil,
 		})
 	}
@@ -652,10 +725,14 @@ func (c *Aria2Client) BatchAddURIs(requests []AddURIRequest) ([]string, error) {
 func (c *Aria2Client) batchAddFallback(requests []AddURIRequest) ([]string, error) {
 	gids := make([]string, 0, len(requests))
 	for _, request := range requests {
-		gid, err := c.AddUri(request.URI, request.Dir, request.Filename, request.Headers, "")
+		res, err := c.Call("aria2.addUri", []string{request.URI}, request.aria2Options())
 		if err != nil {
 			return gids, err
 		}
+		gid, ok := res.(string)
+		if !ok {
+			return gids, fmt.Errorf("invalid response type for gid")
+		}
 		gids = append(gids, gid)
 	}
 	return gids, nil
@@ -683,7 +760,7 @@ func (c *Aria2Client) BatchTellStatus(gids []string) (map[string]StatusDetail, e
 			calls = append(calls, rpcMethodCall{
 				methodName: "aria2.tellStatus",
 				params: c.innerRPCParams(gid, []string{
-					"gid", "status", "dir", "completedLength", "totalLength", "files", "errorMessage",
+					"gid", "status", "dir", "completedLength", "totalLength", "files", "errorCode", "errorMessage",
 				}),
 			})
 		}
@@ -0,0 +1,307 @@
+package downloader
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"hls-accelerator/internal/config"
+)
+
+const (
+	aria2DefaultRPCPort  = "6800"
+	aria2ReadyTimeout    = 15 * time.Second
+	aria2ReadyPoll       = 200 * time.Millisecond
+	aria2StopTimeout     = 10 * time.Second
+	aria2RestartMinDelay = time.Second
+	aria2RestartMaxDelay = time.Minute
+	// aria2StableRun is how long aria2c has to keep running for the restart
+	// backoff to start over.
+	aria2StableRun = time.Minute
+)
+
+// Aria2Process runs aria2c as a child of the server for the aria2_managed
+// setting. aria2c gets the options of the aria2 config file, overridden by
+// aria2_options and by the RPC port, secret and cache directory the server
+// uses. It is restarted with a growing delay whenever it exits, its output
+// goes to the server log, and Stop shuts it down.
+type Aria2Process struct {
+	path   string
+	args   []string
+	client *Aria2Client
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+// aria2Run is one aria2c process; done is closed once it has exited.
+type aria2Run struct {
+	cmd     *exec.Cmd
+	started time.Time
+	done    chan struct{}
+	err     error
+}
+
+type aria2Option struct {
+	key   string
+	value string
+}
+
+// NewAria2Process prepares the managed aria2c for the configured single aria2
+// instance.
+func NewAria2Process() (*Aria2Process, error) {
+	cfg := config.GlobalConfig
+	if cfg.Downloader != "" && cfg.Downloader != BackendAria2 {
+		return nil, fmt.Errorf("aria2_managed needs the %q downloader, not %q", BackendAria2, cfg.Downloader)
+	}
+	if len(cfg.Aria2Endpoints) > 0 {
+		return nil, errors.New("aria2_managed runs a single aria2 instance and cannot be combined with aria2_endpoints")
+	}
+	options, err := readAria2Conf(cfg.Aria2ConfPath)
+	if err != nil {
+		return nil, err
+	}
+	args, err := aria2Args(options, cfg)
+	if err != nil {
+		return nil, err
+	}
+	path := strings.TrimSpace(cfg.Aria2Path)
+	if path == "" {
+		path = "aria2c"
+	}
+	return &Aria2Process{
+		path:    path,
+		args:    args,
+		client:  newAria2Client(cfg.Aria2RPCUrl, cfg.Aria2Secret),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}, nil
+}
+
+// readAria2Conf reads the key=value lines of an aria2 config file. A missing
+// file has no options.
+func readAria2Conf(path string) ([]aria2Option, error) {
+	if strings.TrimSpace(path) == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var options []aria2Option
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s: invalid line %q", path, line)
+		}
+		options = append(options, aria2Option{key: strings.TrimSpace(key), value: strings.TrimSpace(value)})
+	}
+	return options, nil
+}
+
+// aria2Args merges the options of the config file with aria2_options and the
+// settings the server depends on, later ones replacing every earlier value of
+// the same key, and returns them as command line arguments.
+func aria2Args(options []aria2Option, cfg config.Config) ([]string, error) {
+	set := func(key, value string) {
+		kept := options[:0]
+		for _, option := range options {
+			if option.key != key {
+				kept = append(kept, option)
+			}
+		}
+		options = append(kept, aria2Option{key: key, value: value})
+	}
+	for _, key := range slices.Sorted(maps.Keys(cfg.Aria2Options)) {
+		set(key, cfg.Aria2Options[key])
+	}
+
+	rpcURL, err := url.Parse(cfg.Aria2RPCUrl)
+	if err != nil {
+		return nil, fmt.Errorf("aria2_rpc_url: %w", err)
+	}
+	port := rpcURL.Port()
+	if port == "" {
+		port = aria2DefaultRPCPort
+	}
+	cacheDir, err := filepath.Abs(cfg.CacheDir)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Aria2Secret == "" {
+		for _, option := range options {
+			if option.key == "rpc-secret" {
+				return nil, errors.New("the aria2 options set rpc-secret, but aria2_secret is empty")
+			}
+		}
+	} else {
+		set("rpc-secret", cfg.Aria2Secret)
+	}
+	set("enable-rpc", "true")
+	set("rpc-listen-port", port)
+	set("dir", cacheDir)
+	// aria2c has to stay in the foreground to be supervised.
+	set("daemon", "false")
+
+	// The options are complete; aria2c must not read its default config file.
+	args := []string{"--no-conf=true"}
+	for _, option := range options {
+		if option.key == "conf-path" || option.key == "no-conf" {
+			continue
+		}
+		args = append(args, "--"+option.key+"="+option.value)
+	}
+	return args, nil
+}
+
+// Start launches aria2c, waits until its RPC answers and keeps it running
+// from then on. It refuses to start when an aria2 keeps answering at the
+// configured address, which would otherwise take the port; one that is
+// shutting down, like the aria2c of a killed server, is waited for.
+func (p *Aria2Process) Start() error {
+	deadline := time.Now().Add(aria2StopTimeout)
+	for p.answers() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("an aria2 already answers at %s; stop it or turn aria2_managed off", p.client.RPCUrl)
+		}
+		time.Sleep(aria2ReadyPoll)
+	}
+	run, err := p.spawn()
+	if err != nil {
+		return err
+	}
+	if err := p.waitReady(run); err != nil {
+		p.shutdown(run)
+		return err
+	}
+	log.Printf("aria2c started, pid %d", run.cmd.Process.Pid)
+	go p.supervise(run)
+	return nil
+}
+
+// Stop shuts aria2c down and stops restarting it.
+func (p *Aria2Process) Stop() {
+	p.stopOnce.Do(func() { close(p.stop) })
+	<-p.stopped
+}
+
+// answers reports whether an aria2 RPC, possibly with another secret,
+// answers at the configured address.
+func (p *Aria2Process) answers() bool {
+	var rpcErr *JsonRpcError
+	_, err := p.client.GetVersion()
+	return err == nil || errors.As(err, &rpcErr)
+}
+
+func (p *Aria2Process) spawn() (*aria2Run, error) {
+	cmd := exec.Command(p.path, p.args...)
+	stopWithParent(cmd)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start %s: %w", p.path, err)
+	}
+	run := &aria2Run{cmd: cmd, started: time.Now(), done: make(chan struct{})}
+	go func() {
+		scanner := bufio.NewScanner(out)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				log.Printf("aria2c: %s", line)
+			}
+		}
+		run.err = cmd.Wait()
+		close(run.done)
+	}()
+	return run, nil
+}
+
+func (p *Aria2Process) waitReady(run *aria2Run) error {
+	deadline := time.Now().Add(aria2ReadyTimeout)
+	for {
+		if _, err := p.client.GetVersion(); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("aria2c did not answer at %s within %s", p.client.RPCUrl, aria2ReadyTimeout)
+		}
+		select {
+		case <-run.done:
+			return fmt.Errorf("aria2c exited before its RPC was ready: %v", run.err)
+		case <-time.After(aria2ReadyPoll):
+		}
+	}
+}
+
+// supervise restarts aria2c whenever it exits. The delay doubles with every
+// restart up to aria2RestartMaxDelay and starts over after a stable run.
+func (p *Aria2Process) supervise(run *aria2Run) {
+	defer close(p.stopped)
+	delay := aria2RestartMinDelay
+	for {
+		if run != nil {
+			select {
+			case <-run.done:
+			case <-p.stop:
+				p.shutdown(run)
+				return
+			}
+			ran := time.Since(run.started)
+			log.Printf("aria2c exited after %s: %v", ran.Round(time.Second), run.err)
+			if ran >= aria2StableRun {
+				delay = aria2RestartMinDelay
+			}
+		}
+		select {
+		case <-time.After(delay):
+		case <-p.stop:
+			return
+		}
+		delay = min(delay*2, aria2RestartMaxDelay)
+
+		var err error
+		if run, err = p.spawn(); err != nil {
+			log.Printf("aria2c not restarted: %v", err)
+			continue
+		}
+		log.Printf("aria2c restarted, pid %d", run.cmd.Process.Pid)
+	}
+}
+
+// shutdown asks aria2c to exit through RPC, falls back to an interrupt and
+// kills it when it has not exited within aria2StopTimeout.
+func (p *Aria2Process) shutdown(run *aria2Run) {
+	if _, err := p.client.Call("aria2.shutdown"); err != nil {
+		if err := run.cmd.Process.Signal(os.Interrupt); err != nil {
+			_ = run.cmd.Process.Kill()
+		}
+	}
+	select {
+	case <-run.done:
+	case <-time.After(aria2StopTimeout):
+		log.Printf("aria2c did not exit within %s, killing it", aria2StopTimeout)
+		_ = run.cmd.Process.Kill()
+		<-run.done
+	}
+	log.Printf("aria2c stopped")
+}
@@ -0,0 +1,12 @@
+package downloader
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// stopWithParent has the kernel send aria2c SIGTERM when the server dies, so
+// a killed server does not leave it holding the RPC port.
+func stopWithParent(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGTERM}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package downloader
+
+import "os/exec"
+
+// stopWithParent is only supported on Linux; elsewhere Start waits for an
+// aria2c left behind by a killed server to exit.
+func stopWithParent(cmd *exec.Cmd) {}
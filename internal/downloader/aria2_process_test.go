@@ -0,0 +1,133 @@
+package downloader
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestFakeAria2c is not a test but the aria2c the process tests run: a
+// JSON-RPC server at $FAKE_ARIA2C_ADDR whose session ID is its pid. It exits
+// 0 on aria2.shutdown, 1 on aria2.forceShutdown and by itself after
+// $FAKE_ARIA2C_LIFETIME if that is set.
+func TestFakeAria2c(t *testing.T) {
+	addr := os.Getenv("FAKE_ARIA2C_ADDR")
+	if addr == "" {
+		t.Skip("run by the aria2 process tests")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		os.Exit(2)
+	}
+	if lifetime, err := time.ParseDuration(os.Getenv("FAKE_ARIA2C_LIFETIME")); err == nil {
+		time.AfterFunc(lifetime, func() { os.Exit(0) })
+	}
+	exit := func(code int) {
+		// Let the response go out first.
+		time.AfterFunc(50*time.Millisecond, func() { os.Exit(code) })
+	}
+	_ = http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req JsonRpcRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var result interface{} = "OK"
+		switch req.Method {
+		case "aria2.getVersion":
+			result = map[string]string{"version": "fake"}
+		case "aria2.getSessionInfo":
+			result = map[string]string{"sessionId": strconv.Itoa(os.Getpid())}
+		case "aria2.shutdown":
+			exit(0)
+		case "aria2.forceShutdown":
+			exit(1)
+		}
+		_ = json.NewEncoder(w).Encode(JsonRpcResponse{ID: req.ID, Result: result})
+	}))
+	os.Exit(2)
+}
+
+// newFakeAria2Process returns an Aria2Process running TestFakeAria2c on a
+// free port.
+func newFakeAria2Process(t *testing.T) *Aria2Process {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	t.Setenv("FAKE_ARIA2C_ADDR", addr)
+	return &Aria2Process{
+		path:    os.Args[0],
+		args:    []string{"-test.run=^TestFakeAria2c$"},
+		client:  newAria2Client("http://"+addr+"/jsonrpc", ""),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+func TestAria2ProcessRestartsAria2cAndShutsItDown(t *testing.T) {
+	p := newFakeAria2Process(t)
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	first, err := p.client.GetSessionID()
+	if err != nil {
+		t.Fatalf("GetSessionID: %v", err)
+	}
+
+	_, _ = p.client.Call("aria2.forceShutdown")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if session, err := p.client.GetSessionID(); err == nil && session != first {
+			break
+		}
+		if time.Now().After(deadline) {
+			p.Stop()
+			t.Fatal("aria2c was not restarted after it exited")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	p.Stop()
+	if _, err := p.client.GetVersion(); err == nil {
+		t.Fatal("aria2c still answers after Stop")
+	}
+}
+
+func TestAria2ProcessStartWaitsForLeftoverAria2cToExit(t *testing.T) {
+	p := newFakeAria2Process(t)
+	// The aria2c of a killed server, shutting down.
+	leftover := exec.Command(os.Args[0], "-test.run=^TestFakeAria2c$")
+	leftover.Env = append(os.Environ(), "FAKE_ARIA2C_LIFETIME=500ms")
+	if err := leftover.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = leftover.Wait() })
+	deadline := time.Now().Add(5 * time.Second)
+	for !p.answers() {
+		if time.Now().After(deadline) {
+			t.Fatal("the leftover aria2c did not come up")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if err := p.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer p.Stop()
+	session, err := p.client.GetSessionID()
+	if err != nil {
+		t.Fatalf("GetSessionID: %v", err)
+	}
+	if session == strconv.Itoa(leftover.Process.Pid) {
+		t.Fatal("Start took over the leftover aria2c instead of starting its own")
+	}
+}
@@ -4,8 +4,13 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"hls-accelerator/internal/config"
 )
 
 func TestNormalizeGIDs(t *testing.T) {
@@ -246,3 +251,75 @@ func TestCleanupTaskByDirIncludesStoppedResults(t *testing.T) {
 		t.Fatalf("system.multicall count = %d, want 1", multicallCount)
 	}
 }
+
+func TestNoteConnectedReportsReconnects(t *testing.T) {
+	sessionID := "session-1"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req JsonRpcRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatalf("decode request: %v", err)
+		}
+		if req.Method != "aria2.getSessionInfo" {
+			t.Fatalf("unexpected method %s", req.Method)
+		}
+		_ = json.NewEncoder(w).Encode(JsonRpcResponse{ID: req.ID, Result: map[string]string{"sessionId": sessionID}})
+	}))
+	defer srv.Close()
+
+	client := &Aria2Client{RPCUrl: srv.URL, Client: &http.Client{Timeout: time.Second}}
+	if reconnected, changed := client.noteConnected(); reconnected || changed {
+		t.Fatalf("first connection reported as reconnect=%v sessionChanged=%v", reconnected, changed)
+	}
+	if reconnected, changed := client.noteConnected(); !reconnected || changed {
+		t.Fatalf("same session reported as reconnect=%v sessionChanged=%v", reconnected, changed)
+	}
+	sessionID = "session-2"
+	if reconnected, changed := client.noteConnected(); !reconnected || !changed {
+		t.Fatalf("restarted aria2 reported as reconnect=%v sessionChanged=%v", reconnected, changed)
+	}
+	if client.sessionID != "session-2" {
+		t.Fatalf("sessionID = %q, want the restarted session", client.sessionID)
+	}
+}
+
+func TestAria2ArgsMergeConfWithServerSettings(t *testing.T) {
+	conf := filepath.Join(t.TempDir(), "aria2.conf")
+	data := "# RPC\nrpc-listen-port=6800\ndaemon=true\nheader=A: 1\nheader=B: 2\nsplit=16\n"
+	if err := os.WriteFile(conf, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	options, err := readAria2Conf(conf)
+	if err != nil {
+		t.Fatalf("readAria2Conf: %v", err)
+	}
+	cfg := config.Config{
+		Aria2RPCUrl:  "http://127.0.0.1:6900/jsonrpc",
+		Aria2Secret:  "s3cret",
+		CacheDir:     t.TempDir(),
+		Aria2Options: map[string]string{"split": "4", "max-concurrent-downloads": "32"},
+	}
+	args, err := aria2Args(options, cfg)
+	if err != nil {
+		t.Fatalf("aria2Args: %v", err)
+	}
+	want := []string{
+		"--no-conf=true",
+		"--header=A: 1",
+		"--header=B: 2",
+		"--max-concurrent-downloads=32",
+		"--split=4",
+		"--rpc-secret=s3cret",
+		"--enable-rpc=true",
+		"--rpc-listen-port=6900",
+		"--dir=" + cfg.CacheDir,
+		"--daemon=false",
+	}
+	if got := strings.Join(args, " "); got != strings.Join(want, " ") {
+		t.Fatalf("args = %s\nwant %s", got, strings.Join(want, " "))
+	}
+
+	cfg.Aria2Secret = ""
+	if _, err := aria2Args([]aria2Option{{key: "rpc-secret", value: "other"}}, cfg); err == nil {
+		t.Fatal("a secret aria2 is started with but the server does not know should be rejected")
+	}
+}
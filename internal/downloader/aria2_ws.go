@@ -9,20 +9,73 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 )
 
+const (
+	wsHandshakeTimeout = 10 * time.Second
+	wsWriteTimeout     = 10 * time.Second
+	// wsPingInterval is how often the notification connection is pinged. A
+	// connection that has delivered nothing, not even a pong, for two ping
+	// intervals is considered dead, e.g. after the network dropped it
+	// without either side noticing.
+	wsPingInterval = 30 * time.Second
+	// wsMaxMessageSize bounds a reassembled message; aria2 notifications
+	// are a few hundred bytes.
+	wsMaxMessageSize = 1 << 20
+)
+
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+const (
+	wsCloseNormal        = 1000
+	wsCloseProtocolError = 1002
+	wsCloseTooBig        = 1009
+)
+
 type aria2Notification struct {
 	Method string                   `json:"method"`
 	Params []map[string]interface{} `json:"params"`
 }
 
+// wsCloseError is returned when the server closed the connection.
+type wsCloseError struct {
+	code   int
+	reason string
+}
+
+func (e *wsCloseError) Error() string {
+	if e.reason == "" {
+		return fmt.Sprintf("websocket closed by server (%d)", e.code)
+	}
+	return fmt.Sprintf("websocket closed by server (%d): %s", e.code, e.reason)
+}
+
+// wsProtocolError is a violation of RFC 6455 by the server; the connection
+// is closed with code.
+type wsProtocolError struct {
+	code    int
+	message string
+}
+
+func (e *wsProtocolError) Error() string { return "websocket: " + e.message }
+
 func (c *Aria2Client) ListenNotifications(ctx context.Context, handler func(method, gid string)) error {
 	if c == nil {
 		return fmt.Errorf("aria2 client is nil")
@@ -32,31 +85,190 @@ func (c *Aria2Client) ListenNotifications(ctx context.Context, handler func(meth
 	if err != nil {
 		return err
 	}
-	defer conn.Close()
+	ws := &wsConn{conn: conn, done: make(chan struct{})}
+	defer ws.finish()
+	stopCancel := context.AfterFunc(ctx, func() { ws.close(wsCloseNormal, "") })
+	defer stopCancel()
+	go ws.pingLoop(c.wsPingInterval())
+
+	switch reconnected, sessionChanged := c.noteConnected(); {
+	case sessionChanged:
+		handler(EventSessionChanged, "")
+	case reconnected:
+		handler(EventResync, "")
+	}
 
 	for {
-		payload, opcode, err := readWebSocketFrame(conn)
+		payload, opcode, err := ws.readMessage(2 * c.wsPingInterval())
 		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			var protoErr *wsProtocolError
+			if errors.As(err, &protoErr) {
+				ws.close(protoErr.code, protoErr.message)
+			}
 			return err
 		}
+		if opcode != wsOpText {
+			continue
+		}
+		var msg aria2Notification
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			continue
+		}
+		if len(msg.Params) == 0 {
+			continue
+		}
+		gid, _ := msg.Params[0]["gid"].(string)
+		handler(msg.Method, gid)
+	}
+}
+
+func (c *Aria2Client) wsPingInterval() time.Duration {
+	if c.pingInterval > 0 {
+		return c.pingInterval
+	}
+	return wsPingInterval
+}
+
+// noteConnected records a notification connection and reports whether there
+// was one before, so notifications may have been missed in between, and
+// whether aria2 restarted since, which gives it a new session ID.
+func (c *Aria2Client) noteConnected() (reconnected, sessionChanged bool) {
+	sessionID, err := c.GetSessionID()
+	c.sessionMu.Lock()
+	defer c.sessionMu.Unlock()
+	reconnected = c.listened
+	c.listened = true
+	if err == nil && sessionID != "" {
+		if c.sessionID != "" && c.sessionID != sessionID {
+			log.Printf("aria2 %s restarted, session %s is now %s", c.RPCUrl, c.sessionID, sessionID)
+			sessionChanged = true
+		}
+		c.sessionID = sessionID
+	}
+	return reconnected, sessionChanged
+}
+
+// wsConn is an established client connection. Frames are written from the
+// read loop, the ping loop and on close, so writes are serialized.
+type wsConn struct {
+	conn net.Conn
+
+	writeMu sync.Mutex
+	closed  bool // a close frame was sent
+
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+	if ws.closed {
+		return net.ErrClosed
+	}
+	if opcode == wsOpClose {
+		ws.closed = true
+	}
+	_ = ws.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return writeWebSocketFrame(ws.conn, opcode, payload)
+}
+
+// close sends a close frame, unless one was sent already, and drops the
+// connection.
+func (ws *wsConn) close(code int, reason string) {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	if len(reason) <= 123 {
+		payload = append(payload, reason...)
+	}
+	_ = ws.writeFrame(wsOpClose, payload)
+	ws.finish()
+}
+
+func (ws *wsConn) finish() {
+	ws.doneOnce.Do(func() {
+		close(ws.done)
+		_ = ws.conn.Close()
+	})
+}
 
-		switch opcode {
-		case 0x1:
-			var msg aria2Notification
-			if err := json.Unmarshal(payload, &msg); err != nil {
-				continue
+func (ws *wsConn) pingLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ws.done:
+			return
+		case <-ticker.C:
+			if err := ws.writeFrame(wsOpPing, nil); err != nil {
+				return
 			}
-			if len(msg.Params) == 0 {
-				continue
+		}
+	}
+}
+
+// readMessage returns the next text or binary message, reassembled from its
+// fragments. Control frames in between are answered: pings with a pong, a
+// close frame with a close frame of the same code. Every frame, pongs
+// included, extends the read deadline by idle.
+func (ws *wsConn) readMessage(idle time.Duration) ([]byte, byte, error) {
+	var (
+		message []byte
+		opcode  byte
+		started bool
+	)
+	for {
+		_ = ws.conn.SetReadDeadline(time.Now().Add(idle))
+		fin, frameOp, payload, err := readWebSocketFrame(ws.conn, wsMaxMessageSize)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if frameOp >= wsOpClose {
+			if !fin || len(payload) > 125 {
+				return nil, 0, &wsProtocolError{code: wsCloseProtocolError, message: "fragmented or oversized control frame"}
 			}
-			gid, _ := msg.Params[0]["gid"].(string)
-			handler(msg.Method, gid)
-		case 0x8:
-			return io.EOF
-		case 0x9:
-			if err := writeWebSocketFrame(conn, 0xA, payload); err != nil {
-				return err
+			switch frameOp {
+			case wsOpPing:
+				if err := ws.writeFrame(wsOpPong, payload); err != nil {
+					return nil, 0, err
+				}
+			case wsOpPong:
+			case wsOpClose:
+				closeErr := &wsCloseError{code: wsCloseNormal}
+				if len(payload) >= 2 {
+					closeErr.code = int(binary.BigEndian.Uint16(payload))
+					closeErr.reason = string(payload[2:])
+				}
+				ws.close(closeErr.code, "")
+				return nil, 0, closeErr
+			default:
+				return nil, 0, &wsProtocolError{code: wsCloseProtocolError, message: fmt.Sprintf("unknown opcode %#x", frameOp)}
 			}
+			continue
+		}
+
+		switch {
+		case frameOp == wsOpContinuation && !started:
+			return nil, 0, &wsProtocolError{code: wsCloseProtocolError, message: "continuation frame without a message"}
+		case frameOp != wsOpContinuation && started:
+			return nil, 0, &wsProtocolError{code: wsCloseProtocolError, message: "new message before the last one ended"}
+		case frameOp != wsOpContinuation && frameOp != wsOpText && frameOp != wsOpBinary:
+			return nil, 0, &wsProtocolError{code: wsCloseProtocolError, message: fmt.Sprintf("unknown opcode %#x", frameOp)}
+		}
+		if frameOp != wsOpContinuation {
+			opcode = frameOp
+			started = true
+		}
+		if len(message)+len(payload) > wsMaxMessageSize {
+			return nil, 0, &wsProtocolError{code: wsCloseTooBig, message: "message too big"}
+		}
+		message = append(message, payload...)
+		if fin {
+			return message, opcode, nil
 		}
 	}
 }
@@ -67,29 +279,30 @@ func (c *Aria2Client) dialWebSocket(ctx context.Context) (net.Conn, error) {
 		return nil, err
 	}
 
-	host := wsURL.Host
-	if !strings.Contains(host, ":") {
+	port := wsURL.Port()
+	if port == "" {
 		switch wsURL.Scheme {
 		case "wss":
-			host += ":443"
+			port = "443"
 		default:
-			host += ":80"
+			port = "80"
 		}
 	}
+	address := net.JoinHostPort(wsURL.Hostname(), port)
 
-	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	dialer := &net.Dialer{Timeout: wsHandshakeTimeout}
 	var conn net.Conn
 	switch wsURL.Scheme {
 	case "wss":
-		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{
-			ServerName: strings.Split(wsURL.Host, ":")[0],
-		})
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: c.tlsConfig(wsURL.Hostname())}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", address)
 	default:
-		conn, err = dialer.DialContext(ctx, "tcp", host)
+		conn, err = dialer.DialContext(ctx, "tcp", address)
 	}
 	if err != nil {
 		return nil, err
 	}
+	_ = conn.SetDeadline(time.Now().Add(wsHandshakeTimeout))
 
 	keyBytes := make([]byte, 16)
 	if _, err := rand.Read(keyBytes); err != nil {
@@ -125,6 +338,11 @@ func (c *Aria2Client) dialWebSocket(ctx context.Context) (net.Conn, error) {
 		conn.Close()
 		return nil, fmt.Errorf("websocket upgrade failed: %s", resp.Status)
 	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") || !headerHasToken(resp.Header, "Connection", "upgrade") {
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("websocket upgrade failed: missing Upgrade or Connection header")
+	}
 
 	accept := resp.Header.Get("Sec-WebSocket-Accept")
 	if accept != expectedAcceptKey(secKey) {
@@ -133,16 +351,43 @@ func (c *Aria2Client) dialWebSocket(ctx context.Context) (net.Conn, error) {
 		return nil, fmt.Errorf("invalid websocket accept key")
 	}
 
+	_ = conn.SetDeadline(time.Time{})
 	return &bufferedConn{Conn: conn, reader: br}, nil
 }
 
+// tlsConfig returns the TLS settings of the RPC client, so wss:// accepts
+// the same certificates as the https:// RPC endpoint.
+func (c *Aria2Client) tlsConfig(serverName string) *tls.Config {
+	cfg := &tls.Config{}
+	if c.Client != nil {
+		if transport, ok := c.Client.Transport.(*http.Transport); ok && transport.TLSClientConfig != nil {
+			cfg = transport.TLSClientConfig.Clone()
+		}
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = serverName
+	}
+	return cfg
+}
+
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (c *Aria2Client) websocketURL() (*url.URL, error) {
 	rpcURL, err := url.Parse(c.RPCUrl)
 	if err != nil {
 		return nil, err
 	}
 	switch rpcURL.Scheme {
-	case "https":
+	case "https", "wss":
 		rpcURL.Scheme = "wss"
 	default:
 		rpcURL.Scheme = "ws"
@@ -164,51 +409,46 @@ func expectedAcceptKey(secKey string) string {
 	return base64.StdEncoding.EncodeToString(hash[:])
 }
 
-func readWebSocketFrame(r io.Reader) ([]byte, byte, error) {
+// readWebSocketFrame reads one frame sent by a server. Frames must not be
+// masked, must not use extensions and must not carry more than maxPayload
+// bytes.
+func readWebSocketFrame(r io.Reader, maxPayload uint64) (bool, byte, []byte, error) {
 	header := make([]byte, 2)
 	if _, err := io.ReadFull(r, header); err != nil {
-		return nil, 0, err
+		return false, 0, nil, err
 	}
 
 	fin := header[0]&0x80 != 0
 	opcode := header[0] & 0x0F
-	if !fin {
-		return nil, 0, fmt.Errorf("fragmented websocket frames are not supported")
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, &wsProtocolError{code: wsCloseProtocolError, message: "reserved bits set"}
+	}
+	if header[1]&0x80 != 0 {
+		return false, 0, nil, &wsProtocolError{code: wsCloseProtocolError, message: "masked frame from server"}
 	}
 
-	masked := header[1]&0x80 != 0
 	payloadLen := uint64(header[1] & 0x7F)
 	switch payloadLen {
 	case 126:
 		var ext uint16
 		if err := binary.Read(r, binary.BigEndian, &ext); err != nil {
-			return nil, 0, err
+			return false, 0, nil, err
 		}
 		payloadLen = uint64(ext)
 	case 127:
 		if err := binary.Read(r, binary.BigEndian, &payloadLen); err != nil {
-			return nil, 0, err
+			return false, 0, nil, err
 		}
 	}
-
-	var maskKey [4]byte
-	if masked {
-		if _, err := io.ReadFull(r, maskKey[:]); err != nil {
-			return nil, 0, err
-		}
+	if payloadLen > maxPayload {
+		return false, 0, nil, &wsProtocolError{code: wsCloseTooBig, message: "frame too big"}
 	}
 
 	payload := make([]byte, payloadLen)
 	if _, err := io.ReadFull(r, payload); err != nil {
-		return nil, 0, err
-	}
-
-	if masked {
-		for i := range payload {
-			payload[i] ^= maskKey[i%4]
-		}
+		return false, 0, nil, err
 	}
-	return payload, opcode, nil
+	return fin, opcode, payload, nil
 }
 
 func writeWebSocketFrame(w io.Writer, opcode byte, payload []byte) error {
@@ -240,12 +480,12 @@ func writeWebSocketFrame(w io.Writer, opcode byte, payload []byte) error {
 		maskedPayload[i] ^= maskKey[i%4]
 	}
 
-	if _, err := w.Write(header); err != nil {
-		return err
-	}
-	if _, err := w.Write(maskKey); err != nil {
-		return err
-	}
-	_, err := w.Write(maskedPayload)
+	// One write, so a frame is not split by a concurrent writer or a
+	// deadline between header and payload.
+	frame := make([]byte, 0, len(header)+len(maskKey)+len(maskedPayload))
+	frame = append(frame, header...)
+	frame = append(frame, maskKey...)
+	frame = append(frame, maskedPayload...)
+	_, err := w.Write(frame)
 	return err
 }
@@ -0,0 +1,177 @@
+package downloader
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// serveWebSocket accepts notification connections and runs session on the
+// server side of each. RPC calls are refused.
+func serveWebSocket(t *testing.T, useTLS bool, session func(conn net.Conn, r *bufio.Reader)) string {
+	t.Helper()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.NotFound(w, r)
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Accept: " + expectedAcceptKey(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+		_ = rw.Flush()
+		session(conn, rw.Reader)
+	})
+	srv := httptest.NewUnstartedServer(handler)
+	if useTLS {
+		srv.StartTLS()
+	} else {
+		srv.Start()
+	}
+	t.Cleanup(srv.Close)
+	return srv.URL + "/jsonrpc"
+}
+
+func writeServerFrame(t *testing.T, w io.Writer, fin bool, opcode byte, payload []byte) {
+	t.Helper()
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	if _, err := w.Write(append([]byte{first, byte(len(payload))}, payload...)); err != nil {
+		t.Errorf("write frame: %v", err)
+	}
+}
+
+// readClientFrame reads a masked frame of up to 125 bytes.
+func readClientFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, header[1]&0x7F)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= header[2+i%4]
+	}
+	return header[0] & 0x0F, payload, nil
+}
+
+func TestListenNotificationsReassemblesFragmentsAndAnswersControlFrames(t *testing.T) {
+	replies := make(chan string, 4)
+	rpcURL := serveWebSocket(t, true, func(conn net.Conn, r *bufio.Reader) {
+		writeServerFrame(t, conn, false, wsOpText, []byte(`{"jsonrpc":"2.0","method":"aria2.onDownloadComplete",`))
+		writeServerFrame(t, conn, true, wsOpPing, []byte("p1"))
+		writeServerFrame(t, conn, true, wsOpContinuation, []byte(`"params":[{"gid":"2089b05ecca3d829"}]}`))
+		for i := 0; i < 2; i++ {
+			opcode, payload, err := readClientFrame(r)
+			if err != nil {
+				t.Errorf("read client frame: %v", err)
+				return
+			}
+			switch opcode {
+			case wsOpPong:
+				replies <- "pong " + string(payload)
+				writeServerFrame(t, conn, true, wsOpClose, append(binary.BigEndian.AppendUint16(nil, 1001), "going away"...))
+			case wsOpClose:
+				replies <- fmt.Sprintf("close %d", binary.BigEndian.Uint16(payload))
+			}
+		}
+	})
+
+	client := newAria2Client(rpcURL, "")
+	var events []string
+	err := client.ListenNotifications(context.Background(), func(method, gid string) {
+		events = append(events, method+" "+gid)
+	})
+	var closeErr *wsCloseError
+	if !errors.As(err, &closeErr) || closeErr.code != 1001 || closeErr.reason != "going away" {
+		t.Fatalf("ListenNotifications = %v, want the close of the server", err)
+	}
+	if len(events) != 1 || events[0] != EventDownloadComplete+" 2089b05ecca3d829" {
+		t.Fatalf("events = %v, want the reassembled notification", events)
+	}
+	for _, want := range []string{"pong p1", "close 1001"} {
+		select {
+		case got := <-replies:
+			if got != want {
+				t.Fatalf("client replied %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("client did not reply %q", want)
+		}
+	}
+}
+
+func TestListenNotificationsDropsSilentConnection(t *testing.T) {
+	pings := make(chan struct{}, 16)
+	rpcURL := serveWebSocket(t, false, func(conn net.Conn, r *bufio.Reader) {
+		// Like a peer behind a dead link: nothing is answered.
+		for {
+			opcode, _, err := readClientFrame(r)
+			if err != nil {
+				return
+			}
+			if opcode == wsOpPing {
+				pings <- struct{}{}
+			}
+		}
+	})
+
+	client := newAria2Client(rpcURL, "")
+	client.pingInterval = 50 * time.Millisecond
+	done := make(chan error, 1)
+	go func() {
+		done <- client.ListenNotifications(context.Background(), func(string, string) {})
+	}()
+	select {
+	case err := <-done:
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Fatalf("ListenNotifications = %v, want a read timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a connection that answers nothing was not dropped")
+	}
+	if len(pings) == 0 {
+		t.Fatal("the idle connection was not pinged")
+	}
+}
+
+func TestListenNotificationsRejectsMaskedServerFrames(t *testing.T) {
+	closeCode := make(chan uint16, 1)
+	rpcURL := serveWebSocket(t, false, func(conn net.Conn, r *bufio.Reader) {
+		_, _ = conn.Write([]byte{0x80 | wsOpText, 0x80 | 2, 1, 2, 3, 4, 'h', 'i'})
+		if opcode, payload, err := readClientFrame(r); err == nil && opcode == wsOpClose && len(payload) >= 2 {
+			closeCode <- binary.BigEndian.Uint16(payload)
+		}
+	})
+
+	client := newAria2Client(rpcURL, "")
+	var protoErr *wsProtocolError
+	if err := client.ListenNotifications(context.Background(), func(string, string) {}); !errors.As(err, &protoErr) {
+		t.Fatalf("ListenNotifications = %v, want a protocol error", err)
+	}
+	select {
+	case code := <-closeCode:
+		if code != wsCloseProtocolError {
+			t.Fatalf("close code = %d, want %d", code, wsCloseProtocolError)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not close the connection with a status code")
+	}
+}
@@ -0,0 +1,83 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+
+	"hls-accelerator/internal/config"
+)
+
+// Downloader is a download queue the task manager hands its files to. GIDs,
+// statuses ("active", "waiting", "paused", "error", "complete", "removed") and
+// notification methods follow aria2, which was the only backend at first.
+type Downloader interface {
+	// BatchAddURIs queues downloads and returns their GIDs in request order.
+	BatchAddURIs(requests []AddURIRequest) ([]string, error)
+	BatchPause(gids []string) error
+	BatchUnpause(gids []string) error
+	ForceRemoveMany(gids []string)
+	// MoveToFront lets waiting downloads start next, in the given order.
+	MoveToFront(gids []string) error
+	BatchTellStatus(gids []string) (map[string]StatusDetail, error)
+	// QueueStatusesByDir reports the active, waiting and paused downloads
+	// writing into dir.
+	QueueStatusesByDir(dir string) ([]StatusDetail, error)
+	// CleanupTaskByDir drops every download of dir, running or finished.
+	CleanupTaskByDir(dir string) (int, error)
+	PurgeDownloadResult() error
+	// ListenNotifications calls handler with one of the Event methods for
+	// every state change until ctx ends or the connection breaks.
+	ListenNotifications(ctx context.Context, handler func(method, gid string)) error
+}
+
+// Notification methods passed to the ListenNotifications handler.
+const (
+	EventDownloadStart    = "aria2.onDownloadStart"
+	EventDownloadPause    = "aria2.onDownloadPause"
+	EventDownloadStop     = "aria2.onDownloadStop"
+	EventDownloadComplete = "aria2.onDownloadComplete"
+	EventDownloadError    = "aria2.onDownloadError"
+	// EventDownloadLost is sent by an Aria2Pool for the unfinished downloads
+	// of an instance that went down; they have to be queued again.
+	EventDownloadLost = "hls.onDownloadLost"
+	// EventResync is sent without a GID when a notification connection is
+	// established again. Notifications may have been missed meanwhile, and a
+	// restarted aria2 may have forgotten downloads, so the bound GIDs should
+	// be checked with BatchTellStatus.
+	EventResync = "hls.onResync"
+	// EventSessionChanged is sent instead of EventResync when aria2 restarted
+	// in between. Bound GIDs its new session does not hold were lost with the
+	// old one. The GID is empty, or "<instance>/" when only that instance of
+	// an Aria2Pool restarted.
+	EventSessionChanged = "hls.onSessionChanged"
+)
+
+const (
+	BackendAria2 = "aria2"
+	BackendHTTP  = "http"
+)
+
+var (
+	_ Downloader = (*Aria2Client)(nil)
+	_ Downloader = (*HTTPDownloader)(nil)
+	_ Downloader = (*Aria2Pool)(nil)
+)
+
+// New creates the backend chosen by the downloader setting; aria2 becomes a
+// pool when several instances are configured.
+func New() (Downloader, error) {
+	switch config.GlobalConfig.Downloader {
+	case "", BackendAria2:
+		if len(config.GlobalConfig.Aria2Endpoints) == 0 {
+			return NewClient(), nil
+		}
+		pool, err := NewAria2Pool(config.GlobalConfig.Aria2Endpoints)
+		if err != nil {
+			return nil, err
+		}
+		return pool, nil
+	case BackendHTTP:
+		return NewHTTPDownloader(config.GlobalConfig.HTTPDownloadConcurrency), nil
+	}
+	return nil, fmt.Errorf("unknown downloader %q, want %q or %q", config.GlobalConfig.Downloader, BackendAria2, BackendHTTP)
+}
@@ -0,0 +1,588 @@
+package downloader
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// PartSuffix marks a file the HTTP downloader is still writing; it is renamed
+// to the requested name once complete.
+const PartSuffix = ".part"
+
+const (
+	DefaultHTTPDownloadConcurrency = 8
+
+	httpNotificationBuffer = 4096
+	// httpStallTimeout fails a download whose body sends nothing for this long.
+	httpStallTimeout = 30 * time.Second
+)
+
+var errDownloadStalled = errors.New("download stalled")
+
+const (
+	statusActive   = "active"
+	statusWaiting  = "waiting"
+	statusPaused   = "paused"
+	statusError    = "error"
+	statusComplete = "complete"
+	statusRemoved  = "removed"
+)
+
+// HTTPDownloader downloads with plain Go HTTP requests, for deployments
+// without aria2. At most concurrency downloads run at once and the rest wait
+// in queue order. A download writes to <out>.part and continues an existing
+// part file with a Range request, so paused and interrupted downloads resume.
+// Completed downloads are forgotten at once; failed ones are kept for
+// BatchTellStatus until PurgeDownloadResult. A download fails with a timeout
+// when its response headers or, later, its body stop arriving for 30 seconds.
+type HTTPDownloader struct {
+	client       *http.Client
+	concurrency  int
+	stallTimeout time.Duration
+
+	mu        sync.Mutex
+	downloads map[string]*httpDownload
+	queue     []string // waiting GIDs in start order
+	active    int
+
+	notifications chan httpNotification
+}
+
+type httpDownload struct {
+	gid       string
+	request   AddURIRequest
+	status    string
+	completed atomic.Int64
+	total     atomic.Int64
+	errorCode string
+	errorMsg  string
+	// running is set while a goroutine works on the download; cancel stops it.
+	running bool
+	cancel  context.CancelFunc
+}
+
+type httpNotification struct {
+	method string
+	gid    string
+}
+
+// downloadError is a failure with the aria2 exit code that describes it best,
+// so failures are classified the same way with either backend.
+type downloadError struct {
+	code    string
+	message string
+}
+
+func (e *downloadError) Error() string { return e.message }
+
+func NewHTTPDownloader(concurrency int) *HTTPDownloader {
+	if concurrency <= 0 {
+		concurrency = DefaultHTTPDownloadConcurrency
+	}
+	return &HTTPDownloader{
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+				ResponseHeaderTimeout: 30 * time.Second,
+				IdleConnTimeout:       90 * time.Second,
+				MaxIdleConnsPerHost:   concurrency,
+			},
+		},
+		concurrency:   concurrency,
+		stallTimeout:  httpStallTimeout,
+		downloads:     make(map[string]*httpDownload),
+		notifications: make(chan httpNotification, httpNotificationBuffer),
+	}
+}
+
+func (d *HTTPDownloader) BatchAddURIs(requests []AddURIRequest) ([]string, error) {
+	if len(requests) == 0 {
+		return nil, nil
+	}
+	gids := make([]string, 0, len(requests))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, request := range requests {
+		gid, err := d.newGIDLocked()
+		if err != nil {
+			return gids, err
+		}
+		d.downloads[gid] = &httpDownload{gid: gid, request: request, status: statusWaiting}
+		d.queue = append(d.queue, gid)
+		gids = append(gids, gid)
+	}
+	d.startLocked()
+	return gids, nil
+}
+
+func (d *HTTPDownloader) newGIDLocked() (string, error) {
+	buf := make([]byte, 8)
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		gid := hex.EncodeToString(buf)
+		if _, taken := d.downloads[gid]; !taken {
+			return gid, nil
+		}
+	}
+}
+
+func (d *HTTPDownloader) BatchPause(gids []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	paused := make(map[string]struct{})
+	for _, gid := range normalizeGIDs(gids) {
+		dl, ok := d.downloads[gid]
+		if !ok || (dl.status != statusWaiting && dl.status != statusActive) {
+			continue
+		}
+		dl.status = statusPaused
+		if dl.cancel != nil {
+			dl.cancel()
+		}
+		paused[gid] = struct{}{}
+		d.notifyLocked(EventDownloadPause, gid)
+	}
+	d.dropFromQueueLocked(paused)
+	return nil
+}
+
+func (d *HTTPDownloader) BatchUnpause(gids []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, gid := range normalizeGIDs(gids) {
+		dl, ok := d.downloads[gid]
+		if !ok || dl.status != statusPaused {
+			continue
+		}
+		dl.status = statusWaiting
+		d.queue = append(d.queue, gid)
+	}
+	d.startLocked()
+	return nil
+}
+
+func (d *HTTPDownloader) ForceRemoveMany(gids []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	removed := make(map[string]struct{})
+	for _, gid := range normalizeGIDs(gids) {
+		dl, ok := d.downloads[gid]
+		if !ok {
+			continue
+		}
+		stopping := dl.status == statusWaiting || dl.status == statusActive || dl.status == statusPaused
+		d.removeLocked(dl)
+		removed[gid] = struct{}{}
+		if stopping {
+			d.notifyLocked(EventDownloadStop, gid)
+		}
+	}
+	d.dropFromQueueLocked(removed)
+}
+
+func (d *HTTPDownloader) MoveToFront(gids []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	front := make(map[string]struct{})
+	queue := make([]string, 0, len(d.queue))
+	for _, gid := range normalizeGIDs(gids) {
+		if dl, ok := d.downloads[gid]; ok && dl.status == statusWaiting {
+			front[gid] = struct{}{}
+			queue = append(queue, gid)
+		}
+	}
+	for _, gid := range d.queue {
+		if _, ok := front[gid]; !ok {
+			queue = append(queue, gid)
+		}
+	}
+	d.queue = queue
+	return nil
+}
+
+func (d *HTTPDownloader) BatchTellStatus(gids []string) (map[string]StatusDetail, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	out := make(map[string]StatusDetail, len(gids))
+	for _, gid := range normalizeGIDs(gids) {
+		if dl, ok := d.downloads[gid]; ok {
+			out[gid] = dl.detail()
+		}
+	}
+	return out, nil
+}
+
+func (d *HTTPDownloader) QueueStatusesByDir(dir string) ([]StatusDetail, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var out []StatusDetail
+	for _, dl := range d.downloads {
+		switch dl.status {
+		case statusActive, statusWaiting, statusPaused:
+			if dl.request.Dir == dir {
+				out = append(out, dl.detail())
+			}
+		}
+	}
+	return out, nil
+}
+
+func (d *HTTPDownloader) CleanupTaskByDir(dir string) (int, error) {
+	if dir == "" {
+		return 0, nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	removed := make(map[string]struct{})
+	for gid, dl := range d.downloads {
+		if dl.request.Dir == dir {
+			d.removeLocked(dl)
+			removed[gid] = struct{}{}
+		}
+	}
+	d.dropFromQueueLocked(removed)
+	return len(removed), nil
+}
+
+func (d *HTTPDownloader) PurgeDownloadResult() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for gid, dl := range d.downloads {
+		if dl.status == statusError || dl.status == statusComplete {
+			delete(d.downloads, gid)
+		}
+	}
+	return nil
+}
+
+// ListenNotifications delivers notifications until ctx ends. They are
+// buffered while nobody listens, and dropped once a few thousand are pending.
+// Only one listener should run at a time; several would split them.
+func (d *HTTPDownloader) ListenNotifications(ctx context.Context, handler func(method, gid string)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case n := <-d.notifications:
+			handler(n.method, n.gid)
+		}
+	}
+}
+
+func (d *HTTPDownloader) notifyLocked(method, gid string) {
+	select {
+	case d.notifications <- httpNotification{method: method, gid: gid}:
+	default:
+	}
+}
+
+// removeLocked forgets a download and stops it if it runs. Its part file
+// stays, as aria2 keeps the files of removed downloads.
+func (d *HTTPDownloader) removeLocked(dl *httpDownload) {
+	dl.status = statusRemoved
+	if dl.cancel != nil {
+		dl.cancel()
+	}
+	delete(d.downloads, dl.gid)
+}
+
+func (d *HTTPDownloader) dropFromQueueLocked(gids map[string]struct{}) {
+	if len(gids) == 0 {
+		return
+	}
+	queue := d.queue[:0]
+	for _, gid := range d.queue {
+		if _, ok := gids[gid]; !ok {
+			queue = append(queue, gid)
+		}
+	}
+	d.queue = queue
+}
+
+// startLocked starts waiting downloads while workers are free. A download
+// that was paused and resumed before its previous run wound down is left
+// for that run to queue again.
+func (d *HTTPDownloader) startLocked() {
+	for d.active < d.concurrency && len(d.queue) > 0 {
+		gid := d.queue[0]
+		d.queue = d.queue[1:]
+		dl, ok := d.downloads[gid]
+		if !ok || dl.status != statusWaiting || dl.running {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		dl.status = statusActive
+		dl.running = true
+		dl.cancel = cancel
+		d.active++
+		d.notifyLocked(EventDownloadStart, gid)
+		go d.run(ctx, dl)
+	}
+}
+
+func (d *HTTPDownloader) run(ctx context.Context, dl *httpDownload) {
+	err := d.fetch(ctx, dl)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dl.cancel()
+	dl.cancel = nil
+	dl.running = false
+	d.active--
+	switch dl.status {
+	case statusActive:
+		if err == nil {
+			dl.status = statusComplete
+			delete(d.downloads, dl.gid)
+			d.notifyLocked(EventDownloadComplete, dl.gid)
+		} else {
+			dl.status = statusError
+			dl.errorCode, dl.errorMsg = errorDetail(err)
+			d.notifyLocked(EventDownloadError, dl.gid)
+		}
+	case statusWaiting:
+		// Unpaused while this run was stopping.
+		d.queue = append([]string{dl.gid}, d.queue...)
+	}
+	d.startLocked()
+}
+
+// fetch downloads into the part file, continuing what an earlier run left
+// there, and renames it to the requested name when the body is complete.
+func (d *HTTPDownloader) fetch(ctx context.Context, dl *httpDownload) error {
+	request := dl.request
+	if err := os.MkdirAll(request.Dir, 0755); err != nil {
+		return err
+	}
+	target := filepath.Join(request.Dir, request.Filename)
+	part := target + PartSuffix
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, request.URI, nil)
+	if err != nil {
+		return &downloadError{code: "1", message: err.Error()}
+	}
+	for key, value := range request.Headers {
+		req.Header.Set(key, value)
+	}
+	// Items that are a slice of their URL come with a Range header of their own.
+	first, last, sliced := parseByteRange(req.Header.Get("Range"))
+
+	var offset int64
+	if info, err := os.Stat(part); err == nil {
+		offset = info.Size()
+	}
+	if offset > 0 {
+		if sliced && last >= 0 && first+offset > last {
+			return os.Rename(part, target)
+		}
+		lastPos := ""
+		if sliced && last >= 0 {
+			lastPos = strconv.FormatInt(last, 10)
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%s", first+offset, lastPos))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The part file does not fit the resource (anymore); start over.
+		resp.Body.Close()
+		if err := os.Remove(part); err != nil {
+			return err
+		}
+		dl.completed.Store(0)
+		return d.fetch(ctx, dl)
+	case resp.StatusCode == http.StatusPartialContent:
+		if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || start != first+offset {
+			_ = os.Remove(part)
+			return &downloadError{code: "22", message: "unexpected Content-Range " + resp.Header.Get("Content-Range")}
+		}
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		if sliced {
+			return &downloadError{code: "22", message: "server ignored the byte range of the item"}
+		}
+		offset = 0
+	default:
+		return httpStatusError(resp.StatusCode)
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	}
+	file, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return err
+	}
+	dl.completed.Store(offset)
+	if resp.ContentLength >= 0 {
+		dl.total.Store(offset + resp.ContentLength)
+	}
+	body := newStallReader(resp.Body, d.stallTimeout, cancel)
+	_, err = io.Copy(file, &progressReader{r: body, n: &dl.completed})
+	body.stop()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if errors.Is(context.Cause(ctx), errDownloadStalled) {
+			return &downloadError{code: "2", message: fmt.Sprintf("no data received for %s", d.stallTimeout)}
+		}
+		return err
+	}
+	if resp.ContentLength >= 0 && dl.completed.Load() != dl.total.Load() {
+		return io.ErrUnexpectedEOF
+	}
+	return os.Rename(part, target)
+}
+
+type progressReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n.Add(int64(n))
+	return n, err
+}
+
+// stallReader cancels a download whose body stops arriving: the request is
+// cancelled with errDownloadStalled unless some data comes in within timeout
+// of the previous read.
+type stallReader struct {
+	r       io.Reader
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newStallReader(r io.Reader, timeout time.Duration, cancel context.CancelCauseFunc) *stallReader {
+	return &stallReader{
+		r:       r,
+		timeout: timeout,
+		timer:   time.AfterFunc(timeout, func() { cancel(errDownloadStalled) }),
+	}
+}
+
+func (s *stallReader) Read(b []byte) (int, error) {
+	n, err := s.r.Read(b)
+	if n > 0 {
+		s.timer.Reset(s.timeout)
+	}
+	return n, err
+}
+
+func (s *stallReader) stop() {
+	s.timer.Stop()
+}
+
+func (dl *httpDownload) detail() StatusDetail {
+	return StatusDetail{
+		Gid:             dl.gid,
+		Status:          dl.status,
+		Dir:             dl.request.Dir,
+		CompletedLength: strconv.FormatInt(dl.completed.Load(), 10),
+		TotalLength:     strconv.FormatInt(dl.total.Load(), 10),
+		ErrorCode:       dl.errorCode,
+		ErrorMessage:    dl.errorMsg,
+		Files:           []StatusFile{{Path: filepath.Join(dl.request.Dir, dl.request.Filename)}},
+	}
+}
+
+// parseByteRange reads a "bytes=first-last" header; last is -1 when open.
+func parseByteRange(header string) (first, last int64, ok bool) {
+	spec, found := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	if !found {
+		return 0, -1, false
+	}
+	from, to, found := strings.Cut(spec, "-")
+	if !found {
+		return 0, -1, false
+	}
+	first, err := strconv.ParseInt(from, 10, 64)
+	if err != nil {
+		return 0, -1, false
+	}
+	last = -1
+	if to != "" {
+		if last, err = strconv.ParseInt(to, 10, 64); err != nil {
+			return 0, -1, false
+		}
+	}
+	return first, last, true
+}
+
+// contentRangeStart reads the first position of "bytes first-last/size".
+func contentRangeStart(header string) (int64, bool) {
+	spec, found := strings.CutPrefix(header, "bytes ")
+	if !found {
+		return 0, false
+	}
+	from, _, found := strings.Cut(spec, "-")
+	if !found {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(from, 10, 64)
+	return start, err == nil
+}
+
+func httpStatusError(status int) error {
+	code := "22"
+	switch {
+	case status == http.StatusNotFound || status == http.StatusGone:
+		code = "3"
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		code = "24"
+	case status == http.StatusServiceUnavailable:
+		code = "29"
+	}
+	return &downloadError{code: code, message: fmt.Sprintf("HTTP %d %s", status, http.StatusText(status))}
+}
+
+// errorDetail maps a failure to an aria2 exit code and message.
+func errorDetail(err error) (string, string) {
+	var downloadErr *downloadError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &downloadErr):
+		return downloadErr.code, downloadErr.message
+	case errors.As(err, &dnsErr):
+		return "19", err.Error()
+	case errors.Is(err, syscall.ENOSPC):
+		return "9", err.Error()
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "2", err.Error()
+	case errors.As(err, &netErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return "6", err.Error()
+	}
+	return "1", err.Error()
+}
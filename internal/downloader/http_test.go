@@ -0,0 +1,248 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listen collects notifications until the test ends.
+func listen(t *testing.T, d *HTTPDownloader) <-chan httpNotification {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	events := make(chan httpNotification, 64)
+	go func() {
+		_ = d.ListenNotifications(ctx, func(method, gid string) {
+			events <- httpNotification{method: method, gid: gid}
+		})
+	}()
+	return events
+}
+
+// waitFinished returns the completion or error notification of every gid.
+func waitFinished(t *testing.T, events <-chan httpNotification, gids ...string) map[string]string {
+	t.Helper()
+	want := make(map[string]bool, len(gids))
+	for _, gid := range gids {
+		want[gid] = true
+	}
+	got := make(map[string]string)
+	timeout := time.After(5 * time.Second)
+	for len(got) < len(want) {
+		select {
+		case n := <-events:
+			if want[n.gid] && (n.method == EventDownloadComplete || n.method == EventDownloadError) {
+				got[n.gid] = n.method
+			}
+		case <-timeout:
+			t.Fatalf("finished downloads = %v, want all of %v", got, gids)
+		}
+	}
+	return got
+}
+
+func TestHTTPDownloaderCompletesAndReportsErrors(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.ts" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("Referer") != "https://example.com/" {
+			t.Errorf("Referer = %q, want the request header", r.Header.Get("Referer"))
+		}
+		_, _ = w.Write([]byte("content of " + r.URL.Path))
+	}))
+	t.Cleanup(origin.Close)
+
+	d := NewHTTPDownloader(1)
+	events := listen(t, d)
+	dir := filepath.Join(t.TempDir(), "task")
+	headers := map[string]string{"Referer": "https://example.com/"}
+	gids, err := d.BatchAddURIs([]AddURIRequest{
+		{URI: origin.URL + "/a.ts", Dir: dir, Filename: "00001.ts", Headers: headers},
+		{URI: origin.URL + "/missing.ts", Dir: dir, Filename: "00002.ts", Headers: headers},
+	})
+	if err != nil || len(gids) != 2 {
+		t.Fatalf("BatchAddURIs = %v, %v", gids, err)
+	}
+
+	finished := waitFinished(t, events, gids...)
+	if finished[gids[0]] != EventDownloadComplete || finished[gids[1]] != EventDownloadError {
+		t.Fatalf("notifications = %v, want the first to complete and the second to fail", finished)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "00001.ts"))
+	if err != nil || string(data) != "content of /a.ts" {
+		t.Fatalf("downloaded file = %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "00001.ts"+PartSuffix)); !os.IsNotExist(err) {
+		t.Fatalf("part file should be renamed, stat err = %v", err)
+	}
+	statuses, _ := d.BatchTellStatus(gids)
+	if detail := statuses[gids[1]]; detail.Status != "error" || detail.ErrorCode != "3" || !strings.Contains(detail.ErrorMessage, "404") {
+		t.Fatalf("failed status = %+v, want error code 3 with the HTTP status", detail)
+	}
+	if queued, _ := d.QueueStatusesByDir(dir); len(queued) != 0 {
+		t.Fatalf("queue of dir = %+v, want finished downloads left out", queued)
+	}
+	_ = d.PurgeDownloadResult()
+	if statuses, _ := d.BatchTellStatus(gids); len(statuses) != 0 {
+		t.Fatalf("statuses after purge = %+v", statuses)
+	}
+}
+
+func TestHTTPDownloaderResumesPartFiles(t *testing.T) {
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	var mu sync.Mutex
+	ranges := make(map[string]string)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges[r.URL.Path] = r.Header.Get("Range")
+		mu.Unlock()
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(origin.Close)
+
+	dir := t.TempDir()
+	// A whole file and a byte range item, both interrupted after 4 bytes.
+	if err := os.WriteFile(filepath.Join(dir, "whole.ts"+PartSuffix), content[:4], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "slice.ts"+PartSuffix), content[10:14], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewHTTPDownloader(2)
+	events := listen(t, d)
+	gids, err := d.BatchAddURIs([]AddURIRequest{
+		{URI: origin.URL + "/whole", Dir: dir, Filename: "whole.ts"},
+		{URI: origin.URL + "/slice", Dir: dir, Filename: "slice.ts", Headers: map[string]string{"Range": "bytes=10-19"}},
+	})
+	if err != nil {
+		t.Fatalf("BatchAddURIs: %v", err)
+	}
+	for gid, method := range waitFinished(t, events, gids...) {
+		if method != EventDownloadComplete {
+			t.Fatalf("download %s: %s", gid, method)
+		}
+	}
+
+	if ranges["/whole"] != "bytes=4-" || ranges["/slice"] != "bytes=14-19" {
+		t.Fatalf("requested ranges = %v, want the rest after the part files", ranges)
+	}
+	for name, want := range map[string][]byte{"whole.ts": content, "slice.ts": content[10:20]} {
+		if got, _ := os.ReadFile(filepath.Join(dir, name)); !bytes.Equal(got, want) {
+			t.Fatalf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestHTTPDownloaderFailsStalledBodyAndResumesIt(t *testing.T) {
+	content := []byte("0123456789abcdefghij")
+	var requests atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			// Send half of the body, then nothing until the client gives up.
+			w.Header().Set("Content-Length", "20")
+			_, _ = w.Write(content[:10])
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+	t.Cleanup(origin.Close)
+
+	d := NewHTTPDownloader(1)
+	d.stallTimeout = 100 * time.Millisecond
+	events := listen(t, d)
+	dir := t.TempDir()
+	request := AddURIRequest{URI: origin.URL + "/stall.ts", Dir: dir, Filename: "stall.ts"}
+	gids, err := d.BatchAddURIs([]AddURIRequest{request})
+	if err != nil {
+		t.Fatalf("BatchAddURIs: %v", err)
+	}
+	if finished := waitFinished(t, events, gids...); finished[gids[0]] != EventDownloadError {
+		t.Fatalf("notifications = %v, want the stalled download to fail", finished)
+	}
+	statuses, _ := d.BatchTellStatus(gids)
+	if detail := statuses[gids[0]]; detail.ErrorCode != "2" || detail.CompletedLength != "10" {
+		t.Fatalf("stalled status = %+v, want a timeout after 10 bytes", detail)
+	}
+
+	// Queued again, the download continues after the bytes it got.
+	gids, err = d.BatchAddURIs([]AddURIRequest{request})
+	if err != nil {
+		t.Fatalf("BatchAddURIs: %v", err)
+	}
+	if finished := waitFinished(t, events, gids...); finished[gids[0]] != EventDownloadComplete {
+		t.Fatalf("notifications = %v, want the retry to complete", finished)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "stall.ts")); !bytes.Equal(got, content) {
+		t.Fatalf("stall.ts = %q, want %q", got, content)
+	}
+}
+
+func TestHTTPDownloaderQueueOrderPauseAndFront(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var order []string
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		order = append(order, strings.TrimPrefix(r.URL.Path, "/"))
+		mu.Unlock()
+		if r.URL.Path == "/a" {
+			<-release
+		}
+		_, _ = w.Write([]byte(r.URL.Path))
+	}))
+	t.Cleanup(origin.Close)
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+
+	d := NewHTTPDownloader(1)
+	events := listen(t, d)
+	dir := t.TempDir()
+	var requests []AddURIRequest
+	for _, name := range []string{"a", "b", "c", "d"} {
+		requests = append(requests, AddURIRequest{URI: origin.URL + "/" + name, Dir: dir, Filename: name})
+	}
+	gids, err := d.BatchAddURIs(requests)
+	if err != nil {
+		t.Fatalf("BatchAddURIs: %v", err)
+	}
+
+	// "a" holds the only worker; reorder and pause what waits behind it.
+	_ = d.MoveToFront([]string{gids[3], gids[0]})
+	_ = d.BatchPause([]string{gids[1]})
+	if queued, _ := d.QueueStatusesByDir(dir); len(queued) != 4 {
+		t.Fatalf("queue of dir = %+v, want all 4 downloads", queued)
+	}
+	close(release)
+	waitFinished(t, events, gids[0], gids[2], gids[3])
+	mu.Lock()
+	got := strings.Join(order, ",")
+	mu.Unlock()
+	if got != "a,d,c" {
+		t.Fatalf("download order = %s, want a,d,c with b paused", got)
+	}
+
+	_ = d.BatchUnpause([]string{gids[1]})
+	waitFinished(t, events, gids[1])
+	if removed, _ := d.CleanupTaskByDir(dir); removed != 0 {
+		t.Fatalf("CleanupTaskByDir removed %d, want completed downloads forgotten", removed)
+	}
+}
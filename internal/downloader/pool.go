@@ -0,0 +1,577 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"hls-accelerator/internal/config"
+)
+
+const (
+	poolProbeInterval  = 5 * time.Second
+	poolReconnectDelay = 5 * time.Second
+	// poolMaxFailures is how many failed calls in a row take an instance
+	// out of rotation.
+	poolMaxFailures = 3
+	// poolStagingDir is the directory below a download directory with one
+	// subdirectory per instance, which the instance downloads into.
+	poolStagingDir = ".aria2-staging"
+)
+
+var errNoAria2Instance = errors.New("no aria2 instance available")
+
+// Aria2Pool spreads downloads over several aria2 instances that share the
+// cache directory. Its GIDs are "<instance>/<aria2 gid>", so every call on a
+// GID reaches the instance that holds the download. New downloads go to the
+// instances that are up in proportion to their weight. An instance that stops
+// answering is taken out of rotation and its unfinished downloads are
+// reported with EventDownloadLost so they can be queued on another one; when
+// it answers again, its queue is cleared before it gets new downloads.
+//
+// Every instance downloads into its own staging directory below the requested
+// one, and completed files are moved up into place. An instance that was
+// taken out of rotation but is still running, e.g. behind a network
+// partition, therefore never writes to or removes the files, including the
+// .aria2 control file, of the download that replaced its own.
+type Aria2Pool struct {
+	nodes         []*poolNode
+	probeInterval time.Duration
+
+	mu         sync.Mutex
+	lost       []string // GIDs waiting to be reported with EventDownloadLost
+	lostSignal chan struct{}
+}
+
+type poolNode struct {
+	name   string
+	client *Aria2Client
+	weight int
+
+	// Guarded by Aria2Pool.mu.
+	current     int // smooth weighted round-robin state
+	failures    int
+	down        bool
+	outstanding map[string]struct{} // pool GIDs that have not finished yet
+}
+
+func NewAria2Pool(endpoints []config.Aria2Endpoint) (*Aria2Pool, error) {
+	if len(endpoints) == 0 {
+		return nil, errNoAria2Instance
+	}
+	p := &Aria2Pool{
+		probeInterval: poolProbeInterval,
+		lostSignal:    make(chan struct{}, 1),
+	}
+	names := make(map[string]bool, len(endpoints))
+	for i, endpoint := range endpoints {
+		name := strings.TrimSpace(endpoint.Name)
+		if name == "" {
+			name = fmt.Sprintf("aria2-%d", i+1)
+		}
+		switch {
+		case strings.Contains(name, "/"):
+			return nil, fmt.Errorf("aria2 instance name %q must not contain /", name)
+		case names[name]:
+			return nil, fmt.Errorf("duplicate aria2 instance name %q", name)
+		case strings.TrimSpace(endpoint.RPCUrl) == "":
+			return nil, fmt.Errorf("aria2 instance %s has no rpc_url", name)
+		}
+		names[name] = true
+		weight := endpoint.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		p.nodes = append(p.nodes, &poolNode{
+			name:        name,
+			client:      newAria2Client(endpoint.RPCUrl, endpoint.Secret),
+			weight:      weight,
+			outstanding: make(map[string]struct{}),
+		})
+	}
+	return p, nil
+}
+
+func (n *poolNode) poolGID(gid string) string { return n.name + "/" + gid }
+
+func (n *poolNode) stagingDir(dir string) string {
+	return filepath.Join(dir, poolStagingDir, n.name)
+}
+
+// stage points a request at the staging directory of the instance and removes
+// what an earlier download of the same file left there, which no download of
+// this instance uses anymore.
+func (n *poolNode) stage(request AddURIRequest) AddURIRequest {
+	request.Dir = n.stagingDir(request.Dir)
+	path := filepath.Join(request.Dir, request.Filename)
+	for _, leftover := range []string{path, path + ".aria2"} {
+		if err := os.Remove(leftover); err != nil && !os.IsNotExist(err) {
+			log.Printf("aria2 instance %s: %v", n.name, err)
+		}
+	}
+	return request
+}
+
+// settle moves the files of a download that completed in the staging
+// directory of the instance up into the requested directory and points
+// detail at them. Files already moved are left alone.
+func (n *poolNode) settle(detail *StatusDetail) error {
+	staging := filepath.Clean(detail.Dir)
+	if filepath.Base(staging) != n.name || filepath.Base(filepath.Dir(staging)) != poolStagingDir {
+		return nil
+	}
+	dir := filepath.Dir(filepath.Dir(staging))
+	for i, file := range detail.Files {
+		if file.Path == "" {
+			continue
+		}
+		target := filepath.Join(dir, filepath.Base(file.Path))
+		if err := os.Rename(file.Path, target); err != nil {
+			if _, statErr := os.Stat(target); !os.IsNotExist(err) || statErr != nil {
+				return err
+			}
+		}
+		detail.Files[i].Path = target
+	}
+	detail.Dir = dir
+	return nil
+}
+
+// byInstance groups pool GIDs by the instance holding them, as aria2 GIDs
+// in the given order. GIDs of unknown instances are dropped.
+func (p *Aria2Pool) byInstance(gids []string) ([]*poolNode, map[*poolNode][]string) {
+	var order []*poolNode
+	groups := make(map[*poolNode][]string)
+	for _, gid := range normalizeGIDs(gids) {
+		name, raw, ok := strings.Cut(gid, "/")
+		if !ok {
+			continue
+		}
+		for _, node := range p.nodes {
+			if node.name != name {
+				continue
+			}
+			if _, seen := groups[node]; !seen {
+				order = append(order, node)
+			}
+			groups[node] = append(groups[node], raw)
+			break
+		}
+	}
+	return order, groups
+}
+
+// pickLocked chooses the instance for the next download by smooth weighted
+// round-robin over the instances that are up and not excluded.
+func (p *Aria2Pool) pickLocked(exclude map[*poolNode]bool) *poolNode {
+	total := 0
+	var best *poolNode
+	for _, node := range p.nodes {
+		if node.down || exclude[node] {
+			continue
+		}
+		node.current += node.weight
+		total += node.weight
+		if best == nil || node.current > best.current {
+			best = node
+		}
+	}
+	if best != nil {
+		best.current -= total
+	}
+	return best
+}
+
+func (p *Aria2Pool) isDown(node *poolNode) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return node.down
+}
+
+// record updates the health of an instance after a call. Only failures to
+// reach it count; an RPC error means it answered. An instance that is down
+// only comes back through revive.
+func (p *Aria2Pool) record(node *poolNode, err error) {
+	var rpcErr *JsonRpcError
+	if errors.As(err, &rpcErr) {
+		err = nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		if !node.down {
+			node.failures = 0
+		}
+		return
+	}
+	node.failures++
+	if node.down || node.failures < poolMaxFailures {
+		return
+	}
+	node.down = true
+	for gid := range node.outstanding {
+		p.lost = append(p.lost, gid)
+	}
+	log.Printf("aria2 instance %s is down, %d downloads to be queued again: %v", node.name, len(node.outstanding), err)
+	node.outstanding = make(map[string]struct{})
+	select {
+	case p.lostSignal <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Aria2Pool) track(node *poolNode, gid string) {
+	p.mu.Lock()
+	if !node.down {
+		node.outstanding[gid] = struct{}{}
+	}
+	p.mu.Unlock()
+}
+
+func (p *Aria2Pool) forget(node *poolNode, gid string) {
+	p.mu.Lock()
+	delete(node.outstanding, gid)
+	p.mu.Unlock()
+}
+
+// BatchAddURIs assigns every request to an instance. Requests an instance
+// fails to take are assigned to the others; a request no instance took gets
+// an empty GID.
+func (p *Aria2Pool) BatchAddURIs(requests []AddURIRequest) ([]string, error) {
+	if len(requests) == 0 {
+		return nil, nil
+	}
+	gids := make([]string, len(requests))
+	added := 0
+	failed := make(map[*poolNode]bool)
+	todo := allIndexes(len(requests))
+	lastErr := errNoAria2Instance
+	for len(todo) > 0 {
+		var order []*poolNode
+		batches := make(map[*poolNode][]int)
+		p.mu.Lock()
+		for _, idx := range todo {
+			node := p.pickLocked(failed)
+			if node == nil {
+				break
+			}
+			if _, seen := batches[node]; !seen {
+				order = append(order, node)
+			}
+			batches[node] = append(batches[node], idx)
+		}
+		p.mu.Unlock()
+		if len(order) == 0 {
+			break
+		}
+
+		todo = nil
+		for _, node := range order {
+			indexes := batches[node]
+			batch := make([]AddURIRequest, 0, len(indexes))
+			for _, idx := range indexes {
+				batch = append(batch, node.stage(requests[idx]))
+			}
+			nodeGIDs, err := node.client.BatchAddURIs(batch)
+			p.record(node, err)
+			for i, gid := range nodeGIDs {
+				if i < len(indexes) && gid != "" {
+					gids[indexes[i]] = node.poolGID(gid)
+					p.track(node, gids[indexes[i]])
+					added++
+				}
+			}
+			if err != nil {
+				failed[node] = true
+				lastErr = fmt.Errorf("aria2 instance %s: %w", node.name, err)
+				if len(nodeGIDs) < len(indexes) {
+					todo = append(todo, indexes[len(nodeGIDs):]...)
+				}
+			}
+		}
+	}
+	if added == 0 {
+		return nil, lastErr
+	}
+	return gids, nil
+}
+
+func (p *Aria2Pool) BatchPause(gids []string) error {
+	order, groups := p.byInstance(gids)
+	for _, node := range order {
+		if !p.isDown(node) {
+			_ = node.client.BatchPause(groups[node])
+		}
+	}
+	return nil
+}
+
+func (p *Aria2Pool) BatchUnpause(gids []string) error {
+	order, groups := p.byInstance(gids)
+	for _, node := range order {
+		if !p.isDown(node) {
+			_ = node.client.BatchUnpause(groups[node])
+		}
+	}
+	return nil
+}
+
+func (p *Aria2Pool) ForceRemoveMany(gids []string) {
+	order, groups := p.byInstance(gids)
+	for _, node := range order {
+		for _, gid := range groups[node] {
+			p.forget(node, node.poolGID(gid))
+		}
+		if !p.isDown(node) {
+			node.client.ForceRemoveMany(groups[node])
+		}
+	}
+}
+
+func (p *Aria2Pool) MoveToFront(gids []string) error {
+	order, groups := p.byInstance(gids)
+	var firstErr error
+	for _, node := range order {
+		if p.isDown(node) {
+			continue
+		}
+		err := node.client.MoveToFront(groups[node])
+		p.record(node, err)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (p *Aria2Pool) BatchTellStatus(gids []string) (map[string]StatusDetail, error) {
+	out := make(map[string]StatusDetail, len(gids))
+	order, groups := p.byInstance(gids)
+	for _, node := range order {
+		if p.isDown(node) {
+			continue
+		}
+		statuses, err := node.client.BatchTellStatus(groups[node])
+		p.record(node, err)
+		if err != nil {
+			return nil, err
+		}
+		for _, detail := range statuses {
+			detail.Gid = node.poolGID(detail.Gid)
+			switch detail.Status {
+			case "complete", "error", "removed":
+				p.forget(node, detail.Gid)
+			}
+			if detail.Status == "complete" {
+				if err := node.settle(&detail); err != nil {
+					detail.Status = "error"
+					detail.ErrorMessage = "completed file not moved into place: " + err.Error()
+				}
+			}
+			out[detail.Gid] = detail
+		}
+	}
+	return out, nil
+}
+
+// QueueStatusesByDir asks every instance that is up about its staging
+// directory of dir; an instance that does not answer fails the call until it
+// is taken out of rotation, so callers do not queue downloads again that it
+// still holds.
+func (p *Aria2Pool) QueueStatusesByDir(dir string) ([]StatusDetail, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	var out []StatusDetail
+	for _, node := range p.nodes {
+		if p.isDown(node) {
+			continue
+		}
+		statuses, err := node.client.QueueStatusesByDir(node.stagingDir(dir))
+		p.record(node, err)
+		if err != nil {
+			return nil, fmt.Errorf("aria2 instance %s: %w", node.name, err)
+		}
+		for _, detail := range statuses {
+			detail.Gid = node.poolGID(detail.Gid)
+			p.track(node, detail.Gid)
+			out = append(out, detail)
+		}
+	}
+	return out, nil
+}
+
+func (p *Aria2Pool) CleanupTaskByDir(dir string) (int, error) {
+	if dir == "" {
+		return 0, nil
+	}
+	total := 0
+	var firstErr error
+	for _, node := range p.nodes {
+		if p.isDown(node) {
+			continue
+		}
+		cleaned, err := node.client.CleanupTaskByDir(node.stagingDir(dir))
+		p.record(node, err)
+		total += cleaned
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("aria2 instance %s: %w", node.name, err)
+		}
+	}
+	return total, firstErr
+}
+
+func (p *Aria2Pool) PurgeDownloadResult() error {
+	var firstErr error
+	for _, node := range p.nodes {
+		if p.isDown(node) {
+			continue
+		}
+		err := node.client.PurgeDownloadResult()
+		p.record(node, err)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("aria2 instance %s: %w", node.name, err)
+		}
+	}
+	return firstErr
+}
+
+// ListenNotifications keeps one notification connection per instance and
+// probes the health of every instance until ctx ends. The handler is never
+// called concurrently.
+func (p *Aria2Pool) ListenNotifications(ctx context.Context, handler func(method, gid string)) error {
+	var handlerMu sync.Mutex
+	emit := func(method, gid string) {
+		handlerMu.Lock()
+		defer handlerMu.Unlock()
+		handler(method, gid)
+	}
+	for _, node := range p.nodes {
+		go p.listen(ctx, node, emit)
+	}
+	go p.probeLoop(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.lostSignal:
+			p.mu.Lock()
+			lost := p.lost
+			p.lost = nil
+			p.mu.Unlock()
+			for _, gid := range lost {
+				emit(EventDownloadLost, gid)
+			}
+		}
+	}
+}
+
+func (p *Aria2Pool) listen(ctx context.Context, node *poolNode, emit func(method, gid string)) {
+	for {
+		err := node.client.ListenNotifications(ctx, func(method, gid string) {
+			switch method {
+			case EventResync:
+				emit(method, "")
+				return
+			case EventSessionChanged:
+				emit(method, node.name+"/")
+				return
+			}
+			if gid == "" {
+				return
+			}
+			poolGID := node.poolGID(gid)
+			switch method {
+			case EventDownloadComplete, EventDownloadError, EventDownloadStop:
+				p.forget(node, poolGID)
+			}
+			if method == EventDownloadComplete {
+				if err := p.settleCompleted(node, gid); err != nil {
+					log.Printf("aria2 instance %s: download %s completed, but its file was not moved into place: %v", node.name, gid, err)
+					method = EventDownloadError
+				}
+			}
+			emit(method, poolGID)
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("aria2 instance %s notifications disconnected: %v", node.name, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(poolReconnectDelay):
+		}
+	}
+}
+
+// settleCompleted moves the files of a completed download into place.
+func (p *Aria2Pool) settleCompleted(node *poolNode, gid string) error {
+	statuses, err := node.client.BatchTellStatus([]string{gid})
+	p.record(node, err)
+	if err != nil {
+		return err
+	}
+	detail, ok := statuses[gid]
+	if !ok {
+		return fmt.Errorf("download %s is unknown", gid)
+	}
+	return node.settle(&detail)
+}
+
+func (p *Aria2Pool) probeLoop(ctx context.Context) {
+	ticker := time.NewTicker(p.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.probe()
+		}
+	}
+}
+
+// probe asks every instance for its version at the same time, so a hanging
+// instance does not delay the others.
+func (p *Aria2Pool) probe() {
+	var wg sync.WaitGroup
+	for _, node := range p.nodes {
+		wg.Add(1)
+		go func(node *poolNode) {
+			defer wg.Done()
+			_, err := node.client.GetVersion()
+			if err == nil && p.isDown(node) {
+				p.revive(node)
+				return
+			}
+			p.record(node, err)
+		}(node)
+	}
+	wg.Wait()
+}
+
+// revive puts an instance that answers again back into rotation. Its
+// unfinished downloads were queued on other instances meanwhile, so it drops
+// its whole queue first; the instances of a pool are meant to be dedicated.
+func (p *Aria2Pool) revive(node *poolNode) {
+	stale, err := node.client.queueGIDs(func(string) bool { return true })
+	if err != nil {
+		p.record(node, err)
+		return
+	}
+	node.client.ForceRemoveMany(stale)
+	p.mu.Lock()
+	node.down = false
+	node.failures = 0
+	node.current = 0
+	p.mu.Unlock()
+	log.Printf("aria2 instance %s is back, removed %d stale downloads", node.name, len(stale))
+}
@@ -0,0 +1,314 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"hls-accelerator/internal/config"
+)
+
+// fakeAria2 answers the RPC calls a pool makes and records what it was asked.
+// Like aria2, it deletes the control file of a download it removes.
+type fakeAria2 struct {
+	name string
+
+	mu       sync.Mutex
+	down     bool
+	seq      int
+	calls    []string
+	queue    []string          // GIDs reported as active
+	paths    map[string]string // file of every added GID
+	complete map[string]bool
+}
+
+func (f *fakeAria2) serve(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.down || r.Method != http.MethodPost {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var req JsonRpcRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+			return
+		}
+		resp := JsonRpcResponse{ID: req.ID}
+		switch req.Method {
+		case "system.multicall":
+			results := make([]interface{}, 0)
+			for _, raw := range req.Params[0].([]interface{}) {
+				call := raw.(map[string]interface{})
+				params := call["params"].([]interface{})
+				switch method := call["methodName"].(string); method {
+				case "aria2.addUri":
+					f.seq++
+					gid := fmt.Sprintf("%s%d", f.name, f.seq)
+					options := params[1].(map[string]interface{})
+					f.calls = append(f.calls, "add "+options["out"].(string))
+					if f.paths == nil {
+						f.paths = make(map[string]string)
+					}
+					f.paths[gid] = filepath.Join(options["dir"].(string), options["out"].(string))
+					results = append(results, []interface{}{gid})
+				case "aria2.tellStatus":
+					gid := params[0].(string)
+					status := "active"
+					if f.complete[gid] {
+						status = "complete"
+					}
+					results = append(results, []interface{}{map[string]interface{}{
+						"gid":    gid,
+						"status": status,
+						"dir":    filepath.Dir(f.paths[gid]),
+						"files":  []interface{}{map[string]interface{}{"path": f.paths[gid]}},
+					}})
+				default:
+					if method == "aria2.forceRemove" {
+						if path, ok := f.paths[params[0].(string)]; ok {
+							_ = os.Remove(path + ".aria2")
+						}
+					}
+					f.calls = append(f.calls, fmt.Sprintf("%s %v", strings.TrimPrefix(method, "aria2."), params[0]))
+					results = append(results, []interface{}{"OK"})
+				}
+			}
+			resp.Result = results
+		case "aria2.getVersion":
+			resp.Result = map[string]interface{}{"version": "1.37.0"}
+		case "aria2.tellActive":
+			active := make([]interface{}, 0, len(f.queue))
+			for _, gid := range f.queue {
+				active = append(active, map[string]interface{}{"gid": gid, "dir": "/cache/task"})
+			}
+			resp.Result = active
+		case "aria2.tellWaiting":
+			resp.Result = []interface{}{}
+		default:
+			t.Errorf("unexpected method %s", req.Method)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func (f *fakeAria2) setDown(down bool) {
+	f.mu.Lock()
+	f.down = down
+	f.mu.Unlock()
+}
+
+func (f *fakeAria2) takeCalls() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := strings.Join(f.calls, ",")
+	f.calls = nil
+	return calls
+}
+
+func addRequests(names ...string) []AddURIRequest {
+	requests := make([]AddURIRequest, 0, len(names))
+	for _, name := range names {
+		requests = append(requests, AddURIRequest{URI: "https://example.com/" + name, Dir: "/cache/task", Filename: name})
+	}
+	return requests
+}
+
+func TestAria2PoolWeightsAndRoutesByGID(t *testing.T) {
+	a, b := &fakeAria2{name: "a"}, &fakeAria2{name: "b"}
+	pool, err := NewAria2Pool([]config.Aria2Endpoint{
+		{Name: "a", RPCUrl: a.serve(t), Weight: 2},
+		{Name: "b", RPCUrl: b.serve(t)},
+	})
+	if err != nil {
+		t.Fatalf("NewAria2Pool: %v", err)
+	}
+
+	gids, err := pool.BatchAddURIs(addRequests("1", "2", "3", "4", "5", "6"))
+	if err != nil {
+		t.Fatalf("BatchAddURIs: %v", err)
+	}
+	if got, want := strings.Join(gids, ","), "a/a1,b/b1,a/a2,a/a3,b/b2,a/a4"; got != want {
+		t.Fatalf("gids = %s, want %s", got, want)
+	}
+	if got := a.takeCalls(); got != "add 1,add 3,add 4,add 6" {
+		t.Fatalf("instance a calls = %s", got)
+	}
+	if got := b.takeCalls(); got != "add 2,add 5" {
+		t.Fatalf("instance b calls = %s", got)
+	}
+
+	_ = pool.BatchPause([]string{"b/b2", "a/a1", "unknown/x1"})
+	if got, want := a.takeCalls()+";"+b.takeCalls(), "pause a1;pause b2"; got != want {
+		t.Fatalf("pause calls = %s, want %s", got, want)
+	}
+
+	if _, err := NewAria2Pool([]config.Aria2Endpoint{{Name: "x", RPCUrl: "http://a"}, {Name: "x", RPCUrl: "http://b"}}); err == nil {
+		t.Fatal("duplicate instance names should be rejected")
+	}
+}
+
+func TestAria2PoolFailsOverAndRevives(t *testing.T) {
+	a, b := &fakeAria2{name: "a"}, &fakeAria2{name: "b"}
+	pool, err := NewAria2Pool([]config.Aria2Endpoint{
+		{Name: "a", RPCUrl: a.serve(t)},
+		{Name: "b", RPCUrl: b.serve(t)},
+	})
+	if err != nil {
+		t.Fatalf("NewAria2Pool: %v", err)
+	}
+	pool.probeInterval = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	lost := make(chan string, 8)
+	go func() {
+		_ = pool.ListenNotifications(ctx, func(method, gid string) {
+			if method == EventDownloadLost {
+				lost <- gid
+			}
+		})
+	}()
+
+	if gids, _ := pool.BatchAddURIs(addRequests("1", "2")); strings.Join(gids, ",") != "a/a1,b/b1" {
+		t.Fatalf("gids = %v", gids)
+	}
+	b.takeCalls()
+	b.setDown(true)
+	for i := 0; i < poolMaxFailures; i++ {
+		gids, err := pool.BatchAddURIs(addRequests("x", "y"))
+		if err != nil {
+			t.Fatalf("BatchAddURIs with b down: %v", err)
+		}
+		for _, gid := range gids {
+			if !strings.HasPrefix(gid, "a/") {
+				t.Fatalf("gids = %v, want every download failed over to a", gids)
+			}
+		}
+	}
+	select {
+	case gid := <-lost:
+		if gid != "b/b1" {
+			t.Fatalf("lost gid = %s, want b/b1", gid)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("downloads of the instance that went down were not reported lost")
+	}
+
+	b.mu.Lock()
+	b.queue = []string{"b1"}
+	b.mu.Unlock()
+	b.setDown(false)
+	pool.probe()
+	if got := b.takeCalls(); got != "forceRemove b1" {
+		t.Fatalf("instance b calls after coming back = %q, want its stale queue removed", got)
+	}
+	gids, err := pool.BatchAddURIs(addRequests("3", "4"))
+	if err != nil || !strings.Contains(strings.Join(gids, ","), "b/") {
+		t.Fatalf("gids after b came back = %v, %v", gids, err)
+	}
+}
+
+func TestAria2PoolPartitionedInstanceCannotTouchTheReplacementDownload(t *testing.T) {
+	a, b := &fakeAria2{name: "a"}, &fakeAria2{name: "b"}
+	pool, err := NewAria2Pool([]config.Aria2Endpoint{
+		{Name: "a", RPCUrl: a.serve(t)},
+		{Name: "b", RPCUrl: b.serve(t)},
+	})
+	if err != nil {
+		t.Fatalf("NewAria2Pool: %v", err)
+	}
+	pool.probeInterval = time.Hour
+	dir := t.TempDir()
+	request := AddURIRequest{URI: "https://example.com/seg.ts", Dir: dir, Filename: "seg.ts"}
+	write := func(path, content string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gids, err := pool.BatchAddURIs([]AddURIRequest{request})
+	if err != nil || strings.Join(gids, ",") != "a/a1" {
+		t.Fatalf("gids = %v, %v", gids, err)
+	}
+	aFile := filepath.Join(dir, poolStagingDir, "a", "seg.ts")
+	write(aFile, "from a")
+	write(aFile+".aria2", "control of a")
+
+	// a is cut off but keeps running; the download is queued again on b.
+	a.setDown(true)
+	for i := 0; i < poolMaxFailures; i++ {
+		pool.record(pool.nodes[0], errors.New("unreachable"))
+	}
+	gids, err = pool.BatchAddURIs([]AddURIRequest{request})
+	if err != nil || strings.Join(gids, ",") != "b/b1" {
+		t.Fatalf("gids of the queued again download = %v, %v", gids, err)
+	}
+	bFile := filepath.Join(dir, poolStagingDir, "b", "seg.ts")
+	write(bFile, "from b")
+	write(bFile+".aria2", "control of b")
+	write(aFile, "from a, still writing")
+
+	// a answers again and drops its stale download, deleting its control file.
+	a.mu.Lock()
+	a.queue = []string{"a1"}
+	a.mu.Unlock()
+	a.setDown(false)
+	pool.probe()
+	if got := a.takeCalls(); !strings.Contains(got, "forceRemove a1") {
+		t.Fatalf("instance a calls after coming back = %q, want its stale download removed", got)
+	}
+	if _, err := os.Stat(bFile + ".aria2"); err != nil {
+		t.Fatalf("control file of the replacement download: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "seg.ts")); !os.IsNotExist(err) {
+		t.Fatalf("nothing should be in place before b completes, stat err = %v", err)
+	}
+
+	// b completes; its file, not the one a wrote, is moved into place.
+	if err := os.Remove(bFile + ".aria2"); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	b.complete = map[string]bool{"b1": true}
+	b.mu.Unlock()
+	statuses, err := pool.BatchTellStatus([]string{"b/b1"})
+	if err != nil {
+		t.Fatalf("BatchTellStatus: %v", err)
+	}
+	target := filepath.Join(dir, "seg.ts")
+	if detail := statuses["b/b1"]; detail.Status != "complete" || detail.FirstFilePath() != target {
+		t.Fatalf("status = %+v, want complete at %s", detail, target)
+	}
+	if data, _ := os.ReadFile(target); string(data) != "from b" {
+		t.Fatalf("file in place = %q, want the one b downloaded", data)
+	}
+
+	// Handing the file to a again starts over instead of resuming its leftovers.
+	b.setDown(true)
+	for i := 0; i < poolMaxFailures; i++ {
+		pool.record(pool.nodes[1], errors.New("unreachable"))
+	}
+	if gids, err := pool.BatchAddURIs([]AddURIRequest{request}); err != nil || !strings.HasPrefix(gids[0], "a/") {
+		t.Fatalf("gids = %v, %v", gids, err)
+	}
+	if _, err := os.Stat(aFile); !os.IsNotExist(err) {
+		t.Fatalf("leftover of a should be removed, stat err = %v", err)
+	}
+}
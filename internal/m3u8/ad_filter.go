@@ -3,6 +3,7 @@ package m3u8
 import (
 	"net/url"
 	"strings"
+	"sync"
 
 	"github.com/grafov/m3u8"
 )
@@ -21,8 +22,13 @@ type AdFilter interface {
 
 // AdFilterRegistry 广告过滤器注册表
 // 使用注册表模式，方便管理和扩展
+// 配置规则（AdRule）可在运行时整体替换，优先于代码注册的过滤器
 type AdFilterRegistry struct {
-	filters []AdFilter
+	mu          sync.RWMutex
+	filters     []AdFilter
+	rules       []AdRule
+	ruleFilters []AdFilter
+	fallback    AdFilter
 }
 
 // NewAdFilterRegistry 创建新的广告过滤器注册表
@@ -31,23 +37,67 @@ func NewAdFilterRegistry() *AdFilterRegistry {
 		filters: []AdFilter{},
 	}
 	// FFZYAdFilter 已过期，暂时不再默认启用。
-	// 如后续需要恢复或替换规则，可通过 RegisterAdFilter 手动注册。
+	// 如后续需要恢复或替换规则，可在配置 ad_filter_rules 中声明，或通过 RegisterAdFilter 手动注册。
 	return registry
 }
 
 // Register 注册一个新的广告过滤器
 func (r *AdFilterRegistry) Register(filter AdFilter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	r.filters = append(r.filters, filter)
 }
 
+// SetRules 用一组配置规则替换当前规则
+// 任一规则无效时返回错误，原有规则保持不变
+func (r *AdFilterRegistry) SetRules(rules []AdRule) error {
+	filters := make([]AdFilter, 0, len(rules))
+	for _, rule := range rules {
+		filter, err := NewRuleFilter(rule)
+		if err != nil {
+			return err
+		}
+		filters = append(filters, filter)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rules = append([]AdRule(nil), rules...)
+	r.ruleFilters = filters
+	return nil
+}
+
+// SetFallback 设置没有任何过滤器匹配时使用的过滤器（如启发式过滤器），nil 表示不使用
+func (r *AdFilterRegistry) SetFallback(filter AdFilter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fallback = filter
+}
+
+// Rules 返回当前生效的配置规则
+func (r *AdFilterRegistry) Rules() []AdRule {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]AdRule{}, r.rules...)
+}
+
 // GetFilter 根据URL获取匹配的过滤器
-// 返回第一个匹配的过滤器，如果没有匹配的则返回nil
+// 依次匹配配置规则、代码注册的过滤器和兜底过滤器，返回第一个匹配的过滤器，如果没有匹配的则返回nil
 func (r *AdFilterRegistry) GetFilter(originURL *url.URL) AdFilter {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, filter := range r.ruleFilters {
+		if filter.Match(originURL) {
+			return filter
+		}
+	}
 	for _, filter := range r.filters {
 		if filter.Match(originURL) {
 			return filter
 		}
 	}
+	if r.fallback != nil && r.fallback.Match(originURL) {
+		return r.fallback
+	}
 	return nil
 }
 
@@ -122,3 +172,18 @@ func GetAdFilter(originURL *url.URL) AdFilter {
 func RegisterAdFilter(filter AdFilter) {
 	defaultRegistry.Register(filter)
 }
+
+// SetAdRules 替换全局注册表中的配置规则
+func SetAdRules(rules []AdRule) error {
+	return defaultRegistry.SetRules(rules)
+}
+
+// SetFallbackAdFilter 设置全局注册表的兜底过滤器
+func SetFallbackAdFilter(filter AdFilter) {
+	defaultRegistry.SetFallback(filter)
+}
+
+// AdRules 返回全局注册表中当前生效的配置规则
+func AdRules() []AdRule {
+	return defaultRegistry.Rules()
+}
@@ -0,0 +1,247 @@
+package m3u8
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+// AdRange describes a run of consecutive segments an ad filter removed.
+type AdRange struct {
+	FirstSeq uint64  `json:"first_seq"`
+	LastSeq  uint64  `json:"last_seq"`
+	Segments int     `json:"segments"`
+	Duration float64 `json:"duration"`
+	// Source is the rule name, "heuristic" or the type of a code filter.
+	Source string `json:"source"`
+	// Score and Reasons are only set by the heuristic filter.
+	Score   float64  `json:"score,omitempty"`
+	Reasons []string `json:"reasons,omitempty"`
+	URIs    []string `json:"uris"`
+}
+
+// AdRangeReporter is an optional AdFilter extension that explains the ranges
+// it removes; other filters get their ranges derived from the kept set.
+type AdRangeReporter interface {
+	AdFilter
+	FilterRanges(segments []*m3u8.MediaSegment) (map[int]bool, []AdRange)
+}
+
+const DefaultAdHeuristicThreshold = 0.5
+
+// 各项特征在评分中的权重，合计为 1
+var heuristicWeights = []struct {
+	reason string
+	weight float64
+}{
+	{"host", 0.4},
+	{"directory", 0.25},
+	{"filename", 0.2},
+	{"duration", 0.15},
+}
+
+// HeuristicAdFilter 内置的启发式广告过滤器
+// 按 EXT-X-DISCONTINUITY 把片段分块，把每块与整条流的主要特征（host、目录、文件名模式、时长）比较打分，
+// 分数达到阈值的块视为插入的广告。少于两块或某块占一半以上片段时不会被判为广告。
+type HeuristicAdFilter struct {
+	Threshold float64
+}
+
+// NewHeuristicAdFilter creates the heuristic filter; a threshold outside
+// (0, 1] falls back to DefaultAdHeuristicThreshold.
+func NewHeuristicAdFilter(threshold float64) *HeuristicAdFilter {
+	if threshold <= 0 || threshold > 1 {
+		threshold = DefaultAdHeuristicThreshold
+	}
+	return &HeuristicAdFilter{Threshold: threshold}
+}
+
+// Match 启发式过滤器适用于所有播放列表
+func (f *HeuristicAdFilter) Match(originURL *url.URL) bool {
+	return true
+}
+
+// Filter 返回应该保留的片段索引
+func (f *HeuristicAdFilter) Filter(segments []*m3u8.MediaSegment) map[int]bool {
+	keep, _ := f.FilterRanges(segments)
+	return keep
+}
+
+type segmentTraits struct {
+	host, dir, pattern string
+	duration           float64
+}
+
+var digitRuns = regexp.MustCompile(`[0-9]+`)
+
+func traitsOf(seg *m3u8.MediaSegment) segmentTraits {
+	uri := seg.URI
+	if idx := strings.IndexAny(uri, "?#"); idx >= 0 {
+		uri = uri[:idx]
+	}
+	t := segmentTraits{dir: segmentDir(uri), duration: seg.Duration}
+	if u, err := url.Parse(uri); err == nil {
+		t.host = strings.ToLower(u.Host) // 相对地址与播放列表同 host，记为空
+	}
+	t.pattern = digitRuns.ReplaceAllString(uri[strings.LastIndex(uri, "/")+1:], "#")
+	return t
+}
+
+// FilterRanges 给每个不连续块打分，移除达到阈值的块并说明原因
+func (f *HeuristicAdFilter) FilterRanges(segments []*m3u8.MediaSegment) (map[int]bool, []AdRange) {
+	keep := make(map[int]bool)
+	var indices []int
+	for i, seg := range segments {
+		if seg != nil && seg.URI != "" {
+			keep[i] = true
+			indices = append(indices, i)
+		}
+	}
+	var blocks [][]int // positions in indices
+	for pos, i := range indices {
+		if pos == 0 || segments[i].Discontinuity {
+			blocks = append(blocks, nil)
+		}
+		blocks[len(blocks)-1] = append(blocks[len(blocks)-1], pos)
+	}
+	if len(blocks) < 2 {
+		return keep, nil
+	}
+
+	traits := make([]segmentTraits, len(indices))
+	hosts, dirs, patterns, durations := map[string]int{}, map[string]int{}, map[string]int{}, map[float64]int{}
+	for pos, i := range indices {
+		traits[pos] = traitsOf(segments[i])
+		hosts[traits[pos].host]++
+		dirs[traits[pos].dir]++
+		patterns[traits[pos].pattern]++
+		durations[math.Round(traits[pos].duration*10)/10]++
+	}
+	dominantHost, dominantDir, dominantPattern := mode(hosts), mode(dirs), mode(patterns)
+	dominantDuration, best := 0.0, 0
+	for d, n := range durations {
+		if n > best || (n == best && d > dominantDuration) {
+			dominantDuration, best = d, n
+		}
+	}
+
+	var ranges []AdRange
+	for b, block := range blocks {
+		if len(block)*2 >= len(indices) {
+			continue
+		}
+		var differs [4]int
+		for k, pos := range block {
+			t := traits[pos]
+			if t.host != dominantHost {
+				differs[0]++
+			}
+			if t.dir != dominantDir {
+				differs[1]++
+			}
+			if t.pattern != dominantPattern {
+				differs[2]++
+			}
+			// 整条流最后一个片段通常较短，不计入时长差异
+			lastOfStream := b == len(blocks)-1 && k == len(block)-1
+			if !lastOfStream && math.Abs(t.duration-dominantDuration) > 0.5 {
+				differs[3]++
+			}
+		}
+		score := 0.0
+		var reasons []string
+		for n, w := range heuristicWeights {
+			if differs[n] == 0 {
+				continue
+			}
+			score += w.weight * float64(differs[n]) / float64(len(block))
+			reasons = append(reasons, w.reason)
+		}
+		score = math.Round(score*100) / 100
+		if score < f.Threshold {
+			continue
+		}
+		removed := make([]int, 0, len(block))
+		for _, pos := range block {
+			removed = append(removed, indices[pos])
+			delete(keep, indices[pos])
+		}
+		r := newAdRange(segments, removed, "heuristic")
+		r.Score = score
+		r.Reasons = reasons
+		ranges = append(ranges, r)
+	}
+	return keep, ranges
+}
+
+func mode(counts map[string]int) string {
+	value, best := "", -1
+	for v, n := range counts {
+		if n > best || (n == best && v < value) {
+			value, best = v, n
+		}
+	}
+	return value
+}
+
+func newAdRange(segments []*m3u8.MediaSegment, removed []int, source string) AdRange {
+	r := AdRange{
+		FirstSeq: segments[removed[0]].SeqId,
+		LastSeq:  segments[removed[len(removed)-1]].SeqId,
+		Segments: len(removed),
+		Source:   source,
+	}
+	for _, i := range removed {
+		r.Duration += segments[i].Duration
+		r.URIs = append(r.URIs, segments[i].URI)
+	}
+	r.Duration = math.Round(r.Duration*1000) / 1000
+	return r
+}
+
+// adFilterSource 返回过滤器在 AdRange.Source 中使用的名称
+func adFilterSource(filter AdFilter) string {
+	switch f := filter.(type) {
+	case *ruleFilter:
+		if f.rule.Name != "" {
+			return f.rule.Name
+		}
+		return f.rule.Match
+	case *HeuristicAdFilter:
+		return "heuristic"
+	}
+	return fmt.Sprintf("%T", filter)
+}
+
+// applyAdFilter 应用过滤器，返回保留的片段索引和被移除的区间
+func applyAdFilter(filter AdFilter, segments []*m3u8.MediaSegment) (map[int]bool, []AdRange) {
+	if reporter, ok := filter.(AdRangeReporter); ok {
+		return reporter.FilterRanges(segments)
+	}
+	keep := filter.Filter(segments)
+	source := adFilterSource(filter)
+	var ranges []AdRange
+	var run []int
+	flush := func() {
+		if len(run) > 0 {
+			ranges = append(ranges, newAdRange(segments, run, source))
+			run = nil
+		}
+	}
+	for i, seg := range segments {
+		if seg == nil || seg.URI == "" {
+			continue
+		}
+		if keep[i] {
+			flush()
+			continue
+		}
+		run = append(run, i)
+	}
+	flush()
+	return keep, ranges
+}
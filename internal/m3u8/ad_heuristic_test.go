@@ -0,0 +1,71 @@
+package m3u8
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestHeuristicAdFilterDropsOutlierBlock(t *testing.T) {
+	pl := parseMediaPlaylist(t, adRulesPlaylist)
+	keep, ranges := NewHeuristicAdFilter(0).FilterRanges(pl.Segments)
+	if len(keep) != 6 || keep[2] || keep[3] {
+		t.Fatalf("keep = %v, want the two ads.example.net segments removed", keep)
+	}
+	if len(ranges) != 1 {
+		t.Fatalf("ranges = %+v, want one", ranges)
+	}
+	r := ranges[0]
+	if r.FirstSeq != 2 || r.LastSeq != 3 || r.Segments != 2 || r.Duration != 6 || r.Source != "heuristic" {
+		t.Fatalf("range = %+v", r)
+	}
+	if r.Score != 0.8 || !reflect.DeepEqual(r.Reasons, []string{"host", "directory", "duration"}) {
+		t.Fatalf("score = %v reasons = %v, want 0.8 for host, directory and duration", r.Score, r.Reasons)
+	}
+}
+
+func TestHeuristicAdFilterKeepsSimilarBlocks(t *testing.T) {
+	pl := parseMediaPlaylist(t, `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXTINF:4.0,
+v/001.ts
+#EXTINF:4.0,
+v/002.ts
+#EXT-X-DISCONTINUITY
+#EXTINF:4.0,
+other/003.ts
+#EXT-X-DISCONTINUITY
+#EXTINF:4.0,
+v/004.ts
+#EXTINF:4.0,
+v/005.ts
+#EXT-X-ENDLIST
+`)
+	keep, ranges := NewHeuristicAdFilter(0).FilterRanges(pl.Segments)
+	if len(keep) != 5 || len(ranges) != 0 {
+		t.Fatalf("keep = %v ranges = %+v, a different directory alone should not be dropped", keep, ranges)
+	}
+	if keep, _ := NewHeuristicAdFilter(0.2).FilterRanges(pl.Segments); keep[2] {
+		t.Fatal("a lower threshold should drop the block")
+	}
+}
+
+func TestRewriteVariantWithAdsReportsRanges(t *testing.T) {
+	SetFallbackAdFilter(NewHeuristicAdFilter(0))
+	t.Cleanup(func() { SetFallbackAdFilter(nil) })
+
+	base, _ := url.Parse("https://cdn.example.com/vod/index.m3u8")
+	_, items, total, ranges := RewriteVariantWithAds(parseMediaPlaylist(t, adRulesPlaylist), "http://proxy/proxy", "task-heuristic", base, 0, true)
+	if total != 6 || len(items) != 6 {
+		t.Fatalf("total = %d items = %d, want 6", total, len(items))
+	}
+	want := []string{"https://ads.example.net/a/1.ts", "https://ads.example.net/a/2.ts"}
+	if len(ranges) != 1 || !reflect.DeepEqual(ranges[0].URIs, want) {
+		t.Fatalf("ranges = %+v, want the ad URIs", ranges)
+	}
+
+	_, _, total, ranges = RewriteVariantWithAds(parseMediaPlaylist(t, adRulesPlaylist), "http://proxy/proxy", "task-heuristic", base, 0, false)
+	if total != 8 || len(ranges) != 0 {
+		t.Fatalf("total = %d ranges = %+v, want nothing removed with filtering off", total, ranges)
+	}
+}
@@ -0,0 +1,206 @@
+package m3u8
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+// AdRule is a declarative ad filter rule taken from config or the API.
+// Match selects the playlists the rule applies to; every rule kind that is set
+// marks segments as ads, and a segment is removed when any kind marks it.
+type AdRule struct {
+	Name string `json:"name"`
+	// Match is a pattern for the playlist host or full URL, "*" matches any
+	// text. A plain host such as "example.com" also matches its subdomains.
+	Match string `json:"match"`
+	// DiscontinuitySegments removes runs of exactly N segments between two
+	// EXT-X-DISCONTINUITY tags.
+	DiscontinuitySegments []int `json:"discontinuity_segments,omitempty"`
+	// PathPrefixOutlier removes segments whose URL directory differs from the
+	// one most segments share.
+	PathPrefixOutlier bool `json:"path_prefix_outlier,omitempty"`
+	// Durations removes every run of consecutive segments whose durations
+	// follow this pattern, within DurationTolerance seconds (default 0.05).
+	Durations         []float64 `json:"durations,omitempty"`
+	DurationTolerance float64   `json:"duration_tolerance,omitempty"`
+	// URLRegex removes segments whose URI matches.
+	URLRegex string `json:"url_regex,omitempty"`
+}
+
+const defaultDurationTolerance = 0.05
+
+// ruleFilter 是编译后的 AdRule
+type ruleFilter struct {
+	rule     AdRule
+	match    *regexp.Regexp
+	hostOnly bool
+	urlRegex *regexp.Regexp
+	counts   map[int]bool
+}
+
+// NewRuleFilter validates a rule and compiles it into an AdFilter.
+func NewRuleFilter(rule AdRule) (AdFilter, error) {
+	rule.Match = strings.TrimSpace(rule.Match)
+	if rule.Match == "" {
+		return nil, fmt.Errorf("ad rule %q: match is required", rule.Name)
+	}
+	if len(rule.DiscontinuitySegments) == 0 && !rule.PathPrefixOutlier && len(rule.Durations) == 0 && rule.URLRegex == "" {
+		return nil, fmt.Errorf("ad rule %q: no rule kind is set", rule.Name)
+	}
+	f := &ruleFilter{
+		rule:     rule,
+		match:    globRegexp(rule.Match),
+		hostOnly: !strings.ContainsAny(rule.Match, "*/"),
+		counts:   make(map[int]bool, len(rule.DiscontinuitySegments)),
+	}
+	for _, n := range rule.DiscontinuitySegments {
+		if n <= 0 {
+			return nil, fmt.Errorf("ad rule %q: discontinuity segment count must be positive", rule.Name)
+		}
+		f.counts[n] = true
+	}
+	for _, d := range rule.Durations {
+		if d <= 0 {
+			return nil, fmt.Errorf("ad rule %q: durations must be positive", rule.Name)
+		}
+	}
+	if rule.DurationTolerance < 0 {
+		return nil, fmt.Errorf("ad rule %q: duration tolerance must not be negative", rule.Name)
+	}
+	if f.rule.DurationTolerance == 0 {
+		f.rule.DurationTolerance = defaultDurationTolerance
+	}
+	if rule.URLRegex != "" {
+		re, err := regexp.Compile(rule.URLRegex)
+		if err != nil {
+			return nil, fmt.Errorf("ad rule %q: invalid url_regex: %w", rule.Name, err)
+		}
+		f.urlRegex = re
+	}
+	return f, nil
+}
+
+// globRegexp 把 "*" 通配模式转换为不区分大小写的完整匹配正则
+func globRegexp(pattern string) *regexp.Regexp {
+	quoted := strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, `.*`)
+	return regexp.MustCompile(`(?i)^` + quoted + `$`)
+}
+
+// Match 匹配播放列表的 host 或完整 URL
+func (f *ruleFilter) Match(originURL *url.URL) bool {
+	if originURL == nil {
+		return false
+	}
+	host := originURL.Hostname()
+	if f.match.MatchString(host) || f.match.MatchString(originURL.String()) {
+		return true
+	}
+	return f.hostOnly && strings.HasSuffix(strings.ToLower(host), "."+strings.ToLower(f.rule.Match))
+}
+
+// Filter 按规则的各项条件标记广告，返回保留的片段索引
+func (f *ruleFilter) Filter(segments []*m3u8.MediaSegment) map[int]bool {
+	keep := make(map[int]bool)
+	var indices []int
+	for i, seg := range segments {
+		if seg != nil && seg.URI != "" {
+			keep[i] = true
+			indices = append(indices, i)
+		}
+	}
+	if len(f.counts) > 0 {
+		f.markDiscontinuityRuns(segments, indices, keep)
+	}
+	if f.rule.PathPrefixOutlier {
+		markPathOutliers(segments, indices, keep)
+	}
+	if len(f.rule.Durations) > 0 {
+		f.markDurationPattern(segments, indices, keep)
+	}
+	if f.urlRegex != nil {
+		for _, i := range indices {
+			if f.urlRegex.MatchString(segments[i].URI) {
+				delete(keep, i)
+			}
+		}
+	}
+	return keep
+}
+
+// markDiscontinuityRuns 两个 DISCONTINUITY 之间的片段数等于配置值时视为广告
+func (f *ruleFilter) markDiscontinuityRuns(segments []*m3u8.MediaSegment, indices []int, keep map[int]bool) {
+	var marks []int // positions in indices
+	for pos, i := range indices {
+		if segments[i].Discontinuity {
+			marks = append(marks, pos)
+		}
+	}
+	for k := 0; k+1 < len(marks); k++ {
+		start, end := marks[k], marks[k+1]
+		if !f.counts[end-start] {
+			continue
+		}
+		for _, i := range indices[start:end] {
+			delete(keep, i)
+		}
+	}
+}
+
+// markPathOutliers 片段 URL 目录与多数片段不同时视为广告；没有过半的目录时不处理
+func markPathOutliers(segments []*m3u8.MediaSegment, indices []int, keep map[int]bool) {
+	counts := make(map[string]int)
+	for _, i := range indices {
+		counts[segmentDir(segments[i].URI)]++
+	}
+	majority, best := "", 0
+	for dir, n := range counts {
+		if n > best {
+			majority, best = dir, n
+		}
+	}
+	if best*2 <= len(indices) {
+		return
+	}
+	for _, i := range indices {
+		if segmentDir(segments[i].URI) != majority {
+			delete(keep, i)
+		}
+	}
+}
+
+func segmentDir(uri string) string {
+	if idx := strings.IndexAny(uri, "?#"); idx >= 0 {
+		uri = uri[:idx]
+	}
+	if idx := strings.LastIndex(uri, "/"); idx >= 0 {
+		return uri[:idx]
+	}
+	return ""
+}
+
+// markDurationPattern 连续片段的时长依次符合配置的模式时视为广告
+func (f *ruleFilter) markDurationPattern(segments []*m3u8.MediaSegment, indices []int, keep map[int]bool) {
+	pattern := f.rule.Durations
+	for pos := 0; pos+len(pattern) <= len(indices); {
+		matched := true
+		for k, want := range pattern {
+			if math.Abs(segments[indices[pos+k]].Duration-want) > f.rule.DurationTolerance {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			pos++
+			continue
+		}
+		for _, i := range indices[pos : pos+len(pattern)] {
+			delete(keep, i)
+		}
+		pos += len(pattern)
+	}
+}
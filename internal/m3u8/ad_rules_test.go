@@ -0,0 +1,137 @@
+package m3u8
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const adRulesPlaylist = `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXTINF:4.0,
+v/001.ts
+#EXTINF:4.0,
+v/002.ts
+#EXT-X-DISCONTINUITY
+#EXTINF:3.0,
+https://ads.example.net/a/1.ts
+#EXTINF:3.0,
+https://ads.example.net/a/2.ts
+#EXT-X-DISCONTINUITY
+#EXTINF:4.0,
+v/003.ts
+#EXTINF:4.0,
+v/004.ts?token=x
+#EXTINF:4.0,
+v/005.ts
+#EXTINF:2.5,
+v/promo-006.ts
+#EXT-X-ENDLIST
+`
+
+func keptURIs(t *testing.T, rule AdRule) []string {
+	t.Helper()
+	filter, err := NewRuleFilter(rule)
+	if err != nil {
+		t.Fatalf("NewRuleFilter: %v", err)
+	}
+	pl := parseMediaPlaylist(t, adRulesPlaylist)
+	keep := filter.Filter(pl.Segments)
+	var indices []int
+	for i := range keep {
+		indices = append(indices, i)
+	}
+	sort.Ints(indices)
+	var uris []string
+	for _, i := range indices {
+		uri := pl.Segments[i].URI
+		uris = append(uris, uri[strings.LastIndex(uri, "/")+1:])
+	}
+	return uris
+}
+
+func TestRuleFilterKinds(t *testing.T) {
+	cases := []struct {
+		name string
+		rule AdRule
+		want string
+	}{
+		{"discontinuity run", AdRule{Match: "*", DiscontinuitySegments: []int{2}}, "001.ts,002.ts,003.ts,004.ts?token=x,005.ts,promo-006.ts"},
+		{"other count", AdRule{Match: "*", DiscontinuitySegments: []int{5}}, "001.ts,002.ts,1.ts,2.ts,003.ts,004.ts?token=x,005.ts,promo-006.ts"},
+		{"path prefix outlier", AdRule{Match: "*", PathPrefixOutlier: true}, "001.ts,002.ts,003.ts,004.ts?token=x,005.ts,promo-006.ts"},
+		{"duration pattern", AdRule{Match: "*", Durations: []float64{3, 3}}, "001.ts,002.ts,003.ts,004.ts?token=x,005.ts,promo-006.ts"},
+		{"single duration", AdRule{Match: "*", Durations: []float64{2.5}}, "001.ts,002.ts,1.ts,2.ts,003.ts,004.ts?token=x,005.ts"},
+		{"url regex", AdRule{Match: "*", URLRegex: `promo-\d+`}, "001.ts,002.ts,1.ts,2.ts,003.ts,004.ts?token=x,005.ts"},
+		{"combined", AdRule{Match: "*", PathPrefixOutlier: true, URLRegex: "promo"}, "001.ts,002.ts,003.ts,004.ts?token=x,005.ts"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := strings.Join(keptURIs(t, tc.rule), ","); got != tc.want {
+				t.Fatalf("kept = %s, want %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRuleFilterMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		url     string
+		want    bool
+	}{
+		{"example.com", "https://example.com/a.m3u8", true},
+		{"example.com", "https://cdn.example.com/a.m3u8", true},
+		{"example.com", "https://badexample.com/a.m3u8", false},
+		{"*.ffzy*.com", "https://v.ffzy-play.com/a.m3u8", true},
+		{"https://cdn.example.com/vod/*", "https://cdn.example.com/vod/x/index.m3u8", true},
+		{"https://cdn.example.com/vod/*", "https://cdn.example.com/live/index.m3u8", false},
+	}
+	for _, tc := range cases {
+		filter, err := NewRuleFilter(AdRule{Match: tc.pattern, URLRegex: "ad"})
+		if err != nil {
+			t.Fatalf("NewRuleFilter: %v", err)
+		}
+		u, _ := url.Parse(tc.url)
+		if got := filter.Match(u); got != tc.want {
+			t.Fatalf("Match(%q, %q) = %v, want %v", tc.pattern, tc.url, got, tc.want)
+		}
+	}
+}
+
+func TestNewRuleFilterRejectsInvalidRules(t *testing.T) {
+	for _, rule := range []AdRule{
+		{Name: "no match", URLRegex: "ad"},
+		{Name: "no kind", Match: "example.com"},
+		{Name: "bad count", Match: "example.com", DiscontinuitySegments: []int{0}},
+		{Name: "bad regex", Match: "example.com", URLRegex: "("},
+	} {
+		if _, err := NewRuleFilter(rule); err == nil {
+			t.Fatalf("rule %q should be rejected", rule.Name)
+		}
+	}
+}
+
+func TestSetAdRulesAppliesToRewriteVariant(t *testing.T) {
+	t.Cleanup(func() { _ = SetAdRules(nil) })
+	if err := SetAdRules([]AdRule{{Name: "cdn", Match: "cdn.example.com", PathPrefixOutlier: true}}); err != nil {
+		t.Fatalf("SetAdRules: %v", err)
+	}
+	if err := SetAdRules([]AdRule{{Name: "broken", Match: ""}}); err == nil {
+		t.Fatal("invalid rules should be rejected")
+	}
+	if rules := AdRules(); len(rules) != 1 || rules[0].Name != "cdn" {
+		t.Fatalf("rules after rejected update = %+v, want the previous rules", rules)
+	}
+
+	base, _ := url.Parse("https://cdn.example.com/vod/index.m3u8")
+	_, _, total := RewriteVariant(parseMediaPlaylist(t, adRulesPlaylist), "http://proxy/proxy", "task-ads", base)
+	if total != 6 {
+		t.Fatalf("total segments = %d, want the 2 ad segments removed", total)
+	}
+	other, _ := url.Parse("https://other.example.org/index.m3u8")
+	_, _, total = RewriteVariant(parseMediaPlaylist(t, adRulesPlaylist), "http://proxy/proxy", "task-other", other)
+	if total != 8 {
+		t.Fatalf("total segments = %d, want all 8 for a host without rules", total)
+	}
+}
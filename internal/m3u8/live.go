@@ -0,0 +1,109 @@
+package m3u8
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+// SkipSegments drops the first n segments of a live window because they were
+// recorded from an earlier reload. Byte-range offsets are resolved first, and the
+// key and init section of the dropped segments move to the first kept segment,
+// since both tags apply to every segment that follows them.
+func SkipSegments(p *m3u8.MediaPlaylist, originBaseURL *url.URL, n int) {
+	resolveByteRangeOffsets(p.Segments, originBaseURL)
+	var (
+		key     *m3u8.Key
+		initMap *m3u8.Map
+	)
+	for i, seg := range p.Segments {
+		if seg == nil {
+			continue
+		}
+		if i < n {
+			if seg.Key != nil {
+				key = seg.Key
+			}
+			if seg.Map != nil {
+				initMap = seg.Map
+			}
+			p.Segments[i] = nil
+			continue
+		}
+		if seg.Key == nil {
+			seg.Key = key
+		}
+		if seg.Map == nil {
+			seg.Map = initMap
+		}
+		return
+	}
+}
+
+// AppendSegments appends the segments left in a rewritten live window to the
+// playlist recorded so far (empty before the first window). The result is an
+// EVENT playlist, or a VOD playlist with EXT-X-ENDLIST once final is set.
+// window may be nil to only finalize the recording.
+func AppendSegments(recorded string, window *m3u8.MediaPlaylist, final bool) (string, error) {
+	var (
+		segments []*m3u8.MediaSegment
+		target   float64
+		version  uint8
+	)
+	if strings.TrimSpace(recorded) != "" {
+		p, listType, err := Parse(strings.NewReader(recorded))
+		if err != nil {
+			return "", err
+		}
+		if listType != Variant {
+			return "", fmt.Errorf("recorded playlist is not a media playlist")
+		}
+		prev := p.(*m3u8.MediaPlaylist)
+		segments = appendMediaSegments(segments, prev)
+		target = prev.TargetDuration
+		version = prev.Version()
+	}
+	if window != nil {
+		segments = appendMediaSegments(segments, window)
+		if window.TargetDuration > target {
+			target = window.TargetDuration
+		}
+		if window.Version() > version {
+			version = window.Version()
+		}
+	}
+
+	out, err := m3u8.NewMediaPlaylist(0, uint(len(segments))+1)
+	if err != nil {
+		return "", err
+	}
+	for _, seg := range segments {
+		if err := out.AppendSegment(seg); err != nil {
+			return "", err
+		}
+	}
+	if target > out.TargetDuration {
+		out.TargetDuration = target
+	}
+	if version > out.Version() {
+		out.SetVersion(version)
+	}
+	if final {
+		out.MediaType = m3u8.VOD
+		out.Close()
+	} else {
+		out.MediaType = m3u8.EVENT
+	}
+	return out.String(), nil
+}
+
+func appendMediaSegments(dst []*m3u8.MediaSegment, p *m3u8.MediaPlaylist) []*m3u8.MediaSegment {
+	for _, seg := range p.Segments {
+		if seg != nil && seg.URI != "" {
+			dst = append(dst, seg)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,92 @@
+package m3u8
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSkipSegmentsCarriesKeyAndMapToFirstNewSegment(t *testing.T) {
+	window := parseMediaPlaylist(t, `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:10
+#EXT-X-KEY:METHOD=AES-128,URI="k.key"
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:4.0,
+a.m4s
+#EXTINF:4.0,
+b.m4s
+#EXTINF:4.0,
+c.m4s
+`)
+	base, _ := url.Parse("https://live.example.com/ch/index.m3u8")
+
+	SkipSegments(window, base, 2)
+	_, items, total := RewriteVariantFrom(window, "http://proxy/proxy", "task-live", base, 7)
+	if total != 1 {
+		t.Fatalf("total segments = %d, want 1", total)
+	}
+	var names []string
+	for _, item := range items {
+		names = append(names, item.Type+":"+item.Filename)
+	}
+	got := strings.Join(names, ",")
+	if !strings.Contains(got, "ts:00008.m4s") {
+		t.Fatalf("segment should continue numbering at 8, items: %s", got)
+	}
+	if !strings.Contains(got, "map:") || !strings.Contains(got, "key:") {
+		t.Fatalf("key and map of skipped segments should be kept, items: %s", got)
+	}
+}
+
+func TestAppendSegmentsGrowsEventPlaylistAndFinalizesAsVOD(t *testing.T) {
+	base, _ := url.Parse("https://live.example.com/ch/index.m3u8")
+	first := parseMediaPlaylist(t, `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:1
+#EXTINF:4.0,
+a.ts
+#EXTINF:4.0,
+b.ts
+`)
+	_, _, total := RewriteVariant(first, "http://proxy/proxy", "task-live", base)
+	recorded, err := AppendSegments("", first, false)
+	if err != nil {
+		t.Fatalf("AppendSegments first window: %v", err)
+	}
+
+	second := parseMediaPlaylist(t, `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:2
+#EXTINF:4.0,
+b.ts
+#EXTINF:6.0,
+c.ts
+`)
+	SkipSegments(second, base, 1)
+	RewriteVariantFrom(second, "http://proxy/proxy", "task-live", base, total)
+	recorded, err = AppendSegments(recorded, second, false)
+	if err != nil {
+		t.Fatalf("AppendSegments second window: %v", err)
+	}
+	if !strings.Contains(recorded, "#EXT-X-PLAYLIST-TYPE:EVENT") || strings.Contains(recorded, "#EXT-X-ENDLIST") {
+		t.Fatalf("recording playlist should be an open EVENT playlist:\n%s", recorded)
+	}
+	for _, name := range []string{"/00001.ts/", "/00002.ts/", "/00003.ts/"} {
+		if strings.Count(recorded, name) != 1 {
+			t.Fatalf("segment %s should appear exactly once:\n%s", name, recorded)
+		}
+	}
+
+	final, err := AppendSegments(recorded, nil, true)
+	if err != nil {
+		t.Fatalf("AppendSegments final: %v", err)
+	}
+	if !strings.Contains(final, "#EXT-X-PLAYLIST-TYPE:VOD") || !strings.HasSuffix(final, "#EXT-X-ENDLIST\n") {
+		t.Fatalf("final playlist should be VOD with ENDLIST:\n%s", final)
+	}
+	if !strings.Contains(final, "#EXT-X-TARGETDURATION:6") {
+		t.Fatalf("target duration should cover the longest window:\n%s", final)
+	}
+}
@@ -0,0 +1,83 @@
+package m3u8
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+// LocalVideoPlaylistName is the name of the video media playlist of a task
+// with renditions in a localized master playlist, where MediaPlaylistName is
+// taken by the master playlist itself.
+const LocalVideoPlaylistName = "video.m3u8"
+
+var uriAttribute = regexp.MustCompile(`URI="([^"]*)"`)
+
+// LocalizePlaylist rewrites the URIs of a playlist stored for a task into names
+// relative to the task directory, so it plays without the proxy address or the
+// origin: proxied segment, key and map URIs become their cache filenames and
+// the media playlist URIs of a rendition master their playlist names. rename
+// maps each name to the one written and rejects names that must not appear.
+func LocalizePlaylist(content string, rename func(name string) (string, bool)) (string, error) {
+	// Playlists stored before the rewriters dropped the playlist level key still
+	// carry the origin key URI in their header; the first segment has its own copy.
+	if pl, listType, err := Parse(strings.NewReader(content)); err == nil && listType == Variant {
+		if media := pl.(*m3u8.MediaPlaylist); media.Key != nil {
+			media.Key = nil
+			content = media.String()
+		}
+	}
+	var out strings.Builder
+	var failed error
+	localize := func(uri string) string {
+		name, ok := localName(uri)
+		if ok {
+			name, ok = rename(name)
+		}
+		if !ok && failed == nil {
+			failed = fmt.Errorf("playlist uri %q is not a file of the task", uri)
+		}
+		return name
+	}
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#"):
+			line = uriAttribute.ReplaceAllStringFunc(line, func(attr string) string {
+				return `URI="` + localize(uriAttribute.FindStringSubmatch(attr)[1]) + `"`
+			})
+		default:
+			line = localize(line)
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if failed != nil {
+		return "", failed
+	}
+	return out.String(), nil
+}
+
+// localName returns the file name a proxied URI written by the rewriters
+// stands for: .../{seg|key|map}/{taskID}/{filename}/{encoded URL} or
+// .../media/{taskID}/{playlist}.
+func localName(uri string) (string, bool) {
+	if name, ok := ProxiedFilename(uri); ok {
+		return name, true
+	}
+	uri, _, _ = strings.Cut(uri, "?")
+	parts := strings.Split(uri, "/")
+	if len(parts) >= 3 && parts[len(parts)-3] == "media" && parts[len(parts)-1] != "" {
+		return parts[len(parts)-1], true
+	}
+	return "", false
+}
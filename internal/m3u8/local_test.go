@@ -0,0 +1,87 @@
+package m3u8
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestLocalizePlaylistUsesTaskFileNames(t *testing.T) {
+	pl := parseMediaPlaylist(t, `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MAP:URI="init.mp4"
+#EXT-X-KEY:METHOD=AES-128,URI="k.key",IV=0x0102
+#EXTINF:4.0,
+#EXT-X-BYTERANGE:1000@0
+media.m4s
+#EXTINF:4.0,
+#EXT-X-BYTERANGE:1000
+media.m4s
+#EXT-X-ENDLIST
+`)
+	base, _ := url.Parse("https://cdn.example.com/vod/index.m3u8")
+	content, items, _ := RewriteVariant(pl, "http://192.168.1.2:8084/proxy", "task-local", base)
+
+	local, err := LocalizePlaylist(content, func(name string) (string, bool) { return name, true })
+	if err != nil {
+		t.Fatalf("LocalizePlaylist: %v", err)
+	}
+	if strings.Contains(local, "http") || strings.Contains(local, "range=") {
+		t.Fatalf("localized playlist still points at the proxy:\n%s", local)
+	}
+	for _, item := range items {
+		if !strings.Contains(local, item.Filename) {
+			t.Fatalf("localized playlist misses %s:\n%s", item.Filename, local)
+		}
+	}
+	if !strings.Contains(local, ",IV=0x0102") || !strings.Contains(local, "#EXTINF:4.000,") {
+		t.Fatalf("localized playlist lost tag attributes:\n%s", local)
+	}
+
+	if _, err := LocalizePlaylist(content, func(name string) (string, bool) { return name, !strings.HasSuffix(name, ".key") }); err == nil {
+		t.Fatal("a rejected name should fail the playlist")
+	}
+	if _, err := LocalizePlaylist("#EXTM3U\n#EXTINF:4,\nhttps://origin.example.com/a.ts\n", func(name string) (string, bool) { return name, true }); err == nil {
+		t.Fatal("an origin URI should fail the playlist")
+	}
+}
+
+func TestLocalizePlaylistRenamesRenditionPlaylists(t *testing.T) {
+	master := `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="English",URI="http://proxy/proxy/media/task-r/audio0.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000,AUDIO="aud"
+http://proxy/proxy/media/task-r/index.m3u8
+`
+	local, err := LocalizePlaylist(master, func(name string) (string, bool) {
+		if name == MediaPlaylistName {
+			return LocalVideoPlaylistName, true
+		}
+		return name, true
+	})
+	if err != nil {
+		t.Fatalf("LocalizePlaylist: %v", err)
+	}
+	if !strings.Contains(local, `URI="audio0.m3u8"`) || !strings.Contains(local, "\nvideo.m3u8\n") {
+		t.Fatalf("localized master = \n%s", local)
+	}
+}
+
+func TestLocalizePlaylistDropsStaleHeaderKey(t *testing.T) {
+	stored := `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-KEY:METHOD=AES-128,URI="k.key"
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-TARGETDURATION:4
+#EXT-X-KEY:METHOD=AES-128,URI="http://proxy/proxy/key/t/abc.key/https%3A%2F%2Fcdn.example.com%2Fk.key"
+#EXTINF:4.000,
+http://proxy/proxy/seg/t/00001.ts/https%3A%2F%2Fcdn.example.com%2F1.ts
+#EXT-X-ENDLIST
+`
+	local, err := LocalizePlaylist(stored, func(name string) (string, bool) { return name, true })
+	if err != nil {
+		t.Fatalf("LocalizePlaylist: %v", err)
+	}
+	if strings.Count(local, "#EXT-X-KEY") != 1 || !strings.Contains(local, `URI="abc.key"`) {
+		t.Fatalf("localized playlist = \n%s", local)
+	}
+}
@@ -0,0 +1,99 @@
+package m3u8
+
+import (
+	"math"
+	"net/url"
+
+	"github.com/grafov/m3u8"
+)
+
+// MediaPreview summarizes what downloading a media playlist would involve,
+// without rewriting it.
+type MediaPreview struct {
+	Segments int     `json:"segments"`
+	Duration float64 `json:"duration"`
+	Live     bool    `json:"live"`
+	// Keys lists the distinct EXT-X-KEY entries other than METHOD=NONE.
+	Keys          []KeyInfo `json:"keys,omitempty"`
+	UsesMap       bool      `json:"uses_map"`
+	UsesByteRange bool      `json:"uses_byte_range"`
+	// AdFilter names the filter that matches the playlist, if any; AdRanges are
+	// the segments it would remove and Kept* what is left after that.
+	AdFilter     string    `json:"ad_filter,omitempty"`
+	AdRanges     []AdRange `json:"ad_ranges,omitempty"`
+	KeptSegments int       `json:"kept_segments"`
+	KeptDuration float64   `json:"kept_duration"`
+}
+
+// KeyInfo describes one EXT-X-KEY with an absolute key URI.
+type KeyInfo struct {
+	Method    string `json:"method"`
+	URI       string `json:"uri,omitempty"`
+	KeyFormat string `json:"keyformat,omitempty"`
+}
+
+// PreviewMedia reports on a media playlist and returns the segments that would
+// be downloaded, with absolute URLs and byte ranges, so their size can be
+// estimated. With filterAds false no ad filter is applied.
+func PreviewMedia(p *m3u8.MediaPlaylist, originBaseURL *url.URL, filterAds bool) (MediaPreview, []DownloadItem) {
+	preview := MediaPreview{Live: !p.Closed}
+	resolveByteRangeOffsets(p.Segments, originBaseURL)
+
+	seenKeys := make(map[KeyInfo]bool)
+	for _, seg := range p.Segments {
+		if seg == nil {
+			continue
+		}
+		if seg.Map != nil && seg.Map.URI != "" {
+			preview.UsesMap = true
+		}
+		if seg.Key != nil && seg.Key.Method != "" && seg.Key.Method != "NONE" {
+			key := KeyInfo{Method: seg.Key.Method, KeyFormat: seg.Key.Keyformat}
+			if seg.Key.URI != "" {
+				key.URI = resolveURL(originBaseURL, seg.Key.URI)
+			}
+			if !seenKeys[key] {
+				seenKeys[key] = true
+				preview.Keys = append(preview.Keys, key)
+			}
+		}
+		if seg.URI == "" {
+			continue
+		}
+		if seg.Limit > 0 {
+			preview.UsesByteRange = true
+		}
+		preview.Segments++
+		preview.Duration += seg.Duration
+	}
+
+	var keep map[int]bool
+	if filterAds {
+		if filter := GetAdFilter(originBaseURL); filter != nil {
+			preview.AdFilter = adFilterSource(filter)
+			keep, preview.AdRanges = applyAdFilter(filter, p.Segments)
+			for i := range preview.AdRanges {
+				for j, uri := range preview.AdRanges[i].URIs {
+					preview.AdRanges[i].URIs[j] = resolveURL(originBaseURL, uri)
+				}
+			}
+		}
+	}
+	items := make([]DownloadItem, 0, len(p.Segments))
+	for i, seg := range p.Segments {
+		if seg == nil || seg.URI == "" || (keep != nil && !keep[i]) {
+			continue
+		}
+		preview.KeptSegments++
+		preview.KeptDuration += seg.Duration
+		items = append(items, DownloadItem{
+			URL:    resolveURL(originBaseURL, seg.URI),
+			Type:   "ts",
+			Offset: seg.Offset,
+			Length: seg.Limit,
+		})
+	}
+	preview.Duration = math.Round(preview.Duration*1000) / 1000
+	preview.KeptDuration = math.Round(preview.KeptDuration*1000) / 1000
+	return preview, items
+}
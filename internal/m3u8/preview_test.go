@@ -0,0 +1,61 @@
+package m3u8
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestPreviewMediaReportsPlaylistFeatures(t *testing.T) {
+	pl := parseMediaPlaylist(t, `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MAP:URI="init.mp4"
+#EXT-X-KEY:METHOD=AES-128,URI="k1.key"
+#EXTINF:4.0,
+#EXT-X-BYTERANGE:1000@0
+media.m4s
+#EXTINF:4.0,
+#EXT-X-BYTERANGE:1500
+media.m4s
+#EXT-X-KEY:METHOD=AES-128,URI="k1.key"
+#EXTINF:2.5,
+#EXT-X-BYTERANGE:800
+media.m4s
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:1.0,
+plain.m4s
+`)
+	base, _ := url.Parse("https://cdn.example.com/vod/index.m3u8")
+	preview, items := PreviewMedia(pl, base, false)
+	if preview.Segments != 4 || preview.Duration != 11.5 || !preview.Live {
+		t.Fatalf("preview = %+v, want 4 live segments of 11.5s", preview)
+	}
+	if !preview.UsesMap || !preview.UsesByteRange {
+		t.Fatalf("preview = %+v, want map and byte range use", preview)
+	}
+	if len(preview.Keys) != 1 || preview.Keys[0].Method != "AES-128" || preview.Keys[0].URI != "https://cdn.example.com/vod/k1.key" {
+		t.Fatalf("keys = %+v, want the one AES-128 key", preview.Keys)
+	}
+	if len(items) != 4 || items[2].Offset != 2500 || items[2].Length != 800 || items[3].Length != 0 {
+		t.Fatalf("items = %+v, want resolved byte ranges", items)
+	}
+}
+
+func TestPreviewMediaAppliesAdFilter(t *testing.T) {
+	t.Cleanup(func() { _ = SetAdRules(nil) })
+	if err := SetAdRules([]AdRule{{Name: "cdn", Match: "cdn.example.com", PathPrefixOutlier: true}}); err != nil {
+		t.Fatalf("SetAdRules: %v", err)
+	}
+	base, _ := url.Parse("https://cdn.example.com/vod/index.m3u8")
+	preview, items := PreviewMedia(parseMediaPlaylist(t, adRulesPlaylist), base, true)
+	if preview.AdFilter != "cdn" || len(preview.AdRanges) != 1 || preview.AdRanges[0].Segments != 2 {
+		t.Fatalf("preview = %+v, want the cdn rule to remove one range of 2 segments", preview)
+	}
+	if preview.Segments != 8 || preview.KeptSegments != 6 || preview.KeptDuration != 22.5 || len(items) != 6 {
+		t.Fatalf("preview = %+v items = %d, want 6 of 8 segments kept", preview, len(items))
+	}
+
+	preview, items = PreviewMedia(parseMediaPlaylist(t, adRulesPlaylist), base, false)
+	if preview.AdFilter != "" || preview.KeptSegments != 8 || len(items) != 8 {
+		t.Fatalf("preview = %+v, want nothing removed with filtering off", preview)
+	}
+}
@@ -0,0 +1,203 @@
+package m3u8
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+// MediaPlaylistName is the name the video media playlist of a task with
+// renditions is served under, next to the rendition playlists.
+const MediaPlaylistName = "index.m3u8"
+
+// Rendition is an EXT-X-MEDIA audio or subtitle playlist chosen to be
+// downloaded together with a variant. Group prefixes the segment filenames of
+// the rendition and tags its manifest items; Playlist is the name its rewritten
+// media playlist is stored and served under.
+type Rendition struct {
+	Type     string `json:"type"`
+	GroupID  string `json:"group_id"`
+	Name     string `json:"name,omitempty"`
+	Language string `json:"language,omitempty"`
+	Default  bool   `json:"default,omitempty"`
+	URL      string `json:"url"`
+	Group    string `json:"group"`
+	Playlist string `json:"playlist"`
+
+	alt *m3u8.Alternative
+}
+
+// playableVariants returns the variants ListVariants describes, in the same
+// order, so a VariantInfo.Index can be mapped back to the playlist entry.
+func playableVariants(p *m3u8.MasterPlaylist) []*m3u8.Variant {
+	out := make([]*m3u8.Variant, 0, len(p.Variants))
+	for _, v := range p.Variants {
+		if v == nil || v.Iframe || v.URI == "" {
+			continue
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+// SelectRenditions picks the audio and subtitle renditions that go with the
+// variant at index. Only renditions with their own URI are considered, the
+// others are muxed into the variant. Per type, every rendition whose LANGUAGE
+// matches one of languages is taken ("en" matches "en" and "en-US", "*"
+// matches everything). Without a match the DEFAULT=YES rendition is taken,
+// for audio the first one when none is marked, so the result is never silent.
+func SelectRenditions(p *m3u8.MasterPlaylist, index int, originBaseURL *url.URL, languages []string) []Rendition {
+	variants := playableVariants(p)
+	if index < 0 || index >= len(variants) {
+		return nil
+	}
+	v := variants[index]
+
+	var out []Rendition
+	for _, group := range []struct {
+		altType, groupID, prefix string
+		required                 bool
+	}{
+		{"AUDIO", v.Audio, "audio", true},
+		{"SUBTITLES", v.Subtitles, "subs", false},
+	} {
+		if group.groupID == "" {
+			continue
+		}
+		var candidates []*m3u8.Alternative
+		seen := make(map[*m3u8.Alternative]bool)
+		for _, alt := range v.Alternatives {
+			if alt == nil || seen[alt] || alt.URI == "" || alt.Type != group.altType || alt.GroupId != group.groupID {
+				continue
+			}
+			seen[alt] = true
+			candidates = append(candidates, alt)
+		}
+		for _, alt := range pickRenditions(candidates, languages, group.required) {
+			name := fmt.Sprintf("%s%d", group.prefix, len(out))
+			out = append(out, Rendition{
+				Type:     alt.Type,
+				GroupID:  alt.GroupId,
+				Name:     alt.Name,
+				Language: alt.Language,
+				Default:  alt.Default,
+				URL:      resolveURL(originBaseURL, alt.URI),
+				Group:    name,
+				Playlist: name + ".m3u8",
+				alt:      alt,
+			})
+		}
+	}
+	return out
+}
+
+func pickRenditions(candidates []*m3u8.Alternative, languages []string, required bool) []*m3u8.Alternative {
+	if len(candidates) == 0 {
+		return nil
+	}
+	var picked []*m3u8.Alternative
+	for _, alt := range candidates {
+		for _, language := range languages {
+			if matchLanguage(alt.Language, language) {
+				picked = append(picked, alt)
+				break
+			}
+		}
+	}
+	if len(picked) > 0 {
+		return picked
+	}
+	for _, alt := range candidates {
+		if alt.Default {
+			return []*m3u8.Alternative{alt}
+		}
+	}
+	if required {
+		return candidates[:1]
+	}
+	return nil
+}
+
+// matchLanguage compares BCP 47 tags case-insensitively; want matches tag when
+// it equals tag or is a prefix of it ending at a subtag boundary.
+func matchLanguage(tag, want string) bool {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	want = strings.ToLower(strings.TrimSpace(want))
+	if want == "" {
+		return false
+	}
+	if want == "*" {
+		return true
+	}
+	return tag == want || strings.HasPrefix(tag, want+"-")
+}
+
+// RewriteRendition rewrites a rendition media playlist of a task. Its segment
+// files are named after the rendition group (audio0_00001.aac) so they do not
+// collide with the video segments, and its download items carry the group.
+func RewriteRendition(p *m3u8.MediaPlaylist, proxyBaseURL, taskID string, originBaseURL *url.URL, group string) (string, []DownloadItem, int) {
+	content, items, total, _ := rewriteMedia(p, proxyBaseURL, taskID, originBaseURL, 0, group, true)
+	return content, items, total
+}
+
+// BuildRenditionMaster writes the master playlist of a task that downloads the
+// variant at index with renditions: the variant points at the task's video
+// playlist and every downloaded rendition at its own playlist, both below
+// mediaBaseURL. Renditions that were not downloaded are left out, ones without
+// a URI are kept as they are except closed captions: the playlist writer drops
+// their mandatory INSTREAM-ID, and the captions stay in the video stream anyway.
+func BuildRenditionMaster(p *m3u8.MasterPlaylist, index int, mediaBaseURL string, renditions []Rendition) (string, error) {
+	variants := playableVariants(p)
+	if index < 0 || index >= len(variants) {
+		return "", fmt.Errorf("variant index %d out of range, playlist has %d variants", index, len(variants))
+	}
+	v := variants[index]
+	downloaded := make(map[*m3u8.Alternative]Rendition, len(renditions))
+	for _, r := range renditions {
+		downloaded[r.alt] = r
+	}
+
+	params := v.VariantParams
+	params.Alternatives = nil
+	groups := make(map[string]bool)
+	seen := make(map[*m3u8.Alternative]bool)
+	for _, alt := range v.Alternatives {
+		if alt == nil || seen[alt] || alt.Type == "CLOSED-CAPTIONS" {
+			continue
+		}
+		seen[alt] = true
+		copied := *alt
+		if alt.URI != "" {
+			r, ok := downloaded[alt]
+			if !ok {
+				continue
+			}
+			copied.URI = mediaBaseURL + "/" + r.Playlist
+		}
+		params.Alternatives = append(params.Alternatives, &copied)
+		groups[alt.Type+"/"+alt.GroupId] = true
+	}
+	// A group whose renditions were all left out must not be referenced.
+	if !groups["AUDIO/"+params.Audio] {
+		params.Audio = ""
+	}
+	if !groups["SUBTITLES/"+params.Subtitles] {
+		params.Subtitles = ""
+	}
+	if !groups["VIDEO/"+params.Video] {
+		params.Video = ""
+	}
+	if params.Captions != "NONE" {
+		params.Captions = ""
+	}
+
+	master := m3u8.NewMasterPlaylist()
+	if p.Version() > master.Version() {
+		master.SetVersion(p.Version())
+	}
+	master.SetIndependentSegments(p.IndependentSegments())
+	master.Append(mediaBaseURL+"/"+MediaPlaylistName, nil, params)
+	return master.String(), nil
+}
@@ -0,0 +1,109 @@
+package m3u8
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/grafov/m3u8"
+)
+
+const renditionMaster = `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",LANGUAGE="en",DEFAULT=YES,AUTOSELECT=YES,URI="audio/en.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="Deutsch",LANGUAGE="de-DE",DEFAULT=NO,AUTOSELECT=YES,URI="audio/de.m3u8"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="Deutsch",LANGUAGE="de",DEFAULT=NO,AUTOSELECT=YES,URI="subs/de.m3u8"
+#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID="cc",NAME="CC1",LANGUAGE="en",DEFAULT=NO,INSTREAM-ID="CC1"
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,AUDIO="aac",SUBTITLES="subs",CLOSED-CAPTIONS="cc"
+360p/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1280x720,AUDIO="aac",SUBTITLES="subs",CLOSED-CAPTIONS="cc"
+720p/index.m3u8
+`
+
+func parseRenditionMaster(t *testing.T) *m3u8.MasterPlaylist {
+	t.Helper()
+	pl, listType, err := Parse(strings.NewReader(renditionMaster))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if listType != Master {
+		t.Fatalf("playlist type = %v, want Master", listType)
+	}
+	return pl.(*m3u8.MasterPlaylist)
+}
+
+func TestSelectRenditionsByLanguage(t *testing.T) {
+	base, _ := url.Parse("https://cdn.example.com/show/master.m3u8")
+	cases := []struct {
+		name      string
+		languages []string
+		want      string
+	}{
+		{"default audio without languages", nil, "audio0=audio/en.m3u8"},
+		{"language prefix matches region", []string{"DE"}, "audio0=audio/de.m3u8,subs1=subs/de.m3u8"},
+		{"unmatched language falls back to default audio", []string{"fr"}, "audio0=audio/en.m3u8"},
+		{"wildcard takes everything", []string{"*"}, "audio0=audio/en.m3u8,audio1=audio/de.m3u8,subs2=subs/de.m3u8"},
+	}
+	for _, tc := range cases {
+		var got []string
+		for _, r := range SelectRenditions(parseRenditionMaster(t), 1, base, tc.languages) {
+			got = append(got, r.Group+"="+strings.TrimPrefix(r.URL, "https://cdn.example.com/show/"))
+		}
+		if strings.Join(got, ",") != tc.want {
+			t.Fatalf("%s: selected %v, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRewriteRenditionPrefixesFilenamesWithGroup(t *testing.T) {
+	audio := parseMediaPlaylist(t, `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXTINF:4.0,
+a1.aac
+#EXT-X-ENDLIST
+`)
+	base, _ := url.Parse("https://cdn.example.com/show/audio/en.m3u8")
+	content, items, total := RewriteRendition(audio, "http://proxy/proxy", "task-r", base, "audio0")
+	if total != 1 || len(items) != 1 || items[0].Filename != "audio0_00001.aac" || items[0].Group != "audio0" {
+		t.Fatalf("unexpected items: %#v (total %d)", items, total)
+	}
+	if !strings.Contains(content, "/proxy/seg/task-r/audio0_00001.aac/") {
+		t.Fatalf("segment should be proxied under the group filename:\n%s", content)
+	}
+}
+
+func TestBuildRenditionMasterKeepsOnlyDownloadedRenditions(t *testing.T) {
+	master := parseRenditionMaster(t)
+	base, _ := url.Parse("https://cdn.example.com/show/master.m3u8")
+	renditions := SelectRenditions(master, 1, base, []string{"en"})
+
+	content, err := BuildRenditionMaster(master, 1, "http://proxy/proxy/media/task-r", renditions)
+	if err != nil {
+		t.Fatalf("BuildRenditionMaster: %v", err)
+	}
+	for _, want := range []string{
+		`URI="http://proxy/proxy/media/task-r/audio0.m3u8"`,
+		`AUDIO="aac"`,
+		"http://proxy/proxy/media/task-r/index.m3u8",
+	} {
+		if !strings.Contains(content, want) {
+			t.Fatalf("master playlist lacks %s:\n%s", want, content)
+		}
+	}
+	for _, unwanted := range []string{"de.m3u8", "SUBTITLES=", "CLOSED-CAPTIONS", "360p"} {
+		if strings.Contains(content, unwanted) {
+			t.Fatalf("master playlist should not contain %s:\n%s", unwanted, content)
+		}
+	}
+}
+
+func TestRewriteMasterProxiesRenditionsOnce(t *testing.T) {
+	base, _ := url.Parse("https://cdn.example.com/show/master.m3u8")
+	content := RewriteMaster(parseRenditionMaster(t), "http://proxy/proxy", base)
+	enURI := "http://proxy/proxy/m3u8/" + url.QueryEscape("https://cdn.example.com/show/audio/en.m3u8")
+	if strings.Count(content, enURI) != 1 {
+		t.Fatalf("audio rendition should be proxied exactly once:\n%s", content)
+	}
+	if strings.Contains(content, `URI="audio/`) {
+		t.Fatalf("relative rendition URI left in master:\n%s", content)
+	}
+}
@@ -7,6 +7,9 @@ import (
 	"io"
 	"net/url"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/grafov/m3u8"
 )
@@ -22,7 +25,12 @@ const (
 type DownloadItem struct {
 	URL      string
 	Filename string
-	Type     string // "ts" or "key"
+	Type     string // "ts", "key" or "map"
+	// Group is empty for the main media playlist and names the rendition otherwise.
+	Group string
+	// Offset and Length select a byte range of URL; Length 0 means the whole resource.
+	Offset int64
+	Length int64
 }
 
 // Parse checks the content and returns the type and parsed object
@@ -56,39 +64,220 @@ func resolveURL(base *url.URL, ref string) string {
 	return base.ResolveReference(refURL).String()
 }
 
-// RewriteMaster rewrites URIs in a master playlist
+// FormatByteRange renders a byte range the way EXT-X-BYTERANGE does: <length>@<offset>.
+func FormatByteRange(length, offset int64) string {
+	return fmt.Sprintf("%d@%d", length, offset)
+}
+
+// ParseByteRange parses <length>[@<offset>] as produced by FormatByteRange.
+func ParseByteRange(value string) (int64, int64, error) {
+	lengthPart, offsetPart, hasOffset := strings.Cut(value, "@")
+	length, err := strconv.ParseInt(lengthPart, 10, 64)
+	if err != nil || length <= 0 {
+		return 0, 0, fmt.Errorf("invalid byte range %q", value)
+	}
+	var offset int64
+	if hasOffset {
+		offset, err = strconv.ParseInt(offsetPart, 10, 64)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("invalid byte range %q", value)
+		}
+	}
+	return length, offset, nil
+}
+
+// RangeHeader returns the HTTP Range header value for a byte range.
+func RangeHeader(length, offset int64) string {
+	return fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+}
+
+// proxyRangeQuery is appended to proxied URIs whose origin resource is only a
+// slice, so the proxy can fetch the same slice when the file is not cached yet.
+func proxyRangeQuery(length, offset int64) string {
+	if length <= 0 {
+		return ""
+	}
+	return "?range=" + FormatByteRange(length, offset)
+}
+
+// ProxyPathPrefix is the proxy base URL for playlists that are stored: the
+// rewritten URIs stay root-relative and RenderProxyBase makes them absolute for
+// the address a client reached the proxy with.
+const ProxyPathPrefix = "/proxy"
+
+// 行首或 URI 属性里的代理地址前缀；旧版本存储的播放列表带绝对地址，一并替换
+var proxiedURIPrefix = regexp.MustCompile(`(?m)(^|URI=")(?:https?://[^/\s"]*)?/proxy/(seg|key|map|media)/`)
+
+// RenderProxyBase points the proxied URIs of a stored playlist at proxyBaseURL.
+func RenderProxyBase(content, proxyBaseURL string) string {
+	return proxiedURIPrefix.ReplaceAllStringFunc(content, func(prefix string) string {
+		match := proxiedURIPrefix.FindStringSubmatch(prefix)
+		return match[1] + proxyBaseURL + "/" + match[2] + "/"
+	})
+}
+
+// ProxiedFilename returns the cache filename of a segment, key or map URI
+// written by RewriteVariant: .../{seg|key|map}/{taskID}/{filename}/{encoded URL}.
+func ProxiedFilename(uri string) (string, bool) {
+	uri, _, _ = strings.Cut(uri, "?")
+	parts := strings.Split(uri, "/")
+	if len(parts) < 4 {
+		return "", false
+	}
+	switch parts[len(parts)-4] {
+	case "seg", "key", "map":
+		return parts[len(parts)-2], parts[len(parts)-2] != ""
+	}
+	return "", false
+}
+
+func extOf(fullURL, fallback string) string {
+	if u, err := url.Parse(fullURL); err == nil {
+		if e := filepath.Ext(u.Path); e != "" {
+			return e
+		}
+	}
+	return fallback
+}
+
+// resolveByteRangeOffsets fills in EXT-X-BYTERANGE offsets that were omitted.
+// Per RFC 8216 such a range starts right after the previous range of the same
+// resource, but the parser reports the missing offset as 0.
+func resolveByteRangeOffsets(segments []*m3u8.MediaSegment, originBaseURL *url.URL) {
+	rangeEnd := make(map[string]int64)
+	for _, seg := range segments {
+		if seg == nil || seg.URI == "" || seg.Limit <= 0 {
+			continue
+		}
+		fullURL := resolveURL(originBaseURL, seg.URI)
+		if end, ok := rangeEnd[fullURL]; ok && seg.Offset == 0 {
+			seg.Offset = end
+		}
+		rangeEnd[fullURL] = seg.Offset + seg.Limit
+	}
+}
+
+// RewriteMaster rewrites URIs in a master playlist, including the EXT-X-MEDIA
+// renditions attached to its variants.
 func RewriteMaster(p *m3u8.MasterPlaylist, proxyBaseURL string, originBaseURL *url.URL) string {
+	// 同一个 EXT-X-MEDIA 会挂到多个 variant 上，只能改写一次
+	rewritten := make(map[*m3u8.Alternative]bool)
 	for _, v := range p.Variants {
 		fullURL := resolveURL(originBaseURL, v.URI)
 		encodedURL := url.QueryEscape(fullURL)
 		v.URI = fmt.Sprintf("%s/m3u8/%s", proxyBaseURL, encodedURL)
+		for _, alt := range v.Alternatives {
+			if alt == nil || alt.URI == "" || rewritten[alt] {
+				continue
+			}
+			rewritten[alt] = true
+			alt.URI = fmt.Sprintf("%s/m3u8/%s", proxyBaseURL, url.QueryEscape(resolveURL(originBaseURL, alt.URI)))
+		}
 	}
 	return p.String()
 }
 
 // RewriteVariant rewrites URIs in a media playlist and returns download plan
-// proxyBaseURL: http://localhost:PORT/proxy
+// proxyBaseURL: http://HOST:PORT/proxy, or ProxyPathPrefix for stored playlists
 // taskID: unique ID for cache
 func RewriteVariant(p *m3u8.MediaPlaylist, proxyBaseURL, taskID string, originBaseURL *url.URL) (string, []DownloadItem, int) {
+	return RewriteVariantFrom(p, proxyBaseURL, taskID, originBaseURL, 0)
+}
+
+// RewriteVariantWithAds is RewriteVariantFrom that also returns the segment
+// ranges the ad filter removed. With filterAds false no ad filter is applied.
+func RewriteVariantWithAds(p *m3u8.MediaPlaylist, proxyBaseURL, taskID string, originBaseURL *url.URL, firstIndex int, filterAds bool) (string, []DownloadItem, int, []AdRange) {
+	return rewriteMedia(p, proxyBaseURL, taskID, originBaseURL, firstIndex, "", filterAds)
+}
+
+// RewriteVariantFrom is RewriteVariant for a playlist whose first firstIndex
+// segments were already rewritten earlier, e.g. a later window of a live stream;
+// segment files continue at firstIndex+1.
+func RewriteVariantFrom(p *m3u8.MediaPlaylist, proxyBaseURL, taskID string, originBaseURL *url.URL, firstIndex int) (string, []DownloadItem, int) {
+	content, items, total, _ := rewriteMedia(p, proxyBaseURL, taskID, originBaseURL, firstIndex, "", true)
+	return content, items, total
+}
+
+// hasImplicitIV reports whether segments under key derive their IV from the
+// media sequence number.
+func hasImplicitIV(key *m3u8.Key) bool {
+	return key != nil && key.IV == "" && key.Method != "" && !strings.EqualFold(key.Method, "NONE")
+}
+
+func rewriteMedia(p *m3u8.MediaPlaylist, proxyBaseURL, taskID string, originBaseURL *url.URL, firstIndex int, group string, filterAds bool) (string, []DownloadItem, int, []AdRange) {
+	filenamePrefix := ""
+	if group != "" {
+		filenamePrefix = group + "_"
+	}
 	items := []DownloadItem{}
 	seenKeys := make(map[string]bool)
+	seenMaps := make(map[string]bool)
 	totalSegments := 0
 
+	// 先补全省略的 BYTERANGE 偏移量，必须在广告过滤删除片段之前完成
+	resolveByteRangeOffsets(p.Segments, originBaseURL)
+
+	// 解析器把第一个 EXT-X-KEY 另存为播放列表级密钥并原样写回头部；第一个片段已带有同一密钥，
+	// 去掉它以免输出中残留未改写的源站密钥地址
+	p.Key = nil
+
 	// 应用广告过滤器
-	adFilter := GetAdFilter(originBaseURL)
+	var adFilter AdFilter
+	if filterAds {
+		adFilter = GetAdFilter(originBaseURL)
+	}
 	var keepSegments map[int]bool
+	var adRanges []AdRange
 	if adFilter != nil {
-		keepSegments = adFilter.Filter(p.Segments)
+		keepSegments, adRanges = applyAdFilter(adFilter, p.Segments)
+		for i := range adRanges {
+			for j, uri := range adRanges[i].URIs {
+				adRanges[i].URIs[j] = resolveURL(originBaseURL, uri)
+			}
+		}
 		// 移除广告片段：将不在保留列表中的片段设置为nil
+		// 被移除片段上的 EXT-X-MAP / EXT-X-KEY 顺延到下一个保留片段，避免后续片段丢失初始化段或密钥
+		// 没有 IV 的密钥按媒体序列号推导 IV；删掉片段后播放器和导出按输出里的位置重新计数，
+		// 所以删除点之后的片段都写上按原序列号算出的显式 IV
+		var carriedMap *m3u8.Map
+		var carriedKey, currentKey *m3u8.Key
+		removed := false
 		for i, seg := range p.Segments {
-			if seg != nil && !keepSegments[i] {
+			if seg == nil {
+				continue
+			}
+			if seg.Key != nil {
+				currentKey = seg.Key
+			}
+			if !keepSegments[i] {
+				if seg.Map != nil {
+					carriedMap = seg.Map
+				}
+				if seg.Key != nil {
+					carriedKey = seg.Key
+				}
 				p.Segments[i] = nil
+				removed = true
+				continue
+			}
+			if seg.Map == nil {
+				seg.Map = carriedMap
+			}
+			if seg.Key == nil {
+				seg.Key = carriedKey
+			}
+			carriedMap = nil
+			carriedKey = nil
+			if removed && hasImplicitIV(currentKey) {
+				key := *currentKey
+				key.IV = fmt.Sprintf("0x%032x", seg.SeqId)
+				seg.Key = &key
 			}
 		}
 	}
 
 	// 用于重新编号的计数器（只对保留的片段计数）
-	segmentIndex := 0
+	segmentIndex := firstIndex
 
 	// We iterate through segments to collect URLs and rewrite them
 	for _, seg := range p.Segments {
@@ -101,30 +290,63 @@ func RewriteVariant(p *m3u8.MediaPlaylist, proxyBaseURL, taskID string, originBa
 			segmentIndex++ // 只对保留的片段计数
 		}
 
+		// Resolve and Rewrite Map URI (fMP4 / CMAF initialization section)
+		if seg.Map != nil && seg.Map.URI != "" {
+			fullMapURL := resolveURL(originBaseURL, seg.Map.URI)
+
+			// Filename: md5(url[@range]).init<ext>, so different slices of one file do not collide
+			mapID := fullMapURL
+			if seg.Map.Limit > 0 {
+				mapID += "@" + FormatByteRange(seg.Map.Limit, seg.Map.Offset)
+			}
+			hash := md5.Sum([]byte(mapID))
+			filename := hex.EncodeToString(hash[:]) + ".init" + extOf(fullMapURL, ".mp4")
+			encodedURL := url.QueryEscape(fullMapURL)
+
+			// Rewrite to: /proxy/map/{taskID}/{filename}/{encoded_url}[?range=<length>@<offset>]
+			seg.Map.URI = fmt.Sprintf("%s/map/%s/%s/%s%s", proxyBaseURL, taskID, filename, encodedURL, proxyRangeQuery(seg.Map.Limit, seg.Map.Offset))
+
+			if !seenMaps[filename] {
+				items = append(items, DownloadItem{
+					URL:      fullMapURL,
+					Filename: filename,
+					Type:     "map",
+					Group:    group,
+					Offset:   seg.Map.Offset,
+					Length:   seg.Map.Limit,
+				})
+				seenMaps[filename] = true
+			}
+			// The proxy serves exactly the selected slice, so the range must not be applied again.
+			seg.Map.Limit = 0
+			seg.Map.Offset = 0
+		}
+
 		// Resolve and Rewrite Segment URI
 		if seg.URI != "" {
 			fullSegURL := resolveURL(originBaseURL, seg.URI)
 
 			// Determine extension
-			ext := ".ts"
-			if u, err := url.Parse(fullSegURL); err == nil {
-				if e := filepath.Ext(u.Path); e != "" {
-					ext = e
-				}
-			}
+			ext := extOf(fullSegURL, ".ts")
 
 			// 使用重新编号的索引（segmentIndex）而不是原始索引（i+1）
-			filename := fmt.Sprintf("%05d%s", segmentIndex, ext) // 1-based index with ext
+			filename := fmt.Sprintf("%s%05d%s", filenamePrefix, segmentIndex, ext) // 1-based index with ext
 			encodedURL := url.QueryEscape(fullSegURL)
 
-			// Rewrite to: /proxy/seg/{taskID}/{filename}/{encoded_url}
-			seg.URI = fmt.Sprintf("%s/seg/%s/%s/%s", proxyBaseURL, taskID, filename, encodedURL)
+			// Rewrite to: /proxy/seg/{taskID}/{filename}/{encoded_url}[?range=<length>@<offset>]
+			seg.URI = fmt.Sprintf("%s/seg/%s/%s/%s%s", proxyBaseURL, taskID, filename, encodedURL, proxyRangeQuery(seg.Limit, seg.Offset))
 
 			items = append(items, DownloadItem{
 				URL:      fullSegURL,
 				Filename: filename,
 				Type:     "ts",
+				Group:    group,
+				Offset:   seg.Offset,
+				Length:   seg.Limit,
 			})
+			// Each proxied segment URI already is its own slice.
+			seg.Limit = 0
+			seg.Offset = 0
 		}
 
 		// Resolve and Rewrite Key URI
@@ -144,10 +366,14 @@ func RewriteVariant(p *m3u8.MediaPlaylist, proxyBaseURL, taskID string, originBa
 					URL:      fullKeyURL,
 					Filename: filename,
 					Type:     "key",
+					Group:    group,
 				})
 				seenKeys[filename] = true
 			}
 		}
 	}
-	return p.String(), items, totalSegments
+	// The writer ignores per-segment maps while a playlist default map is set, and
+	// the default still points at the origin, so rely on the rewritten segment maps.
+	p.Map = nil
+	return p.String(), items, totalSegments, adRanges
 }
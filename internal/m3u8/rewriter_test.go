@@ -0,0 +1,165 @@
+package m3u8
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/grafov/m3u8"
+)
+
+func parseMediaPlaylist(t *testing.T, content string) *m3u8.MediaPlaylist {
+	t.Helper()
+	pl, listType, err := Parse(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if listType != Variant {
+		t.Fatalf("playlist type = %v, want Variant", listType)
+	}
+	return pl.(*m3u8.MediaPlaylist)
+}
+
+func TestRewriteVariantDownloadsAndProxiesMapSections(t *testing.T) {
+	mediaPl := parseMediaPlaylist(t, `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:4
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="720@0"
+#EXTINF:4.0,
+seg1.m4s
+#EXTINF:4.0,
+seg2.m4s
+#EXT-X-DISCONTINUITY
+#EXT-X-MAP:URI="other/init.mp4"
+#EXTINF:4.0,
+other/seg3.m4s
+#EXT-X-ENDLIST
+`)
+	base, _ := url.Parse("https://cdn.example.com/vod/index.m3u8")
+
+	content, items, total := RewriteVariant(mediaPl, "http://proxy/proxy", "task-1", base)
+	if total != 3 {
+		t.Fatalf("total segments = %d, want 3", total)
+	}
+
+	var maps []DownloadItem
+	for _, item := range items {
+		if item.Type == "map" {
+			maps = append(maps, item)
+		}
+	}
+	if len(maps) != 2 {
+		t.Fatalf("map items = %d, want 2: %#v", len(maps), items)
+	}
+	if items[0].Type != "map" {
+		t.Fatalf("first item type = %q, init section should precede its segments", items[0].Type)
+	}
+	if maps[0].URL != "https://cdn.example.com/vod/init.mp4" || maps[0].Length != 720 || maps[0].Offset != 0 {
+		t.Fatalf("unexpected first map item: %#v", maps[0])
+	}
+	if maps[1].URL != "https://cdn.example.com/vod/other/init.mp4" || maps[1].Length != 0 {
+		t.Fatalf("unexpected second map item: %#v", maps[1])
+	}
+
+	if strings.Count(content, "#EXT-X-MAP:") != 2 {
+		t.Fatalf("rewritten playlist should keep both maps:\n%s", content)
+	}
+	if strings.Contains(content, "BYTERANGE") {
+		t.Fatalf("proxied map should not carry the origin byte range:\n%s", content)
+	}
+	wantURI := "http://proxy/proxy/map/task-1/" + maps[0].Filename + "/" + url.QueryEscape(maps[0].URL) + "?range=720@0"
+	if !strings.Contains(content, `URI="`+wantURI+`"`) {
+		t.Fatalf("rewritten playlist missing %s:\n%s", wantURI, content)
+	}
+	if strings.Contains(content, `URI="init.mp4"`) {
+		t.Fatalf("rewritten playlist still points at origin map:\n%s", content)
+	}
+}
+
+func TestParseByteRange(t *testing.T) {
+	length, offset, err := ParseByteRange("720@100")
+	if err != nil || length != 720 || offset != 100 {
+		t.Fatalf("ParseByteRange = %d, %d, %v", length, offset, err)
+	}
+	if RangeHeader(length, offset) != "bytes=100-819" {
+		t.Fatalf("RangeHeader = %q", RangeHeader(length, offset))
+	}
+	if _, _, err := ParseByteRange("abc"); err == nil {
+		t.Fatal("expected invalid byte range to be rejected")
+	}
+}
+
+func TestRewriteVariantKeepsByteRangesPerSegment(t *testing.T) {
+	mediaPl := parseMediaPlaylist(t, `#EXTM3U
+#EXT-X-VERSION:4
+#EXT-X-TARGETDURATION:10
+#EXTINF:10.0,
+#EXT-X-BYTERANGE:1000@0
+main.ts
+#EXTINF:10.0,
+#EXT-X-BYTERANGE:1500
+main.ts
+#EXTINF:10.0,
+#EXT-X-BYTERANGE:800
+main.ts
+#EXT-X-ENDLIST
+`)
+	base, _ := url.Parse("https://cdn.example.com/vod/index.m3u8")
+
+	content, items, total := RewriteVariant(mediaPl, "http://proxy/proxy", "task-br", base)
+	if total != 3 || len(items) != 3 {
+		t.Fatalf("total = %d, items = %d, want 3 and 3", total, len(items))
+	}
+
+	want := []struct{ offset, length int64 }{{0, 1000}, {1000, 1500}, {2500, 800}}
+	for i, w := range want {
+		item := items[i]
+		if item.URL != "https://cdn.example.com/vod/main.ts" {
+			t.Fatalf("items[%d].URL = %q", i, item.URL)
+		}
+		if item.Offset != w.offset || item.Length != w.length {
+			t.Fatalf("items[%d] range = %d@%d, want %d@%d", i, item.Length, item.Offset, w.length, w.offset)
+		}
+		if !strings.Contains(content, "/"+item.Filename+"/") {
+			t.Fatalf("rewritten playlist missing %s:\n%s", item.Filename, content)
+		}
+	}
+	if items[0].Filename == items[1].Filename {
+		t.Fatal("byte range segments of one resource must get distinct filenames")
+	}
+	if strings.Contains(content, "#EXT-X-BYTERANGE") {
+		t.Fatalf("proxied segments should not carry origin byte ranges:\n%s", content)
+	}
+	if !strings.Contains(content, "?range=1500@1000") {
+		t.Fatalf("rewritten playlist should pass the slice to the proxy:\n%s", content)
+	}
+}
+
+func TestRenderProxyBaseRewritesStoredAndLegacyAddresses(t *testing.T) {
+	pl := parseMediaPlaylist(t, `#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-KEY:METHOD=AES-128,URI="k.key"
+#EXTINF:4.0,
+a.ts
+#EXT-X-ENDLIST
+`)
+	base, _ := url.Parse("https://cdn.example.com/vod/index.m3u8")
+	stored, _, _ := RewriteVariant(pl, ProxyPathPrefix, "task-render", base)
+	if strings.Contains(stored, "http://") || !strings.Contains(stored, "\n/proxy/seg/task-render/00001.ts/") {
+		t.Fatalf("stored playlist is not host independent:\n%s", stored)
+	}
+
+	rendered := RenderProxyBase(stored, "https://media.example.net/hls/proxy")
+	if !strings.Contains(rendered, `URI="https://media.example.net/hls/proxy/key/task-render/`) ||
+		!strings.Contains(rendered, "\nhttps://media.example.net/hls/proxy/seg/task-render/00001.ts/https%3A%2F%2Fcdn.example.com%2Fvod%2Fa.ts\n") {
+		t.Fatalf("rendered playlist = \n%s", rendered)
+	}
+	legacy := strings.ReplaceAll(stored, "/proxy/", "http://localhost:8084/proxy/")
+	if got := RenderProxyBase(legacy, "https://media.example.net/hls/proxy"); got != rendered {
+		t.Fatalf("legacy playlist rendered = \n%s\nwant\n%s", got, rendered)
+	}
+	master := "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000\n/proxy/media/task-render/index.m3u8\n"
+	if got := RenderProxyBase(master, "http://10.0.0.2:8084/proxy"); !strings.Contains(got, "\nhttp://10.0.0.2:8084/proxy/media/task-render/index.m3u8\n") {
+		t.Fatalf("rendered master = \n%s", got)
+	}
+}
@@ -0,0 +1,172 @@
+package m3u8
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/grafov/m3u8"
+)
+
+// VariantInfo describes one playable variant of a master playlist. Index is the
+// position in the list returned by ListVariants and is what VariantPolicy.Index
+// refers to.
+type VariantInfo struct {
+	Index            int     `json:"index"`
+	URL              string  `json:"url"`
+	Bandwidth        uint32  `json:"bandwidth"`
+	AverageBandwidth uint32  `json:"average_bandwidth,omitempty"`
+	Resolution       string  `json:"resolution,omitempty"`
+	Width            int     `json:"width,omitempty"`
+	Height           int     `json:"height,omitempty"`
+	Codecs           string  `json:"codecs,omitempty"`
+	FrameRate        float64 `json:"frame_rate,omitempty"`
+	Name             string  `json:"name,omitempty"`
+}
+
+// VariantPolicy chooses a variant of a master playlist. A set Index wins over
+// everything else. Otherwise variants outside the height and bandwidth limits
+// are dropped, Codecs (prefixes such as "avc1" or "hvc1", in order of
+// preference) narrows the rest when any of them matches, and the highest
+// bandwidth left is taken. The zero policy picks the highest bandwidth.
+type VariantPolicy struct {
+	Index        *int     `json:"index,omitempty"`
+	MaxHeight    int      `json:"max_height,omitempty"`
+	MinHeight    int      `json:"min_height,omitempty"`
+	MaxBandwidth uint32   `json:"max_bandwidth,omitempty"`
+	Codecs       []string `json:"codecs,omitempty"`
+}
+
+// ListVariants returns the variants of a master playlist with absolute URLs.
+// I-frame only variants cannot be played on their own and are left out.
+func ListVariants(p *m3u8.MasterPlaylist, originBaseURL *url.URL) []VariantInfo {
+	variants := playableVariants(p)
+	out := make([]VariantInfo, 0, len(variants))
+	for _, v := range variants {
+		width, height := parseResolution(v.Resolution)
+		out = append(out, VariantInfo{
+			Index:            len(out),
+			URL:              resolveURL(originBaseURL, v.URI),
+			Bandwidth:        v.Bandwidth,
+			AverageBandwidth: v.AverageBandwidth,
+			Resolution:       v.Resolution,
+			Width:            width,
+			Height:           height,
+			Codecs:           v.Codecs,
+			FrameRate:        v.FrameRate,
+			Name:             v.Name,
+		})
+	}
+	return out
+}
+
+// SelectVariant applies policy to variants. When the limits exclude every
+// variant, the lowest bandwidth one is taken if a maximum was set and the
+// highest otherwise, so a too strict policy degrades instead of failing.
+func SelectVariant(variants []VariantInfo, policy VariantPolicy) (VariantInfo, error) {
+	if len(variants) == 0 {
+		return VariantInfo{}, fmt.Errorf("master playlist has no variants")
+	}
+	if policy.Index != nil {
+		index := *policy.Index
+		if index < 0 || index >= len(variants) {
+			return VariantInfo{}, fmt.Errorf("variant index %d out of range, playlist has %d variants", index, len(variants))
+		}
+		return variants[index], nil
+	}
+
+	candidates := make([]VariantInfo, 0, len(variants))
+	for _, v := range variants {
+		if policy.allows(v) {
+			candidates = append(candidates, v)
+		}
+	}
+	if len(candidates) == 0 {
+		if policy.MaxHeight > 0 || policy.MaxBandwidth > 0 {
+			return lowestBandwidth(variants), nil
+		}
+		return highestBandwidth(variants), nil
+	}
+	for _, codec := range policy.Codecs {
+		preferred := make([]VariantInfo, 0, len(candidates))
+		for _, v := range candidates {
+			if hasCodec(v.Codecs, codec) {
+				preferred = append(preferred, v)
+			}
+		}
+		if len(preferred) > 0 {
+			candidates = preferred
+			break
+		}
+	}
+	return highestBandwidth(candidates), nil
+}
+
+// allows checks the limits of the policy; a variant without RESOLUTION passes
+// the height limits because they cannot be judged.
+func (policy VariantPolicy) allows(v VariantInfo) bool {
+	if v.Height > 0 {
+		if policy.MaxHeight > 0 && v.Height > policy.MaxHeight {
+			return false
+		}
+		if policy.MinHeight > 0 && v.Height < policy.MinHeight {
+			return false
+		}
+	}
+	if policy.MaxBandwidth > 0 && v.Bandwidth > policy.MaxBandwidth {
+		return false
+	}
+	return true
+}
+
+func highestBandwidth(variants []VariantInfo) VariantInfo {
+	best := variants[0]
+	for _, v := range variants[1:] {
+		if v.Bandwidth > best.Bandwidth {
+			best = v
+		}
+	}
+	return best
+}
+
+func lowestBandwidth(variants []VariantInfo) VariantInfo {
+	best := variants[0]
+	for _, v := range variants[1:] {
+		if v.Bandwidth < best.Bandwidth {
+			best = v
+		}
+	}
+	return best
+}
+
+// hasCodec reports whether a CODECS attribute contains a codec starting with
+// prefix, e.g. "avc1" matches "avc1.64001f,mp4a.40.2".
+func hasCodec(codecs, prefix string) bool {
+	prefix = strings.ToLower(strings.TrimSpace(prefix))
+	if prefix == "" {
+		return false
+	}
+	for _, codec := range strings.Split(codecs, ",") {
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(codec)), prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseResolution(resolution string) (int, int) {
+	w, h, ok := strings.Cut(strings.ToLower(resolution), "x")
+	if !ok {
+		return 0, 0
+	}
+	width, err := strconv.Atoi(strings.TrimSpace(w))
+	if err != nil {
+		return 0, 0
+	}
+	height, err := strconv.Atoi(strings.TrimSpace(h))
+	if err != nil {
+		return 0, 0
+	}
+	return width, height
+}
@@ -0,0 +1,76 @@
+package m3u8
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/grafov/m3u8"
+)
+
+func parseMasterVariants(t *testing.T) []VariantInfo {
+	t.Helper()
+	pl, listType, err := Parse(strings.NewReader(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,CODECS="avc1.4d401e,mp4a.40.2"
+360p/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1280x720,CODECS="avc1.4d401f,mp4a.40.2"
+720p/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720,CODECS="hvc1.1.6.L93.B0,mp4a.40.2"
+720p-hevc/index.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=6000000,RESOLUTION=1920x1080,CODECS="avc1.640028,mp4a.40.2"
+1080p/index.m3u8
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=90000,RESOLUTION=1920x1080,URI="1080p/iframes.m3u8"
+`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if listType != Master {
+		t.Fatalf("playlist type = %v, want Master", listType)
+	}
+	base, _ := url.Parse("https://cdn.example.com/show/master.m3u8")
+	return ListVariants(pl.(*m3u8.MasterPlaylist), base)
+}
+
+func TestListVariantsResolvesURLsAndSkipsIFrameStreams(t *testing.T) {
+	variants := parseMasterVariants(t)
+	if len(variants) != 4 {
+		t.Fatalf("len(variants) = %d, want 4", len(variants))
+	}
+	v := variants[1]
+	if v.Index != 1 || v.URL != "https://cdn.example.com/show/720p/index.m3u8" || v.Width != 1280 || v.Height != 720 {
+		t.Fatalf("unexpected variant: %#v", v)
+	}
+}
+
+func TestSelectVariantAppliesPolicy(t *testing.T) {
+	variants := parseMasterVariants(t)
+	index := 0
+	cases := []struct {
+		name   string
+		policy VariantPolicy
+		want   string
+	}{
+		{"highest bandwidth by default", VariantPolicy{}, "1080p/index.m3u8"},
+		{"max height", VariantPolicy{MaxHeight: 720}, "720p/index.m3u8"},
+		{"max height prefers codec", VariantPolicy{MaxHeight: 720, Codecs: []string{"hvc1", "avc1"}}, "720p-hevc/index.m3u8"},
+		{"unmatched codec is only a preference", VariantPolicy{Codecs: []string{"av01"}}, "1080p/index.m3u8"},
+		{"max bandwidth", VariantPolicy{MaxBandwidth: 1000000}, "360p/index.m3u8"},
+		{"min height", VariantPolicy{MinHeight: 720, MaxBandwidth: 3000000}, "720p/index.m3u8"},
+		{"too strict max falls back to lowest", VariantPolicy{MaxHeight: 240}, "360p/index.m3u8"},
+		{"explicit index wins", VariantPolicy{Index: &index, MinHeight: 1080}, "360p/index.m3u8"},
+	}
+	for _, tc := range cases {
+		got, err := SelectVariant(variants, tc.policy)
+		if err != nil {
+			t.Fatalf("%s: SelectVariant: %v", tc.name, err)
+		}
+		if !strings.HasSuffix(got.URL, "/show/"+tc.want) {
+			t.Fatalf("%s: selected %s, want %s", tc.name, got.URL, tc.want)
+		}
+	}
+
+	outOfRange := 9
+	if _, err := SelectVariant(variants, VariantPolicy{Index: &outOfRange}); err == nil {
+		t.Fatal("out of range index should fail")
+	}
+}
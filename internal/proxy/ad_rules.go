@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"hls-accelerator/internal/config"
+	playlist "hls-accelerator/internal/m3u8"
+)
+
+type adRulesBody struct {
+	Rules []config.AdFilterRule `json:"rules"`
+}
+
+// applyAdRules compiles the rules into the ad filter registry; invalid rules
+// leave the current ones in place.
+func applyAdRules(rules []config.AdFilterRule) error {
+	converted := make([]playlist.AdRule, 0, len(rules))
+	for _, rule := range rules {
+		converted = append(converted, playlist.AdRule(rule))
+	}
+	return playlist.SetAdRules(converted)
+}
+
+func currentAdRules() []config.AdFilterRule {
+	rules := playlist.AdRules()
+	out := make([]config.AdFilterRule, 0, len(rules))
+	for _, rule := range rules {
+		out = append(out, config.AdFilterRule(rule))
+	}
+	return out
+}
+
+func writeAdRules(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(adRulesBody{Rules: currentAdRules()})
+}
+
+func (s *Server) handleGetAdRules(w http.ResponseWriter, r *http.Request) {
+	writeAdRules(w)
+}
+
+// handlePutAdRules replaces the ad filter rules and writes them to config.json.
+func (s *Server) handlePutAdRules(w http.ResponseWriter, r *http.Request) {
+	var body adRulesBody
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := applyAdRules(body.Rules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := config.SaveAdFilterRules(body.Rules); err != nil {
+		log.Printf("save ad filter rules failed: %v", err)
+		http.Error(w, "rules applied but not saved: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeAdRules(w)
+}
+
+// handleReloadAdRules applies the ad filter rules of config.json again.
+func (s *Server) handleReloadAdRules(w http.ResponseWriter, r *http.Request) {
+	rules, err := config.ReadAdFilterRules()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := applyAdRules(rules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeAdRules(w)
+}
@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// maxSharedBody bounds the memory of one coalesced response. Larger responses
+// with a known length go to a single client and the others fetch their own;
+// one without a length that outgrows it is read on by a single client.
+const maxSharedBody = 64 << 20
+
+var errSharedBodyTooLarge = errors.New("upstream response too large to share")
+
+// requestKey identifies what an upstream request returns: its URL and a hash
+// of its headers, so that requests with different cookies or credentials,
+// such as those of different tasks, never share a response.
+func requestKey(req *http.Request) string {
+	h := sha256.New()
+	for _, name := range slices.Sorted(maps.Keys(req.Header)) {
+		for _, value := range req.Header[name] {
+			fmt.Fprintf(h, "%s: %s\n", name, value)
+		}
+	}
+	return req.Method + " " + req.URL.String() + " " + hex.EncodeToString(h.Sum(nil))
+}
+
+// upstreamGroup coalesces concurrent GET requests for the same key into one
+// upstream fetch. The fetch runs on its own, so it completes even when the
+// client that started it goes away, and every waiting client reads the body
+// as it arrives.
+type upstreamGroup struct {
+	mu      sync.Mutex
+	fetches map[string]*sharedFetch
+}
+
+type sharedFetch struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	started bool // status and header are known
+	reqErr  error
+	status  int
+	header  http.Header
+	length  int64
+	data    []byte
+	done    bool
+	bodyErr error
+	// solo is a response too large to share, handed to the first client.
+	solo    *http.Response
+	claimed bool
+	// overflowed is set once a body without a known length outgrew
+	// maxSharedBody. The first client reading past the shared data takes
+	// over live, the rest of the body; the others fail.
+	overflowed bool
+	live       io.ReadCloser
+	readers    int
+}
+
+// do returns the response for key, fetched with req unless a fetch for the
+// same key is already running. The caller must close the body.
+func (g *upstreamGroup) do(client *http.Client, key string, req *http.Request) (*http.Response, error) {
+	g.mu.Lock()
+	f, ok := g.fetches[key]
+	if !ok {
+		f = &sharedFetch{}
+		f.cond = sync.NewCond(&f.mu)
+		if g.fetches == nil {
+			g.fetches = make(map[string]*sharedFetch)
+		}
+		g.fetches[key] = f
+		go g.run(client, key, req, f)
+	}
+	g.mu.Unlock()
+
+	resp, shared, err := f.response()
+	if !shared {
+		return client.Do(req)
+	}
+	return resp, err
+}
+
+func (g *upstreamGroup) run(client *http.Client, key string, req *http.Request, f *sharedFetch) {
+	defer func() {
+		g.mu.Lock()
+		if g.fetches[key] == f {
+			delete(g.fetches, key)
+		}
+		g.mu.Unlock()
+	}()
+
+	resp, err := client.Do(req)
+	f.mu.Lock()
+	f.started = true
+	if err != nil {
+		f.reqErr = err
+		f.done = true
+		f.cond.Broadcast()
+		f.mu.Unlock()
+		return
+	}
+	f.status, f.header, f.length = resp.StatusCode, resp.Header, resp.ContentLength
+	if resp.ContentLength > maxSharedBody {
+		f.solo = resp
+		f.done = true
+		f.cond.Broadcast()
+		f.mu.Unlock()
+		return
+	}
+	f.cond.Broadcast()
+	f.mu.Unlock()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		f.mu.Lock()
+		f.data = append(f.data, buf[:n]...)
+		if err == nil && len(f.data) > maxSharedBody {
+			f.overflowed = true
+			if f.readers > 0 {
+				f.live = resp.Body
+			} else {
+				resp.Body.Close()
+			}
+			f.cond.Broadcast()
+			f.mu.Unlock()
+			return
+		}
+		if err != nil {
+			f.done = true
+			if err != io.EOF {
+				f.bodyErr = err
+			}
+		}
+		f.cond.Broadcast()
+		f.mu.Unlock()
+		if err != nil {
+			resp.Body.Close()
+			return
+		}
+	}
+}
+
+// response waits for the upstream status and returns a response whose body
+// reads the shared data. It reports false when the caller has to fetch on its
+// own because the response is too large to share.
+func (f *sharedFetch) response() (*http.Response, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for !f.started {
+		f.cond.Wait()
+	}
+	if f.solo != nil {
+		if f.claimed {
+			return nil, false, nil
+		}
+		f.claimed = true
+		return f.solo, true, nil
+	}
+	if f.reqErr != nil {
+		return nil, true, f.reqErr
+	}
+	if f.overflowed {
+		return nil, false, nil
+	}
+	f.readers++
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", f.status, http.StatusText(f.status)),
+		StatusCode:    f.status,
+		Header:        f.header.Clone(),
+		ContentLength: f.length,
+		Body:          &sharedBody{f: f},
+	}, true, nil
+}
+
+// sharedBody reads a shared fetch from the start, waiting for data that has
+// not arrived yet.
+type sharedBody struct {
+	f      *sharedFetch
+	off    int
+	live   io.ReadCloser
+	closed bool
+}
+
+func (b *sharedBody) Read(p []byte) (int, error) {
+	if b.live != nil {
+		return b.live.Read(p)
+	}
+	f := b.f
+	f.mu.Lock()
+	for b.off >= len(f.data) && !f.done && !f.overflowed {
+		f.cond.Wait()
+	}
+	if b.off < len(f.data) {
+		n := copy(p, f.data[b.off:])
+		b.off += n
+		f.mu.Unlock()
+		return n, nil
+	}
+	if f.overflowed {
+		if f.live == nil {
+			f.mu.Unlock()
+			return 0, errSharedBodyTooLarge
+		}
+		b.live, f.live = f.live, nil
+		f.mu.Unlock()
+		return b.live.Read(p)
+	}
+	defer f.mu.Unlock()
+	if f.bodyErr != nil {
+		return 0, f.bodyErr
+	}
+	return 0, io.EOF
+}
+
+// Close closes the rest of the body when this client took it over, or when
+// it was the last one that could have.
+func (b *sharedBody) Close() error {
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	f := b.f
+	f.mu.Lock()
+	f.readers--
+	live := b.live
+	if f.readers == 0 && f.live != nil {
+		live, f.live = f.live, nil
+	}
+	f.mu.Unlock()
+	if live != nil {
+		return live.Close()
+	}
+	return nil
+}
+
+// playlistCache keeps playlists fetched through /proxy/m3u8/ for a short time,
+// so players reloading or starting together do not hit the origin each time.
+type playlistCache struct {
+	mu      sync.Mutex
+	entries map[string]cachedPlaylist
+}
+
+type cachedPlaylist struct {
+	body    []byte
+	expires time.Time
+}
+
+func (c *playlistCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.body, true
+}
+
+func (c *playlistCache) put(key string, body []byte, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if c.entries == nil {
+		c.entries = make(map[string]cachedPlaylist)
+	}
+	for k, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cachedPlaylist{body: body, expires: now.Add(ttl)}
+}
@@ -0,0 +1,221 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"hls-accelerator/internal/config"
+)
+
+func TestUpstreamGroupSharesOneFetchBetweenConcurrentCallers(t *testing.T) {
+	var hits atomic.Int32
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		_, _ = io.WriteString(w, "first half,")
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = io.WriteString(w, "second half")
+	}))
+	defer origin.Close()
+
+	var g upstreamGroup
+	// do returns once the status is known, so every caller joins the fetch
+	// while its body is still held back.
+	var resps []*http.Response
+	for range 3 {
+		req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+		resp, err := g.do(origin.Client(), requestKey(req), req)
+		if err != nil {
+			t.Fatalf("do: %v", err)
+		}
+		resps = append(resps, resp)
+	}
+	close(release)
+
+	var wg sync.WaitGroup
+	bodies := make([]string, len(resps))
+	for i, resp := range resps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer resp.Body.Close()
+			data, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Errorf("read body %d: %v", i, err)
+			}
+			bodies[i] = string(data)
+		}()
+	}
+	wg.Wait()
+	for i, body := range bodies {
+		if body != "first half,second half" {
+			t.Fatalf("body %d = %q", i, body)
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Fatalf("upstream requests = %d, want 1", n)
+	}
+}
+
+func TestUpstreamGroupDoesNotShareResponsesLargerThanTheLimit(t *testing.T) {
+	var hits atomic.Int32
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Length", strconv.Itoa(maxSharedBody+1))
+		_, _ = io.WriteString(w, "x")
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer origin.Close()
+	defer close(release)
+
+	var g upstreamGroup
+	var resps []*http.Response
+	for range 2 {
+		req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+		resp, err := g.do(origin.Client(), requestKey(req), req)
+		if err != nil {
+			t.Fatalf("do: %v", err)
+		}
+		defer resp.Body.Close()
+		resps = append(resps, resp)
+	}
+	if resps[0] == resps[1] {
+		t.Fatal("a response above the limit must go to one caller only")
+	}
+	for i, resp := range resps {
+		if resp.ContentLength != maxSharedBody+1 {
+			t.Fatalf("response %d length = %d", i, resp.ContentLength)
+		}
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(resp.Body, buf); err != nil || buf[0] != 'x' {
+			t.Fatalf("response %d starts with %q, %v", i, buf, err)
+		}
+	}
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("upstream requests = %d, want 2", n)
+	}
+}
+
+func TestUpstreamGroupHandsAnUnknownLengthBodyPastTheLimitToOneCaller(t *testing.T) {
+	const size = maxSharedBody + 1<<20
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "x")
+		w.(http.Flusher).Flush()
+		<-release
+		chunk := make([]byte, 1<<20)
+		for written := 1; written < size; written += len(chunk) {
+			if _, err := w.Write(chunk[:min(len(chunk), size-written)]); err != nil {
+				return
+			}
+		}
+	}))
+	defer origin.Close()
+
+	var g upstreamGroup
+	var resps []*http.Response
+	for range 2 {
+		req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+		resp, err := g.do(origin.Client(), requestKey(req), req)
+		if err != nil {
+			t.Fatalf("do: %v", err)
+		}
+		defer resp.Body.Close()
+		resps = append(resps, resp)
+	}
+	close(release)
+
+	n, err := io.Copy(io.Discard, resps[0].Body)
+	if err != nil || n != size {
+		t.Fatalf("first caller read %d bytes, %v; want %d", n, err, size)
+	}
+	if _, err := io.Copy(io.Discard, resps[1].Body); err != errSharedBodyTooLarge {
+		t.Fatalf("second caller error = %v, want %v", err, errSharedBodyTooLarge)
+	}
+}
+
+func TestPlaylistCacheExpiresEntries(t *testing.T) {
+	var c playlistCache
+	c.put("a", []byte("playlist"), 50*time.Millisecond)
+	c.put("b", []byte("uncached"), 0)
+	if body, ok := c.get("a"); !ok || string(body) != "playlist" {
+		t.Fatalf("get(a) = %q, %v", body, ok)
+	}
+	if _, ok := c.get("b"); ok {
+		t.Fatal("a zero TTL must not cache")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, ok := c.get("a"); ok {
+		t.Fatal("expired entry still returned")
+	}
+}
+
+func TestFetchProxiedPlaylistKeepsRequestHeadersApart(t *testing.T) {
+	oldTTL := config.GlobalConfig.PlaylistCacheTTLMs
+	config.GlobalConfig.PlaylistCacheTTLMs = 60000
+	t.Cleanup(func() { config.GlobalConfig.PlaylistCacheTTLMs = oldTTL })
+
+	var hits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		_, _ = io.WriteString(w, "#EXTM3U\n# for "+r.Header.Get("Cookie")+"\n")
+	}))
+	defer origin.Close()
+	s := &Server{client: origin.Client()}
+
+	fetch := func(cookie string) string {
+		t.Helper()
+		body, err := s.fetchProxiedPlaylist(origin.URL+"/index.m3u8", map[string]string{"Cookie": cookie, "Referer": "https://example.com/"})
+		if err != nil {
+			t.Fatalf("fetchProxiedPlaylist: %v", err)
+		}
+		return string(body)
+	}
+	if body := fetch("session=a"); body != "#EXTM3U\n# for session=a\n" {
+		t.Fatalf("body for a = %q", body)
+	}
+	if body := fetch("session=b"); body != "#EXTM3U\n# for session=b\n" {
+		t.Fatalf("body for b = %q, another task's playlist was shared", body)
+	}
+	if body := fetch("session=a"); body != "#EXTM3U\n# for session=a\n" {
+		t.Fatalf("cached body for a = %q", body)
+	}
+	if n := hits.Load(); n != 2 {
+		t.Fatalf("upstream requests = %d, want 2", n)
+	}
+}
+
+func TestRequestKeyCoversHeaders(t *testing.T) {
+	newRequest := func(headers ...string) *http.Request {
+		req, _ := http.NewRequest(http.MethodGet, "https://cdn.example.com/seg.ts", nil)
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		return req
+	}
+	a := requestKey(newRequest("Cookie", "a", "Referer", "r"))
+	if b := requestKey(newRequest("Referer", "r", "Cookie", "a")); a != b {
+		t.Fatalf("header order changed the key: %q != %q", a, b)
+	}
+	for _, other := range []*http.Request{
+		newRequest("Cookie", "b", "Referer", "r"),
+		newRequest("Cookie", "a", "Referer", "r", "Authorization", "Bearer x"),
+		newRequest("Cookie", "a", "Referer", "r", "Range", "bytes=0-9"),
+	} {
+		if requestKey(other) == a {
+			t.Fatalf("headers %v share the key of %v", other.Header, newRequest("Cookie", "a", "Referer", "r").Header)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"hls-accelerator/internal/config"
+	playlist "hls-accelerator/internal/m3u8"
+)
+
+// parseTrustedProxies reads the trusted_proxies setting: addresses and CIDR
+// ranges.
+func parseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("trusted_proxies: %w", err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trusted_proxies: %w", err)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// requestProxyBase returns the proxy base URL a client reached us with: the
+// configured public base URL, otherwise the X-Forwarded-* headers of a trusted
+// reverse proxy or the request itself. Forwarded values that could not be
+// part of a URL are ignored.
+func (s *Server) requestProxyBase(r *http.Request) string {
+	if base := config.PublicBaseURL(); base != "" {
+		return base + playlist.ProxyPathPrefix
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	prefix := ""
+	if s.fromTrustedProxy(r) {
+		if proto := strings.ToLower(forwardedValue(r, "X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if forwardedHost := forwardedValue(r, "X-Forwarded-Host"); validForwardedHost(forwardedHost) {
+			host = forwardedHost
+		}
+		if forwardedPrefix := strings.TrimRight(forwardedValue(r, "X-Forwarded-Prefix"), "/"); validForwardedPrefix(forwardedPrefix) {
+			prefix = forwardedPrefix
+		}
+	}
+	return scheme + "://" + host + prefix + playlist.ProxyPathPrefix
+}
+
+// fromTrustedProxy reports whether the request came straight from one of the
+// trusted proxies.
+func (s *Server) fromTrustedProxy(r *http.Request) bool {
+	if len(s.trustedProxies) == 0 {
+		return false
+	}
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr := addrPort.Addr().Unmap()
+	for _, prefix := range s.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedValue returns the first entry of a header that chained proxies
+// append to.
+func forwardedValue(r *http.Request, header string) string {
+	value, _, _ := strings.Cut(r.Header.Get(header), ",")
+	return strings.TrimSpace(value)
+}
+
+// validForwardedHost accepts host[:port], where host is a DNS name, an IPv4
+// address or an IPv6 address in brackets.
+func validForwardedHost(value string) bool {
+	host := value
+	if h, port, err := net.SplitHostPort(value); err == nil {
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			return false
+		}
+		host = h
+	} else if strings.HasPrefix(value, "[") && strings.HasSuffix(value, "]") {
+		host = value[1 : len(value)-1]
+	}
+	bracketed := strings.HasPrefix(value, "[")
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.Zone() == "" && addr.Is6() == bracketed
+	}
+	return !bracketed && validHostname(host)
+}
+
+func validHostname(host string) bool {
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !isAlphaNum(c) && c != '-' && c != '_' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// validForwardedPrefix accepts an empty prefix or a path of plain segments.
+func validForwardedPrefix(prefix string) bool {
+	if prefix == "" {
+		return true
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		return false
+	}
+	for _, segment := range strings.Split(prefix[1:], "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+		for _, c := range segment {
+			if !isAlphaNum(c) && !strings.ContainsRune("-._~", c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isAlphaNum(c rune) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
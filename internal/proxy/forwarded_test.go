@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"hls-accelerator/internal/config"
+)
+
+func TestRequestProxyBaseHonoursForwardedHeadersOnlyFromTrustedProxies(t *testing.T) {
+	oldBase := config.GlobalConfig.PublicBaseURL
+	config.GlobalConfig.PublicBaseURL = ""
+	t.Cleanup(func() { config.GlobalConfig.PublicBaseURL = oldBase })
+
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "::1"})
+	if err != nil {
+		t.Fatalf("parseTrustedProxies: %v", err)
+	}
+	s := &Server{trustedProxies: trusted}
+
+	cases := []struct {
+		name       string
+		remoteAddr string
+		proto      string
+		host       string
+		prefix     string
+		want       string
+	}{
+		{"trusted", "10.1.2.3:5000", "https", "media.example.com", "/hls/", "https://media.example.com/hls/proxy"},
+		{"trusted ipv6", "[::1]:5000", "https", "[2001:db8::1]:8443", "", "https://[2001:db8::1]:8443/proxy"},
+		{"untrusted", "192.0.2.7:5000", "https", "evil.example.com", "/x", "http://lan:8084/proxy"},
+		{"bad proto", "10.1.2.3:5000", "javascript", "media.example.com", "", "http://media.example.com/proxy"},
+		{"bad host", "10.1.2.3:5000", "https", `evil.example.com/"><x`, "", "https://lan:8084/proxy"},
+		{"bad port", "10.1.2.3:5000", "https", "media.example.com:99999", "", "https://lan:8084/proxy"},
+		{"bare ipv6 host", "10.1.2.3:5000", "https", "2001:db8::1", "", "https://lan:8084/proxy"},
+		{"bad prefix", "10.1.2.3:5000", "https", "media.example.com", "/a/../b", "https://media.example.com/proxy"},
+		{"first entry", "10.1.2.3:5000", "https, http", "media.example.com, other", "", "https://media.example.com/proxy"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://lan:8084/proxy/m3u8/x", nil)
+			r.RemoteAddr = tc.remoteAddr
+			r.Header.Set("X-Forwarded-Proto", tc.proto)
+			r.Header.Set("X-Forwarded-Host", tc.host)
+			r.Header.Set("X-Forwarded-Prefix", tc.prefix)
+			if got := s.requestProxyBase(r); got != tc.want {
+				t.Fatalf("requestProxyBase = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseTrustedProxiesRejectsInvalidEntries(t *testing.T) {
+	for _, entry := range []string{"localhost", "10.0.0.0/33", ""} {
+		if _, err := parseTrustedProxies([]string{entry}); err == nil {
+			t.Errorf("parseTrustedProxies(%q) succeeded", entry)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"database/sql"
+	"errors"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// handlePlay serves a task from its directory alone: playlists built from the
+// task manifest with relative URIs and the downloaded files they point at.
+// Nothing is fetched from the origin, files not downloaded yet are not found.
+func (s *Server) handlePlay(w http.ResponseWriter, r *http.Request) {
+	taskID, name := r.PathValue("id"), r.PathValue("name")
+	if strings.HasSuffix(name, ".m3u8") {
+		content, err := s.taskManager.LocalPlaylist(taskID, name)
+		if err != nil {
+			writePlayError(w, r, err)
+			return
+		}
+		writeM3U8(w, content)
+		return
+	}
+	filePath, err := s.taskManager.LocalFilePath(taskID, name)
+	if err != nil {
+		writePlayError(w, r, err)
+		return
+	}
+	if path.Ext(name) == ".ts" {
+		w.Header().Set("Content-Type", "video/mp2t")
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	http.ServeFile(w, r, filePath)
+}
+
+func writePlayError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, sql.ErrNoRows) || errors.Is(err, fs.ErrNotExist) {
+		http.NotFound(w, r)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"hls-accelerator/internal/config"
+	playlist "hls-accelerator/internal/m3u8"
+	"hls-accelerator/internal/task"
+
+	"github.com/grafov/m3u8"
+)
+
+// previewSampleSegments is how many segments are sized with HEAD requests to
+// estimate the size of a playlist.
+const previewSampleSegments = 5
+
+type previewReport struct {
+	URL  string `json:"url"`
+	Type string `json:"type"`
+	// Variants, SelectedIndex and Renditions are set for master playlists;
+	// MediaURL is the media playlist the task would download.
+	Variants      []playlist.VariantInfo `json:"variants,omitempty"`
+	SelectedIndex *int                   `json:"selected_index,omitempty"`
+	Renditions    []playlist.Rendition   `json:"renditions,omitempty"`
+	MediaURL      string                 `json:"media_url"`
+	Media         playlist.MediaPreview  `json:"media"`
+	EstimatedSize *sizeEstimate          `json:"estimated_size,omitempty"`
+}
+
+// sizeEstimate is exact when every segment is a byte range; otherwise the
+// average size of Sampled segments is extrapolated to the rest.
+type sizeEstimate struct {
+	Bytes   int64 `json:"bytes"`
+	Sampled int   `json:"sampled"`
+	Exact   bool  `json:"exact"`
+}
+
+// handlePreview fetches and parses the playlist of an add request and reports
+// what the task would download, without creating it.
+func (s *Server) handlePreview(w http.ResponseWriter, r *http.Request) {
+	addReq, err := task.DecodeAddRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	headers := task.RequestHeaders(addReq.Headers)
+	resp, err := s.fetchUpstreamM3U8(r.Context(), addReq.URL, headers)
+	if err != nil {
+		http.Error(w, "failed to fetch upstream: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	pl, playlistType, err := playlist.Parse(resp.Body)
+	if err != nil {
+		http.Error(w, "failed to parse m3u8: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	report := previewReport{URL: addReq.URL, Type: "media", MediaURL: addReq.URL}
+	base, _ := url.Parse(addReq.URL)
+	var mediaPl *m3u8.MediaPlaylist
+	switch playlistType {
+	case playlist.Master:
+		masterPl := pl.(*m3u8.MasterPlaylist)
+		policy := defaultVariantPolicy()
+		if addReq.Variant != nil {
+			policy = *addReq.Variant
+		}
+		report.Type = "master"
+		report.Variants = playlist.ListVariants(masterPl, base)
+		selected, err := playlist.SelectVariant(report.Variants, policy)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		report.SelectedIndex = &selected.Index
+		report.MediaURL = selected.URL
+		if mediaPl, err = s.fetchMediaPlaylist(r.Context(), selected.URL, headers); err != nil {
+			http.Error(w, "failed to fetch variant: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		languages := config.GlobalConfig.RenditionLanguages
+		if len(addReq.Languages) > 0 {
+			languages = addReq.Languages
+		}
+		// Live streams are recorded without renditions.
+		if mediaPl.Closed {
+			report.Renditions = playlist.SelectRenditions(masterPl, selected.Index, base, languages)
+		}
+		base, _ = url.Parse(selected.URL)
+	case playlist.Variant:
+		mediaPl = pl.(*m3u8.MediaPlaylist)
+	default:
+		http.Error(w, "unsupported playlist type", http.StatusBadGateway)
+		return
+	}
+
+	filterAds := addReq.AdFilter == nil || *addReq.AdFilter
+	media, items := playlist.PreviewMedia(mediaPl, base, filterAds)
+	report.Media = media
+	report.EstimatedSize = s.estimateSize(r.Context(), items, headers)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	_ = json.NewEncoder(w).Encode(report)
+}
+
+// estimateSize adds up the byte ranges and extrapolates the rest from a few
+// evenly spaced segments; nil means no segment size could be learned.
+func (s *Server) estimateSize(ctx context.Context, items []playlist.DownloadItem, headers map[string]string) *sizeEstimate {
+	var known int64
+	var unknown []playlist.DownloadItem
+	for _, item := range items {
+		if item.Length > 0 {
+			known += item.Length
+		} else {
+			unknown = append(unknown, item)
+		}
+	}
+	if len(unknown) == 0 {
+		if len(items) == 0 {
+			return nil
+		}
+		return &sizeEstimate{Bytes: known, Exact: true}
+	}
+
+	samples := previewSampleSegments
+	if samples > len(unknown) {
+		samples = len(unknown)
+	}
+	sizes := make([]int64, samples)
+	var wg sync.WaitGroup
+	for i := range sizes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sizes[i] = s.remoteSize(ctx, unknown[i*len(unknown)/samples].URL, headers)
+		}(i)
+	}
+	wg.Wait()
+
+	var sum int64
+	sampled := 0
+	for _, size := range sizes {
+		if size > 0 {
+			sum += size
+			sampled++
+		}
+	}
+	if sampled == 0 {
+		return nil
+	}
+	return &sizeEstimate{
+		Bytes:   known + sum*int64(len(unknown))/int64(sampled),
+		Sampled: sampled,
+	}
+}
+
+// remoteSize asks the origin for the size of a resource with HEAD, and with a
+// one byte range request when HEAD is refused or reports no length. It returns
+// 0 when the size stays unknown.
+func (s *Server) remoteSize(ctx context.Context, rawURL string, headers map[string]string) int64 {
+	if size := s.probeSize(ctx, http.MethodHead, rawURL, headers, ""); size > 0 {
+		return size
+	}
+	return s.probeSize(ctx, http.MethodGet, rawURL, headers, "bytes=0-0")
+}
+
+func (s *Server) probeSize(ctx context.Context, method, rawURL string, headers map[string]string, byteRange string) int64 {
+	req, err := http.NewRequestWithContext(ctx, method, rawURL, nil)
+	if err != nil {
+		return 0
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		// Content-Range: bytes 0-0/<total>
+		_, total, _ := strings.Cut(resp.Header.Get("Content-Range"), "/")
+		size, err := strconv.ParseInt(total, 10, 64)
+		if err != nil {
+			return 0
+		}
+		return size
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return resp.ContentLength
+	}
+	return 0
+}
@@ -1,12 +1,18 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/netip"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -22,29 +28,57 @@ import (
 
 type Server struct {
 	addr        string
+	httpServer  *http.Server
 	client      *http.Client
 	taskManager *task.Manager
+	// fetches coalesces concurrent upstream requests for the same resource.
+	fetches   upstreamGroup
+	playlists playlistCache
+	// trustedProxies are the reverse proxies whose X-Forwarded-* headers
+	// name the proxy address.
+	trustedProxies []netip.Prefix
 }
 
 func NewServer() (*Server, error) {
-	aria2 := downloader.NewClient()
+	dl, err := downloader.New()
+	if err != nil {
+		return nil, err
+	}
 	db, err := database.Init(config.GlobalConfig.CacheDir)
 	if err != nil {
 		return nil, err
 	}
-	tm, err := task.NewManager(aria2, db)
+	trustedProxies, err := parseTrustedProxies(config.GlobalConfig.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	tm, err := task.NewManager(dl, db)
 	if err != nil {
 		return nil, err
 	}
+	if err := applyAdRules(config.GlobalConfig.AdFilterRules); err != nil {
+		log.Printf("ad filter rules not applied: %v", err)
+	}
+	if config.GlobalConfig.AdHeuristic {
+		playlist.SetFallbackAdFilter(playlist.NewHeuristicAdFilter(config.GlobalConfig.AdHeuristicThreshold))
+	}
+	if rewritten, err := tm.RefreshM3U8Files(); err != nil {
+		log.Printf("m3u8 files not refreshed: %v", err)
+	} else if rewritten > 0 {
+		log.Printf("rewrote %d m3u8 files for proxy address %s", rewritten, task.M3U8FileProxyBase())
+	}
+	addr := fmt.Sprintf(":%d", config.GlobalConfig.ProxyPort)
 	return &Server{
-		addr: fmt.Sprintf(":%d", config.GlobalConfig.ProxyPort),
+		addr:       addr,
+		httpServer: &http.Server{Addr: addr},
 		client: &http.Client{
 			Timeout: 30 * time.Second,
 			Transport: &http.Transport{
 				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 			},
 		},
-		taskManager: tm,
+		taskManager:    tm,
+		trustedProxies: trustedProxies,
 	}, nil
 }
 
@@ -56,29 +90,51 @@ func (s *Server) Start() error {
 	mux.HandleFunc("POST /api/v1/tasks", func(w http.ResponseWriter, r *http.Request) {
 		s.taskManager.HandleAdd(w, r, s.startDownloadFromURL)
 	})
+	mux.HandleFunc("GET /api/v1/tasks/{id}", s.taskManager.HandleGetV1)
 	mux.HandleFunc("POST /api/v1/tasks/{id}/pause", s.taskManager.HandlePauseV1)
 	mux.HandleFunc("POST /api/v1/tasks/{id}/resume", s.taskManager.HandleResumeV1)
 	mux.HandleFunc("POST /api/v1/tasks/{id}/retry", s.taskManager.HandleRetryV1)
+	mux.HandleFunc("POST /api/v1/tasks/{id}/stop", s.taskManager.HandleStopV1)
+	mux.HandleFunc("POST /api/v1/tasks/{id}/export", s.taskManager.HandleExportV1)
 	mux.HandleFunc("POST /api/v1/tasks/sync", s.taskManager.HandleSyncProgress)
 	mux.HandleFunc("DELETE /api/v1/tasks/{id}", s.taskManager.HandleDeleteV1)
+	mux.HandleFunc("GET /api/v1/variants", s.handleVariants)
+	mux.HandleFunc("POST /api/v1/preview", s.handlePreview)
+	mux.HandleFunc("GET /api/v1/ad-rules", s.handleGetAdRules)
+	mux.HandleFunc("PUT /api/v1/ad-rules", s.handlePutAdRules)
+	mux.HandleFunc("POST /api/v1/ad-rules/reload", s.handleReloadAdRules)
 
 	mux.HandleFunc("/proxy/m3u8/", s.handleM3U8)
 	mux.HandleFunc("/proxy/seg/", s.handleSegment)
 	mux.HandleFunc("/proxy/key/", s.handleKey)
+	mux.HandleFunc("/proxy/map/", s.handleMap)
+	mux.HandleFunc("GET /proxy/media/{id}/{name}", s.handleTaskMedia)
+	mux.HandleFunc("GET /play/{id}/{name}", s.handlePlay)
 
 	log.Printf("Proxy starting at http://localhost%s", s.addr)
-	return http.ListenAndServe(s.addr, mux)
+	s.httpServer.Handler = mux
+	return s.httpServer.ListenAndServe()
+}
+
+// Shutdown stops accepting connections and waits until the running requests
+// are answered or ctx ends. Start returns http.ErrServerClosed then.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
 }
 
-func (s *Server) startDownloadFromURL(addReq task.AddTaskRequest) error {
+func (s *Server) startDownloadFromURL(ctx context.Context, addReq task.AddTaskRequest) error {
 	rawURL := addReq.URL
 	taskName := strings.TrimSpace(addReq.Name)
 	if taskName == "" {
 		taskName = task.DeriveTaskName(rawURL)
 	}
 
-	req, _ := http.NewRequest(http.MethodGet, rawURL, nil)
-	for key, value := range config.GlobalConfig.Headers {
+	headers := task.RequestHeaders(addReq.Headers)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+	for key, value := range headers {
 		req.Header.Set(key, value)
 	}
 	resp, err := s.client.Do(req)
@@ -97,32 +153,43 @@ func (s *Server) startDownloadFromURL(addReq task.AddTaskRequest) error {
 	}
 	if type_ == playlist.Master {
 		masterPl := pl.(*m3u8.MasterPlaylist)
-		if len(masterPl.Variants) == 0 {
-			return fmt.Errorf("master playlist has no variants")
+		policy := defaultVariantPolicy()
+		if addReq.Variant != nil {
+			policy = *addReq.Variant
+		}
+		selected, err := playlist.SelectVariant(playlist.ListVariants(masterPl, base), policy)
+		if err != nil {
+			return err
+		}
+		languages := config.GlobalConfig.RenditionLanguages
+		if len(addReq.Languages) > 0 {
+			languages = addReq.Languages
 		}
-		best := masterPl.Variants[0]
-		for _, variant := range masterPl.Variants {
-			if variant.Bandwidth > best.Bandwidth {
-				best = variant
-			}
+		if renditions := playlist.SelectRenditions(masterPl, selected.Index, base, languages); len(renditions) > 0 {
+			return s.startRenditionTask(ctx, addReq, taskName, masterPl, selected, renditions)
 		}
-		return s.startDownloadFromURL(task.AddTaskRequest{
-			Name: taskName,
-			URL:  playlist.ResolveURL(base, best.URI),
-		})
+		return s.startDownloadFromURL(ctx, variantRequest(addReq, taskName, selected))
 	}
 	if type_ != playlist.Variant {
 		return fmt.Errorf("unsupported playlist type")
 	}
 
-	taskID := cache.GetTaskID(rawURL)
+	taskID := addReq.TaskID
+	if taskID == "" {
+		taskID = cache.GetTaskID(rawURL)
+	}
 	mediaPl := pl.(*m3u8.MediaPlaylist)
-	proxyHost := strings.TrimSpace(config.GlobalConfig.ProxyHost)
-	if proxyHost == "" {
-		proxyHost = "localhost"
+	// Stored playlists keep root-relative URIs; they are rendered per request.
+	proxyBase := playlist.ProxyPathPrefix
+	// Without EXT-X-ENDLIST the playlist is a live window that keeps growing.
+	live := !mediaPl.Closed
+	filterAds := addReq.AdFilter == nil || *addReq.AdFilter
+	updated, items, total, adRanges := playlist.RewriteVariantWithAds(mediaPl, proxyBase, taskID, base, 0, filterAds)
+	if live {
+		if updated, err = playlist.AppendSegments("", mediaPl, false); err != nil {
+			return err
+		}
 	}
-	proxyBase := fmt.Sprintf("http://%s:%d/proxy", proxyHost, config.GlobalConfig.ProxyPort)
-	updated, items, total := playlist.RewriteVariant(mediaPl, proxyBase, taskID, base)
 	if err := cache.EnsureTaskDir(taskID); err != nil {
 		return err
 	}
@@ -142,8 +209,18 @@ func (s *Server) startDownloadFromURL(addReq task.AddTaskRequest) error {
 		Status:         task.TaskStatusParsing,
 		ProxiedContent: updated,
 		M3U8FilePath:   m3u8FilePath,
+		ExportFormat:   addReq.ExportFormat,
+		Headers:        addReq.Headers,
+		AdRanges:       adRanges,
+	}
+	var created bool
+	if live {
+		recording := task.NewLiveRecording(taskID, rawURL, proxyBase, mediaPl, total, addReq.MaxDurationSec)
+		recording.NoAdFilter = !filterAds
+		created, err = s.taskManager.CreateLiveTaskWithItems(meta, items, recording)
+	} else {
+		created, err = s.taskManager.CreateTaskWithItems(meta, items)
 	}
-	created, err := s.taskManager.CreateTaskWithItems(meta, items)
 	if err != nil {
 		return err
 	}
@@ -153,6 +230,146 @@ func (s *Server) startDownloadFromURL(addReq task.AddTaskRequest) error {
 	return s.taskManager.UpdateTaskProxiedContent(taskID, updated)
 }
 
+// startRenditionTask downloads the selected variant together with its audio and
+// subtitle renditions as one task keyed by the master playlist URL, so playing
+// that URL through the proxy gets the stored master playlist. Live streams are
+// recorded without renditions.
+func (s *Server) startRenditionTask(ctx context.Context, addReq task.AddTaskRequest, taskName string, masterPl *m3u8.MasterPlaylist, selected playlist.VariantInfo, renditions []playlist.Rendition) error {
+	headers := task.RequestHeaders(addReq.Headers)
+	videoPl, err := s.fetchMediaPlaylist(ctx, selected.URL, headers)
+	if err != nil {
+		return err
+	}
+	if !videoPl.Closed {
+		log.Printf("live variant is recorded without renditions url=%s", addReq.URL)
+		return s.startDownloadFromURL(ctx, variantRequest(addReq, taskName, selected))
+	}
+
+	rawURL := addReq.URL
+	taskID := addReq.TaskID
+	if taskID == "" {
+		taskID = cache.GetTaskID(rawURL)
+	}
+	proxyBase := playlist.ProxyPathPrefix
+	variantURL, _ := url.Parse(selected.URL)
+	filterAds := addReq.AdFilter == nil || *addReq.AdFilter
+	updated, items, total, adRanges := playlist.RewriteVariantWithAds(videoPl, proxyBase, taskID, variantURL, 0, filterAds)
+
+	playlists := make(map[string]string, len(renditions)+1)
+	downloaded := make([]playlist.Rendition, 0, len(renditions))
+	for _, rendition := range renditions {
+		renditionPl, err := s.fetchMediaPlaylist(ctx, rendition.URL, headers)
+		if err == nil && !renditionPl.Closed {
+			err = fmt.Errorf("rendition playlist has no EXT-X-ENDLIST")
+		}
+		if err != nil {
+			log.Printf("skip rendition task=%s group=%s url=%s err=%v", taskID, rendition.Group, rendition.URL, err)
+			continue
+		}
+		renditionURL, _ := url.Parse(rendition.URL)
+		content, renditionItems, segments := playlist.RewriteRendition(renditionPl, proxyBase, taskID, renditionURL, rendition.Group)
+		items = append(items, renditionItems...)
+		total += segments
+		playlists[rendition.Playlist] = content
+		downloaded = append(downloaded, rendition)
+	}
+	master, err := playlist.BuildRenditionMaster(masterPl, selected.Index, fmt.Sprintf("%s/media/%s", proxyBase, taskID), downloaded)
+	if err != nil {
+		return err
+	}
+	playlists[task.MasterPlaylistFileName] = master
+
+	if err := cache.EnsureTaskDir(taskID); err != nil {
+		return err
+	}
+	m3u8FilePath, err := s.taskManager.SaveTaskM3U8File(taskName, master)
+	if err != nil {
+		return err
+	}
+	created, err := s.taskManager.CreateRenditionTaskWithItems(task.TaskMetadata{
+		ID:             taskID,
+		Name:           taskName,
+		OriginalURL:    rawURL,
+		TotalSegments:  total,
+		OutputDir:      cache.GetTaskDir(taskID),
+		CreatedTime:    time.Now(),
+		UpdatedTime:    time.Now(),
+		Status:         task.TaskStatusParsing,
+		ProxiedContent: updated,
+		M3U8FilePath:   m3u8FilePath,
+		ExportFormat:   addReq.ExportFormat,
+		Headers:        addReq.Headers,
+		AdRanges:       adRanges,
+	}, items, playlists)
+	if err != nil {
+		return err
+	}
+	if !created {
+		return fmt.Errorf("task already exists")
+	}
+	return s.taskManager.UpdateTaskProxiedContent(taskID, updated)
+}
+
+// variantRequest turns the request for a master playlist into one for the
+// selected variant.
+func variantRequest(addReq task.AddTaskRequest, taskName string, selected playlist.VariantInfo) task.AddTaskRequest {
+	variantReq := addReq
+	variantReq.Name = taskName
+	variantReq.URL = selected.URL
+	variantReq.Variant = nil
+	return variantReq
+}
+
+func defaultVariantPolicy() playlist.VariantPolicy {
+	cfg := config.GlobalConfig
+	return playlist.VariantPolicy{
+		MaxHeight:    cfg.VariantMaxHeight,
+		MinHeight:    cfg.VariantMinHeight,
+		MaxBandwidth: cfg.VariantMaxBandwidth,
+		Codecs:       cfg.VariantCodecs,
+	}
+}
+
+// handleVariants lists the variants of a master playlist so a client can pick
+// one (VariantPolicy.Index) before creating the task. default_index is the
+// variant the configured policy would choose.
+func (s *Server) handleVariants(w http.ResponseWriter, r *http.Request) {
+	rawURL := strings.TrimSpace(r.URL.Query().Get("url"))
+	parsedURL, err := url.Parse(rawURL)
+	if rawURL == "" || err != nil || parsedURL.Scheme == "" || parsedURL.Host == "" {
+		http.Error(w, "invalid url", http.StatusBadRequest)
+		return
+	}
+	resp, err := s.fetchUpstreamM3U8(r.Context(), rawURL, task.RequestHeaders(nil))
+	if err != nil {
+		http.Error(w, "failed to fetch upstream", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	pl, playlistType, err := playlist.Parse(resp.Body)
+	if err != nil {
+		http.Error(w, "failed to parse m3u8", http.StatusBadGateway)
+		return
+	}
+	result := map[string]interface{}{
+		"url":      rawURL,
+		"type":     "media",
+		"variants": []playlist.VariantInfo{},
+	}
+	if playlistType == playlist.Master {
+		variants := playlist.ListVariants(pl.(*m3u8.MasterPlaylist), parsedURL)
+		result["type"] = "master"
+		result["variants"] = variants
+		if selected, err := playlist.SelectVariant(variants, defaultVariantPolicy()); err == nil {
+			result["default_index"] = selected.Index
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
 func (s *Server) handleM3U8(w http.ResponseWriter, r *http.Request) {
 	encodedURL := strings.TrimPrefix(r.URL.Path, "/proxy/m3u8/")
 	if encodedURL == "" {
@@ -171,24 +388,27 @@ func (s *Server) handleM3U8(w http.ResponseWriter, r *http.Request) {
 	}
 
 	taskID := cache.GetTaskID(originURL)
+	if content, err := s.taskManager.GetTaskPlaylist(taskID, task.MasterPlaylistFileName); err == nil && content != "" {
+		writeM3U8(w, playlist.RenderProxyBase(content, s.requestProxyBase(r)))
+		return
+	}
 	if content, err := s.taskManager.GetTaskProxiedContent(taskID); err == nil && content != "" {
-		writeM3U8(w, content)
+		writeM3U8(w, playlist.RenderProxyBase(content, s.requestProxyBase(r)))
 		return
 	}
 
-	resp, err := s.fetchUpstreamM3U8(originURL)
+	body, err := s.fetchProxiedPlaylist(originURL, s.taskManager.TaskRequestHeaders(taskID))
 	if err != nil {
 		http.Error(w, "failed to fetch upstream", http.StatusBadGateway)
 		return
 	}
-	defer resp.Body.Close()
 
-	pl, playlistType, err := playlist.Parse(resp.Body)
+	pl, playlistType, err := playlist.Parse(bytes.NewReader(body))
 	if err != nil {
 		http.Error(w, "failed to parse m3u8", http.StatusBadGateway)
 		return
 	}
-	proxyBase := fmt.Sprintf("http://%s/proxy", r.Host)
+	proxyBase := s.requestProxyBase(r)
 	switch playlistType {
 	case playlist.Master:
 		writeM3U8(w, playlist.RewriteMaster(pl.(*m3u8.MasterPlaylist), proxyBase, parsedURL))
@@ -200,12 +420,82 @@ func (s *Server) handleM3U8(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (s *Server) fetchUpstreamM3U8(originURL string) (*http.Response, error) {
+// handleTaskMedia serves the media playlists the master playlist of a task with
+// renditions points at: the video playlist and the stored rendition playlists.
+func (s *Server) handleTaskMedia(w http.ResponseWriter, r *http.Request) {
+	taskID, name := r.PathValue("id"), r.PathValue("name")
+	// The id becomes part of a cache path, so only existing tasks are served.
+	if meta, err := s.taskManager.GetTask(taskID); err != nil || meta.Status == task.TaskStatusDeleted {
+		http.NotFound(w, r)
+		return
+	}
+	var content string
+	var err error
+	if name == playlist.MediaPlaylistName {
+		content, err = s.taskManager.GetTaskProxiedContent(taskID)
+	} else {
+		content, err = s.taskManager.GetTaskPlaylist(taskID, name)
+	}
+	if err != nil || content == "" {
+		http.NotFound(w, r)
+		return
+	}
+	writeM3U8(w, playlist.RenderProxyBase(content, s.requestProxyBase(r)))
+}
+
+// fetchProxiedPlaylist fetches a playlist for /proxy/m3u8/. Concurrent clients
+// share one upstream request, and repeats within playlist_cache_ttl_ms are
+// answered from memory; both only for the same request headers.
+func (s *Server) fetchProxiedPlaylist(originURL string, headers map[string]string) ([]byte, error) {
 	req, err := http.NewRequest(http.MethodGet, originURL, nil)
 	if err != nil {
 		return nil, err
 	}
-	for key, value := range config.GlobalConfig.Headers {
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	key := requestKey(req)
+	if body, ok := s.playlists.get(key); ok {
+		return body, nil
+	}
+	resp, err := s.fetches.do(s.client, "m3u8 "+key, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("bad upstream status: %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	s.playlists.put(key, body, time.Duration(config.GlobalConfig.PlaylistCacheTTLMs)*time.Millisecond)
+	return body, nil
+}
+
+func (s *Server) fetchMediaPlaylist(ctx context.Context, originURL string, headers map[string]string) (*m3u8.MediaPlaylist, error) {
+	resp, err := s.fetchUpstreamM3U8(ctx, originURL, headers)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	pl, playlistType, err := playlist.Parse(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if playlistType != playlist.Variant {
+		return nil, fmt.Errorf("not a media playlist: %s", originURL)
+	}
+	return pl.(*m3u8.MediaPlaylist), nil
+}
+
+func (s *Server) fetchUpstreamM3U8(ctx context.Context, originURL string, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, originURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
 		req.Header.Set(key, value)
 	}
 	resp, err := s.client.Do(req)
@@ -233,6 +523,10 @@ func (s *Server) handleKey(w http.ResponseWriter, r *http.Request) {
 	s.handleProxyFile(w, r, "/proxy/key/")
 }
 
+func (s *Server) handleMap(w http.ResponseWriter, r *http.Request) {
+	s.handleProxyFile(w, r, "/proxy/map/")
+}
+
 func (s *Server) handleProxyFile(w http.ResponseWriter, r *http.Request, prefix string) {
 	pathValue := strings.TrimPrefix(r.URL.Path, prefix)
 	parts := strings.SplitN(pathValue, "/", 3)
@@ -246,25 +540,192 @@ func (s *Server) handleProxyFile(w http.ResponseWriter, r *http.Request, prefix
 		http.Error(w, "invalid url encoding", http.StatusBadRequest)
 		return
 	}
+	var sliceLength, sliceOffset int64
+	if byteRange := r.URL.Query().Get("range"); byteRange != "" {
+		sliceLength, sliceOffset, err = playlist.ParseByteRange(byteRange)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 	if cache.FileExists(taskID, filename) && !cache.FileExists(taskID, filename+".aria2") {
 		http.ServeFile(w, r, cache.GetFilePath(taskID, filename))
 		return
 	}
+	if prefix == "/proxy/seg/" {
+		go s.taskManager.PrioritizePlayback(taskID, filename)
+	}
 
 	req, _ := http.NewRequest(http.MethodGet, originURL, nil)
-	for key, value := range config.GlobalConfig.Headers {
+	for key, value := range s.taskManager.TaskRequestHeaders(taskID) {
 		req.Header.Set(key, value)
 	}
-	resp, err := s.client.Do(req)
+	// A Range request of the player is forwarded, within the slice for byte
+	// range items; only complete files are written through to the cache.
+	clientRange := r.Header.Get("Range")
+	var partial bool
+	var contentRange string
+	if sliceLength > 0 {
+		if start, end, ok := parseSingleRange(clientRange, sliceLength); ok {
+			contentRange = fmt.Sprintf("bytes %d-%d/%d", start, end, sliceLength)
+			sliceOffset += start
+			sliceLength = end - start + 1
+			partial = true
+		}
+		req.Header.Set("Range", playlist.RangeHeader(sliceLength, sliceOffset))
+	} else if clientRange != "" {
+		partial = true
+		req.Header.Set("Range", clientRange)
+		if ifRange := r.Header.Get("If-Range"); ifRange != "" {
+			req.Header.Set("If-Range", ifRange)
+		}
+	}
+	// Complete fetches are shared by every client asking for the same file or
+	// slice with the same headers at the same time; partial ones are the
+	// player's own.
+	var resp *http.Response
+	if partial {
+		resp, err = s.client.Do(req)
+	} else {
+		resp, err = s.fetches.do(s.client, requestKey(req), req)
+	}
 	if err != nil {
 		http.Error(w, "failed to fetch upstream", http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
-	for key, values := range resp.Header {
-		w.Header()[key] = values
+
+	var tmp *os.File
+	if !partial {
+		if tmp = writeThroughFile(taskID, filename); tmp != nil {
+			defer os.Remove(tmp.Name())
+			defer tmp.Close()
+		}
+	}
+	var complete bool
+	if sliceLength > 0 {
+		complete = writeUpstreamSlice(w, resp, sliceLength, sliceOffset, contentRange, tmp)
+	} else {
+		for key, values := range resp.Header {
+			w.Header()[key] = values
+		}
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(resp.StatusCode)
+		var body io.Reader = resp.Body
+		if tmp != nil {
+			body = io.TeeReader(resp.Body, tmp)
+		}
+		n, err := io.Copy(w, body)
+		complete = err == nil && resp.StatusCode == http.StatusOK && (resp.ContentLength < 0 || n == resp.ContentLength)
+	}
+	if tmp != nil && complete {
+		// Nothing was partial, so the slice is still the one of the URL.
+		s.storeWriteThrough(taskID, task.ManifestItem{Filename: filename, URL: originURL, Offset: sliceOffset, Length: sliceLength}, tmp)
+	}
+}
+
+// writeUpstreamSlice answers with just the requested slice as a complete 200
+// response, because the rewritten playlist no longer carries the byte range,
+// or as a 206 response with contentRange when the player asked for a part of
+// it. Origins that ignore the Range header are sliced locally. The slice is
+// also written to tmp unless it is nil, and it reports whether all of it was
+// passed on.
+func writeUpstreamSlice(w http.ResponseWriter, resp *http.Response, length, offset int64, contentRange string, tmp *os.File) bool {
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			http.Error(w, "upstream body shorter than byte range", http.StatusBadGateway)
+			return false
+		}
+	default:
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+		return false
+	}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
 	}
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.Header().Set("Accept-Ranges", "bytes")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.WriteHeader(resp.StatusCode)
-	_, _ = io.Copy(w, resp.Body)
+	status := http.StatusOK
+	if contentRange != "" {
+		w.Header().Set("Content-Range", contentRange)
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+	var body io.Reader = resp.Body
+	if tmp != nil {
+		body = io.TeeReader(resp.Body, tmp)
+	}
+	n, err := io.CopyN(w, body, length)
+	return err == nil && n == length
+}
+
+// parseSingleRange parses a Range header asking for one range of a resource of
+// size bytes and returns its first and last byte. Multiple or unsatisfiable
+// ranges are not supported; the whole resource is sent instead.
+func parseSingleRange(header string, size int64) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	if first == "" {
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, false
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, size - 1, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
+
+// writeThroughFile creates the temporary file a complete upstream response is
+// copied into, in the directory of the task; nil when there is no such task.
+func writeThroughFile(taskID, filename string) *os.File {
+	dir := cache.GetTaskDir(taskID)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return nil
+	}
+	tmp, err := os.CreateTemp(dir, "."+filename+".*.tmp")
+	if err != nil {
+		return nil
+	}
+	return tmp
+}
+
+// storeWriteThrough hands a complete file fetched for a player to the task,
+// so it counts as downloaded if it is the manifest item fetched describes.
+func (s *Server) storeWriteThrough(taskID string, fetched task.ManifestItem, tmp *os.File) {
+	if err := tmp.Sync(); err != nil {
+		return
+	}
+	if err := tmp.Close(); err != nil {
+		return
+	}
+	if _, err := s.taskManager.StoreProxiedFile(taskID, fetched, tmp.Name()); err != nil {
+		log.Printf("write-through of %s failed task=%s: %v", fetched.Filename, taskID, err)
+	}
 }
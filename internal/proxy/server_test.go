@@ -0,0 +1,335 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"hls-accelerator/internal/cache"
+	"hls-accelerator/internal/config"
+	"hls-accelerator/internal/database"
+	"hls-accelerator/internal/downloader"
+	playlist "hls-accelerator/internal/m3u8"
+	"hls-accelerator/internal/task"
+)
+
+// idleDownloader accepts downloads but never runs them, so items stay pending
+// until the proxy writes them through.
+type idleDownloader struct {
+	mu      sync.Mutex
+	added   int
+	removed chan string
+}
+
+func (d *idleDownloader) BatchAddURIs(requests []downloader.AddURIRequest) ([]string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	gids := make([]string, len(requests))
+	for i := range requests {
+		d.added++
+		gids[i] = fmt.Sprintf("gid-%d", d.added)
+	}
+	return gids, nil
+}
+
+func (d *idleDownloader) BatchPause([]string) error   { return nil }
+func (d *idleDownloader) BatchUnpause([]string) error { return nil }
+func (d *idleDownloader) MoveToFront([]string) error  { return nil }
+
+func (d *idleDownloader) ForceRemoveMany(gids []string) {
+	for _, gid := range gids {
+		d.removed <- gid
+	}
+}
+
+func (d *idleDownloader) BatchTellStatus(gids []string) (map[string]downloader.StatusDetail, error) {
+	statuses := make(map[string]downloader.StatusDetail, len(gids))
+	for _, gid := range gids {
+		statuses[gid] = downloader.StatusDetail{Gid: gid, Status: "active"}
+	}
+	return statuses, nil
+}
+
+func (d *idleDownloader) QueueStatusesByDir(string) ([]downloader.StatusDetail, error) {
+	return nil, nil
+}
+func (d *idleDownloader) CleanupTaskByDir(string) (int, error) { return 0, nil }
+func (d *idleDownloader) PurgeDownloadResult() error           { return nil }
+
+func (d *idleDownloader) ListenNotifications(ctx context.Context, handler func(method, gid string)) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestMain(m *testing.M) {
+	// The task managers of the tests keep running in the background, so they
+	// share one cache directory that outlives every test.
+	dir, err := os.MkdirTemp("", "proxy-test-")
+	if err != nil {
+		panic(err)
+	}
+	config.GlobalConfig.CacheDir = dir
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// proxyFileTest is an origin serving a body at /media.ts with Range support
+// and a server with a task whose items are slices of it.
+type proxyFileTest struct {
+	s      *Server
+	dl     *idleDownloader
+	origin *httptest.Server
+	taskID string
+}
+
+func newProxyFileTest(t *testing.T, body []byte, items []playlist.DownloadItem) *proxyFileTest {
+	t.Helper()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "media.ts", time.Time{}, bytes.NewReader(body))
+	}))
+	t.Cleanup(origin.Close)
+
+	db, err := database.Init(t.TempDir())
+	if err != nil {
+		t.Fatalf("database.Init: %v", err)
+	}
+	dl := &idleDownloader{removed: make(chan string, 16)}
+	tm, err := task.NewManager(dl, db)
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	for i := range items {
+		items[i].URL = origin.URL + "/media.ts"
+	}
+	taskID := fmt.Sprintf("%s-%d", t.Name(), time.Now().UnixNano())
+	if err := cache.EnsureTaskDir(taskID); err != nil {
+		t.Fatalf("EnsureTaskDir: %v", err)
+	}
+	created, err := tm.CreateTaskWithItems(task.TaskMetadata{
+		ID:            taskID,
+		Name:          taskID,
+		OriginalURL:   origin.URL + "/index.m3u8",
+		TotalSegments: len(items),
+		OutputDir:     cache.GetTaskDir(taskID),
+		CreatedTime:   time.Now(),
+		UpdatedTime:   time.Now(),
+	}, items)
+	if err != nil || !created {
+		t.Fatalf("CreateTaskWithItems = %v, %v", created, err)
+	}
+	return &proxyFileTest{
+		s:      &Server{client: origin.Client(), taskManager: tm},
+		dl:     dl,
+		origin: origin,
+		taskID: taskID,
+	}
+}
+
+// waitItem waits until the item of filename satisfies ok.
+func (pt *proxyFileTest) waitItem(t *testing.T, filename string, ok func(task.TaskItemState) bool) task.TaskItemState {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		detail, err := pt.s.taskManager.GetTaskDetail(pt.taskID)
+		if err != nil {
+			t.Fatalf("GetTaskDetail: %v", err)
+		}
+		for _, item := range detail.Items {
+			if item.Filename == filename && ok(item) {
+				return item
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("item %s did not reach the expected state: %+v", filename, detail.Items)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// get asks for filename of the task the way a rewritten playlist points at it.
+func (pt *proxyFileTest) get(filename, query string, header http.Header) *httptest.ResponseRecorder {
+	return pt.getFrom(filename, pt.origin.URL+"/media.ts", query, header)
+}
+
+// getFrom asks for filename of the task, fetched from originURL.
+func (pt *proxyFileTest) getFrom(filename, originURL, query string, header http.Header) *httptest.ResponseRecorder {
+	target := "/proxy/seg/" + pt.taskID + "/" + filename + "/" + url.QueryEscape(originURL) + query
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for key, values := range header {
+		r.Header[key] = values
+	}
+	rec := httptest.NewRecorder()
+	pt.s.handleSegment(rec, r)
+	return rec
+}
+
+func (pt *proxyFileTest) stored(filename string) []byte {
+	data, _ := os.ReadFile(cache.GetFilePath(pt.taskID, filename))
+	return data
+}
+
+// assertNotWrittenThrough checks that filename is neither stored nor left as a
+// temporary file in the task directory.
+func (pt *proxyFileTest) assertNotWrittenThrough(t *testing.T, filename string) {
+	t.Helper()
+	if cache.FileExists(pt.taskID, filename) {
+		t.Fatalf("%s should not be written through", filename)
+	}
+	entries, err := os.ReadDir(cache.GetTaskDir(pt.taskID))
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "."+filename+".") {
+			t.Fatalf("temporary file %s left behind", entry.Name())
+		}
+	}
+}
+
+func TestHandleProxyFileWritesCompleteFetchThrough(t *testing.T) {
+	body := []byte(strings.Repeat("0123456789", 10))
+	pt := newProxyFileTest(t, body, []playlist.DownloadItem{
+		{Filename: "00001.ts", Type: "segment"},
+	})
+	item := pt.waitItem(t, "00001.ts", func(item task.TaskItemState) bool { return item.GID != "" })
+
+	rec := pt.get("00001.ts", "", nil)
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), body) {
+		t.Fatalf("response = %d %q", rec.Code, rec.Body.Bytes())
+	}
+	if stored := pt.stored("00001.ts"); !bytes.Equal(stored, body) {
+		t.Fatalf("stored file = %q", stored)
+	}
+	pt.waitItem(t, "00001.ts", func(item task.TaskItemState) bool { return item.State == task.ItemStateDone })
+	select {
+	case gid := <-pt.dl.removed:
+		if gid != item.GID {
+			t.Fatalf("removed %s, want the download %s of the stored item", gid, item.GID)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the queued download of the stored item was not removed")
+	}
+
+	// The stored file is served from the cache from now on.
+	pt.origin.Close()
+	rec = pt.get("00001.ts", "", nil)
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), body) {
+		t.Fatalf("cached response = %d %q", rec.Code, rec.Body.Bytes())
+	}
+}
+
+func TestHandleProxyFileServesClientRangeWithinByteRangeItem(t *testing.T) {
+	body := []byte(strings.Repeat("abcdefghij", 20))
+	pt := newProxyFileTest(t, body, []playlist.DownloadItem{
+		{Filename: "00001.ts", Type: "segment", Offset: 50, Length: 100},
+	})
+
+	rec := pt.get("00001.ts", "?range=100@50", http.Header{"Range": {"bytes=10-19"}})
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("status = %d, want 206", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Range"); got != "bytes 10-19/100" {
+		t.Fatalf("Content-Range = %q", got)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), body[60:70]) {
+		t.Fatalf("body = %q, want %q", rec.Body.Bytes(), body[60:70])
+	}
+	pt.assertNotWrittenThrough(t, "00001.ts")
+
+	// Without a client range the whole slice is answered and stored.
+	rec = pt.get("00001.ts", "?range=100@50", nil)
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), body[50:150]) {
+		t.Fatalf("slice response = %d %q", rec.Code, rec.Body.Bytes())
+	}
+	if stored := pt.stored("00001.ts"); !bytes.Equal(stored, body[50:150]) {
+		t.Fatalf("stored slice = %q", stored)
+	}
+	pt.waitItem(t, "00001.ts", func(item task.TaskItemState) bool { return item.State == task.ItemStateDone })
+}
+
+func TestHandleProxyFilePassesPartialContentThrough(t *testing.T) {
+	body := []byte(strings.Repeat("0123456789", 10))
+	pt := newProxyFileTest(t, body, []playlist.DownloadItem{
+		{Filename: "00001.ts", Type: "segment"},
+	})
+
+	rec := pt.get("00001.ts", "", http.Header{"Range": {"bytes=20-29"}})
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("status = %d, want 206", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Range"); got != "bytes 20-29/100" {
+		t.Fatalf("Content-Range = %q", got)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), body[20:30]) {
+		t.Fatalf("body = %q, want %q", rec.Body.Bytes(), body[20:30])
+	}
+	pt.assertNotWrittenThrough(t, "00001.ts")
+	if item := pt.waitItem(t, "00001.ts", func(task.TaskItemState) bool { return true }); item.State == task.ItemStateDone {
+		t.Fatal("a partial response must not complete the item")
+	}
+}
+
+func TestHandleProxyFileStoresOnlyTheManifestSource(t *testing.T) {
+	body := []byte(strings.Repeat("abcdefghij", 20))
+	pt := newProxyFileTest(t, body, []playlist.DownloadItem{
+		{Filename: "00001.ts", Type: "segment", Offset: 50, Length: 100},
+	})
+
+	for _, req := range []struct{ originURL, query string }{
+		{pt.origin.URL + "/other.ts", "?range=100@50"},
+		{pt.origin.URL + "/media.ts", "?range=100@0"},
+		{pt.origin.URL + "/media.ts", ""},
+	} {
+		rec := pt.getFrom("00001.ts", req.originURL, req.query, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s%s: status = %d, want it proxied", req.originURL, req.query, rec.Code)
+		}
+		pt.assertNotWrittenThrough(t, "00001.ts")
+	}
+	if item := pt.waitItem(t, "00001.ts", func(task.TaskItemState) bool { return true }); item.State == task.ItemStateDone {
+		t.Fatal("a response from another source must not complete the item")
+	}
+}
+
+func TestHandleTaskMediaServesOnlyPlaylistsOfExistingTasks(t *testing.T) {
+	pt := newProxyFileTest(t, []byte("media"), []playlist.DownloadItem{
+		{Filename: "00001.ts", Type: "segment"},
+	})
+	if err := pt.s.taskManager.SaveTaskPlaylist(pt.taskID, "audio_en.m3u8", "#EXTM3U\n"); err != nil {
+		t.Fatalf("SaveTaskPlaylist: %v", err)
+	}
+	// A playlist in a directory of the cache that belongs to no task.
+	stray := "stray-" + pt.taskID
+	if err := cache.EnsureTaskDir(stray); err != nil {
+		t.Fatalf("EnsureTaskDir: %v", err)
+	}
+	if err := os.WriteFile(cache.GetFilePath(stray, "audio_en.m3u8"), []byte("#EXTM3U\n# stray\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(id string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/proxy/media/x/audio_en.m3u8", nil)
+		r.SetPathValue("id", id)
+		r.SetPathValue("name", "audio_en.m3u8")
+		rec := httptest.NewRecorder()
+		pt.s.handleTaskMedia(rec, r)
+		return rec
+	}
+	if rec := get(pt.taskID); rec.Code != http.StatusOK || !strings.HasPrefix(rec.Body.String(), "#EXTM3U") {
+		t.Fatalf("playlist of the task = %d %q", rec.Code, rec.Body.String())
+	}
+	for _, id := range []string{stray, pt.taskID + "/../" + stray, "../" + stray} {
+		if rec := get(id); rec.Code != http.StatusNotFound {
+			t.Fatalf("id %q: status = %d %q, want 404", id, rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package remux
+
+import "errors"
+
+var errShortBitstream = errors.New("remux: bitstream too short")
+
+// bitReader reads big-endian bit fields and Exp-Golomb codes from an RBSP.
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+}
+
+func (r *bitReader) u(n int) (uint32, error) {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			return 0, errShortBitstream
+		}
+		bit := (r.data[r.pos/8] >> (7 - uint(r.pos%8))) & 1
+		v = v<<1 | uint32(bit)
+		r.pos++
+	}
+	return v, nil
+}
+
+func (r *bitReader) skip(n int) error {
+	if r.pos+n > len(r.data)*8 {
+		return errShortBitstream
+	}
+	r.pos += n
+	return nil
+}
+
+func (r *bitReader) ue() (uint32, error) {
+	zeros := 0
+	for {
+		bit, err := r.u(1)
+		if err != nil {
+			return 0, err
+		}
+		if bit == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, errors.New("remux: invalid Exp-Golomb code")
+		}
+	}
+	rest, err := r.u(zeros)
+	if err != nil {
+		return 0, err
+	}
+	return (1<<uint(zeros) - 1) + rest, nil
+}
+
+func (r *bitReader) se() (int32, error) {
+	v, err := r.ue()
+	if err != nil {
+		return 0, err
+	}
+	if v%2 == 1 {
+		return int32((v + 1) / 2), nil
+	}
+	return -int32(v / 2), nil
+}
+
+// unescapeRBSP removes the emulation prevention bytes (00 00 03) of a NAL unit.
+func unescapeRBSP(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// splitAnnexB splits an Annex B byte stream into NAL units without start codes.
+func splitAnnexB(data []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+	i := 0
+	for i+2 < len(data) {
+		if data[i] == 0 && data[i+1] == 0 && data[i+2] == 1 {
+			if start >= 0 {
+				end := i
+				for end > start && data[end-1] == 0 {
+					end--
+				}
+				if end > start {
+					nals = append(nals, data[start:end])
+				}
+			}
+			i += 3
+			start = i
+			continue
+		}
+		i++
+	}
+	if start >= 0 && start < len(data) {
+		nals = append(nals, data[start:])
+	} else if start < 0 && len(data) > 0 {
+		// No start code at all: treat the payload as a single NAL unit.
+		nals = append(nals, data)
+	}
+	return nals
+}
@@ -0,0 +1,372 @@
+package remux
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// videoConfig is what the MP4 sample entry needs to know about a video stream.
+type videoConfig struct {
+	hevc   bool
+	width  int
+	height int
+	record []byte // avcC or hvcC payload
+}
+
+// h264SPS holds the SPS fields used for avcC and the frame size.
+type h264SPS struct {
+	profile, compat, level       byte
+	chromaFormat                 uint32
+	bitDepthLuma, bitDepthChroma uint32
+	width, height                int
+}
+
+var h264HighProfiles = map[byte]bool{100: true, 110: true, 122: true, 244: true, 44: true, 83: true, 86: true, 118: true, 128: true, 138: true, 139: true, 134: true, 135: true}
+
+func parseH264SPS(nal []byte) (h264SPS, error) {
+	rbsp := unescapeRBSP(nal)
+	if len(rbsp) < 4 {
+		return h264SPS{}, errShortBitstream
+	}
+	sps := h264SPS{profile: rbsp[1], compat: rbsp[2], level: rbsp[3], chromaFormat: 1}
+	r := &bitReader{data: rbsp, pos: 32}
+	if _, err := r.ue(); err != nil { // seq_parameter_set_id
+		return sps, err
+	}
+	separateColourPlane := uint32(0)
+	if h264HighProfiles[sps.profile] {
+		var err error
+		if sps.chromaFormat, err = r.ue(); err != nil {
+			return sps, err
+		}
+		if sps.chromaFormat == 3 {
+			if separateColourPlane, err = r.u(1); err != nil {
+				return sps, err
+			}
+		}
+		if sps.bitDepthLuma, err = r.ue(); err != nil {
+			return sps, err
+		}
+		if sps.bitDepthChroma, err = r.ue(); err != nil {
+			return sps, err
+		}
+		if err := r.skip(1); err != nil { // qpprime_y_zero_transform_bypass_flag
+			return sps, err
+		}
+		scalingMatrix, err := r.u(1)
+		if err != nil {
+			return sps, err
+		}
+		if scalingMatrix == 1 {
+			lists := 8
+			if sps.chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				present, err := r.u(1)
+				if err != nil {
+					return sps, err
+				}
+				if present == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						delta, err := r.se()
+						if err != nil {
+							return sps, err
+						}
+						next = (last + delta + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	if _, err := r.ue(); err != nil { // log2_max_frame_num_minus4
+		return sps, err
+	}
+	pocType, err := r.ue()
+	if err != nil {
+		return sps, err
+	}
+	switch pocType {
+	case 0:
+		if _, err := r.ue(); err != nil {
+			return sps, err
+		}
+	case 1:
+		if err := r.skip(1); err != nil {
+			return sps, err
+		}
+		if _, err := r.se(); err != nil {
+			return sps, err
+		}
+		if _, err := r.se(); err != nil {
+			return sps, err
+		}
+		cycle, err := r.ue()
+		if err != nil {
+			return sps, err
+		}
+		for i := uint32(0); i < cycle; i++ {
+			if _, err := r.se(); err != nil {
+				return sps, err
+			}
+		}
+	}
+	if _, err := r.ue(); err != nil { // max_num_ref_frames
+		return sps, err
+	}
+	if err := r.skip(1); err != nil { // gaps_in_frame_num_value_allowed_flag
+		return sps, err
+	}
+	widthMbs, err := r.ue()
+	if err != nil {
+		return sps, err
+	}
+	heightUnits, err := r.ue()
+	if err != nil {
+		return sps, err
+	}
+	frameMbsOnly, err := r.u(1)
+	if err != nil {
+		return sps, err
+	}
+	if frameMbsOnly == 0 {
+		if err := r.skip(1); err != nil {
+			return sps, err
+		}
+	}
+	if err := r.skip(1); err != nil { // direct_8x8_inference_flag
+		return sps, err
+	}
+	var cropLeft, cropRight, cropTop, cropBottom uint32
+	cropping, err := r.u(1)
+	if err != nil {
+		return sps, err
+	}
+	if cropping == 1 {
+		for _, v := range []*uint32{&cropLeft, &cropRight, &cropTop, &cropBottom} {
+			if *v, err = r.ue(); err != nil {
+				return sps, err
+			}
+		}
+	}
+
+	cropUnitX, cropUnitY := 1, 2-int(frameMbsOnly)
+	if sps.chromaFormat != 0 && separateColourPlane == 0 {
+		subWidth, subHeight := 2, 2
+		switch sps.chromaFormat {
+		case 2:
+			subHeight = 1
+		case 3:
+			subWidth, subHeight = 1, 1
+		}
+		cropUnitX = subWidth
+		cropUnitY = subHeight * (2 - int(frameMbsOnly))
+	}
+	sps.width = int(widthMbs+1)*16 - cropUnitX*int(cropLeft+cropRight)
+	sps.height = (2-int(frameMbsOnly))*int(heightUnits+1)*16 - cropUnitY*int(cropTop+cropBottom)
+	return sps, nil
+}
+
+func h264Config(sps, pps []byte) (videoConfig, error) {
+	info, err := parseH264SPS(sps)
+	if err != nil {
+		return videoConfig{}, fmt.Errorf("parse H.264 SPS: %w", err)
+	}
+	record := []byte{1, info.profile, info.compat, info.level, 0xFF, 0xE1}
+	record = binary.BigEndian.AppendUint16(record, uint16(len(sps)))
+	record = append(record, sps...)
+	record = append(record, 1)
+	record = binary.BigEndian.AppendUint16(record, uint16(len(pps)))
+	record = append(record, pps...)
+	if h264HighProfiles[info.profile] {
+		record = append(record,
+			0xFC|byte(info.chromaFormat&3),
+			0xF8|byte(info.bitDepthLuma&7),
+			0xF8|byte(info.bitDepthChroma&7),
+			0)
+	}
+	return videoConfig{width: info.width, height: info.height, record: record}, nil
+}
+
+// h265SPS holds the SPS fields used for hvcC and the frame size.
+type h265SPS struct {
+	generalPTL                   []byte // the 12 bytes of general_profile_space .. general_level_idc
+	maxSubLayers                 int
+	temporalIDNested             bool
+	chromaFormat                 uint32
+	bitDepthLuma, bitDepthChroma uint32
+	width, height                int
+}
+
+func parseH265SPS(nal []byte) (h265SPS, error) {
+	rbsp := unescapeRBSP(nal)
+	if len(rbsp) < 15 {
+		return h265SPS{}, errShortBitstream
+	}
+	// rbsp[0:2] is the NAL unit header.
+	sps := h265SPS{
+		maxSubLayers:     int(rbsp[2]>>1&7) + 1,
+		temporalIDNested: rbsp[2]&1 == 1,
+		generalPTL:       append([]byte(nil), rbsp[3:15]...),
+	}
+	r := &bitReader{data: rbsp, pos: 15 * 8}
+	subLayers := sps.maxSubLayers - 1
+	profilePresent := make([]uint32, subLayers)
+	levelPresent := make([]uint32, subLayers)
+	for i := 0; i < subLayers; i++ {
+		var err error
+		if profilePresent[i], err = r.u(1); err != nil {
+			return sps, err
+		}
+		if levelPresent[i], err = r.u(1); err != nil {
+			return sps, err
+		}
+	}
+	if subLayers > 0 {
+		if err := r.skip(2 * (8 - subLayers)); err != nil {
+			return sps, err
+		}
+	}
+	for i := 0; i < subLayers; i++ {
+		if profilePresent[i] == 1 {
+			if err := r.skip(88); err != nil {
+				return sps, err
+			}
+		}
+		if levelPresent[i] == 1 {
+			if err := r.skip(8); err != nil {
+				return sps, err
+			}
+		}
+	}
+	if _, err := r.ue(); err != nil { // sps_seq_parameter_set_id
+		return sps, err
+	}
+	var err error
+	if sps.chromaFormat, err = r.ue(); err != nil {
+		return sps, err
+	}
+	if sps.chromaFormat == 3 {
+		if err := r.skip(1); err != nil {
+			return sps, err
+		}
+	}
+	width, err := r.ue()
+	if err != nil {
+		return sps, err
+	}
+	height, err := r.ue()
+	if err != nil {
+		return sps, err
+	}
+	var left, right, top, bottom uint32
+	window, err := r.u(1)
+	if err != nil {
+		return sps, err
+	}
+	if window == 1 {
+		for _, v := range []*uint32{&left, &right, &top, &bottom} {
+			if *v, err = r.ue(); err != nil {
+				return sps, err
+			}
+		}
+	}
+	if sps.bitDepthLuma, err = r.ue(); err != nil {
+		return sps, err
+	}
+	if sps.bitDepthChroma, err = r.ue(); err != nil {
+		return sps, err
+	}
+	subWidth, subHeight := 1, 1
+	switch sps.chromaFormat {
+	case 1:
+		subWidth, subHeight = 2, 2
+	case 2:
+		subWidth = 2
+	}
+	sps.width = int(width) - subWidth*int(left+right)
+	sps.height = int(height) - subHeight*int(top+bottom)
+	return sps, nil
+}
+
+func h265Config(vps, sps, pps []byte) (videoConfig, error) {
+	info, err := parseH265SPS(sps)
+	if err != nil {
+		return videoConfig{}, fmt.Errorf("parse H.265 SPS: %w", err)
+	}
+	record := []byte{1}
+	record = append(record, info.generalPTL...)
+	record = append(record,
+		0xF0, 0x00, // min_spatial_segmentation_idc
+		0xFC, // parallelismType
+		0xFC|byte(info.chromaFormat&3),
+		0xF8|byte(info.bitDepthLuma&7),
+		0xF8|byte(info.bitDepthChroma&7),
+		0, 0, // avgFrameRate
+	)
+	nested := byte(0)
+	if info.temporalIDNested {
+		nested = 1
+	}
+	record = append(record, byte(info.maxSubLayers&7)<<3|nested<<2|3, 3)
+	for _, array := range []struct {
+		nalType byte
+		nal     []byte
+	}{{32, vps}, {33, sps}, {34, pps}} {
+		record = append(record, 0x80|array.nalType, 0, 1)
+		record = binary.BigEndian.AppendUint16(record, uint16(len(array.nal)))
+		record = append(record, array.nal...)
+	}
+	return videoConfig{hevc: true, width: info.width, height: info.height, record: record}, nil
+}
+
+// audioConfig describes an AAC stream taken from its ADTS headers.
+type audioConfig struct {
+	objectType   byte
+	freqIndex    byte
+	channels     byte
+	sampleRate   int
+	specificInfo []byte // AudioSpecificConfig
+}
+
+var adtsSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// adtsHeader parses the ADTS header at the start of data and returns the
+// config, the header length and the full frame length.
+func adtsHeader(data []byte) (audioConfig, int, int, bool) {
+	if len(data) < 7 || data[0] != 0xFF || data[1]&0xF6 != 0xF0 {
+		return audioConfig{}, 0, 0, false
+	}
+	headerLen := 7
+	if data[1]&1 == 0 {
+		headerLen = 9
+	}
+	freqIndex := data[2] >> 2 & 0x0F
+	if int(freqIndex) >= len(adtsSampleRates) {
+		return audioConfig{}, 0, 0, false
+	}
+	frameLen := int(data[3]&3)<<11 | int(data[4])<<3 | int(data[5])>>5
+	if frameLen < headerLen {
+		return audioConfig{}, 0, 0, false
+	}
+	cfg := audioConfig{
+		objectType: data[2]>>6 + 1,
+		freqIndex:  freqIndex,
+		channels:   (data[2]&1)<<2 | data[3]>>6,
+		sampleRate: adtsSampleRates[freqIndex],
+	}
+	asc := uint16(cfg.objectType)<<11 | uint16(cfg.freqIndex)<<7 | uint16(cfg.channels)<<3
+	cfg.specificInfo = []byte{byte(asc >> 8), byte(asc)}
+	return cfg, headerLen, frameLen, true
+}
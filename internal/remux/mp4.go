@@ -0,0 +1,336 @@
+package remux
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+const movieTimescale = 1000
+
+// mp4Box builds an ISO BMFF box from its payload parts.
+func mp4Box(typ string, parts ...[]byte) []byte {
+	size := 8
+	for _, p := range parts {
+		size += len(p)
+	}
+	out := make([]byte, 0, size)
+	out = binary.BigEndian.AppendUint32(out, uint32(size))
+	out = append(out, typ...)
+	for _, p := range parts {
+		out = append(out, p...)
+	}
+	return out
+}
+
+func fullBox(typ string, version byte, flags uint32, parts ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return mp4Box(typ, append([][]byte{header}, parts...)...)
+}
+
+// fields packs big-endian integers; each value is written with the width of
+// its Go type.
+func fields(values ...any) []byte {
+	var out []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case uint8:
+			out = append(out, v)
+		case uint16:
+			out = binary.BigEndian.AppendUint16(out, v)
+		case uint32:
+			out = binary.BigEndian.AppendUint32(out, v)
+		case uint64:
+			out = binary.BigEndian.AppendUint64(out, v)
+		case int16:
+			out = binary.BigEndian.AppendUint16(out, uint16(v))
+		case int32:
+			out = binary.BigEndian.AppendUint32(out, uint32(v))
+		case int64:
+			out = binary.BigEndian.AppendUint64(out, uint64(v))
+		case []byte:
+			out = append(out, v...)
+		case string:
+			out = append(out, v...)
+		default:
+			panic("remux: unsupported field type")
+		}
+	}
+	return out
+}
+
+var unityMatrix = fields(
+	uint32(0x00010000), uint32(0), uint32(0),
+	uint32(0), uint32(0x00010000), uint32(0),
+	uint32(0), uint32(0), uint32(0x40000000),
+)
+
+// writeMP4 writes ftyp, moov and the mdat box whose payload is copied from
+// mediaData.
+func (m *muxer) writeMP4(w io.Writer, mediaData io.Reader) error {
+	tracks := m.tracks()
+	brands := []string{"isom", "iso2", "mp41"}
+	if m.video != nil && !m.video.video.hevc {
+		brands = append(brands, "avc1")
+	}
+	ftyp := mp4Box("ftyp", fields("isom", uint32(0x200)))
+	for _, brand := range brands {
+		ftyp = append(ftyp, brand...)
+	}
+	binary.BigEndian.PutUint32(ftyp, uint32(len(ftyp)))
+
+	mdatHeader := fields(uint32(8+m.written), "mdat")
+	if 8+m.written > math.MaxUint32 {
+		mdatHeader = fields(uint32(1), "mdat", uint64(16+m.written))
+	}
+	// The moov size does not depend on the chunk offsets, only on whether
+	// they need 64 bits.
+	co64 := false
+	moov := m.moov(tracks, 0, co64)
+	base := uint64(len(ftyp) + len(moov) + len(mdatHeader))
+	if base+m.written > math.MaxUint32 {
+		co64 = true
+		moov = m.moov(tracks, 0, co64)
+		base = uint64(len(ftyp) + len(moov) + len(mdatHeader))
+	}
+	moov = m.moov(tracks, base, co64)
+
+	for _, part := range [][]byte{ftyp, moov, mdatHeader} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	_, err := io.Copy(w, mediaData)
+	return err
+}
+
+func (m *muxer) tracks() []*track {
+	var tracks []*track
+	for _, t := range []*track{m.video, m.audio} {
+		if t != nil && len(t.samples) > 0 {
+			tracks = append(tracks, t)
+		}
+	}
+	return tracks
+}
+
+func (m *muxer) moov(tracks []*track, base uint64, co64 bool) []byte {
+	// Tracks start at the earliest presentation time; a later track is
+	// delayed with an empty edit.
+	start := int64(math.MaxInt64)
+	for _, t := range tracks {
+		if v := t.firstPTS() * movieTimescale / int64(t.timescale); v < start {
+			start = v
+		}
+	}
+	var traks [][]byte
+	var movieDuration int64
+	for i, t := range tracks {
+		delay := t.firstPTS()*movieTimescale/int64(t.timescale) - start
+		trak, duration := t.trak(uint32(i+1), delay, base, co64)
+		traks = append(traks, trak)
+		if duration > movieDuration {
+			movieDuration = duration
+		}
+	}
+	mvhd := fullBox("mvhd", 0, 0, fields(
+		uint32(0), uint32(0), uint32(movieTimescale), uint32(movieDuration),
+		uint32(0x00010000), uint16(0x0100), uint16(0), uint32(0), uint32(0),
+		unityMatrix,
+		make([]byte, 24),
+		uint32(len(tracks)+1),
+	))
+	return mp4Box("moov", append([][]byte{mvhd}, traks...)...)
+}
+
+func (t *track) firstPTS() int64 {
+	return t.samples[0].dts + t.samples[0].cto
+}
+
+// trak builds the track box and returns it with the track duration in the
+// movie timescale.
+func (t *track) trak(id uint32, delay int64, base uint64, co64 bool) ([]byte, int64) {
+	durations := t.durations()
+	var mediaDuration int64
+	for _, d := range durations {
+		mediaDuration += d
+	}
+	firstCTO := t.samples[0].cto
+	segmentDuration := (mediaDuration - firstCTO) * movieTimescale / int64(t.timescale)
+	if segmentDuration < 0 {
+		segmentDuration = 0
+	}
+	var edits [][]byte
+	if delay > 0 {
+		edits = append(edits, fields(uint32(delay), int32(-1), uint32(0x00010000)))
+	}
+	edits = append(edits, fields(uint32(segmentDuration), int32(firstCTO), uint32(0x00010000)))
+	elst := fullBox("elst", 0, 0, append([][]byte{fields(uint32(len(edits)))}, edits...)...)
+	duration := delay + segmentDuration
+
+	var volume uint16
+	var width, height uint32
+	if t.video != nil {
+		width, height = uint32(t.video.width)<<16, uint32(t.video.height)<<16
+	} else {
+		volume = 0x0100
+	}
+	tkhd := fullBox("tkhd", 0, 3, fields(
+		uint32(0), uint32(0), id, uint32(0), uint32(duration),
+		uint32(0), uint32(0), uint16(0), uint16(0), volume, uint16(0),
+		unityMatrix, width, height,
+	))
+
+	var mdhd []byte
+	if mediaDuration > math.MaxUint32 {
+		mdhd = fullBox("mdhd", 1, 0, fields(uint64(0), uint64(0), t.timescale, uint64(mediaDuration), uint16(0x55C4), uint16(0)))
+	} else {
+		mdhd = fullBox("mdhd", 0, 0, fields(uint32(0), uint32(0), t.timescale, uint32(mediaDuration), uint16(0x55C4), uint16(0)))
+	}
+	handler, name, header := "soun", "SoundHandler", fullBox("smhd", 0, 0, fields(uint16(0), uint16(0)))
+	if t.video != nil {
+		handler, name, header = "vide", "VideoHandler", fullBox("vmhd", 0, 1, fields(uint16(0), uint16(0), uint16(0), uint16(0)))
+	}
+	hdlr := fullBox("hdlr", 0, 0, fields(uint32(0), handler, make([]byte, 12), name, uint8(0)))
+	dinf := mp4Box("dinf", fullBox("dref", 0, 0, fields(uint32(1)), fullBox("url ", 0, 1)))
+	minf := mp4Box("minf", header, dinf, t.stbl(durations, base, co64))
+	mdia := mp4Box("mdia", mdhd, hdlr, minf)
+	return mp4Box("trak", tkhd, mp4Box("edts", elst), mdia), duration
+}
+
+func (t *track) stbl(durations []int64, base uint64, co64 bool) []byte {
+	boxes := [][]byte{fullBox("stsd", 0, 0, fields(uint32(1)), t.sampleEntry())}
+
+	stts := runLengths(len(durations), func(i int) int64 { return durations[i] })
+	boxes = append(boxes, fullBox("stts", 0, 0, entryTable(stts)))
+
+	hasCTO := false
+	for _, s := range t.samples {
+		hasCTO = hasCTO || s.cto != 0
+	}
+	if hasCTO {
+		ctts := runLengths(len(t.samples), func(i int) int64 { return t.samples[i].cto })
+		boxes = append(boxes, fullBox("ctts", 0, 0, entryTable(ctts)))
+	}
+
+	var syncSamples []byte
+	syncCount := 0
+	for i, s := range t.samples {
+		if s.sync {
+			syncSamples = binary.BigEndian.AppendUint32(syncSamples, uint32(i+1))
+			syncCount++
+		}
+	}
+	if syncCount < len(t.samples) {
+		boxes = append(boxes, fullBox("stss", 0, 0, fields(uint32(syncCount)), syncSamples))
+	}
+
+	var stsc []byte
+	stscCount := 0
+	for i, c := range t.chunks {
+		if i == 0 || c.samples != t.chunks[i-1].samples {
+			stsc = append(stsc, fields(uint32(i+1), c.samples, uint32(1))...)
+			stscCount++
+		}
+	}
+	boxes = append(boxes, fullBox("stsc", 0, 0, fields(uint32(stscCount)), stsc))
+
+	sizes := make([]byte, 0, 4*len(t.samples))
+	for _, s := range t.samples {
+		sizes = binary.BigEndian.AppendUint32(sizes, s.size)
+	}
+	boxes = append(boxes, fullBox("stsz", 0, 0, fields(uint32(0), uint32(len(t.samples))), sizes))
+
+	offsets := fields(uint32(len(t.chunks)))
+	for _, c := range t.chunks {
+		if co64 {
+			offsets = binary.BigEndian.AppendUint64(offsets, base+c.offset)
+		} else {
+			offsets = binary.BigEndian.AppendUint32(offsets, uint32(base+c.offset))
+		}
+	}
+	if co64 {
+		boxes = append(boxes, fullBox("co64", 0, 0, offsets))
+	} else {
+		boxes = append(boxes, fullBox("stco", 0, 0, offsets))
+	}
+	return mp4Box("stbl", boxes...)
+}
+
+func (t *track) sampleEntry() []byte {
+	if v := t.video; v != nil {
+		entryType, recordType := "avc1", "avcC"
+		if v.hevc {
+			entryType, recordType = "hvc1", "hvcC"
+		}
+		return mp4Box(entryType, fields(
+			make([]byte, 6), uint16(1),
+			uint16(0), uint16(0), make([]byte, 12),
+			uint16(v.width), uint16(v.height),
+			uint32(0x00480000), uint32(0x00480000), uint32(0),
+			uint16(1), make([]byte, 32), uint16(0x18), int16(-1),
+		), mp4Box(recordType, v.record))
+	}
+	a := t.audio
+	channels := uint16(a.channels)
+	if channels == 0 {
+		channels = 2 // defined in a program config element
+	}
+	decoderConfig := descriptor(0x04, fields(
+		uint8(0x40), uint8(0x15), []byte{0, 0, 0}, uint32(0), uint32(0),
+		descriptor(0x05, a.specificInfo),
+	))
+	esds := fullBox("esds", 0, 0, descriptor(0x03, fields(uint16(0), uint8(0), decoderConfig, descriptor(0x06, []byte{0x02}))))
+	return mp4Box("mp4a", fields(
+		make([]byte, 6), uint16(1),
+		uint32(0), uint32(0),
+		channels, uint16(16), uint16(0), uint16(0),
+		uint32(a.sampleRate)<<16,
+	), esds)
+}
+
+// descriptor builds an MPEG-4 descriptor with an expandable size field.
+func descriptor(tag byte, payload []byte) []byte {
+	out := []byte{tag}
+	size := len(payload)
+	var sizeBytes []byte
+	for {
+		sizeBytes = append([]byte{byte(size & 0x7F)}, sizeBytes...)
+		size >>= 7
+		if size == 0 {
+			break
+		}
+	}
+	for i := 0; i < len(sizeBytes)-1; i++ {
+		sizeBytes[i] |= 0x80
+	}
+	out = append(out, sizeBytes...)
+	return append(out, payload...)
+}
+
+type runLength struct {
+	count uint32
+	value int64
+}
+
+func runLengths(n int, value func(int) int64) []runLength {
+	var runs []runLength
+	for i := 0; i < n; i++ {
+		v := value(i)
+		if len(runs) > 0 && runs[len(runs)-1].value == v {
+			runs[len(runs)-1].count++
+			continue
+		}
+		runs = append(runs, runLength{count: 1, value: v})
+	}
+	return runs
+}
+
+func entryTable(runs []runLength) []byte {
+	out := fields(uint32(len(runs)))
+	for _, r := range runs {
+		out = binary.BigEndian.AppendUint32(out, r.count)
+		out = binary.BigEndian.AppendUint32(out, uint32(r.value))
+	}
+	return out
+}
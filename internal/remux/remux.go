@@ -0,0 +1,320 @@
+// Package remux rewraps MPEG-TS into MP4 without re-encoding and without any
+// external tool. Only H.264, H.265 and ADTS AAC elementary streams are
+// understood, which covers what HLS services deliver in MPEG-TS.
+package remux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	videoTimescale = 90000
+	// A timestamp step larger than this, or backwards, is a discontinuity
+	// (e.g. between concatenated segments of different encodes).
+	maxTimestampJumpSec = 10
+)
+
+// ErrNoStreams is returned when the input carries no H.264, H.265 or AAC stream.
+var ErrNoStreams = errors.New("remux: no H.264, H.265 or AAC stream found")
+
+// TSToMP4 remuxes an MPEG-TS stream into a faststart MP4 at dstPath: the moov
+// box comes before the media data, so players can start and seek without
+// reading the whole file. Media data is spooled to dstPath+".mdat" while the
+// sample tables are built.
+func TSToMP4(src io.Reader, dstPath string) error {
+	spoolPath := dstPath + ".mdat"
+	spool, err := os.Create(spoolPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = spool.Close()
+		_ = os.Remove(spoolPath)
+	}()
+
+	m := &muxer{spool: bufio.NewWriterSize(spool, 1<<20)}
+	if err := newTSDemuxer(src, m.handlePES).run(); err != nil {
+		return err
+	}
+	if err := m.commitVideo(); err != nil {
+		return err
+	}
+	if err := m.spool.Flush(); err != nil {
+		return err
+	}
+	if m.video == nil && m.audio == nil {
+		return ErrNoStreams
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	out, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(out, 1<<20)
+	if err := m.writeMP4(w, spool); err != nil {
+		_ = out.Close()
+		_ = os.Remove(dstPath)
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		_ = out.Close()
+		_ = os.Remove(dstPath)
+		return err
+	}
+	return out.Close()
+}
+
+type sample struct {
+	dts  int64 // in track timescale
+	cto  int64 // composition time offset
+	size uint32
+	sync bool
+}
+
+type chunk struct {
+	offset  uint64 // relative to the start of the media data
+	samples uint32
+}
+
+type track struct {
+	timescale uint32
+	video     *videoConfig
+	audio     *audioConfig
+	samples   []sample
+	chunks    []chunk
+
+	// Timestamp normalization: offset is added to raw timestamps so they stay
+	// increasing across 33-bit wraparounds and discontinuities.
+	offset       int64
+	wrap         int64
+	lastDuration int64
+}
+
+func newTrack(timescale uint32, defaultDuration int64) *track {
+	return &track{
+		timescale:    timescale,
+		wrap:         (int64(1) << 33) * int64(timescale) / videoTimescale,
+		lastDuration: defaultDuration,
+	}
+}
+
+// timestamp normalizes a raw timestamp of the track's next sample.
+func (t *track) timestamp(raw int64) int64 {
+	v := raw + t.offset
+	if len(t.samples) == 0 {
+		return v
+	}
+	last := t.samples[len(t.samples)-1].dts
+	if delta := v - last; delta < -t.wrap/2 {
+		t.offset += t.wrap
+		v += t.wrap
+	}
+	if delta := v - last; delta <= 0 || delta > maxTimestampJumpSec*int64(t.timescale) {
+		adjust := last + t.lastDuration - v
+		t.offset += adjust
+		v += adjust
+	}
+	return v
+}
+
+func (t *track) add(s sample, offset uint64, sameChunk bool) {
+	if n := len(t.samples); n > 0 {
+		t.lastDuration = s.dts - t.samples[n-1].dts
+	}
+	t.samples = append(t.samples, s)
+	if sameChunk && len(t.chunks) > 0 {
+		t.chunks[len(t.chunks)-1].samples++
+		return
+	}
+	t.chunks = append(t.chunks, chunk{offset: offset, samples: 1})
+}
+
+// durations returns the duration of every sample; the last sample repeats the
+// previous duration.
+func (t *track) durations() []int64 {
+	out := make([]int64, len(t.samples))
+	for i := range t.samples {
+		if i+1 < len(t.samples) {
+			out[i] = t.samples[i+1].dts - t.samples[i].dts
+		} else {
+			out[i] = t.lastDuration
+		}
+	}
+	return out
+}
+
+type accessUnit struct {
+	pts, dts int64
+	data     []byte
+}
+
+type muxer struct {
+	spool   *bufio.Writer
+	written uint64
+	last    *track
+
+	video      *track
+	videoType  byte
+	vps        []byte
+	sps        []byte
+	pps        []byte
+	pendingAU  *accessUnit
+	audio      *track
+	audioBuf   []byte
+	audioBase  int64
+	audioCount int64
+}
+
+func (m *muxer) handlePES(pes pesPacket) error {
+	switch pes.streamType {
+	case streamTypeH264, streamTypeH265:
+		if m.videoType != 0 && m.videoType != pes.streamType {
+			return nil
+		}
+		m.videoType = pes.streamType
+		if !pes.hasPTS {
+			// An access unit split over several PES packets.
+			if m.pendingAU != nil {
+				m.pendingAU.data = append(m.pendingAU.data, pes.data...)
+			}
+			return nil
+		}
+		if err := m.commitVideo(); err != nil {
+			return err
+		}
+		m.pendingAU = &accessUnit{pts: pes.pts, dts: pes.dts, data: pes.data}
+	case streamTypeAAC:
+		return m.handleAudio(pes)
+	}
+	return nil
+}
+
+func (m *muxer) commitVideo() error {
+	au := m.pendingAU
+	m.pendingAU = nil
+	if au == nil {
+		return nil
+	}
+	hevc := m.videoType == streamTypeH265
+	payload := make([]byte, 0, len(au.data)+64)
+	sync := false
+	for _, nal := range splitAnnexB(au.data) {
+		if len(nal) == 0 {
+			continue
+		}
+		if hevc {
+			if len(nal) < 2 {
+				continue
+			}
+			switch nalType := nal[0] >> 1 & 0x3F; {
+			case nalType == 32:
+				m.vps = append(m.vps[:0], nal...)
+				continue
+			case nalType == 33:
+				m.sps = append(m.sps[:0], nal...)
+				continue
+			case nalType == 34:
+				m.pps = append(m.pps[:0], nal...)
+				continue
+			case nalType == 35:
+				continue
+			case nalType >= 16 && nalType <= 23:
+				sync = true
+			}
+		} else {
+			switch nal[0] & 0x1F {
+			case 7:
+				m.sps = append(m.sps[:0], nal...)
+				continue
+			case 8:
+				m.pps = append(m.pps[:0], nal...)
+				continue
+			case 9, 12:
+				continue
+			case 5:
+				sync = true
+			}
+		}
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(nal)))
+		payload = append(payload, nal...)
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	if m.video == nil {
+		// Frames before the first key frame cannot be decoded.
+		if !sync || len(m.sps) == 0 || len(m.pps) == 0 || (hevc && len(m.vps) == 0) {
+			return nil
+		}
+		var cfg videoConfig
+		var err error
+		if hevc {
+			cfg, err = h265Config(m.vps, m.sps, m.pps)
+		} else {
+			cfg, err = h264Config(m.sps, m.pps)
+		}
+		if err != nil {
+			return err
+		}
+		m.video = newTrack(videoTimescale, videoTimescale/30)
+		m.video.video = &cfg
+	}
+	cto := au.pts - au.dts
+	if cto < 0 || cto > maxTimestampJumpSec*videoTimescale {
+		cto = 0
+	}
+	dts := m.video.timestamp(au.dts)
+	return m.writeSample(m.video, sample{dts: dts, cto: cto, sync: sync}, payload)
+}
+
+func (m *muxer) handleAudio(pes pesPacket) error {
+	if pes.hasPTS && len(m.audioBuf) == 0 {
+		m.audioBase = pes.pts
+		m.audioCount = 0
+	}
+	m.audioBuf = append(m.audioBuf, pes.data...)
+	buf := m.audioBuf
+	for len(buf) > 0 {
+		cfg, headerLen, frameLen, ok := adtsHeader(buf)
+		if !ok {
+			buf = buf[1:] // resync on the next ADTS header
+			continue
+		}
+		if frameLen > len(buf) {
+			break
+		}
+		if m.audio == nil {
+			m.audio = newTrack(uint32(cfg.sampleRate), 1024)
+			m.audio.audio = &cfg
+		}
+		raw := m.audioBase*int64(m.audio.timescale)/videoTimescale + m.audioCount*1024
+		m.audioCount++
+		dts := m.audio.timestamp(raw)
+		if err := m.writeSample(m.audio, sample{dts: dts, sync: true}, buf[headerLen:frameLen]); err != nil {
+			return err
+		}
+		buf = buf[frameLen:]
+	}
+	m.audioBuf = append(m.audioBuf[:0], buf...)
+	return nil
+}
+
+func (m *muxer) writeSample(t *track, s sample, payload []byte) error {
+	s.size = uint32(len(payload))
+	t.add(s, m.written, m.last == t)
+	m.last = t
+	n, err := m.spool.Write(payload)
+	m.written += uint64(n)
+	if err != nil {
+		return fmt.Errorf("remux: write media data: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,292 @@
+package remux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type bitWriter struct {
+	data  []byte
+	nbits int
+}
+
+func (w *bitWriter) u(n int, v uint32) {
+	for i := n - 1; i >= 0; i-- {
+		if w.nbits%8 == 0 {
+			w.data = append(w.data, 0)
+		}
+		if v>>uint(i)&1 == 1 {
+			w.data[len(w.data)-1] |= 1 << (7 - uint(w.nbits%8))
+		}
+		w.nbits++
+	}
+}
+
+func (w *bitWriter) ue(v uint32) {
+	v++
+	n := 0
+	for x := v; x > 1; x >>= 1 {
+		n++
+	}
+	w.u(n, 0)
+	w.u(n+1, v)
+}
+
+// testSPS is a baseline H.264 SPS for 640x480.
+func testSPS() []byte {
+	w := &bitWriter{}
+	w.u(8, 0x67)
+	w.u(8, 66) // profile_idc
+	w.u(8, 0)
+	w.u(8, 30) // level_idc
+	w.ue(0)    // seq_parameter_set_id
+	w.ue(0)    // log2_max_frame_num_minus4
+	w.ue(0)    // pic_order_cnt_type
+	w.ue(0)    // log2_max_pic_order_cnt_lsb_minus4
+	w.ue(1)    // max_num_ref_frames
+	w.u(1, 0)  // gaps_in_frame_num_value_allowed_flag
+	w.ue(39)   // pic_width_in_mbs_minus1
+	w.ue(29)   // pic_height_in_map_units_minus1
+	w.u(1, 1)  // frame_mbs_only_flag
+	w.u(1, 1)  // direct_8x8_inference_flag
+	w.u(1, 0)  // frame_cropping_flag
+	w.u(1, 0)  // vui_parameters_present_flag
+	w.u(1, 1)  // rbsp_stop_one_bit
+	return w.data
+}
+
+func timestampBytes(marker byte, ts int64) []byte {
+	return []byte{
+		marker<<4 | byte(ts>>29&0x0E) | 1,
+		byte(ts >> 22),
+		byte(ts>>14) | 1,
+		byte(ts >> 7),
+		byte(ts<<1) | 1,
+	}
+}
+
+func pesBytes(streamID byte, pts, dts int64, payload []byte) []byte {
+	header := timestampBytes(2, pts)
+	flags := byte(0x80)
+	if dts != pts {
+		header = append(timestampBytes(3, pts), timestampBytes(1, dts)...)
+		flags = 0xC0
+	}
+	out := []byte{0, 0, 1, streamID, 0, 0, 0x80, flags, byte(len(header))}
+	out = append(out, header...)
+	return append(out, payload...)
+}
+
+// tsPackets splits a PES packet or PSI section into 188-byte packets,
+// padding the last one with adaptation field stuffing.
+func tsPackets(pid uint16, payload []byte, psi bool) []byte {
+	if psi {
+		payload = append([]byte{0}, payload...)
+	}
+	var out []byte
+	first := true
+	for len(payload) > 0 {
+		n := min(len(payload), 184)
+		packet := []byte{0x47, byte(pid >> 8 & 0x1F), byte(pid), 0x10}
+		if first {
+			packet[1] |= 0x40
+		}
+		if n < 184 {
+			packet[3] = 0x30
+			stuffing := 184 - n - 1
+			packet = append(packet, byte(stuffing))
+			if stuffing > 0 {
+				packet = append(packet, 0)
+				packet = append(packet, bytes.Repeat([]byte{0xFF}, stuffing-1)...)
+			}
+		}
+		packet = append(packet, payload[:n]...)
+		out = append(out, packet...)
+		payload = payload[n:]
+		first = false
+	}
+	return out
+}
+
+func psi(tableID byte, body []byte) []byte {
+	length := len(body) + 5 + 4
+	section := []byte{tableID, 0xB0 | byte(length>>8), byte(length), 0, 1, 0xC1, 0, 0}
+	section = append(section, body...)
+	return append(section, 0, 0, 0, 0) // CRC is not checked
+}
+
+func adtsFrame(payload []byte) []byte {
+	frameLen := 7 + len(payload)
+	// AAC LC, 48 kHz, stereo, no CRC.
+	header := []byte{0xFF, 0xF1, 0x4C, 0x80 | byte(frameLen>>11), byte(frameLen >> 3), byte(frameLen<<5) | 0x1F, 0xFC}
+	return append(header, payload...)
+}
+
+func buildTestTS() []byte {
+	var ts []byte
+	ts = append(ts, tsPackets(0, psi(0, []byte{0, 1, 0xE1, 0x00}), true)...)
+	ts = append(ts, tsPackets(0x100, psi(2, []byte{
+		0xE1, 0x01, 0xF0, 0x00,
+		streamTypeH264, 0xE1, 0x01, 0xF0, 0x00,
+		streamTypeAAC, 0xE1, 0x02, 0xF0, 0x00,
+	}), true)...)
+
+	startCode := []byte{0, 0, 0, 1}
+	pps := []byte{0x68, 0xCE, 0x38, 0x80}
+	base := int64(900000)
+	for i := 0; i < 4; i++ {
+		var au []byte
+		au = append(au, startCode...)
+		au = append(au, 0x09, 0xF0)
+		if i == 0 {
+			au = append(au, startCode...)
+			au = append(au, testSPS()...)
+			au = append(au, startCode...)
+			au = append(au, pps...)
+			au = append(au, startCode...)
+			au = append(au, 0x65)
+		} else {
+			au = append(au, startCode...)
+			au = append(au, 0x41)
+		}
+		au = append(au, bytes.Repeat([]byte{byte(i + 1)}, 300)...)
+		dts := base + int64(i)*3000
+		ts = append(ts, tsPackets(0x101, pesBytes(0xE0, dts+3000, dts, au), false)...)
+
+		var audio []byte
+		for j := 0; j < 2; j++ {
+			audio = append(audio, adtsFrame(bytes.Repeat([]byte{0xA0}, 20))...)
+		}
+		ts = append(ts, tsPackets(0x102, pesBytes(0xC0, base+int64(i)*3840, base+int64(i)*3840, audio), false)...)
+	}
+	return ts
+}
+
+type testBox struct {
+	typ     string
+	payload []byte
+}
+
+func readBoxes(t *testing.T, data []byte) []testBox {
+	t.Helper()
+	var boxes []testBox
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("truncated box header")
+		}
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			t.Fatalf("invalid box size %d for %q", size, data[4:8])
+		}
+		boxes = append(boxes, testBox{typ: string(data[4:8]), payload: data[8:size]})
+		data = data[size:]
+	}
+	return boxes
+}
+
+func findBox(t *testing.T, data []byte, path ...string) []byte {
+	t.Helper()
+	for _, typ := range path {
+		found := false
+		for _, b := range readBoxes(t, data) {
+			if b.typ == typ {
+				data, found = b.payload, true
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("box %q not found in %v", typ, path)
+		}
+	}
+	return data
+}
+
+func TestTSToMP4WritesFaststartFile(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "out.mp4")
+	if err := TSToMP4(bytes.NewReader(buildTestTS()), dst); err != nil {
+		t.Fatalf("TSToMP4: %v", err)
+	}
+	data, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dst + ".mdat"); !os.IsNotExist(err) {
+		t.Fatalf("spool file was not removed: %v", err)
+	}
+
+	top := readBoxes(t, data)
+	if len(top) != 3 || top[0].typ != "ftyp" || top[1].typ != "moov" || top[2].typ != "mdat" {
+		t.Fatalf("unexpected top-level boxes: %+v", top)
+	}
+	var traks [][]byte
+	for _, b := range readBoxes(t, top[1].payload) {
+		if b.typ == "trak" {
+			traks = append(traks, b.payload)
+		}
+	}
+	if len(traks) != 2 {
+		t.Fatalf("expected 2 tracks, got %d", len(traks))
+	}
+
+	mdatStart := len(data) - len(top[2].payload)
+	for i, want := range []struct {
+		handler string
+		samples uint32
+		size    uint32
+	}{
+		{"vide", 4, 4 + 301},
+		{"soun", 8, 20},
+	} {
+		trak := traks[i]
+		hdlr := findBox(t, trak, "mdia", "hdlr")
+		if got := string(hdlr[8:12]); got != want.handler {
+			t.Fatalf("track %d handler = %s, want %s", i, got, want.handler)
+		}
+		stsz := findBox(t, trak, "mdia", "minf", "stbl", "stsz")
+		if got := binary.BigEndian.Uint32(stsz[8:]); got != want.samples {
+			t.Fatalf("%s sample count = %d, want %d", want.handler, got, want.samples)
+		}
+		if got := binary.BigEndian.Uint32(stsz[12:]); got != want.size {
+			t.Fatalf("%s first sample size = %d, want %d", want.handler, got, want.size)
+		}
+		stco := findBox(t, trak, "mdia", "minf", "stbl", "stco")
+		offset := int(binary.BigEndian.Uint32(stco[8:]))
+		if offset < mdatStart || offset >= len(data) {
+			t.Fatalf("%s first chunk offset %d is outside mdat", want.handler, offset)
+		}
+		if i == 0 {
+			// Length-prefixed IDR slice without SPS, PPS or access unit delimiter.
+			if got := binary.BigEndian.Uint32(data[offset:]); got != 301 || data[offset+4] != 0x65 {
+				t.Fatalf("unexpected first video sample header % x", data[offset:offset+5])
+			}
+		} else if data[offset] != 0xA0 {
+			t.Fatalf("audio sample still carries the ADTS header: % x", data[offset:offset+4])
+		}
+	}
+
+	stsd := findBox(t, traks[0], "mdia", "minf", "stbl", "stsd")
+	entry := readBoxes(t, stsd[8:])[0]
+	if entry.typ != "avc1" {
+		t.Fatalf("video sample entry = %s, want avc1", entry.typ)
+	}
+	if w, h := binary.BigEndian.Uint16(entry.payload[24:]), binary.BigEndian.Uint16(entry.payload[26:]); w != 640 || h != 480 {
+		t.Fatalf("video size = %dx%d, want 640x480", w, h)
+	}
+	stss := findBox(t, traks[0], "mdia", "minf", "stbl", "stss")
+	if count := binary.BigEndian.Uint32(stss[4:]); count != 1 {
+		t.Fatalf("sync sample count = %d, want 1", count)
+	}
+}
+
+func TestTSToMP4RejectsInputWithoutStreams(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "out.mp4")
+	if err := TSToMP4(bytes.NewReader([]byte("not a transport stream")), dst); err != ErrNoStreams {
+		t.Fatalf("expected ErrNoStreams, got %v", err)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Fatalf("no output file expected: %v", err)
+	}
+}
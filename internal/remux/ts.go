@@ -0,0 +1,204 @@
+package remux
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+const tsPacketSize = 188
+
+const (
+	streamTypeAAC  = 0x0F
+	streamTypeH264 = 0x1B
+	streamTypeH265 = 0x24
+)
+
+// pesPacket is a reassembled PES packet. Timestamps are in 90 kHz units.
+type pesPacket struct {
+	streamType byte
+	pts, dts   int64
+	hasPTS     bool
+	data       []byte
+}
+
+// tsDemuxer reassembles the PES packets of the first program of an MPEG-TS
+// stream. Only the elementary streams remux understands are followed.
+type tsDemuxer struct {
+	r       *bufio.Reader
+	pmtPID  int
+	streams map[uint16]*pesBuffer
+	order   []uint16
+	onPES   func(pesPacket) error
+}
+
+type pesBuffer struct {
+	streamType byte
+	data       []byte
+	started    bool
+}
+
+func newTSDemuxer(r io.Reader, onPES func(pesPacket) error) *tsDemuxer {
+	return &tsDemuxer{
+		r:       bufio.NewReaderSize(r, 1<<20),
+		pmtPID:  -1,
+		streams: make(map[uint16]*pesBuffer),
+		onPES:   onPES,
+	}
+}
+
+func (d *tsDemuxer) run() error {
+	packet := make([]byte, tsPacketSize)
+	for {
+		if err := d.readPacket(packet); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				break
+			}
+			return err
+		}
+		if err := d.handlePacket(packet); err != nil {
+			return err
+		}
+	}
+	for _, pid := range d.order {
+		if err := d.flush(d.streams[pid]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readPacket reads the next packet, skipping garbage until a sync byte.
+func (d *tsDemuxer) readPacket(packet []byte) error {
+	for {
+		b, err := d.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b != 0x47 {
+			continue
+		}
+		packet[0] = b
+		_, err = io.ReadFull(d.r, packet[1:])
+		return err
+	}
+}
+
+func (d *tsDemuxer) handlePacket(packet []byte) error {
+	pid := uint16(packet[1]&0x1F)<<8 | uint16(packet[2])
+	unitStart := packet[1]&0x40 != 0
+	adaptation := packet[3] >> 4 & 3
+	start := 4
+	if adaptation&2 != 0 {
+		start = 5 + int(packet[4])
+	}
+	if adaptation&1 == 0 || start >= tsPacketSize {
+		return nil
+	}
+	payload := packet[start:]
+
+	switch {
+	case pid == 0:
+		if unitStart && d.pmtPID < 0 {
+			d.parsePAT(payload)
+		}
+	case int(pid) == d.pmtPID:
+		if unitStart && len(d.streams) == 0 {
+			d.parsePMT(payload)
+		}
+	default:
+		st, ok := d.streams[pid]
+		if !ok {
+			return nil
+		}
+		if unitStart {
+			if err := d.flush(st); err != nil {
+				return err
+			}
+			st.started = true
+		}
+		if st.started {
+			st.data = append(st.data, payload...)
+		}
+	}
+	return nil
+}
+
+func psiSection(payload []byte) []byte {
+	if len(payload) < 1 || 1+int(payload[0]) >= len(payload) {
+		return nil
+	}
+	section := payload[1+int(payload[0]):]
+	if len(section) < 3 {
+		return nil
+	}
+	length := int(section[1]&0x0F)<<8 | int(section[2])
+	if 3+length > len(section) || length < 4 {
+		return nil
+	}
+	return section[:3+length-4] // without CRC
+}
+
+func (d *tsDemuxer) parsePAT(payload []byte) {
+	section := psiSection(payload)
+	if len(section) < 8 || section[0] != 0 {
+		return
+	}
+	for i := 8; i+4 <= len(section); i += 4 {
+		program := uint16(section[i])<<8 | uint16(section[i+1])
+		if program == 0 {
+			continue
+		}
+		d.pmtPID = int(section[i+2]&0x1F)<<8 | int(section[i+3])
+		return
+	}
+}
+
+func (d *tsDemuxer) parsePMT(payload []byte) {
+	section := psiSection(payload)
+	if len(section) < 12 || section[0] != 2 {
+		return
+	}
+	infoLen := int(section[10]&0x0F)<<8 | int(section[11])
+	for i := 12 + infoLen; i+5 <= len(section); {
+		streamType := section[i]
+		pid := uint16(section[i+1]&0x1F)<<8 | uint16(section[i+2])
+		esInfoLen := int(section[i+3]&0x0F)<<8 | int(section[i+4])
+		switch streamType {
+		case streamTypeAAC, streamTypeH264, streamTypeH265:
+			if _, ok := d.streams[pid]; !ok {
+				d.streams[pid] = &pesBuffer{streamType: streamType}
+				d.order = append(d.order, pid)
+			}
+		}
+		i += 5 + esInfoLen
+	}
+}
+
+func (d *tsDemuxer) flush(st *pesBuffer) error {
+	data := st.data
+	st.data = st.data[:0]
+	if len(data) < 9 || data[0] != 0 || data[1] != 0 || data[2] != 1 {
+		return nil
+	}
+	headerLen := int(data[8])
+	if 9+headerLen > len(data) {
+		return nil
+	}
+	pes := pesPacket{streamType: st.streamType}
+	flags := data[7] >> 6
+	if flags&2 != 0 && headerLen >= 5 {
+		pes.pts = parseTimestamp(data[9:14])
+		pes.dts = pes.pts
+		pes.hasPTS = true
+		if flags == 3 && headerLen >= 10 {
+			pes.dts = parseTimestamp(data[14:19])
+		}
+	}
+	pes.data = append([]byte(nil), data[9+headerLen:]...)
+	return d.onPES(pes)
+}
+
+func parseTimestamp(b []byte) int64 {
+	return int64(b[0]>>1&7)<<30 | int64(b[1])<<22 | int64(b[2]>>1)<<15 | int64(b[3])<<7 | int64(b[4]>>1)
+}
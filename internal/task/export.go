@@ -0,0 +1,404 @@
+package task
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"hls-accelerator/internal/cache"
+	"hls-accelerator/internal/config"
+	playlist "hls-accelerator/internal/m3u8"
+	"hls-accelerator/internal/remux"
+
+	"github.com/grafov/m3u8"
+)
+
+// exportSegment is what the stored playlist says about one segment file.
+type exportSegment struct {
+	seq     uint64
+	key     *m3u8.Key
+	keyFile string
+	mapFile string
+}
+
+// StartExport merges a completed task into one file in the background and
+// returns the export state. A running export is returned as it is. A non-empty
+// format replaces the export format of the task.
+func (m *Manager) StartExport(taskID, format string) (*TaskExport, error) {
+	meta, err := m.GetTask(taskID)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Status != TaskStatusCompleted {
+		return nil, fmt.Errorf("task is %s, only completed tasks can be exported", meta.Status)
+	}
+	if format != "" && format != meta.ExportFormat {
+		if err := m.UpdateTaskExportFormat(taskID, format); err != nil {
+			return nil, err
+		}
+		meta.ExportFormat = format
+	}
+
+	m.exportMu.Lock()
+	if state, running := m.exports[taskID]; running {
+		current := *state
+		m.exportMu.Unlock()
+		return &current, nil
+	}
+	state := &TaskExport{Status: ExportStatusRunning, Format: exportFormat(*meta)}
+	m.exports[taskID] = state
+	m.exportMu.Unlock()
+
+	if err := m.UpdateTaskExport(taskID, ExportStatusRunning, meta.ExportPath, ""); err != nil {
+		m.exportMu.Lock()
+		delete(m.exports, taskID)
+		m.exportMu.Unlock()
+		return nil, err
+	}
+	go m.runExport(*meta, state)
+	return &TaskExport{Status: ExportStatusRunning, Format: state.Format}, nil
+}
+
+// exportOnComplete starts the automatic export of a task that just completed,
+// unless it was exported before.
+func (m *Manager) exportOnComplete(taskID string) {
+	meta, err := m.GetTask(taskID)
+	if err != nil || meta.ExportStatus != "" {
+		return
+	}
+	if _, err := m.StartExport(taskID, ""); err != nil {
+		log.Printf("start export failed task=%s err=%v", taskID, err)
+	}
+}
+
+func (m *Manager) runExport(meta TaskMetadata, state *TaskExport) {
+	path, err := m.exportTask(meta, func(done, total int, bytes int64) {
+		m.exportMu.Lock()
+		state.DoneSegments = done
+		state.TotalSegments = total
+		state.Bytes = bytes
+		if total > 0 {
+			state.Progress = float64(done) / float64(total)
+		}
+		m.exportMu.Unlock()
+	})
+	status, errMsg := ExportStatusCompleted, ""
+	if err != nil {
+		status, errMsg = ExportStatusFailed, err.Error()
+		log.Printf("export failed task=%s err=%v", meta.ID, err)
+	} else {
+		log.Printf("export completed task=%s path=%s", meta.ID, path)
+	}
+	if err := m.UpdateTaskExport(meta.ID, status, path, errMsg); err != nil {
+		log.Printf("save export state failed task=%s err=%v", meta.ID, err)
+	}
+	m.exportMu.Lock()
+	delete(m.exports, meta.ID)
+	m.exportMu.Unlock()
+}
+
+// exportSummary is the export state shown with a task: the live counters of a
+// running export, otherwise what the last export left in the database.
+func (m *Manager) exportSummary(meta TaskMetadata) *TaskExport {
+	m.exportMu.Lock()
+	state, running := m.exports[meta.ID]
+	if running {
+		current := *state
+		m.exportMu.Unlock()
+		return &current
+	}
+	m.exportMu.Unlock()
+
+	if meta.ExportStatus == "" {
+		return nil
+	}
+	summary := &TaskExport{Status: meta.ExportStatus, Format: exportFormat(meta), Path: meta.ExportPath, Error: meta.ExportError}
+	if meta.ExportStatus == ExportStatusCompleted {
+		summary.Progress = 1
+	}
+	return summary
+}
+
+// exportTask writes the segments of the main media playlist in manifest order
+// into one file, decrypting AES-128 segments with the downloaded keys. fMP4
+// tasks get their init sections written in front and an .mp4 extension;
+// MPEG-TS tasks exported as mp4 are remuxed once the segments are merged.
+// Audio and subtitle renditions are not part of the export.
+func (m *Manager) exportTask(meta TaskMetadata, progress func(done, total int, bytes int64)) (string, error) {
+	content, err := m.GetTaskProxiedContent(meta.ID)
+	if err != nil {
+		return "", err
+	}
+	pl, listType, err := playlist.Parse(strings.NewReader(content))
+	if err != nil {
+		return "", fmt.Errorf("parse task playlist: %w", err)
+	}
+	if listType != playlist.Variant {
+		return "", fmt.Errorf("task playlist is not a media playlist")
+	}
+	segments := exportSegments(pl.(*m3u8.MediaPlaylist))
+
+	manifest, err := m.LoadTaskManifest(meta.ID, meta.OriginalURL, meta.TotalSegments)
+	if err != nil {
+		return "", err
+	}
+	order := make([]string, 0, len(manifest.Items))
+	fmp4 := false
+	for _, item := range manifest.Items {
+		if normalizeManifestType(item.Type) != "segment" || item.Group != "" {
+			continue
+		}
+		seg, ok := segments[item.Filename]
+		if !ok {
+			return "", fmt.Errorf("segment %s is not in the task playlist", item.Filename)
+		}
+		if seg.mapFile != "" {
+			fmp4 = true
+		}
+		order = append(order, item.Filename)
+	}
+	if len(order) == 0 {
+		return "", fmt.Errorf("task has no segments to export")
+	}
+
+	remuxTS := !fmp4 && exportFormat(meta) == ExportFormatMP4
+	ext := ".ts"
+	if fmp4 || remuxTS {
+		ext = ".mp4"
+	}
+	outPath, err := exportPath(meta, ext)
+	if err != nil {
+		return "", err
+	}
+	tmpPath := outPath + ".part"
+	mergedPath := tmpPath
+	if remuxTS {
+		mergedPath = outPath + ".ts.part"
+	}
+	f, err := os.Create(mergedPath)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if f != nil {
+			_ = f.Close()
+			_ = os.Remove(mergedPath)
+		}
+	}()
+
+	w := bufio.NewWriterSize(f, 1<<20)
+	keys := make(map[string][]byte)
+	lastMap := ""
+	var written int64
+	for i, filename := range order {
+		seg := segments[filename]
+		if seg.mapFile != "" && seg.mapFile != lastMap {
+			data, err := os.ReadFile(cache.GetFilePath(meta.ID, seg.mapFile))
+			if err != nil {
+				return "", err
+			}
+			n, err := w.Write(data)
+			written += int64(n)
+			if err != nil {
+				return "", err
+			}
+			lastMap = seg.mapFile
+		}
+		data, err := os.ReadFile(cache.GetFilePath(meta.ID, filename))
+		if err != nil {
+			return "", err
+		}
+		if data, err = decryptExportSegment(meta.ID, seg, data, keys); err != nil {
+			return "", fmt.Errorf("segment %s: %w", filename, err)
+		}
+		n, err := w.Write(data)
+		written += int64(n)
+		if err != nil {
+			return "", err
+		}
+		progress(i+1, len(order), written)
+	}
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+	err = f.Close()
+	f = nil
+	if err != nil {
+		_ = os.Remove(mergedPath)
+		return "", err
+	}
+	if remuxTS {
+		err := remuxFile(mergedPath, tmpPath)
+		_ = os.Remove(mergedPath)
+		if err != nil {
+			_ = os.Remove(tmpPath)
+			return "", fmt.Errorf("remux to mp4: %w", err)
+		}
+	}
+	if err := os.Rename(tmpPath, outPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return "", err
+	}
+	return outPath, nil
+}
+
+func remuxFile(srcPath, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return remux.TSToMP4(src, dstPath)
+}
+
+// exportSegments maps segment filenames to their key, init section and media
+// sequence number. The parser only attaches EXT-X-KEY and EXT-X-MAP to the
+// segment right after the tag, so both are carried forward here.
+func exportSegments(p *m3u8.MediaPlaylist) map[string]exportSegment {
+	out := make(map[string]exportSegment, p.Count())
+	var key *m3u8.Key
+	keyFile, mapFile := "", ""
+	for _, seg := range p.Segments {
+		if seg == nil {
+			continue
+		}
+		if seg.Key != nil {
+			key, keyFile = seg.Key, ""
+			if filename, ok := playlist.ProxiedFilename(seg.Key.URI); ok {
+				keyFile = filename
+			}
+		}
+		if seg.Map != nil {
+			mapFile, _ = playlist.ProxiedFilename(seg.Map.URI)
+		}
+		filename, ok := playlist.ProxiedFilename(seg.URI)
+		if !ok {
+			continue
+		}
+		out[filename] = exportSegment{seq: seg.SeqId, key: key, keyFile: keyFile, mapFile: mapFile}
+	}
+	return out
+}
+
+func decryptExportSegment(taskID string, seg exportSegment, data []byte, keys map[string][]byte) ([]byte, error) {
+	if seg.key == nil || seg.key.Method == "" || strings.EqualFold(seg.key.Method, "NONE") {
+		return data, nil
+	}
+	if !strings.EqualFold(seg.key.Method, "AES-128") {
+		return nil, fmt.Errorf("unsupported encryption method %s", seg.key.Method)
+	}
+	if seg.keyFile == "" {
+		return nil, fmt.Errorf("key was not downloaded")
+	}
+	key, ok := keys[seg.keyFile]
+	if !ok {
+		var err error
+		if key, err = os.ReadFile(cache.GetFilePath(taskID, seg.keyFile)); err != nil {
+			return nil, err
+		}
+		keys[seg.keyFile] = key
+	}
+	iv, err := segmentIV(seg.key.IV, seg.seq)
+	if err != nil {
+		return nil, err
+	}
+	return decryptAES128(data, key, iv)
+}
+
+// segmentIV parses an explicit IV attribute, or derives the IV from the media
+// sequence number as RFC 8216 section 5.2 prescribes when there is none.
+func segmentIV(value string, seq uint64) ([]byte, error) {
+	iv := make([]byte, aes.BlockSize)
+	value = strings.TrimSpace(value)
+	if value == "" {
+		binary.BigEndian.PutUint64(iv[8:], seq)
+		return iv, nil
+	}
+	hexIV := strings.TrimPrefix(strings.TrimPrefix(value, "0x"), "0X")
+	if len(hexIV)%2 == 1 {
+		hexIV = "0" + hexIV
+	}
+	decoded, err := hex.DecodeString(hexIV)
+	if err != nil || len(decoded) > aes.BlockSize {
+		return nil, fmt.Errorf("invalid IV %q", value)
+	}
+	copy(iv[aes.BlockSize-len(decoded):], decoded)
+	return iv, nil
+}
+
+func decryptAES128(data, key, iv []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("encrypted size %d is not a multiple of the block size", len(data))
+	}
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(data, data)
+	padding := int(data[len(data)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, fmt.Errorf("invalid PKCS#7 padding")
+	}
+	for _, b := range data[len(data)-padding:] {
+		if int(b) != padding {
+			return nil, fmt.Errorf("invalid PKCS#7 padding")
+		}
+	}
+	return data[:len(data)-padding], nil
+}
+
+// exportFormat is the format the next export of a task produces.
+func exportFormat(meta TaskMetadata) string {
+	if meta.ExportFormat != "" {
+		return meta.ExportFormat
+	}
+	if format, ok := normalizeExportFormat(config.GlobalConfig.ExportFormat); ok && format != "" {
+		return format
+	}
+	return ExportFormatTS
+}
+
+// normalizeExportFormat accepts "ts", "mp4" and empty, in any case.
+func normalizeExportFormat(value string) (string, bool) {
+	switch format := strings.ToLower(strings.TrimSpace(value)); format {
+	case "", ExportFormatTS, ExportFormatMP4:
+		return format, true
+	}
+	return "", false
+}
+
+// exportPath picks the output file for a task: a new export overwrites the
+// previous one of the same task, otherwise a free "name(n)" is taken.
+func exportPath(meta TaskMetadata, ext string) (string, error) {
+	dir, err := filepath.Abs(strings.TrimSpace(config.GlobalConfig.ExportDir))
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	if meta.ExportPath != "" && filepath.Dir(meta.ExportPath) == dir && filepath.Ext(meta.ExportPath) == ext {
+		return meta.ExportPath, nil
+	}
+	baseName := sanitizeFileName(meta.Name)
+	if baseName == "" {
+		baseName = "Untitled Task"
+	}
+	for suffix := 0; ; suffix++ {
+		fileBase := baseName
+		if suffix > 0 {
+			fileBase = fmt.Sprintf("%s(%d)", baseName, suffix)
+		}
+		candidate := filepath.Join(dir, fileBase+ext)
+		if _, err := os.Stat(candidate); os.IsNotExist(err) {
+			return candidate, nil
+		}
+	}
+}
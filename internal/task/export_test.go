@@ -0,0 +1,283 @@
+package task
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"hls-accelerator/internal/cache"
+	"hls-accelerator/internal/config"
+	playlist "hls-accelerator/internal/m3u8"
+
+	"github.com/grafov/m3u8"
+)
+
+func encryptAES128(t *testing.T, plain, key, iv []byte) []byte {
+	t.Helper()
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("NewCipher: %v", err)
+	}
+	padding := aes.BlockSize - len(plain)%aes.BlockSize
+	data := append(append([]byte{}, plain...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+	return data
+}
+
+func TestExportTaskDecryptsAES128SegmentsInManifestOrder(t *testing.T) {
+	m := newTestManager(t)
+	oldCacheDir, oldExportDir := config.GlobalConfig.CacheDir, config.GlobalConfig.ExportDir
+	config.GlobalConfig.CacheDir = t.TempDir()
+	config.GlobalConfig.ExportDir = t.TempDir()
+	t.Cleanup(func() {
+		config.GlobalConfig.CacheDir = oldCacheDir
+		config.GlobalConfig.ExportDir = oldExportDir
+	})
+
+	const taskID = "task-export"
+	origin, _ := url.Parse("https://cdn.example.com/vod/index.m3u8")
+	pl, _, err := playlist.Parse(strings.NewReader(`#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-KEY:METHOD=AES-128,URI="k1.key"
+#EXTINF:4.0,
+a.ts
+#EXTINF:4.0,
+b.ts
+#EXT-X-KEY:METHOD=AES-128,URI="k2.key",IV=0x000102030405060708090a0b0c0d0e0f
+#EXTINF:4.0,
+c.ts
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:4.0,
+d.ts
+#EXT-X-ENDLIST
+`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	content, items, total := playlist.RewriteVariant(pl.(*m3u8.MediaPlaylist), "http://proxy/proxy", taskID, origin)
+
+	key1 := []byte("0123456789abcdef")
+	key2 := []byte("fedcba9876543210")
+	seqIV := func(seq byte) []byte {
+		iv := make([]byte, aes.BlockSize)
+		iv[aes.BlockSize-1] = seq
+		return iv
+	}
+	explicitIV := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	files := map[string][]byte{
+		"00001.ts": encryptAES128(t, []byte("segment-a|"), key1, seqIV(7)),
+		"00002.ts": encryptAES128(t, []byte("segment-b, one block and more|"), key1, seqIV(8)),
+		"00003.ts": encryptAES128(t, []byte("segment-c|"), key2, explicitIV),
+		"00004.ts": []byte("segment-d"),
+	}
+	for _, item := range items {
+		if item.Type == "key" {
+			if strings.HasSuffix(item.URL, "k1.key") {
+				files[item.Filename] = key1
+			} else {
+				files[item.Filename] = key2
+			}
+		}
+	}
+	if err := cache.EnsureTaskDir(taskID); err != nil {
+		t.Fatalf("EnsureTaskDir: %v", err)
+	}
+	for name, data := range files {
+		if err := os.WriteFile(cache.GetFilePath(taskID, name), data, 0644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	meta := TaskMetadata{
+		ID:             taskID,
+		Name:           "Movie: Part 1",
+		OriginalURL:    origin.String(),
+		TotalSegments:  total,
+		CreatedTime:    time.Now(),
+		UpdatedTime:    time.Now(),
+		Status:         TaskStatusCompleted,
+		ProxiedContent: content,
+	}
+	if err := m.CreateTask(meta); err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	if err := m.SaveTaskManifest(buildManifest(taskID, meta.OriginalURL, items, total)); err != nil {
+		t.Fatalf("SaveTaskManifest: %v", err)
+	}
+
+	var lastDone, lastTotal int
+	path, err := m.exportTask(meta, func(done, total int, _ int64) {
+		lastDone, lastTotal = done, total
+	})
+	if err != nil {
+		t.Fatalf("exportTask: %v", err)
+	}
+	if filepath.Base(path) != "Movie_ Part 1.ts" {
+		t.Fatalf("export path = %s, want a sanitized .ts name", path)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read export: %v", err)
+	}
+	if want := "segment-a|segment-b, one block and more|segment-c|segment-d"; string(got) != want {
+		t.Fatalf("export content = %q, want %q", got, want)
+	}
+	if lastDone != 4 || lastTotal != 4 {
+		t.Fatalf("progress = %d/%d, want 4/4", lastDone, lastTotal)
+	}
+}
+
+func TestExportTaskRemuxFailureLeavesNoFiles(t *testing.T) {
+	m := newTestManager(t)
+	oldCacheDir, oldExportDir := config.GlobalConfig.CacheDir, config.GlobalConfig.ExportDir
+	config.GlobalConfig.CacheDir = t.TempDir()
+	config.GlobalConfig.ExportDir = t.TempDir()
+	t.Cleanup(func() {
+		config.GlobalConfig.CacheDir = oldCacheDir
+		config.GlobalConfig.ExportDir = oldExportDir
+	})
+
+	const taskID = "task-export-mp4"
+	origin, _ := url.Parse("https://cdn.example.com/vod/index.m3u8")
+	pl, _, err := playlist.Parse(strings.NewReader("#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4.0,\na.ts\n#EXT-X-ENDLIST\n"))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	content, items, total := playlist.RewriteVariant(pl.(*m3u8.MediaPlaylist), "http://proxy/proxy", taskID, origin)
+	if err := cache.EnsureTaskDir(taskID); err != nil {
+		t.Fatalf("EnsureTaskDir: %v", err)
+	}
+	if err := os.WriteFile(cache.GetFilePath(taskID, "00001.ts"), []byte("not a transport stream"), 0644); err != nil {
+		t.Fatalf("write segment: %v", err)
+	}
+	meta := TaskMetadata{
+		ID:             taskID,
+		Name:           "Movie",
+		OriginalURL:    origin.String(),
+		TotalSegments:  total,
+		Status:         TaskStatusCompleted,
+		ProxiedContent: content,
+		ExportFormat:   ExportFormatMP4,
+	}
+	if err := m.CreateTask(meta); err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	if err := m.SaveTaskManifest(buildManifest(taskID, meta.OriginalURL, items, total)); err != nil {
+		t.Fatalf("SaveTaskManifest: %v", err)
+	}
+	stored, err := m.GetTask(taskID)
+	if err != nil || stored.ExportFormat != ExportFormatMP4 {
+		t.Fatalf("stored export format = %+v, %v", stored, err)
+	}
+
+	if _, err := m.exportTask(*stored, func(int, int, int64) {}); err == nil || !strings.Contains(err.Error(), "remux") {
+		t.Fatalf("expected a remux error, got %v", err)
+	}
+	entries, err := os.ReadDir(config.GlobalConfig.ExportDir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("export dir should be empty, found %s", entries[0].Name())
+	}
+}
+
+func TestExportTaskDerivesImplicitIVsFromTheOriginalSequenceAfterAdRemoval(t *testing.T) {
+	m := newTestManager(t)
+	oldCacheDir, oldExportDir := config.GlobalConfig.CacheDir, config.GlobalConfig.ExportDir
+	config.GlobalConfig.CacheDir = t.TempDir()
+	config.GlobalConfig.ExportDir = t.TempDir()
+	t.Cleanup(func() {
+		config.GlobalConfig.CacheDir = oldCacheDir
+		config.GlobalConfig.ExportDir = oldExportDir
+	})
+	t.Cleanup(func() { _ = playlist.SetAdRules(nil) })
+	if err := playlist.SetAdRules([]playlist.AdRule{{Name: "ads", Match: "cdn.example.com", URLRegex: "^ad/"}}); err != nil {
+		t.Fatalf("SetAdRules: %v", err)
+	}
+
+	const taskID = "task-export-ads"
+	origin, _ := url.Parse("https://cdn.example.com/vod/index.m3u8")
+	pl, _, err := playlist.Parse(strings.NewReader(`#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:10
+#EXT-X-KEY:METHOD=AES-128,URI="k.key"
+#EXTINF:4.0,
+a.ts
+#EXTINF:4.0,
+ad/1.ts
+#EXTINF:4.0,
+ad/2.ts
+#EXTINF:4.0,
+b.ts
+#EXTINF:4.0,
+c.ts
+#EXT-X-ENDLIST
+`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	content, items, total := playlist.RewriteVariant(pl.(*m3u8.MediaPlaylist), "http://proxy/proxy", taskID, origin)
+	if total != 3 {
+		t.Fatalf("total segments = %d, want the 2 ad segments removed", total)
+	}
+
+	key := []byte("0123456789abcdef")
+	seqIV := func(seq byte) []byte {
+		iv := make([]byte, aes.BlockSize)
+		iv[aes.BlockSize-1] = seq
+		return iv
+	}
+	files := map[string][]byte{
+		"00001.ts": encryptAES128(t, []byte("segment-a|"), key, seqIV(10)),
+		"00002.ts": encryptAES128(t, []byte("segment-b|"), key, seqIV(13)),
+		"00003.ts": encryptAES128(t, []byte("segment-c"), key, seqIV(14)),
+	}
+	for _, item := range items {
+		if item.Type == "key" {
+			files[item.Filename] = key
+		}
+	}
+	if err := cache.EnsureTaskDir(taskID); err != nil {
+		t.Fatalf("EnsureTaskDir: %v", err)
+	}
+	for name, data := range files {
+		if err := os.WriteFile(cache.GetFilePath(taskID, name), data, 0644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+	meta := TaskMetadata{
+		ID:             taskID,
+		Name:           "ads",
+		OriginalURL:    origin.String(),
+		TotalSegments:  total,
+		CreatedTime:    time.Now(),
+		UpdatedTime:    time.Now(),
+		Status:         TaskStatusCompleted,
+		ProxiedContent: content,
+	}
+	if err := m.CreateTask(meta); err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	if err := m.SaveTaskManifest(buildManifest(taskID, meta.OriginalURL, items, total)); err != nil {
+		t.Fatalf("SaveTaskManifest: %v", err)
+	}
+
+	path, err := m.exportTask(meta, func(int, int, int64) {})
+	if err != nil {
+		t.Fatalf("exportTask: %v", err)
+	}
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read export: %v", err)
+	}
+	if want := "segment-a|segment-b|segment-c"; string(got) != want {
+		t.Fatalf("export content = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,358 @@
+package task
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"hls-accelerator/internal/cache"
+	"hls-accelerator/internal/config"
+	playlist "hls-accelerator/internal/m3u8"
+
+	"github.com/grafov/m3u8"
+)
+
+const (
+	liveMinPollInterval   = time.Second
+	liveDefaultTarget     = 6 * time.Second
+	liveMaxPollFailures   = 10
+	liveStateFileName     = "live.json"
+	livePlaylistFetchTime = 30 * time.Second
+)
+
+var liveClient = &http.Client{
+	Timeout: livePlaylistFetchTime,
+	Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	},
+}
+
+type liveRecorder struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewLiveRecording builds the recorder state after the first window has been
+// rewritten; segments is the number of segment files that window produced.
+func NewLiveRecording(taskID, playlistURL, proxyBase string, window *m3u8.MediaPlaylist, segments, maxDurationSec int) LiveRecording {
+	now := time.Now()
+	rec := LiveRecording{
+		TaskID:         taskID,
+		PlaylistURL:    playlistURL,
+		ProxyBase:      proxyBase,
+		NextMediaSeq:   window.SeqNo + uint64(window.Count()),
+		NextIndex:      segments,
+		TargetDuration: window.TargetDuration,
+		StartedAt:      now,
+		LastPollAt:     now,
+	}
+	if maxDurationSec <= 0 {
+		maxDurationSec = config.GlobalConfig.LiveMaxDurationSec
+	}
+	if maxDurationSec > 0 {
+		deadline := now.Add(time.Duration(maxDurationSec) * time.Second)
+		rec.Deadline = &deadline
+	}
+	return rec
+}
+
+// pollInterval follows RFC 8216 section 6.3.4: reload after one target duration,
+// or after half of it when the previous reload brought nothing new.
+func (rec *LiveRecording) pollInterval(changed bool) time.Duration {
+	wait := time.Duration(rec.TargetDuration * float64(time.Second))
+	if wait <= 0 {
+		wait = liveDefaultTarget
+	}
+	if !changed {
+		wait /= 2
+	}
+	if wait < liveMinPollInterval {
+		wait = liveMinPollInterval
+	}
+	return wait
+}
+
+// StopRecording ends a live recording by hand. Segments already in the manifest
+// keep downloading; the stored playlist is closed with EXT-X-ENDLIST.
+func (m *Manager) StopRecording(taskID string) (*LiveRecording, error) {
+	meta, err := m.GetTask(taskID)
+	if err != nil {
+		return nil, err
+	}
+	if !meta.Live {
+		return nil, fmt.Errorf("task is not a live recording")
+	}
+	m.stopRecorder(taskID)
+	rec, err := readLiveRecording(taskID)
+	if err != nil {
+		return nil, err
+	}
+	if rec == nil {
+		return nil, fmt.Errorf("live recording state not found")
+	}
+	if rec.Stopped {
+		return rec, nil
+	}
+	if err := m.finishRecording(taskID, rec, LiveStopManual); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// startRecording runs the reload loop of a live task unless one is running.
+func (m *Manager) startRecording(taskID string, initialWait time.Duration) {
+	m.recordMu.Lock()
+	if _, running := m.recorders[taskID]; running {
+		m.recordMu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	recorder := &liveRecorder{cancel: cancel, done: make(chan struct{})}
+	m.recorders[taskID] = recorder
+	m.recordMu.Unlock()
+
+	go func() {
+		defer func() {
+			m.recordMu.Lock()
+			if m.recorders[taskID] == recorder {
+				delete(m.recorders, taskID)
+			}
+			m.recordMu.Unlock()
+			close(recorder.done)
+		}()
+		m.recordLive(ctx, taskID, initialWait)
+	}()
+}
+
+// stopRecorder cancels the reload loop of a task and waits until it has exited,
+// so the caller is the only writer of live.json afterwards.
+func (m *Manager) stopRecorder(taskID string) {
+	m.recordMu.Lock()
+	recorder, ok := m.recorders[taskID]
+	m.recordMu.Unlock()
+	if !ok {
+		return
+	}
+	recorder.cancel()
+	<-recorder.done
+}
+
+func (m *Manager) recordLive(ctx context.Context, taskID string, wait time.Duration) {
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		var done bool
+		wait, done = m.pollLive(ctx, taskID)
+		if done {
+			return
+		}
+	}
+}
+
+// pollLive reloads the live playlist once and returns the wait before the next
+// reload, or done once the recording has stopped.
+func (m *Manager) pollLive(ctx context.Context, taskID string) (time.Duration, bool) {
+	rec, err := readLiveRecording(taskID)
+	if err != nil || rec == nil {
+		log.Printf("live recording state unavailable task=%s: %v", taskID, err)
+		return 0, true
+	}
+	if rec.Stopped {
+		return 0, true
+	}
+	now := time.Now()
+	if rec.Deadline != nil && !now.Before(*rec.Deadline) {
+		if err := m.finishRecording(taskID, rec, LiveStopMaxDuration); err != nil {
+			log.Printf("finish live recording failed task=%s: %v", taskID, err)
+		}
+		return 0, true
+	}
+
+	window, err := fetchLiveWindow(ctx, rec.PlaylistURL, m.TaskRequestHeaders(taskID))
+	added := 0
+	if err == nil {
+		added, err = m.appendLiveWindow(taskID, rec, window)
+	}
+	if ctx.Err() != nil {
+		return 0, true
+	}
+	if err != nil {
+		rec.PollFailures++
+		log.Printf("live reload failed task=%s failures=%d: %v", taskID, rec.PollFailures, err)
+		if rec.PollFailures >= liveMaxPollFailures {
+			if err := m.finishRecording(taskID, rec, LiveStopUnavailable); err != nil {
+				log.Printf("finish live recording failed task=%s: %v", taskID, err)
+			}
+			return 0, true
+		}
+		if err := writeJSONAtomic(liveStatePath(taskID), rec); err != nil {
+			log.Printf("write live state failed task=%s: %v", taskID, err)
+		}
+		return rec.pollInterval(false), false
+	}
+
+	rec.PollFailures = 0
+	rec.LastPollAt = now
+	if window.Closed {
+		if err := m.finishRecording(taskID, rec, LiveStopEndList); err != nil {
+			log.Printf("finish live recording failed task=%s: %v", taskID, err)
+		}
+		return 0, true
+	}
+	if err := writeJSONAtomic(liveStatePath(taskID), rec); err != nil {
+		log.Printf("write live state failed task=%s: %v", taskID, err)
+	}
+	return rec.pollInterval(added > 0), false
+}
+
+// appendLiveWindow takes the segments of window that were not recorded yet into
+// the manifest, the running runtime and the stored playlist, and advances rec.
+func (m *Manager) appendLiveWindow(taskID string, rec *LiveRecording, window *m3u8.MediaPlaylist) (int, error) {
+	if window.TargetDuration > 0 {
+		rec.TargetDuration = window.TargetDuration
+	}
+	first := window.SeqNo
+	end := first + uint64(window.Count())
+	if end <= rec.NextMediaSeq {
+		return 0, nil
+	}
+	if first > rec.NextMediaSeq {
+		log.Printf("live window moved past unrecorded segments task=%s missed=%d", taskID, first-rec.NextMediaSeq)
+	}
+	origin, err := url.Parse(rec.PlaylistURL)
+	if err != nil {
+		return 0, err
+	}
+	skip := 0
+	if rec.NextMediaSeq > first {
+		skip = int(rec.NextMediaSeq - first)
+	}
+	playlist.SkipSegments(window, origin, skip)
+	_, items, segments, adRanges := playlist.RewriteVariantWithAds(window, rec.ProxyBase, taskID, origin, rec.NextIndex, !rec.NoAdFilter)
+
+	// Load the runtime before the manifest grows so it is not built from the new
+	// manifest rows and then extended with them a second time.
+	rt, err := m.loadRuntime(taskID)
+	if err != nil {
+		return 0, err
+	}
+	added, err := m.AppendTaskManifestItems(taskID, buildManifest(taskID, rec.PlaylistURL, items, segments).Items)
+	if err != nil {
+		return 0, err
+	}
+	totalItems, totalSegments := rt.appendItems(added)
+	if err := m.UpdateTaskTotals(taskID, totalItems, totalSegments); err != nil {
+		return 0, err
+	}
+	if err := m.saveLivePlaylist(taskID, window, false); err != nil {
+		return 0, err
+	}
+	if err := m.AppendTaskAdRanges(taskID, adRanges); err != nil {
+		return 0, err
+	}
+	rec.NextMediaSeq = end
+	rec.NextIndex += segments
+	if len(added) > 0 && !m.hasDispatch(taskID) {
+		m.StartDispatch(taskID)
+	}
+	return segments, nil
+}
+
+// finishRecording marks the recording stopped, closes the stored playlist and
+// lets the runtime complete once the remaining items are downloaded.
+func (m *Manager) finishRecording(taskID string, rec *LiveRecording, reason string) error {
+	now := time.Now()
+	rec.Stopped = true
+	rec.StopReason = reason
+	rec.StoppedAt = &now
+	if err := m.saveLivePlaylist(taskID, nil, true); err != nil {
+		return err
+	}
+	if err := writeJSONAtomic(liveStatePath(taskID), rec); err != nil {
+		return err
+	}
+	log.Printf("live recording stopped task=%s reason=%s", taskID, reason)
+	rt, err := m.loadRuntime(taskID)
+	if err != nil {
+		return err
+	}
+	rt.stopRecording()
+	return m.flushRuntime(taskID, rt)
+}
+
+func (m *Manager) saveLivePlaylist(taskID string, window *m3u8.MediaPlaylist, final bool) error {
+	meta, err := m.GetTask(taskID)
+	if err != nil {
+		return err
+	}
+	recorded, err := m.GetTaskProxiedContent(taskID)
+	if err != nil {
+		return err
+	}
+	content, err := playlist.AppendSegments(recorded, window, final)
+	if err != nil {
+		return err
+	}
+	if err := m.UpdateTaskProxiedContent(taskID, content); err != nil {
+		return err
+	}
+	return m.UpdateTaskM3U8File(meta.M3U8FilePath, content)
+}
+
+func fetchLiveWindow(ctx context.Context, playlistURL string, headers map[string]string) (*m3u8.MediaPlaylist, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, playlistURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := liveClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("bad status code: %d", resp.StatusCode)
+	}
+	pl, listType, err := playlist.Parse(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if listType != playlist.Variant {
+		return nil, fmt.Errorf("live playlist is not a media playlist")
+	}
+	return pl.(*m3u8.MediaPlaylist), nil
+}
+
+func liveStatePath(taskID string) string {
+	return filepath.Join(cache.GetTaskDir(taskID), liveStateFileName)
+}
+
+// readLiveRecording returns nil without error when the task has no live.json.
+func readLiveRecording(taskID string) (*LiveRecording, error) {
+	data, err := os.ReadFile(liveStatePath(taskID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec LiveRecording
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
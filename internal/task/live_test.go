@@ -0,0 +1,237 @@
+package task
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"hls-accelerator/internal/config"
+	"hls-accelerator/internal/downloader"
+	playlist "hls-accelerator/internal/m3u8"
+)
+
+func newLiveTestManager(t *testing.T) *Manager {
+	t.Helper()
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("open sqlite: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	// Every connection to :memory: is a database of its own.
+	db.SetMaxOpenConns(1)
+
+	oldCacheDir := config.GlobalConfig.CacheDir
+	config.GlobalConfig.CacheDir = t.TempDir()
+	t.Cleanup(func() {
+		config.GlobalConfig.CacheDir = oldCacheDir
+	})
+
+	var gidMu sync.Mutex
+	gidSeq := 0
+	aria2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		var req downloader.JsonRpcRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+			return
+		}
+		resp := downloader.JsonRpcResponse{ID: req.ID}
+		switch req.Method {
+		case "system.multicall":
+			calls := req.Params[0].([]interface{})
+			results := make([]interface{}, 0, len(calls))
+			gidMu.Lock()
+			for range calls {
+				gidSeq++
+				results = append(results, []interface{}{fmt.Sprintf("gid-%d", gidSeq)})
+			}
+			gidMu.Unlock()
+			resp.Result = results
+		default:
+			t.Errorf("unexpected method %s", req.Method)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(aria2.Close)
+
+	m := &Manager{
+		downloader: &downloader.Aria2Client{
+			RPCUrl: aria2.URL,
+			Client: &http.Client{Timeout: time.Second},
+		},
+		db:         db,
+		deleteSem:  make(chan struct{}, 1),
+		runtimes:   make(map[string]*taskRuntime),
+		dispatches: make(map[string]context.CancelFunc),
+		recorders:  make(map[string]*liveRecorder),
+		creations:  make(map[string]*taskCreation),
+	}
+	if err := m.InitTable(); err != nil {
+		t.Fatalf("InitTable: %v", err)
+	}
+	// Let background dispatches and task creations finish before the cache dir
+	// is restored.
+	busy := func() bool {
+		m.creationMu.Lock()
+		creating := len(m.creations)
+		m.creationMu.Unlock()
+		return creating > 0 || m.RuntimeMetrics().ActiveDispatches > 0
+	}
+	t.Cleanup(func() {
+		deadline := time.Now().Add(2 * time.Second)
+		for busy() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+	return m
+}
+
+func TestPollLiveAppendsNewSegmentsUntilEndList(t *testing.T) {
+	m := newLiveTestManager(t)
+
+	var windowMu sync.Mutex
+	window := `#EXTM3U
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:100
+#EXTINF:2.0,
+s100.ts
+#EXTINF:2.0,
+s101.ts
+`
+	// The origin only answers requests that carry the task's Referer.
+	taskHeaders := map[string]string{"referer": "https://site.example/"}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Referer") != "https://site.example/" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		windowMu.Lock()
+		defer windowMu.Unlock()
+		_, _ = w.Write([]byte(window))
+	}))
+	defer origin.Close()
+	setWindow := func(content string) {
+		windowMu.Lock()
+		window = content
+		windowMu.Unlock()
+	}
+
+	const taskID = "live-task"
+	playlistURL := origin.URL + "/ch/index.m3u8"
+	base, _ := url.Parse(playlistURL)
+	first, err := fetchLiveWindow(context.Background(), playlistURL, RequestHeaders(taskHeaders))
+	if err != nil {
+		t.Fatalf("fetchLiveWindow: %v", err)
+	}
+	_, items, total := playlist.RewriteVariant(first, "http://proxy/proxy", taskID, base)
+	content, err := playlist.AppendSegments("", first, false)
+	if err != nil {
+		t.Fatalf("AppendSegments: %v", err)
+	}
+	rec := NewLiveRecording(taskID, playlistURL, "http://proxy/proxy", first, total, 0)
+	created, err := m.CreateLiveTaskWithItems(TaskMetadata{
+		ID:             taskID,
+		Name:           taskID,
+		OriginalURL:    playlistURL,
+		TotalSegments:  total,
+		CreatedTime:    time.Now(),
+		UpdatedTime:    time.Now(),
+		ProxiedContent: content,
+		Headers:        taskHeaders,
+	}, items, rec)
+	if err != nil || !created {
+		t.Fatalf("CreateLiveTaskWithItems created=%v err=%v", created, err)
+	}
+	// Drive the reloads by hand instead of through the timer loop.
+	m.stopRecorder(taskID)
+
+	// Every known item finishing must not complete a task that is still recording.
+	for _, name := range []string{"00001.ts", "00002.ts"} {
+		m.markCompletedByFilename(taskID, name)
+	}
+	rt, err := m.loadRuntime(taskID)
+	if err != nil {
+		t.Fatalf("loadRuntime: %v", err)
+	}
+	if _, snapshot := rt.snapshot(); snapshot.Status != TaskStatusDownloading {
+		t.Fatalf("status while recording = %q, want %q", snapshot.Status, TaskStatusDownloading)
+	}
+
+	setWindow(`#EXTM3U
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:101
+#EXTINF:2.0,
+s101.ts
+#EXTINF:2.0,
+s102.ts
+#EXTINF:2.0,
+s103.ts
+`)
+	if wait, done := m.pollLive(context.Background(), taskID); done || wait != 2*time.Second {
+		t.Fatalf("pollLive = (%v, %v), want (2s, false)", wait, done)
+	}
+	manifest, err := m.LoadTaskManifest(taskID, playlistURL, 0)
+	if err != nil {
+		t.Fatalf("LoadTaskManifest: %v", err)
+	}
+	var names []string
+	for _, item := range manifest.Items {
+		names = append(names, item.Filename)
+	}
+	if got := strings.Join(names, ","); got != "00001.ts,00002.ts,00003.ts,00004.ts" {
+		t.Fatalf("manifest = %s, want the two new segments appended once", got)
+	}
+	meta, err := m.GetTask(taskID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if meta.TotalSegments != 4 || meta.TotalItems != 4 || !meta.Live {
+		t.Fatalf("task totals = %d/%d live=%v, want 4/4 live", meta.TotalSegments, meta.TotalItems, meta.Live)
+	}
+
+	setWindow(`#EXTM3U
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:103
+#EXTINF:2.0,
+s103.ts
+#EXTINF:1.5,
+s104.ts
+#EXT-X-ENDLIST
+`)
+	if _, done := m.pollLive(context.Background(), taskID); !done {
+		t.Fatal("pollLive should stop at EXT-X-ENDLIST")
+	}
+	stored, err := readLiveRecording(taskID)
+	if err != nil || stored == nil {
+		t.Fatalf("readLiveRecording: %v", err)
+	}
+	if !stored.Stopped || stored.StopReason != LiveStopEndList || stored.NextMediaSeq != 105 {
+		t.Fatalf("recording state = %+v, want stopped by endlist at seq 105", stored)
+	}
+	final, err := m.GetTaskProxiedContent(taskID)
+	if err != nil {
+		t.Fatalf("GetTaskProxiedContent: %v", err)
+	}
+	if !strings.HasSuffix(final, "#EXT-X-ENDLIST\n") || strings.Count(final, "#EXTINF") != 5 {
+		t.Fatalf("final playlist should hold 5 segments and ENDLIST:\n%s", final)
+	}
+
+	for _, name := range []string{"00003.ts", "00004.ts", "00005.ts"} {
+		m.markCompletedByFilename(taskID, name)
+	}
+	rt, err = m.loadRuntime(taskID)
+	if err != nil {
+		t.Fatalf("loadRuntime: %v", err)
+	}
+	if _, snapshot := rt.snapshot(); snapshot.Status != TaskStatusCompleted {
+		t.Fatalf("status after recording stopped = %q, want %q", snapshot.Status, TaskStatusCompleted)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hls-accelerator/internal/cache"
 	"hls-accelerator/internal/config"
@@ -23,6 +24,12 @@ import (
 
 const pausedRuntimeTTL = 10 * time.Minute
 
+const recoveryRetryInterval = 5 * time.Second
+
+// downloaderRetryDelay is how long items wait when they could not be handed to
+// the downloader because it was unreachable; it is not a failed attempt.
+const downloaderRetryDelay = 5 * time.Second
+
 const (
 	dirtyFlushTick           = 500 * time.Millisecond
 	downloadingFlushInterval = 2 * time.Second
@@ -32,7 +39,7 @@ const (
 
 type Manager struct {
 	mu               sync.Mutex
-	aria2            *downloader.Aria2Client
+	downloader       downloader.Downloader
 	db               *sql.DB
 	deleteSem        chan struct{}
 	progressNotifyCh chan aria2NotificationEvent
@@ -43,15 +50,40 @@ type Manager struct {
 	dispatchMu sync.Mutex
 	dispatches map[string]context.CancelFunc
 
+	recordMu  sync.Mutex
+	recorders map[string]*liveRecorder
+
+	exportMu sync.Mutex
+	exports  map[string]*TaskExport
+
+	creationMu sync.Mutex
+	creations  map[string]*taskCreation
+
 	metricsMu       sync.Mutex
 	lastFlushCost   time.Duration
 	totalFlushCost  time.Duration
 	totalFlushCount int64
 }
 
+// taskCreation is a task whose playlist is being fetched and parsed after
+// HandleAdd returned; cancel aborts it.
+type taskCreation struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+var errTaskExists = errors.New("task already exists")
+
+// errDownloaderUnavailable wraps failures to reach the downloader, which are
+// worth waiting out, unlike errors of the task itself.
+var errDownloaderUnavailable = errors.New("downloader unavailable")
+
 type aria2NotificationEvent struct {
 	Method string
 	GID    string
+	// SessionChanged marks a resync after aria2 restarted: bound GIDs starting
+	// with GID that its new session does not hold are lost.
+	SessionChanged bool
 }
 
 type taskRuntime struct {
@@ -62,34 +94,59 @@ type taskRuntime struct {
 	segmentBySeq      []bool
 	remaining         map[string]uint32
 	failed            map[string]struct{}
+	failures          map[string]ItemFailure
+	retryAt           map[string]time.Time
+	retry             retryPolicy
 	dispatching       map[string]struct{}
 	gidToFile         map[string]string
 	fileToGID         map[string]string
 	remainingSegments int
 	paused            bool
+	recording         bool
 	dirty             bool
 	dirtySince        time.Time
 	lastAccessAt      time.Time
 }
 
-func NewManager(aria2 *downloader.Aria2Client, db *sql.DB) (*Manager, error) {
+func NewManager(dl downloader.Downloader, db *sql.DB) (*Manager, error) {
 	m := &Manager{
-		aria2:            aria2,
+		downloader:       dl,
 		db:               db,
 		deleteSem:        make(chan struct{}, 1),
 		progressNotifyCh: make(chan aria2NotificationEvent, 4096),
 		runtimes:         make(map[string]*taskRuntime),
 		dispatches:       make(map[string]context.CancelFunc),
+		recorders:        make(map[string]*liveRecorder),
+		exports:          make(map[string]*TaskExport),
+		creations:        make(map[string]*taskCreation),
 	}
 	if err := m.InitTable(); err != nil {
 		return nil, err
 	}
+	if err := m.failInterruptedCreations(); err != nil {
+		return nil, err
+	}
+	// Snapshot interrupted tasks before any new task can be created by this process.
+	interrupted, err := m.GetTasksByStatuses(TaskStatusDownloading)
+	if err != nil {
+		return nil, err
+	}
+	recording, err := m.GetTasksByStatuses(TaskStatusDownloading, TaskStatusPaused)
+	if err != nil {
+		return nil, err
+	}
 	m.startBackgroundLoops()
+	go m.recoverInterruptedTasks(taskIDsOf(interrupted))
+	for _, meta := range recording {
+		if meta.Live {
+			m.startRecording(meta.ID, 0)
+		}
+	}
 	return m, nil
 }
 
 func (m *Manager) startBackgroundLoops() {
-	// Consume aria2 event notifications and fold them into in-memory runtime state.
+	// Consume downloader event notifications and fold them into in-memory runtime state.
 	go m.progressNotificationLoop()
 	// Drain buffered notifications in small batches to avoid per-event overhead.
 	go m.progressNotificationWorker()
@@ -97,6 +154,8 @@ func (m *Manager) startBackgroundLoops() {
 	go m.flushDirtyLoop()
 	// Periodically reconcile filesystem / aria2 state as a compensation path.
 	go m.reconcileLoop()
+	// Re-dispatch items whose automatic retry backoff has elapsed.
+	go m.retryLoop()
 	// Evict inactive runtimes so long-lived processes do not accumulate stale memory.
 	go m.cleanupRuntimeLoop()
 	// Run a low-frequency global purge as a final safety net for leftover aria2 results.
@@ -104,7 +163,26 @@ func (m *Manager) startBackgroundLoops() {
 }
 
 func (m *Manager) CreateTaskWithItems(meta TaskMetadata, items []playlist.DownloadItem) (bool, error) {
-	if len(items) == 0 {
+	return m.createTask(meta, items, nil, nil)
+}
+
+// CreateRenditionTaskWithItems creates a task that downloads a variant together
+// with its audio and subtitle renditions. playlists maps file names in the task
+// directory to their content: the rendition media playlists and the master
+// playlist (MasterPlaylistFileName) that ties them to the video playlist.
+func (m *Manager) CreateRenditionTaskWithItems(meta TaskMetadata, items []playlist.DownloadItem, playlists map[string]string) (bool, error) {
+	return m.createTask(meta, items, nil, playlists)
+}
+
+// CreateLiveTaskWithItems creates a task from the first window of a live playlist
+// and keeps recording it until one of the stop conditions in rec is reached.
+func (m *Manager) CreateLiveTaskWithItems(meta TaskMetadata, items []playlist.DownloadItem, rec LiveRecording) (bool, error) {
+	meta.Live = true
+	return m.createTask(meta, items, &rec, nil)
+}
+
+func (m *Manager) createTask(meta TaskMetadata, items []playlist.DownloadItem, rec *LiveRecording, playlists map[string]string) (bool, error) {
+	if len(items) == 0 && rec == nil {
 		return false, fmt.Errorf("no items to download")
 	}
 	manifest := buildManifest(meta.ID, meta.OriginalURL, items, meta.TotalSegments)
@@ -115,7 +193,7 @@ func (m *Manager) CreateTaskWithItems(meta TaskMetadata, items []playlist.Downlo
 	meta.FailedItems = 0
 	meta.Status = TaskStatusDownloading
 
-	created, err := m.TryCreateTask(meta)
+	created, err := m.storeTask(meta)
 	if err != nil || !created {
 		return created, err
 	}
@@ -128,13 +206,127 @@ func (m *Manager) CreateTaskWithItems(meta TaskMetadata, items []playlist.Downlo
 		_ = m.DeleteTaskDB(meta.ID)
 		return false, err
 	}
+	for name, content := range playlists {
+		if err := m.SaveTaskPlaylist(meta.ID, name, content); err != nil {
+			_ = m.DeleteTaskDB(meta.ID)
+			return false, err
+		}
+	}
+	// live.json must exist before the runtime is loaded, otherwise an empty first
+	// window would complete the task immediately.
+	if rec != nil {
+		if err := writeJSONAtomic(liveStatePath(meta.ID), rec); err != nil {
+			_ = m.DeleteTaskDB(meta.ID)
+			return false, err
+		}
+	}
 	if _, err := m.loadRuntime(meta.ID); err != nil {
 		return false, err
 	}
 	m.StartDispatch(meta.ID)
+	if rec != nil {
+		m.startRecording(meta.ID, rec.pollInterval(true))
+	}
 	return true, nil
 }
 
+// storeTask inserts the task row, or takes over the placeholder row of a
+// creation started by HandleAdd unless that creation was cancelled.
+func (m *Manager) storeTask(meta TaskMetadata) (bool, error) {
+	m.creationMu.Lock()
+	defer m.creationMu.Unlock()
+	creation, ok := m.creations[meta.ID]
+	if !ok {
+		return m.TryCreateTask(meta)
+	}
+	if err := creation.ctx.Err(); err != nil {
+		return false, err
+	}
+	return m.replaceTaskPlaceholder(meta)
+}
+
+// beginCreation inserts the pending row of a submitted task so it is listed
+// while its playlist is parsed; the returned context is cancelled when the
+// task is deleted before it was created.
+func (m *Manager) beginCreation(meta TaskMetadata) (context.Context, error) {
+	m.creationMu.Lock()
+	defer m.creationMu.Unlock()
+	if _, ok := m.creations[meta.ID]; ok {
+		return nil, errTaskExists
+	}
+	created, err := m.TryCreateTask(meta)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		return nil, errTaskExists
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.creations[meta.ID] = &taskCreation{ctx: ctx, cancel: cancel}
+	return ctx, nil
+}
+
+// runCreation runs triggerFunc for a submitted task and records why it failed
+// on the task; a cancelled creation leaves nothing behind.
+func (m *Manager) runCreation(ctx context.Context, req AddTaskRequest, triggerFunc func(context.Context, AddTaskRequest) error) {
+	taskID := req.TaskID
+	defer func() {
+		m.creationMu.Lock()
+		if creation, ok := m.creations[taskID]; ok {
+			creation.cancel()
+			delete(m.creations, taskID)
+		}
+		m.creationMu.Unlock()
+	}()
+
+	if err := m.UpdateTaskStatus(taskID, TaskStatusParsing); err != nil {
+		log.Printf("mark task parsing failed task=%s err=%v", taskID, err)
+	}
+	err := triggerFunc(ctx, req)
+	if ctx.Err() != nil {
+		log.Printf("task creation cancelled task=%s url=%s", taskID, req.URL)
+		// Nothing reached aria2, only the task directory may have been written.
+		_ = os.RemoveAll(cache.GetTaskDir(taskID))
+		return
+	}
+	if err != nil {
+		log.Printf("start task failed task=%s url=%s err=%v", taskID, req.URL, err)
+		if err := m.FailTaskCreation(taskID, err.Error()); err != nil {
+			log.Printf("store task creation error failed task=%s err=%v", taskID, err)
+		}
+	}
+}
+
+// cancelCreation aborts the creation of a task that is still pending or
+// parsing and removes its row. It reports false when no creation is running or
+// the task was created in the meantime.
+func (m *Manager) cancelCreation(taskID string) (bool, error) {
+	m.creationMu.Lock()
+	defer m.creationMu.Unlock()
+	creation, ok := m.creations[taskID]
+	if !ok {
+		return false, nil
+	}
+	deleted, err := m.deleteTaskPlaceholder(taskID)
+	if err != nil || !deleted {
+		return false, err
+	}
+	creation.cancel()
+	return true, nil
+}
+
+// checkCreated rejects operations on tasks that have no items yet because
+// their playlist is still being parsed or could not be parsed.
+func checkCreated(meta *TaskMetadata) error {
+	switch {
+	case meta.Status == TaskStatusPending || meta.Status == TaskStatusParsing:
+		return fmt.Errorf("task is still being created")
+	case meta.Status == TaskStatusFailed && meta.Error != "":
+		return fmt.Errorf("task could not be created (%s), delete it and add it again", meta.Error)
+	}
+	return nil
+}
+
 func (m *Manager) GetTasks() ([]TaskSummary, error) {
 	dbTasks, err := m.ListTasksDB()
 	if err != nil {
@@ -142,11 +334,77 @@ func (m *Manager) GetTasks() ([]TaskSummary, error) {
 	}
 	out := make([]TaskSummary, 0, len(dbTasks))
 	for _, meta := range dbTasks {
-		out = append(out, summarizeTask(meta))
+		summary := summarizeTask(meta)
+		summary.Export = m.exportSummary(meta)
+		out = append(out, summary)
 	}
 	return out, nil
 }
 
+// GetTaskDetail returns the task summary plus the state of every manifest item.
+// A resident runtime is used as-is; otherwise the state is rebuilt from
+// progress.json and the files on disk so that inactive tasks are not reloaded.
+func (m *Manager) GetTaskDetail(taskID string) (*TaskDetail, error) {
+	meta, err := m.GetTask(taskID)
+	if err != nil {
+		return nil, err
+	}
+	if meta.Status == TaskStatusDeleted {
+		return nil, sql.ErrNoRows
+	}
+	manifest, err := m.LoadTaskManifest(taskID, meta.OriginalURL, meta.TotalSegments)
+	if err != nil {
+		return nil, err
+	}
+
+	m.runtimeMu.Lock()
+	rt := m.runtimes[taskID]
+	m.runtimeMu.Unlock()
+
+	var view itemStateView
+	if rt != nil {
+		view = rt.itemStates()
+	} else {
+		progress, err := readProgress(taskProgressPath(taskID), taskID)
+		if err != nil {
+			return nil, err
+		}
+		view = itemStateView{
+			failed:   failedSet(progress.Failed),
+			failures: failureMap(progress.Failures),
+			pending:  make(map[string]struct{}),
+		}
+		if meta.Status != TaskStatusCompleted {
+			for _, item := range manifest.Items {
+				if cache.FileExists(taskID, item.Filename) && !cache.FileExists(taskID, item.Filename+".aria2") {
+					continue
+				}
+				view.pending[item.Filename] = struct{}{}
+			}
+		}
+	}
+
+	var rec *LiveRecording
+	if meta.Live {
+		if rec, err = readLiveRecording(taskID); err != nil {
+			return nil, err
+		}
+	}
+
+	items := make([]TaskItemState, 0, len(manifest.Items))
+	for seq, item := range manifest.Items {
+		items = append(items, view.describe(uint32(seq), item))
+	}
+	summary := summarizeTask(*meta)
+	summary.Export = m.exportSummary(*meta)
+	return &TaskDetail{
+		TaskSummary: summary,
+		Recording:   rec,
+		AdRanges:    meta.AdRanges,
+		Items:       items,
+	}, nil
+}
+
 func (m *Manager) RuntimeMetrics() RuntimeMetrics {
 	m.runtimeMu.Lock()
 	runtimeCount := len(m.runtimes)
@@ -213,6 +471,8 @@ func summarizeTask(meta TaskMetadata) TaskSummary {
 		OutputDir:          meta.OutputDir,
 		M3U8FilePath:       meta.M3U8FilePath,
 		Progress:           progress,
+		Live:               meta.Live,
+		Error:              meta.Error,
 	}
 }
 
@@ -225,6 +485,9 @@ func (m *Manager) PauseTask(taskID string) (int, error) {
 	case TaskStatusCompleted, TaskStatusDeleted:
 		return 0, fmt.Errorf("task status %s does not support pause", meta.Status)
 	}
+	if err := checkCreated(meta); err != nil {
+		return 0, err
+	}
 	rt, err := m.loadRuntime(taskID)
 	if err != nil {
 		return 0, err
@@ -234,12 +497,12 @@ func (m *Manager) PauseTask(taskID string) (int, error) {
 	rt.mu.Lock()
 	rt.paused = true
 	gids := keysOfMap(rt.gidToFile)
-	pendingCount := rt.pendingDispatchableCountLocked()
+	pendingCount := rt.pendingDispatchableCountLocked(time.Now())
 	rt.markDirtyLocked()
 	rt.mu.Unlock()
 
-	if m.aria2 != nil && len(gids) > 0 {
-		_ = m.aria2.BatchPause(gids)
+	if m.downloader != nil && len(gids) > 0 {
+		_ = m.downloader.BatchPause(gids)
 	}
 	if err := m.flushRuntime(taskID, rt); err != nil {
 		return 0, err
@@ -256,6 +519,9 @@ func (m *Manager) ResumeTask(taskID string) (int, error) {
 	case TaskStatusCompleted, TaskStatusDeleted:
 		return 0, fmt.Errorf("task status %s does not support resume", meta.Status)
 	}
+	if err := checkCreated(meta); err != nil {
+		return 0, err
+	}
 	rt, err := m.loadRuntime(taskID)
 	if err != nil {
 		return 0, err
@@ -263,12 +529,12 @@ func (m *Manager) ResumeTask(taskID string) (int, error) {
 	rt.mu.Lock()
 	rt.paused = false
 	gids := keysOfMap(rt.gidToFile)
-	count := rt.pendingDispatchableCountLocked() + len(gids)
+	count := rt.pendingDispatchableCountLocked(time.Now()) + len(gids)
 	rt.markDirtyLocked()
 	rt.mu.Unlock()
 
-	if m.aria2 != nil && len(gids) > 0 {
-		_ = m.aria2.BatchUnpause(gids)
+	if m.downloader != nil && len(gids) > 0 {
+		_ = m.downloader.BatchUnpause(gids)
 	}
 	if err := m.flushRuntime(taskID, rt); err != nil {
 		return 0, err
@@ -286,13 +552,23 @@ func (m *Manager) RetryTask(taskID string) (int, error) {
 	case TaskStatusCompleted, TaskStatusDeleted:
 		return 0, fmt.Errorf("task status %s does not support retry", meta.Status)
 	}
+	if err := checkCreated(meta); err != nil {
+		return 0, err
+	}
 	rt, err := m.loadRuntime(taskID)
 	if err != nil {
 		return 0, err
 	}
 	rt.mu.Lock()
 	count := len(rt.failed)
+	for filename := range rt.failed {
+		// A manual retry grants a fresh automatic retry budget.
+		failure := rt.failures[filename]
+		failure.Attempts = 0
+		rt.failures[filename] = failure
+	}
 	rt.failed = make(map[string]struct{})
+	rt.retryAt = make(map[string]time.Time)
 	rt.paused = false
 	rt.markDirtyLocked()
 	rt.mu.Unlock()
@@ -309,10 +585,21 @@ func (m *Manager) DeleteTask(taskID string) error {
 	if err != nil {
 		return err
 	}
+	if meta.Status == TaskStatusPending || meta.Status == TaskStatusParsing {
+		// Deleting a task that is still being created cancels the creation.
+		cancelled, err := m.cancelCreation(taskID)
+		if err != nil || cancelled {
+			return err
+		}
+		if meta, err = m.GetTask(taskID); err != nil {
+			return err
+		}
+	}
 	if meta.Status == TaskStatusDownloading || meta.Status == TaskStatusParsing {
 		return fmt.Errorf("cannot delete running task, please pause it first")
 	}
 	m.cancelDispatch(taskID)
+	m.stopRecorder(taskID)
 	if err := m.UpdateTaskStatus(taskID, TaskStatusDeleted); err != nil {
 		return err
 	}
@@ -327,9 +614,9 @@ func (m *Manager) deleteTaskAsync(taskID, m3u8FilePath string) {
 	m.acquireDeleteSlot()
 	defer m.releaseDeleteSlot()
 
-	if m.aria2 != nil {
+	if m.downloader != nil {
 		taskDir := cache.GetTaskDir(taskID)
-		if cleaned, err := m.aria2.CleanupTaskByDir(taskDir); err != nil {
+		if cleaned, err := m.downloader.CleanupTaskByDir(taskDir); err != nil {
 			log.Printf("delete task aria2 cleanup failed task=%s dir=%s cleaned=%d err=%v", taskID, taskDir, cleaned, err)
 		}
 	}
@@ -379,6 +666,7 @@ func (m *Manager) dispatchTask(ctx context.Context, taskID string) {
 		log.Printf("load runtime failed task=%s: %v", taskID, err)
 		return
 	}
+	headers := m.TaskRequestHeaders(taskID)
 
 	const batchSize = 50
 	for {
@@ -392,69 +680,95 @@ func (m *Manager) dispatchTask(ctx context.Context, taskID string) {
 		if len(filenames) == 0 {
 			return
 		}
-
-		itemsByFilename, err := m.LoadManifestItemsByFilenames(taskID, filenames)
-		if err != nil {
-			log.Printf("load manifest items failed task=%s: %v", taskID, err)
-			for _, filename := range filenames {
-				m.markFailedByFilename(taskID, filename, "load manifest items failed")
-			}
+		if !m.dispatchItems(taskID, rt, filenames, headers) {
 			return
 		}
+	}
+}
 
-		requests := make([]downloader.AddURIRequest, 0, len(filenames))
+// dispatchItems hands claimed items to the downloader and binds their GIDs. It returns
+// false when the batch failed as a whole and dispatching should stop. Items the
+// downloader could not take because it was unreachable are queued again after
+// downloaderRetryDelay without counting an attempt; only an RPC error, which
+// aria2 returns for the item it rejected, counts as a failure of that item.
+func (m *Manager) dispatchItems(taskID string, rt *taskRuntime, filenames []string, headers map[string]string) bool {
+	itemsByFilename, err := m.LoadManifestItemsByFilenames(taskID, filenames)
+	if err != nil {
+		log.Printf("load manifest items failed task=%s: %v", taskID, err)
 		for _, filename := range filenames {
-			item, ok := itemsByFilename[filename]
-			if !ok {
-				m.markFailedByFilename(taskID, filename, "manifest item not found")
-				continue
-			}
-			if cache.FileExists(taskID, item.Filename) && !cache.FileExists(taskID, item.Filename+".aria2") {
-				m.markCompletedByFilename(taskID, item.Filename)
-				continue
-			}
-			if err := cleanupResumeArtifacts(taskID, item.Filename); err != nil {
-				m.markFailedByFilename(taskID, item.Filename, err.Error())
-				continue
-			}
-			requests = append(requests, downloader.AddURIRequest{
-				URI:      item.URL,
-				Dir:      cache.GetTaskDir(taskID),
-				Filename: item.Filename,
-				Headers:  defaultHeaders(),
-			})
-		}
-		if len(requests) == 0 {
-			continue
+			m.markFailedByFilename(taskID, filename, "load manifest items failed", "")
 		}
+		return false
+	}
 
-		gids, err := m.aria2.BatchAddURIs(requests)
-		if err != nil {
-			for _, req := range requests {
-				m.markFailedByFilename(taskID, req.Filename, err.Error())
-			}
-			return
+	requests := make([]downloader.AddURIRequest, 0, len(filenames))
+	for _, filename := range filenames {
+		item, ok := itemsByFilename[filename]
+		if !ok {
+			m.markFailedByFilename(taskID, filename, "manifest item not found", "")
+			continue
+		}
+		if cache.FileExists(taskID, item.Filename) && !cache.FileExists(taskID, item.Filename+".aria2") {
+			m.markCompletedByFilename(taskID, item.Filename)
+			continue
+		}
+		if err := cleanupResumeArtifacts(taskID, item.Filename); err != nil {
+			m.markFailedByFilename(taskID, item.Filename, err.Error(), "")
+			continue
 		}
+		requests = append(requests, downloader.AddURIRequest{
+			URI:      item.URL,
+			Dir:      cache.GetTaskDir(taskID),
+			Filename: item.Filename,
+			Headers:  itemHeaders(item, headers),
+			Options:  itemOptions(item),
+		})
+	}
+	if len(requests) == 0 {
+		return true
+	}
 
-		for idx, req := range requests {
-			if idx >= len(gids) || gids[idx] == "" {
-				m.markFailedByFilename(taskID, req.Filename, "missing gid from aria2")
-				continue
-			}
+	gids, err := m.downloader.BatchAddURIs(requests)
+	var rpcErr *downloader.JsonRpcError
+	itemErr := errors.As(err, &rpcErr)
+	deferred := make([]string, 0)
+	for idx, req := range requests {
+		switch {
+		case idx < len(gids) && gids[idx] != "":
 			if paused := rt.bindGID(req.Filename, gids[idx]); paused {
-				_ = m.aria2.BatchPause([]string{gids[idx]})
+				_ = m.downloader.BatchPause([]string{gids[idx]})
 			}
+		case err == nil:
+			m.markFailedByFilename(taskID, req.Filename, "missing gid from downloader", "")
+		case itemErr && idx == len(gids):
+			// The downloader took the requests before this one and rejected it.
+			m.markFailedByFilename(taskID, req.Filename, err.Error(), "")
+		default:
+			deferred = append(deferred, req.Filename)
 		}
-		_ = m.flushRuntime(taskID, rt)
 	}
+	if len(deferred) > 0 {
+		log.Printf("downloader did not take %d items task=%s, retrying in %s: %v", len(deferred), taskID, downloaderRetryDelay, err)
+		rt.deferDispatch(deferred, time.Now().Add(downloaderRetryDelay))
+	}
+	_ = m.flushRuntime(taskID, rt)
+	return err == nil
 }
 
 func (m *Manager) progressNotificationLoop() {
-	if m.aria2 == nil {
+	if m.downloader == nil {
 		return
 	}
 	for {
-		err := m.aria2.ListenNotifications(context.Background(), func(method, gid string) {
+		err := m.downloader.ListenNotifications(context.Background(), func(method, gid string) {
+			if method == downloader.EventResync || method == downloader.EventSessionChanged {
+				go m.resyncAfterReconnect(aria2NotificationEvent{
+					Method:         method,
+					GID:            gid,
+					SessionChanged: method == downloader.EventSessionChanged,
+				})
+				return
+			}
 			if method == "" || gid == "" {
 				return
 			}
@@ -464,7 +778,7 @@ func (m *Manager) progressNotificationLoop() {
 			}
 		})
 		if err != nil {
-			log.Printf("aria2 notification loop disconnected: %v", err)
+			log.Printf("downloader notification loop disconnected: %v", err)
 		}
 		time.Sleep(5 * time.Second)
 	}
@@ -505,17 +819,149 @@ func (m *Manager) applyAria2Event(event aria2NotificationEvent) {
 		return
 	}
 	switch event.Method {
-	case "aria2.onDownloadComplete":
+	case downloader.EventDownloadComplete:
 		m.markCompletedByFilename(taskID, filename)
-	case "aria2.onDownloadError":
-		m.markFailedByFilename(taskID, filename, "aria2 download error")
-	case "aria2.onDownloadPause", "aria2.onDownloadStop":
+	case downloader.EventDownloadError:
+		reason, code := m.aria2ErrorDetail(event.GID)
+		m.markFailedByFilename(taskID, filename, firstNonEmpty(reason, "aria2 download error"), code)
+	case downloader.EventDownloadLost:
+		m.requeueLostDownload(taskID, event.GID)
+	case downloader.EventDownloadPause, downloader.EventDownloadStop:
 		// runtime state is already sufficient; no-op
-	case "aria2.onDownloadStart":
+	case downloader.EventDownloadStart:
 		// no-op
 	}
 }
 
+// requeueLostDownload dispatches an item again whose download went away with
+// the aria2 instance holding it. It does not count as a failed attempt.
+func (m *Manager) requeueLostDownload(taskID, gid string) {
+	rt, err := m.loadRuntime(taskID)
+	if err != nil || !rt.releaseGID(gid) {
+		return
+	}
+	if !m.hasDispatch(taskID) {
+		m.StartDispatch(taskID)
+	}
+}
+
+// resyncAfterReconnect catches up on what happened while no notification
+// could arrive, instead of waiting for the next reconcile round.
+func (m *Manager) resyncAfterReconnect(event aria2NotificationEvent) {
+	if updated, err := m.SyncTaskProgress(); err != nil {
+		log.Printf("reconcile after reconnect failed: %v", err)
+	} else if updated > 0 {
+		log.Printf("reconcile after reconnect updated %d items", updated)
+	}
+	m.resyncBindings(event)
+}
+
+// resyncBindings checks every bound GID against the downloader after the
+// notification connection came back. aria2 restarted without a session file
+// no longer knows them, so those items are dispatched again; downloads that
+// finished while no notification could arrive are settled here.
+func (m *Manager) resyncBindings(event aria2NotificationEvent) {
+	m.runtimeMu.Lock()
+	snapshot := make(map[string]*taskRuntime, len(m.runtimes))
+	for taskID, rt := range m.runtimes {
+		snapshot[taskID] = rt
+	}
+	m.runtimeMu.Unlock()
+
+	for taskID, rt := range snapshot {
+		bound := rt.boundGIDsSnapshot()
+		if len(bound) == 0 {
+			continue
+		}
+		var released int
+		var err error
+		if event.SessionChanged {
+			released, err = m.releaseOldSessionGIDs(taskID, rt, bound, event.GID)
+		} else {
+			released, err = m.resyncTaskGIDs(taskID, rt, bound)
+		}
+		if err != nil {
+			log.Printf("resync downloads failed task=%s: %v", taskID, err)
+			continue
+		}
+		if released == 0 {
+			continue
+		}
+		log.Printf("resync task=%s: %d downloads unknown to the downloader, dispatching them again", taskID, released)
+		if !m.hasDispatch(taskID) {
+			m.StartDispatch(taskID)
+		}
+	}
+}
+
+// resyncTaskGIDs asks the downloader for every bound GID of a task, settles
+// the finished ones and releases the ones it does not know. It returns how
+// many were released.
+func (m *Manager) resyncTaskGIDs(taskID string, rt *taskRuntime, bound map[string]string) (int, error) {
+	gids := make([]string, 0, len(bound))
+	for gid := range bound {
+		gids = append(gids, gid)
+	}
+	statuses, err := m.downloader.BatchTellStatus(gids)
+	if err != nil {
+		return 0, err
+	}
+	released := 0
+	for gid, filename := range bound {
+		status, known := statuses[gid]
+		switch {
+		case !known || status.Status == "removed":
+			if rt.releaseGID(gid) {
+				released++
+			}
+		case status.Status == "complete":
+			m.markCompletedByFilename(taskID, filename)
+		case status.Status == "error":
+			m.markFailedByFilename(taskID, filename, firstNonEmpty(status.ErrorMessage, "aria2 download error"), status.ErrorCode)
+		}
+	}
+	return released, nil
+}
+
+// releaseOldSessionGIDs releases the bound GIDs starting with prefix that a
+// restarted aria2 does not hold in its queue, without asking for each of
+// them. A session file may have brought some back; those stay bound, and
+// the ones that finished meanwhile are found by the reconcile before.
+func (m *Manager) releaseOldSessionGIDs(taskID string, rt *taskRuntime, bound map[string]string, prefix string) (int, error) {
+	queued, err := m.downloader.QueueStatusesByDir(cache.GetTaskDir(taskID))
+	if err != nil {
+		return 0, err
+	}
+	inSession := make(map[string]struct{}, len(queued))
+	for _, status := range queued {
+		inSession[status.Gid] = struct{}{}
+	}
+	released := 0
+	for gid := range bound {
+		if _, ok := inSession[gid]; ok || !strings.HasPrefix(gid, prefix) {
+			continue
+		}
+		if rt.releaseGID(gid) {
+			released++
+		}
+	}
+	return released, nil
+}
+
+// aria2ErrorDetail asks aria2 why a download failed. The notification itself only
+// carries the GID, so the reason has to be fetched before the binding is dropped.
+func (m *Manager) aria2ErrorDetail(gid string) (string, string) {
+	if m.downloader == nil {
+		return "", ""
+	}
+	statuses, err := m.downloader.BatchTellStatus([]string{gid})
+	if err != nil {
+		return "", ""
+	}
+	detail := statuses[gid]
+	return detail.ErrorMessage, detail.ErrorCode
+}
+
 func (m *Manager) flushDirtyLoop() {
 	ticker := time.NewTicker(dirtyFlushTick)
 	defer ticker.Stop()
@@ -538,6 +984,30 @@ func (m *Manager) flushDirtyLoop() {
 	}
 }
 
+func (m *Manager) retryLoop() {
+	ticker := time.NewTicker(retryScanTick)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.dispatchDueRetries(time.Now())
+	}
+}
+
+func (m *Manager) dispatchDueRetries(now time.Time) {
+	m.runtimeMu.Lock()
+	due := make([]string, 0)
+	for taskID, rt := range m.runtimes {
+		if rt.hasDueRetry(now) {
+			due = append(due, taskID)
+		}
+	}
+	m.runtimeMu.Unlock()
+	for _, taskID := range due {
+		if !m.hasDispatch(taskID) {
+			m.StartDispatch(taskID)
+		}
+	}
+}
+
 func (m *Manager) cleanupRuntimeLoop() {
 	ticker := time.NewTicker(time.Minute)
 	defer ticker.Stop()
@@ -549,8 +1019,8 @@ func (m *Manager) cleanupRuntimeLoop() {
 func (m *Manager) dailyPurgeLoop() {
 	for {
 		time.Sleep(time.Until(nextPurgeTime(time.Now())))
-		if m.aria2 != nil {
-			if err := m.aria2.PurgeDownloadResult(); err != nil {
+		if m.downloader != nil {
+			if err := m.downloader.PurgeDownloadResult(); err != nil {
 				log.Printf("daily purge download result failed: %v", err)
 			}
 		}
@@ -637,12 +1107,14 @@ func (m *Manager) ReconcileTask(taskID string) (int, error) {
 		}
 	}
 
-	if m.aria2 != nil {
-		statuses, err := m.aria2.QueueStatusesByDir(cache.GetTaskDir(taskID))
+	if m.downloader != nil {
+		bound := rt.boundGIDsSnapshot()
+		statuses, err := m.downloader.QueueStatusesByDir(cache.GetTaskDir(taskID))
 		if err != nil {
 			return updated, err
 		}
 		for _, status := range statuses {
+			delete(bound, status.Gid)
 			filename := filepath.Base(status.FirstFilePath())
 			if filename == "." || filename == "" {
 				continue
@@ -654,16 +1126,155 @@ func (m *Manager) ReconcileTask(taskID string) (int, error) {
 					updated++
 				}
 			case "error":
-				if m.markFailedByFilename(taskID, filename, firstNonEmpty(status.ErrorMessage, "aria2 reconcile error")) {
+				if m.markFailedByFilename(taskID, filename, firstNonEmpty(status.ErrorMessage, "aria2 reconcile error"), status.ErrorCode) {
 					updated++
 				}
 			}
 		}
+		// Bound downloads that left the queue have stopped; asking for them
+		// settles the ones whose notification got lost, which for an
+		// Aria2Pool also moves the file out of its staging directory.
+		settled, err := m.settleStoppedGIDs(taskID, bound)
+		updated += settled
+		if err != nil {
+			return updated, err
+		}
+	}
+	if updated > 0 || rt.shouldFlush(time.Now()) {
+		_ = m.flushRuntime(taskID, rt)
+	}
+	return updated, nil
+}
+
+// settleStoppedGIDs asks the downloader for the bound GIDs and completes or
+// fails the items of the finished ones. It returns how many items changed.
+func (m *Manager) settleStoppedGIDs(taskID string, bound map[string]string) (int, error) {
+	if len(bound) == 0 {
+		return 0, nil
+	}
+	gids := make([]string, 0, len(bound))
+	for gid := range bound {
+		gids = append(gids, gid)
+	}
+	statuses, err := m.downloader.BatchTellStatus(gids)
+	if err != nil {
+		return 0, err
+	}
+	updated := 0
+	for gid, filename := range bound {
+		status, ok := statuses[gid]
+		if !ok {
+			continue
+		}
+		switch status.Status {
+		case "complete":
+			if m.markCompletedByFilename(taskID, filename) {
+				updated++
+			}
+		case "error":
+			if m.markFailedByFilename(taskID, filename, firstNonEmpty(status.ErrorMessage, "aria2 reconcile error"), status.ErrorCode) {
+				updated++
+			}
+		}
+	}
+	return updated, nil
+}
+
+// recoverInterruptedTasks re-attaches tasks that were still running when the
+// previous process exited. aria2 may come up later than we do (e.g. after a
+// reboot), so tasks that cannot be reconciled yet are retried until it answers.
+func (m *Manager) recoverInterruptedTasks(taskIDs []string) {
+	if m.downloader == nil {
+		return
+	}
+	pending := taskIDs
+	for len(pending) > 0 {
+		retry := make([]string, 0, len(pending))
+		for _, taskID := range pending {
+			err := m.recoverTask(taskID)
+			switch {
+			case err == nil:
+			case errors.Is(err, errDownloaderUnavailable):
+				log.Printf("recover task waiting for the downloader task=%s: %v", taskID, err)
+				retry = append(retry, taskID)
+			default:
+				log.Printf("recover task failed, marking failed task=%s: %v", taskID, err)
+				if err := m.FailTask(taskID, "not resumed after a restart: "+err.Error()); err != nil {
+					log.Printf("mark task failed task=%s: %v", taskID, err)
+				}
+			}
+		}
+		pending = retry
+		if len(pending) > 0 {
+			time.Sleep(recoveryRetryInterval)
+		}
+	}
+}
+
+// recoverTask rebuilds the runtime from progress.json and the manifest, binds
+// the GIDs aria2 still holds for this task and re-dispatches only the items
+// that are neither on disk nor queued in aria2. Failures to reach aria2 are
+// wrapped in errDownloaderUnavailable.
+func (m *Manager) recoverTask(taskID string) error {
+	meta, err := m.GetTask(taskID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if meta.Status != TaskStatusDownloading {
+		return nil
+	}
+	manifestIndex, err := m.LoadTaskManifestIndex(taskID)
+	if err != nil {
+		return err
+	}
+	if len(manifestIndex) == 0 {
+		return errors.New("task has no manifest")
+	}
+
+	rt, err := m.loadRuntime(taskID)
+	if err != nil {
+		return err
+	}
+	statuses, err := m.downloader.QueueStatusesByDir(cache.GetTaskDir(taskID))
+	if err != nil {
+		return fmt.Errorf("%w: %v", errDownloaderUnavailable, err)
+	}
+	paused := make([]string, 0)
+	for _, status := range statuses {
+		filename := filepath.Base(status.FirstFilePath())
+		if filename == "." || filename == "" {
+			continue
+		}
+		switch status.Status {
+		case "complete":
+			m.markCompletedByFilename(taskID, filename)
+		case "error":
+			m.markFailedByFilename(taskID, filename, firstNonEmpty(status.ErrorMessage, "aria2 recover error"), status.ErrorCode)
+		default:
+			rt.registerGID(status.Gid, filename)
+			if status.Status == "paused" {
+				paused = append(paused, status.Gid)
+			}
+		}
 	}
-	if updated > 0 || rt.shouldFlush(time.Now()) {
-		_ = m.flushRuntime(taskID, rt)
+	if len(paused) > 0 {
+		_ = m.downloader.BatchUnpause(paused)
 	}
-	return updated, nil
+
+	rt.mu.Lock()
+	rt.markDirtyLocked()
+	rt.mu.Unlock()
+	if err := m.flushRuntime(taskID, rt); err != nil {
+		return err
+	}
+	if status, _, _ := rt.stateForEviction(); status == TaskStatusCompleted {
+		return nil
+	}
+	m.StartDispatch(taskID)
+	return nil
 }
 
 func (m *Manager) loadRuntime(taskID string) (*taskRuntime, error) {
@@ -689,6 +1300,14 @@ func (m *Manager) loadRuntime(taskID string) (*taskRuntime, error) {
 	}
 
 	rt := newTaskRuntime(taskID, meta.TotalItems, meta.TotalSegments, manifestIndex, progress, meta.Status == TaskStatusPaused)
+	rt.retry = retryPolicyFromConfig()
+	if meta.Live {
+		rec, err := readLiveRecording(taskID)
+		if err != nil {
+			return nil, err
+		}
+		rt.recording = rec != nil && !rec.Stopped
+	}
 	rt.syncCompletedFiles(taskID)
 
 	m.runtimeMu.Lock()
@@ -716,6 +1335,9 @@ func (m *Manager) flushRuntime(taskID string, rt *taskRuntime) error {
 	case TaskStatusCompleted, TaskStatusFailed:
 		m.evictRuntime(taskID, rt)
 	}
+	if snapshot.Status == TaskStatusCompleted && config.GlobalConfig.ExportOnComplete {
+		m.exportOnComplete(taskID)
+	}
 	m.recordFlushCost(time.Since(start))
 	return nil
 }
@@ -775,12 +1397,60 @@ func (m *Manager) markCompletedByFilename(taskID, filename string) bool {
 	return true
 }
 
-func (m *Manager) markFailedByFilename(taskID, filename, errMsg string) bool {
+// StoreProxiedFile moves a file the proxy fetched completely for a player from
+// tmpPath into the task directory and marks the item completed, so it is not
+// downloaded again; an aria2 download queued for it is removed. fetched names
+// the item and where it was fetched from. It reports false and leaves tmpPath
+// alone when that is not the URL and byte range of the item in the manifest,
+// or when the item is not pending, is being handed to aria2 or aria2 is
+// already writing it.
+func (m *Manager) StoreProxiedFile(taskID string, fetched ManifestItem, tmpPath string) (bool, error) {
+	meta, err := m.GetTask(taskID)
+	if err != nil {
+		return false, err
+	}
+	if meta.Status == TaskStatusDeleted || checkCreated(meta) != nil {
+		return false, nil
+	}
+	filename := fetched.Filename
+	// The proxy URL comes from the client; only what the task would download
+	// itself may end up in its cache.
+	items, err := m.LoadManifestItemsByFilenames(taskID, []string{filename})
+	if err != nil {
+		return false, err
+	}
+	item, ok := items[filename]
+	if !ok || item.URL != fetched.URL || item.Offset != fetched.Offset || item.Length != fetched.Length {
+		return false, nil
+	}
+	rt, err := m.loadRuntime(taskID)
+	if err != nil {
+		return false, err
+	}
+	gid, claimed := rt.claimProxied(filename)
+	if !claimed {
+		return false, nil
+	}
+	if cache.FileExists(taskID, filename+".aria2") {
+		rt.unclaimProxied(filename)
+		return false, nil
+	}
+	if err := os.Rename(tmpPath, cache.GetFilePath(taskID, filename)); err != nil {
+		rt.unclaimProxied(filename)
+		return false, err
+	}
+	if rt.markCompleted(filename) && gid != "" && m.downloader != nil {
+		go m.downloader.ForceRemoveMany([]string{gid})
+	}
+	return true, nil
+}
+
+func (m *Manager) markFailedByFilename(taskID, filename, errMsg, errCode string) bool {
 	rt, err := m.loadRuntime(taskID)
 	if err != nil {
 		return false
 	}
-	if !rt.markFailed(filename, errMsg) {
+	if !rt.markFailed(filename, errMsg, errCode) {
 		return false
 	}
 	return true
@@ -809,6 +1479,20 @@ func (m *Manager) HandleListV1(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (m *Manager) HandleGetV1(w http.ResponseWriter, r *http.Request) {
+	taskID := r.PathValue("id")
+	detail, err := m.GetTaskDetail(taskID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "task not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, detail)
+}
+
 func (m *Manager) HandlePauseV1(w http.ResponseWriter, r *http.Request) {
 	taskID := r.PathValue("id")
 	paused, err := m.PauseTask(taskID)
@@ -839,6 +1523,48 @@ func (m *Manager) HandleRetryV1(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, map[string]interface{}{"retried_items": retried})
 }
 
+func (m *Manager) HandleStopV1(w http.ResponseWriter, r *http.Request) {
+	taskID := r.PathValue("id")
+	rec, err := m.StopRecording(taskID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "task not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, map[string]interface{}{"recording": rec})
+}
+
+func (m *Manager) HandleExportV1(w http.ResponseWriter, r *http.Request) {
+	taskID := r.PathValue("id")
+	// The body is optional: {"format": "mp4"} changes the export format of the task.
+	var body struct {
+		Format string `json:"format"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format, ok := normalizeExportFormat(body.Format)
+	if !ok {
+		http.Error(w, "format must be ts or mp4", http.StatusBadRequest)
+		return
+	}
+	state, err := m.StartExport(taskID, format)
+	if err == sql.ErrNoRows {
+		http.Error(w, "task not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	writeJSON(w, map[string]interface{}{"export": state})
+}
+
 func (m *Manager) HandleDeleteV1(w http.ResponseWriter, r *http.Request) {
 	taskID := r.PathValue("id")
 	if err := m.DeleteTask(taskID); err != nil {
@@ -857,36 +1583,56 @@ func (m *Manager) HandleSyncProgress(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, map[string]interface{}{"updated": updated})
 }
 
-func (m *Manager) HandleAdd(w http.ResponseWriter, r *http.Request, triggerFunc func(AddTaskRequest) error) {
+// DecodeAddRequest reads and validates the JSON body of an add request; the
+// error describes what is wrong with the request.
+func DecodeAddRequest(r *http.Request) (AddTaskRequest, error) {
+	var body AddTaskRequest
 	if !strings.Contains(r.Header.Get("Content-Type"), "application/json") {
-		http.Error(w, "Content-Type must be application/json", http.StatusBadRequest)
-		return
+		return body, fmt.Errorf("Content-Type must be application/json")
 	}
-	var body AddTaskRequest
 	decoder := json.NewDecoder(r.Body)
 	decoder.DisallowUnknownFields()
 	if err := decoder.Decode(&body); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		return body, err
 	}
 	var extra struct{}
 	if err := decoder.Decode(&extra); err != io.EOF {
-		http.Error(w, "Request body must contain a single JSON object", http.StatusBadRequest)
-		return
+		return body, fmt.Errorf("Request body must contain a single JSON object")
 	}
 
 	body.Name = strings.TrimSpace(body.Name)
 	body.URL = strings.TrimSpace(body.URL)
 	if body.URL == "" {
-		http.Error(w, "url is required", http.StatusBadRequest)
-		return
+		return body, fmt.Errorf("url is required")
 	}
 	if body.Name == "" {
 		body.Name = DeriveTaskName(body.URL)
 	}
+	if body.Variant != nil && body.Variant.Index != nil && *body.Variant.Index < 0 {
+		return body, fmt.Errorf("variant index must not be negative")
+	}
+	var ok bool
+	if body.ExportFormat, ok = normalizeExportFormat(body.ExportFormat); !ok {
+		return body, fmt.Errorf("export_format must be ts or mp4")
+	}
+	if err := validateHeaders(body.Headers); err != nil {
+		return body, err
+	}
 	parsedURL, err := url.Parse(body.URL)
 	if err != nil || parsedURL.Scheme == "" || parsedURL.Host == "" {
-		http.Error(w, "invalid url", http.StatusBadRequest)
+		return body, fmt.Errorf("invalid url")
+	}
+	return body, nil
+}
+
+// HandleAdd validates the request, lists the task as pending right away and
+// creates it from its playlist in the background with triggerFunc. A failed
+// creation leaves the task failed with the error; deleting the task before it
+// is created cancels the context passed to triggerFunc.
+func (m *Manager) HandleAdd(w http.ResponseWriter, r *http.Request, triggerFunc func(context.Context, AddTaskRequest) error) {
+	body, err := DecodeAddRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -896,16 +1642,37 @@ func (m *Manager) HandleAdd(w http.ResponseWriter, r *http.Request, triggerFunc
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if exists && status != TaskStatusDeleted {
+	if exists && status == TaskStatusDeleted {
+		http.Error(w, "task is still being deleted, try again shortly", http.StatusConflict)
+		return
+	}
+	if exists {
 		http.Error(w, fmt.Sprintf("task already exists with status: %s", status), http.StatusConflict)
 		return
 	}
 
-	go func() {
-		if err := triggerFunc(body); err != nil {
-			log.Printf("start task failed url=%s err=%v", body.URL, err)
-		}
-	}()
+	body.TaskID = taskID
+	now := time.Now()
+	ctx, err := m.beginCreation(TaskMetadata{
+		ID:           taskID,
+		Name:         body.Name,
+		OriginalURL:  body.URL,
+		OutputDir:    cache.GetTaskDir(taskID),
+		CreatedTime:  now,
+		UpdatedTime:  now,
+		Status:       TaskStatusPending,
+		ExportFormat: body.ExportFormat,
+		Headers:      body.Headers,
+	})
+	if errors.Is(err, errTaskExists) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	go m.runCreation(ctx, body, triggerFunc)
 	w.WriteHeader(http.StatusCreated)
 	writeJSON(w, map[string]interface{}{"id": taskID, "name": body.Name, "url": body.URL, "status": TaskStatusPending})
 }
@@ -922,6 +1689,9 @@ func buildManifest(taskID, originalURL string, items []playlist.DownloadItem, to
 			Filename: item.Filename,
 			URL:      item.URL,
 			Type:     normalizeManifestType(item.Type),
+			Offset:   item.Offset,
+			Length:   item.Length,
+			Group:    item.Group,
 		})
 	}
 	return TaskManifest{
@@ -957,13 +1727,16 @@ func newTaskRuntime(taskID string, totalItems, totalSegments int, manifestIndex
 			remainingSegments++
 		}
 	}
+	failed := failedSet(progress.Failed)
 	return &taskRuntime{
 		taskID:            taskID,
 		totalItems:        totalItems,
 		totalSegments:     totalSegments,
 		segmentBySeq:      segmentBySeq,
 		remaining:         remaining,
-		failed:            failedSet(progress.Failed),
+		failed:            failed,
+		failures:          failureMap(progress.Failures),
+		retryAt:           retryTimes(progress.RetryAt, remaining, failed),
 		dispatching:       make(map[string]struct{}),
 		gidToFile:         make(map[string]string),
 		fileToGID:         make(map[string]string),
@@ -983,6 +1756,8 @@ func (rt *taskRuntime) syncCompletedFiles(taskID string) {
 		if cache.FileExists(taskID, filename) && !cache.FileExists(taskID, filename+".aria2") {
 			delete(rt.remaining, filename)
 			delete(rt.failed, filename)
+			delete(rt.failures, filename)
+			delete(rt.retryAt, filename)
 			if rt.isSegment(index) && rt.remainingSegments > 0 {
 				rt.remainingSegments--
 			}
@@ -998,6 +1773,7 @@ func (rt *taskRuntime) claimPending(limit int) []string {
 	if rt.paused {
 		return nil
 	}
+	now := time.Now()
 	items := make([]string, 0, limit)
 	for filename := range rt.remaining {
 		if len(items) >= limit {
@@ -1006,6 +1782,12 @@ func (rt *taskRuntime) claimPending(limit int) []string {
 		if _, failed := rt.failed[filename]; failed {
 			continue
 		}
+		if retryAt, waiting := rt.retryAt[filename]; waiting {
+			if now.Before(retryAt) {
+				continue
+			}
+			delete(rt.retryAt, filename)
+		}
 		if _, active := rt.fileToGID[filename]; active {
 			continue
 		}
@@ -1040,6 +1822,71 @@ func (rt *taskRuntime) registerGID(gid, filename string) {
 	rt.fileToGID[filename] = gid
 }
 
+// deferDispatch puts claimed items back until the given time without counting
+// a failed attempt.
+func (rt *taskRuntime) deferDispatch(filenames []string, until time.Time) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for _, filename := range filenames {
+		delete(rt.dispatching, filename)
+		if _, ok := rt.remaining[filename]; ok {
+			rt.retryAt[filename] = until
+		}
+	}
+	rt.markDirtyLocked()
+}
+
+// releaseGID unbinds a download so its item is pending again.
+func (rt *taskRuntime) releaseGID(gid string) bool {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	filename, ok := rt.gidToFile[gid]
+	if !ok {
+		return false
+	}
+	delete(rt.gidToFile, gid)
+	if rt.fileToGID[filename] == gid {
+		delete(rt.fileToGID, filename)
+	}
+	rt.markDirtyLocked()
+	return true
+}
+
+// boundGIDsSnapshot returns a copy of the GID to filename bindings.
+func (rt *taskRuntime) boundGIDsSnapshot() map[string]string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	bound := make(map[string]string, len(rt.gidToFile))
+	for gid, filename := range rt.gidToFile {
+		bound[gid] = filename
+	}
+	return bound
+}
+
+// claimProxied claims filename for a file the proxy fetched when it still has
+// to be downloaded and is not being handed to the downloader, and returns the
+// GID it is bound to, if any. The item counts as dispatching until
+// markCompleted or unclaimProxied, so dispatchItems leaves it alone meanwhile.
+func (rt *taskRuntime) claimProxied(filename string) (string, bool) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if _, ok := rt.remaining[filename]; !ok {
+		return "", false
+	}
+	if _, dispatching := rt.dispatching[filename]; dispatching {
+		return "", false
+	}
+	rt.dispatching[filename] = struct{}{}
+	return rt.fileToGID[filename], true
+}
+
+// unclaimProxied gives back an item claimProxied claimed without storing it.
+func (rt *taskRuntime) unclaimProxied(filename string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	delete(rt.dispatching, filename)
+}
+
 func (rt *taskRuntime) markCompleted(filename string) bool {
 	rt.mu.Lock()
 	defer rt.mu.Unlock()
@@ -1050,6 +1897,8 @@ func (rt *taskRuntime) markCompleted(filename string) bool {
 	}
 	delete(rt.remaining, filename)
 	delete(rt.failed, filename)
+	delete(rt.failures, filename)
+	delete(rt.retryAt, filename)
 	delete(rt.dispatching, filename)
 	if gid, ok := rt.fileToGID[filename]; ok {
 		delete(rt.fileToGID, filename)
@@ -1062,7 +1911,7 @@ func (rt *taskRuntime) markCompleted(filename string) bool {
 	return true
 }
 
-func (rt *taskRuntime) markFailed(filename, errMsg string) bool {
+func (rt *taskRuntime) markFailed(filename, errMsg, errCode string) bool {
 	rt.mu.Lock()
 	defer rt.mu.Unlock()
 	rt.lastAccessAt = time.Now()
@@ -1074,17 +1923,79 @@ func (rt *taskRuntime) markFailed(filename, errMsg string) bool {
 		delete(rt.fileToGID, filename)
 		delete(rt.gidToFile, gid)
 	}
-	rt.failed[filename] = struct{}{}
+	failure := rt.failures[filename]
+	failure.Reason = errMsg
+	failure.ErrorCode = errCode
+	failure.Attempts++
+	failure.FailedAt = time.Now()
+	rt.failures[filename] = failure
+	if rt.retry.shouldRetry(failure.Attempts, classifyFailure(errMsg, errCode)) {
+		rt.retryAt[filename] = failure.FailedAt.Add(rt.retry.backoff(failure.Attempts))
+	} else {
+		delete(rt.retryAt, filename)
+		rt.failed[filename] = struct{}{}
+	}
 	rt.markDirtyLocked()
 	return true
 }
 
-func (rt *taskRuntime) pendingDispatchableCountLocked() int {
+// appendItems adds items appended to the manifest of a live task and returns
+// the new item and segment totals.
+func (rt *taskRuntime) appendItems(items []ManifestIndexItem) (int, int) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.lastAccessAt = time.Now()
+	for _, item := range items {
+		if _, ok := rt.remaining[item.Filename]; ok {
+			continue
+		}
+		rt.remaining[item.Filename] = item.Seq
+		for int(item.Seq) >= len(rt.segmentBySeq) {
+			rt.segmentBySeq = append(rt.segmentBySeq, false)
+		}
+		rt.totalItems++
+		if item.IsSegment {
+			rt.segmentBySeq[item.Seq] = true
+			rt.totalSegments++
+			rt.remainingSegments++
+		}
+	}
+	rt.markDirtyLocked()
+	return rt.totalItems, rt.totalSegments
+}
+
+func (rt *taskRuntime) stopRecording() {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.recording = false
+	rt.markDirtyLocked()
+}
+
+func (rt *taskRuntime) hasDueRetry(now time.Time) bool {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.paused {
+		return false
+	}
+	for _, retryAt := range rt.retryAt {
+		if !now.Before(retryAt) {
+			return true
+		}
+	}
+	return false
+}
+
+// pendingDispatchableCountLocked counts the items claimPending would hand out
+// at now; items waiting for their retry backoff are not due yet.
+func (rt *taskRuntime) pendingDispatchableCountLocked(now time.Time) int {
 	count := 0
 	for filename := range rt.remaining {
 		if _, failed := rt.failed[filename]; failed {
 			continue
 		}
+		if retryAt, waiting := rt.retryAt[filename]; waiting && now.Before(retryAt) {
+			continue
+		}
 		if _, active := rt.fileToGID[filename]; active {
 			continue
 		}
@@ -1106,6 +2017,79 @@ func (rt *taskRuntime) remainingFilenamesSnapshot() []string {
 	return items
 }
 
+// itemStateView is a point-in-time copy of the per-item runtime state used to
+// answer detail queries without holding the runtime lock.
+type itemStateView struct {
+	pending     map[string]struct{}
+	failed      map[string]struct{}
+	failures    map[string]ItemFailure
+	retryAt     map[string]time.Time
+	dispatching map[string]struct{}
+	fileToGID   map[string]string
+}
+
+func (rt *taskRuntime) itemStates() itemStateView {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	view := itemStateView{
+		pending:     make(map[string]struct{}, len(rt.remaining)),
+		failed:      make(map[string]struct{}, len(rt.failed)),
+		failures:    failureMap(rt.failures),
+		retryAt:     make(map[string]time.Time, len(rt.retryAt)),
+		dispatching: make(map[string]struct{}, len(rt.dispatching)),
+		fileToGID:   make(map[string]string, len(rt.fileToGID)),
+	}
+	for filename := range rt.remaining {
+		view.pending[filename] = struct{}{}
+	}
+	for filename := range rt.failed {
+		view.failed[filename] = struct{}{}
+	}
+	for filename, retryAt := range rt.retryAt {
+		view.retryAt[filename] = retryAt
+	}
+	for filename := range rt.dispatching {
+		view.dispatching[filename] = struct{}{}
+	}
+	for filename, gid := range rt.fileToGID {
+		view.fileToGID[filename] = gid
+	}
+	return view
+}
+
+func (v itemStateView) describe(seq uint32, item ManifestItem) TaskItemState {
+	state := TaskItemState{
+		Seq:      seq,
+		Filename: item.Filename,
+		URL:      item.URL,
+		Type:     normalizeManifestType(item.Type),
+		State:    ItemStateDone,
+	}
+	if _, ok := v.pending[item.Filename]; ok {
+		state.State = ItemStatePending
+	}
+	if gid, ok := v.fileToGID[item.Filename]; ok {
+		state.State = ItemStateDispatching
+		state.GID = gid
+	} else if _, ok := v.dispatching[item.Filename]; ok {
+		state.State = ItemStateDispatching
+	}
+	if _, ok := v.failed[item.Filename]; ok {
+		state.State = ItemStateFailed
+	}
+	if failure, ok := v.failures[item.Filename]; ok && state.State != ItemStateDone {
+		failedAt := failure.FailedAt
+		state.Reason = failure.Reason
+		state.ErrorCode = failure.ErrorCode
+		state.Attempts = failure.Attempts
+		state.FailedAt = &failedAt
+	}
+	if retryAt, ok := v.retryAt[item.Filename]; ok && state.State == ItemStatePending {
+		state.RetryAt = &retryAt
+	}
+	return state
+}
+
 type runtimeSnapshot struct {
 	Status             string
 	DoneItems          int
@@ -1121,19 +2105,13 @@ func (rt *taskRuntime) snapshot() (TaskProgressFile, runtimeSnapshot) {
 	doneItems := rt.totalItems - len(rt.remaining)
 	downloadedSegments := rt.totalSegments - rt.remainingSegments
 	failedItems := len(rt.failed)
-	status := TaskStatusDownloading
-	switch {
-	case len(rt.remaining) == 0:
-		status = TaskStatusCompleted
-	case rt.paused:
-		status = TaskStatusPaused
-	case failedItems > 0 && failedItems == len(rt.remaining) && len(rt.fileToGID) == 0 && len(rt.dispatching) == 0:
-		status = TaskStatusFailed
-	}
+	status := rt.statusLocked()
 
 	progress := TaskProgressFile{
 		TaskID:             rt.taskID,
 		Failed:             failedNames(rt.failed),
+		Failures:           copyFailures(rt.failures),
+		RetryAt:            copyRetryTimes(rt.retryAt),
 		DownloadedSegments: downloadedSegments,
 		DoneItems:          doneItems,
 		UpdatedAt:          time.Now(),
@@ -1163,16 +2141,22 @@ func (rt *taskRuntime) touch() {
 func (rt *taskRuntime) stateForEviction() (string, time.Time, bool) {
 	rt.mu.Lock()
 	defer rt.mu.Unlock()
-	status := TaskStatusDownloading
+	return rt.statusLocked(), rt.lastAccessAt, rt.dirty
+}
+
+// statusLocked derives the task status from the runtime. A live task that is
+// still recording stays downloading even when every known item is done or
+// failed, because the next reload may bring new segments.
+func (rt *taskRuntime) statusLocked() string {
 	switch {
-	case len(rt.remaining) == 0:
-		status = TaskStatusCompleted
+	case len(rt.remaining) == 0 && !rt.recording:
+		return TaskStatusCompleted
 	case rt.paused:
-		status = TaskStatusPaused
-	case len(rt.failed) > 0 && len(rt.failed) == len(rt.remaining) && len(rt.fileToGID) == 0 && len(rt.dispatching) == 0:
-		status = TaskStatusFailed
+		return TaskStatusPaused
+	case !rt.recording && len(rt.failed) > 0 && len(rt.failed) == len(rt.remaining) && len(rt.fileToGID) == 0 && len(rt.dispatching) == 0:
+		return TaskStatusFailed
 	}
-	return status, rt.lastAccessAt, rt.dirty
+	return TaskStatusDownloading
 }
 
 func (rt *taskRuntime) shouldFlush(now time.Time) bool {
@@ -1185,13 +2169,11 @@ func (rt *taskRuntime) shouldFlush(now time.Time) bool {
 		rt.dirtySince = now
 	}
 	wait := downloadingFlushInterval
-	switch {
-	case len(rt.remaining) == 0:
+	switch rt.statusLocked() {
+	case TaskStatusCompleted, TaskStatusFailed:
 		wait = terminalFlushInterval
-	case rt.paused:
+	case TaskStatusPaused:
 		wait = pausedFlushInterval
-	case len(rt.failed) > 0 && len(rt.failed) == len(rt.remaining) && len(rt.fileToGID) == 0 && len(rt.dispatching) == 0:
-		wait = terminalFlushInterval
 	}
 	return now.Sub(rt.dirtySince) >= wait
 }
@@ -1252,8 +2234,62 @@ func writeJSON(w http.ResponseWriter, value interface{}) {
 	_ = json.NewEncoder(w).Encode(value)
 }
 
-func defaultHeaders() map[string]string {
-	return config.GlobalConfig.Headers
+// RequestHeaders returns the configured headers overridden by the headers of
+// a task. Names are compared case-insensitively.
+func RequestHeaders(taskHeaders map[string]string) map[string]string {
+	headers := make(map[string]string, len(config.GlobalConfig.Headers)+len(taskHeaders))
+	for key, value := range config.GlobalConfig.Headers {
+		headers[http.CanonicalHeaderKey(key)] = value
+	}
+	for key, value := range taskHeaders {
+		headers[http.CanonicalHeaderKey(key)] = value
+	}
+	return headers
+}
+
+// TaskRequestHeaders returns the headers for upstream requests of a task; an
+// unknown task gets the configured headers.
+func (m *Manager) TaskRequestHeaders(taskID string) map[string]string {
+	taskHeaders, err := m.GetTaskHeaders(taskID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("load task headers failed task=%s: %v", taskID, err)
+	}
+	return RequestHeaders(taskHeaders)
+}
+
+// validateHeaders rejects header names and values that cannot be sent as is.
+func validateHeaders(headers map[string]string) error {
+	for key, value := range headers {
+		if key == "" || strings.ContainsAny(key, " \t\r\n:") {
+			return fmt.Errorf("invalid header name %q", key)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid value for header %s", key)
+		}
+	}
+	return nil
+}
+
+// itemOptions keeps ranged items on a single connection; aria2 would otherwise
+// split them with its own Range requests and ignore the slice we asked for.
+func itemOptions(item ManifestItem) map[string]string {
+	if item.Length <= 0 {
+		return nil
+	}
+	return map[string]string{"split": "1"}
+}
+
+// itemHeaders adds a Range header for items that are only a slice of their URL.
+func itemHeaders(item ManifestItem, taskHeaders map[string]string) map[string]string {
+	if item.Length <= 0 {
+		return taskHeaders
+	}
+	headers := make(map[string]string, len(taskHeaders)+1)
+	for key, value := range taskHeaders {
+		headers[key] = value
+	}
+	headers["Range"] = playlist.RangeHeader(item.Length, item.Offset)
+	return headers
 }
 
 func failedSet(names []string) map[string]struct{} {
@@ -1267,6 +2303,55 @@ func failedSet(names []string) map[string]struct{} {
 	return out
 }
 
+func failureMap(in map[string]ItemFailure) map[string]ItemFailure {
+	out := make(map[string]ItemFailure, len(in))
+	for name, failure := range in {
+		if strings.TrimSpace(name) == "" {
+			continue
+		}
+		out[name] = failure
+	}
+	return out
+}
+
+func copyFailures(in map[string]ItemFailure) map[string]ItemFailure {
+	if len(in) == 0 {
+		return nil
+	}
+	out := make(map[string]ItemFailure, len(in))
+	for name, failure := range in {
+		out[name] = failure
+	}
+	return out
+}
+
+// retryTimes keeps the stored retry times of items that are still remaining
+// and not failed for good.
+func retryTimes(in map[string]time.Time, remaining map[string]uint32, failed map[string]struct{}) map[string]time.Time {
+	out := make(map[string]time.Time, len(in))
+	for name, at := range in {
+		if _, ok := remaining[name]; !ok {
+			continue
+		}
+		if _, ok := failed[name]; ok {
+			continue
+		}
+		out[name] = at
+	}
+	return out
+}
+
+func copyRetryTimes(in map[string]time.Time) map[string]time.Time {
+	if len(in) == 0 {
+		return nil
+	}
+	out := make(map[string]time.Time, len(in))
+	for name, at := range in {
+		out[name] = at
+	}
+	return out
+}
+
 func failedNames(in map[string]struct{}) []string {
 	out := make([]string, 0, len(in))
 	for key := range in {
@@ -1276,8 +2361,11 @@ func failedNames(in map[string]struct{}) []string {
 }
 
 func normalizeManifestType(itemType string) string {
-	if strings.EqualFold(strings.TrimSpace(itemType), "key") {
+	switch strings.ToLower(strings.TrimSpace(itemType)) {
+	case "key":
 		return "key"
+	case "map":
+		return "map"
 	}
 	return "segment"
 }
@@ -1291,6 +2379,14 @@ func cleanupResumeArtifacts(taskID, filename string) error {
 	return nil
 }
 
+func taskIDsOf(tasks []TaskMetadata) []string {
+	ids := make([]string, 0, len(tasks))
+	for _, meta := range tasks {
+		ids = append(ids, meta.ID)
+	}
+	return ids
+}
+
 func keysOfMap(m map[string]string) []string {
 	keys := make([]string, 0, len(m))
 	for key := range m {
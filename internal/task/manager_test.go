@@ -1,12 +1,17 @@
 package task
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -213,7 +218,7 @@ func TestProgressSnapshotUsesCompactFailedOnlyFormat(t *testing.T) {
 	if !rt.markCompleted("00001.ts") {
 		t.Fatal("expected first item to complete")
 	}
-	if !rt.markFailed("00002.ts", "boom") {
+	if !rt.markFailed("00002.ts", "boom", "") {
 		t.Fatal("expected second item to fail")
 	}
 
@@ -300,16 +305,14 @@ func TestCompletedTaskRejectsPauseResumeRetryWithoutLoadingRuntime(t *testing.T)
 }
 
 func TestRuntimeMetricsReportsRuntimeDirtyAndFlushStats(t *testing.T) {
-	db, err := sql.Open("sqlite", ":memory:")
-	if err != nil {
-		t.Fatalf("open sqlite: %v", err)
-	}
-	t.Cleanup(func() { _ = db.Close() })
+	oldCacheDir := config.GlobalConfig.CacheDir
+	config.GlobalConfig.CacheDir = t.TempDir()
+	t.Cleanup(func() { config.GlobalConfig.CacheDir = oldCacheDir })
 
-	m, err := NewManager(nil, db)
-	if err != nil {
-		t.Fatalf("NewManager: %v", err)
-	}
+	// Without background loops, so the dirty runtime is never flushed.
+	m := newTestManager(t)
+	m.runtimes = make(map[string]*taskRuntime)
+	m.dispatches = make(map[string]context.CancelFunc)
 
 	rt := newTaskRuntime("metrics-task", 1, 1, []ManifestIndexItem{
 		{Seq: 0, Filename: "00001.ts", IsSegment: true},
@@ -422,7 +425,7 @@ func TestDeleteTaskAsyncCleansAria2ByDirImmediately(t *testing.T) {
 	})
 
 	m := &Manager{
-		aria2: &downloader.Aria2Client{
+		downloader: &downloader.Aria2Client{
 			RPCUrl: srv.URL,
 			Client: &http.Client{Timeout: time.Second},
 		},
@@ -472,3 +475,814 @@ func TestDeleteTaskAsyncCleansAria2ByDirImmediately(t *testing.T) {
 		t.Fatal("task should be removed from db")
 	}
 }
+
+func TestRecoverTaskRebindsQueuedGIDsAndDispatchesOnlyMissingItems(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("open sqlite: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	oldCacheDir := config.GlobalConfig.CacheDir
+	tempDir := t.TempDir()
+	config.GlobalConfig.CacheDir = tempDir
+	t.Cleanup(func() {
+		config.GlobalConfig.CacheDir = oldCacheDir
+	})
+
+	const taskID = "recover-task"
+	taskDir := cache.GetTaskDir(taskID)
+	added := make(chan string, 8)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+
+		var req downloader.JsonRpcRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+			return
+		}
+
+		resp := downloader.JsonRpcResponse{ID: req.ID}
+		switch req.Method {
+		case "aria2.tellActive":
+			resp.Result = []map[string]string{
+				{"gid": "active-1", "dir": taskDir},
+			}
+		case "aria2.tellWaiting":
+			resp.Result = []map[string]string{}
+		case "system.multicall":
+			calls := req.Params[0].([]interface{})
+			results := make([]interface{}, 0, len(calls))
+			for _, raw := range calls {
+				call := raw.(map[string]interface{})
+				switch call["methodName"] {
+				case "aria2.tellStatus":
+					results = append(results, []interface{}{map[string]interface{}{
+						"gid":    "active-1",
+						"status": "active",
+						"dir":    taskDir,
+						"files":  []map[string]string{{"path": filepath.Join(taskDir, "00002.ts")}},
+					}})
+				case "aria2.addUri":
+					opts := call["params"].([]interface{})[1].(map[string]interface{})
+					added <- opts["out"].(string)
+					results = append(results, []interface{}{"gid-new"})
+				default:
+					t.Errorf("unexpected multicall method %v", call["methodName"])
+				}
+			}
+			resp.Result = results
+		default:
+			t.Errorf("unexpected method %s", req.Method)
+		}
+
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			t.Errorf("encode response: %v", err)
+		}
+	}))
+	defer srv.Close()
+
+	m := &Manager{
+		downloader: &downloader.Aria2Client{
+			RPCUrl: srv.URL,
+			Client: &http.Client{Timeout: time.Second},
+		},
+		db:         db,
+		deleteSem:  make(chan struct{}, 1),
+		runtimes:   make(map[string]*taskRuntime),
+		dispatches: make(map[string]context.CancelFunc),
+	}
+	if err := m.InitTable(); err != nil {
+		t.Fatalf("InitTable: %v", err)
+	}
+
+	meta := TaskMetadata{
+		ID:            taskID,
+		Name:          taskID,
+		OriginalURL:   "https://example.com/recover.m3u8",
+		CreatedTime:   time.Now(),
+		UpdatedTime:   time.Now(),
+		TotalItems:    3,
+		TotalSegments: 3,
+		Status:        TaskStatusDownloading,
+	}
+	if err := m.CreateTask(meta); err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	manifest := buildManifest(taskID, meta.OriginalURL, []playlist.DownloadItem{
+		{Filename: "00001.ts", URL: "https://example.com/1.ts", Type: "segment"},
+		{Filename: "00002.ts", URL: "https://example.com/2.ts", Type: "segment"},
+		{Filename: "00003.ts", URL: "https://example.com/3.ts", Type: "segment"},
+	}, 3)
+	if err := m.SaveTaskManifest(manifest); err != nil {
+		t.Fatalf("SaveTaskManifest: %v", err)
+	}
+	if err := writeJSONAtomic(taskProgressPath(taskID), buildInitialProgress(manifest)); err != nil {
+		t.Fatalf("write progress: %v", err)
+	}
+	if err := os.WriteFile(cache.GetFilePath(taskID, "00001.ts"), []byte("done"), 0644); err != nil {
+		t.Fatalf("WriteFile segment: %v", err)
+	}
+
+	if err := m.recoverTask(taskID); err != nil {
+		t.Fatalf("recoverTask: %v", err)
+	}
+
+	select {
+	case filename := <-added:
+		if filename != "00003.ts" {
+			t.Fatalf("dispatched %q, want 00003.ts", filename)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("missing item was not re-dispatched")
+	}
+	select {
+	case filename := <-added:
+		t.Fatalf("unexpected extra dispatch of %q", filename)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	rt, err := m.loadRuntime(taskID)
+	if err != nil {
+		t.Fatalf("loadRuntime: %v", err)
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.fileToGID["00002.ts"] != "active-1" {
+		t.Fatalf("00002.ts gid = %q, want active-1", rt.fileToGID["00002.ts"])
+	}
+	if _, ok := rt.remaining["00001.ts"]; ok {
+		t.Fatal("00001.ts on disk should be counted as done")
+	}
+}
+
+func TestRecoverInterruptedTasksFailsBrokenTasksAndWaitsForDownloader(t *testing.T) {
+	m := newTestManager(t)
+	m.runtimes = make(map[string]*taskRuntime)
+	m.dispatches = make(map[string]context.CancelFunc)
+	oldCacheDir := config.GlobalConfig.CacheDir
+	config.GlobalConfig.CacheDir = t.TempDir()
+	t.Cleanup(func() { config.GlobalConfig.CacheDir = oldCacheDir })
+
+	var down atomic.Bool
+	down.Store(true)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+			return
+		}
+		var req downloader.JsonRpcRequest
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		_ = json.NewEncoder(w).Encode(downloader.JsonRpcResponse{ID: req.ID, Result: []interface{}{}})
+	}))
+	t.Cleanup(srv.Close)
+	m.downloader = &downloader.Aria2Client{RPCUrl: srv.URL, Client: &http.Client{Timeout: time.Second}}
+
+	for _, id := range []string{"broken-progress", "waits-for-aria2"} {
+		meta := TaskMetadata{ID: id, OriginalURL: "https://example.com/" + id + ".m3u8", CreatedTime: time.Now(), UpdatedTime: time.Now(),
+			TotalItems: 1, TotalSegments: 1, Status: TaskStatusDownloading}
+		if err := m.CreateTask(meta); err != nil {
+			t.Fatalf("CreateTask: %v", err)
+		}
+		manifest := buildManifest(id, meta.OriginalURL, []playlist.DownloadItem{{Filename: "00001.ts", URL: "https://example.com/1.ts", Type: "segment"}}, 1)
+		if err := m.SaveTaskManifest(manifest); err != nil {
+			t.Fatalf("SaveTaskManifest: %v", err)
+		}
+	}
+	if err := os.MkdirAll(cache.GetTaskDir("broken-progress"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(taskProgressPath("broken-progress"), []byte("{not json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.recoverInterruptedTasks([]string{"broken-progress", "waits-for-aria2"})
+		close(done)
+	}()
+	broken := waitForTaskStatus(t, m, "broken-progress", TaskStatusFailed)
+	if !strings.Contains(broken.Error, "not resumed") {
+		t.Fatalf("error = %q, want why the task was not resumed", broken.Error)
+	}
+	if meta, _ := m.GetTask("waits-for-aria2"); meta.Status != TaskStatusDownloading {
+		t.Fatalf("status = %s, an unreachable downloader should not fail the task", meta.Status)
+	}
+	down.Store(false)
+	select {
+	case <-done:
+	case <-time.After(2 * recoveryRetryInterval):
+		t.Fatal("recovery did not finish once the downloader answered")
+	}
+	// The dispatch recovery started writes progress.json when it ends, which
+	// has to happen before CacheDir is restored.
+	deadline := time.Now().Add(5 * time.Second)
+	for m.hasDispatch("waits-for-aria2") {
+		if time.Now().After(deadline) {
+			t.Fatal("the dispatch of the recovered task did not finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUnreachableDownloaderDefersItemsWithoutCountingAttempts(t *testing.T) {
+	m, rt := newHTTPDownloadTask(t, "downloader-down", "https://example.com", 2)
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+	m.downloader = &downloader.Aria2Client{RPCUrl: srv.URL, Client: &http.Client{Timeout: time.Second}}
+
+	before := time.Now()
+	filenames := rt.claimPending(10)
+	if m.dispatchItems("downloader-down", rt, filenames, nil) {
+		t.Fatal("dispatchItems should stop when the downloader is unreachable")
+	}
+	rt.mu.Lock()
+	failures, failed := len(rt.failures), len(rt.failed)
+	retryAt := copyRetryTimes(rt.retryAt)
+	rt.mu.Unlock()
+	if failures != 0 || failed != 0 {
+		t.Fatalf("failures = %d, failed = %d, an unreachable downloader is not a failed attempt", failures, failed)
+	}
+	if len(retryAt) != 2 || !retryAt["00001.ts"].After(before) {
+		t.Fatalf("retryAt = %v, want both items queued again later", retryAt)
+	}
+
+	progress, _ := rt.snapshot()
+	reloaded := newTaskRuntime("downloader-down", 2, 2, []ManifestIndexItem{
+		{Seq: 0, Filename: "00001.ts", IsSegment: true},
+		{Seq: 1, Filename: "00002.ts", IsSegment: true},
+	}, progress, false)
+	if got := reloaded.retryAt["00001.ts"]; !got.Equal(retryAt["00001.ts"]) {
+		t.Fatalf("retryAt after reload = %v, want %v", got, retryAt["00001.ts"])
+	}
+	if items := reloaded.claimPending(10); len(items) != 0 {
+		t.Fatalf("claimed %v before the stored retry time", items)
+	}
+}
+
+func TestMarkFailedRecordsReasonAndSurvivesProgressRoundTrip(t *testing.T) {
+	manifestIndex := []ManifestIndexItem{
+		{Seq: 0, Filename: "00001.ts", IsSegment: true},
+		{Seq: 1, Filename: "00002.ts", IsSegment: true},
+	}
+	rt := newTaskRuntime("task-failure", 2, 2, manifestIndex, TaskProgressFile{TaskID: "task-failure", Failed: []string{}}, false)
+
+	rt.markFailed("00001.ts", "connection timed out", "2")
+	rt.markFailed("00001.ts", "HTTP 403", "22")
+
+	progress, _ := rt.snapshot()
+	failure, ok := progress.Failures["00001.ts"]
+	if !ok {
+		t.Fatal("expected failure record for 00001.ts")
+	}
+	if failure.Reason != "HTTP 403" || failure.ErrorCode != "22" {
+		t.Fatalf("failure = %#v, want last reason and code", failure)
+	}
+	if failure.Attempts != 2 {
+		t.Fatalf("attempts = %d, want 2", failure.Attempts)
+	}
+	if failure.FailedAt.IsZero() {
+		t.Fatal("failed_at should be set")
+	}
+
+	restored := newTaskRuntime("task-failure", 2, 2, manifestIndex, progress, false)
+	if restored.failures["00001.ts"].Attempts != 2 {
+		t.Fatalf("restored attempts = %d, want 2", restored.failures["00001.ts"].Attempts)
+	}
+
+	restored.markCompleted("00001.ts")
+	progress, _ = restored.snapshot()
+	if _, ok := progress.Failures["00001.ts"]; ok {
+		t.Fatal("completed item should drop its failure record")
+	}
+}
+
+func TestGetTaskDetailReportsPerItemStates(t *testing.T) {
+	m := newTestManager(t)
+	m.runtimes = make(map[string]*taskRuntime)
+
+	oldCacheDir := config.GlobalConfig.CacheDir
+	config.GlobalConfig.CacheDir = t.TempDir()
+	t.Cleanup(func() {
+		config.GlobalConfig.CacheDir = oldCacheDir
+	})
+
+	meta := TaskMetadata{
+		ID:            "detail-task",
+		Name:          "detail-task",
+		OriginalURL:   "https://example.com/detail.m3u8",
+		CreatedTime:   time.Now(),
+		UpdatedTime:   time.Now(),
+		TotalItems:    4,
+		TotalSegments: 4,
+		Status:        TaskStatusDownloading,
+	}
+	if err := m.CreateTask(meta); err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	manifest := buildManifest(meta.ID, meta.OriginalURL, []playlist.DownloadItem{
+		{Filename: "00001.ts", URL: "https://example.com/1.ts", Type: "segment"},
+		{Filename: "00002.ts", URL: "https://example.com/2.ts", Type: "segment"},
+		{Filename: "00003.ts", URL: "https://example.com/3.ts", Type: "segment"},
+		{Filename: "00004.ts", URL: "https://example.com/4.ts", Type: "segment"},
+	}, 4)
+	if err := m.SaveTaskManifest(manifest); err != nil {
+		t.Fatalf("SaveTaskManifest: %v", err)
+	}
+	if err := writeJSONAtomic(taskProgressPath(meta.ID), buildInitialProgress(manifest)); err != nil {
+		t.Fatalf("write progress: %v", err)
+	}
+
+	rt, err := m.loadRuntime(meta.ID)
+	if err != nil {
+		t.Fatalf("loadRuntime: %v", err)
+	}
+	rt.markCompleted("00001.ts")
+	rt.bindGID("00002.ts", "gid-2")
+	rt.markFailed("00003.ts", "HTTP 404", "3")
+
+	detail, err := m.GetTaskDetail(meta.ID)
+	if err != nil {
+		t.Fatalf("GetTaskDetail: %v", err)
+	}
+	if detail.ID != meta.ID || len(detail.Items) != 4 {
+		t.Fatalf("unexpected detail: id=%q items=%d", detail.ID, len(detail.Items))
+	}
+
+	want := []string{ItemStateDone, ItemStateDispatching, ItemStateFailed, ItemStatePending}
+	for i, state := range want {
+		if detail.Items[i].State != state {
+			t.Fatalf("items[%d].state = %q, want %q", i, detail.Items[i].State, state)
+		}
+	}
+	if detail.Items[1].GID != "gid-2" {
+		t.Fatalf("items[1].gid = %q, want gid-2", detail.Items[1].GID)
+	}
+	failed := detail.Items[2]
+	if failed.Reason != "HTTP 404" || failed.ErrorCode != "3" || failed.Attempts != 1 || failed.FailedAt == nil {
+		t.Fatalf("unexpected failed item: %#v", failed)
+	}
+}
+
+func TestStoreProxiedFileCompletesOnlyPendingItems(t *testing.T) {
+	m := newTestManager(t)
+	m.runtimes = make(map[string]*taskRuntime)
+
+	oldCacheDir := config.GlobalConfig.CacheDir
+	config.GlobalConfig.CacheDir = t.TempDir()
+	t.Cleanup(func() {
+		config.GlobalConfig.CacheDir = oldCacheDir
+	})
+
+	meta := TaskMetadata{
+		ID:            "write-through",
+		OriginalURL:   "https://example.com/wt.m3u8",
+		CreatedTime:   time.Now(),
+		UpdatedTime:   time.Now(),
+		TotalItems:    3,
+		TotalSegments: 3,
+		Status:        TaskStatusDownloading,
+	}
+	if err := m.CreateTask(meta); err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	manifest := buildManifest(meta.ID, meta.OriginalURL, []playlist.DownloadItem{
+		{Filename: "00001.ts", URL: "https://example.com/1.ts", Type: "segment"},
+		{Filename: "00002.ts", URL: "https://example.com/2.ts", Type: "segment"},
+		{Filename: "00003.ts", URL: "https://example.com/3.ts", Type: "segment"},
+	}, 3)
+	if err := m.SaveTaskManifest(manifest); err != nil {
+		t.Fatalf("SaveTaskManifest: %v", err)
+	}
+	if err := writeJSONAtomic(taskProgressPath(meta.ID), buildInitialProgress(manifest)); err != nil {
+		t.Fatalf("write progress: %v", err)
+	}
+	rt, err := m.loadRuntime(meta.ID)
+	if err != nil {
+		t.Fatalf("loadRuntime: %v", err)
+	}
+	rt.bindGID("00001.ts", "gid-1")
+	if err := os.WriteFile(cache.GetFilePath(meta.ID, "00002.ts.aria2"), nil, 0644); err != nil {
+		t.Fatalf("write control file: %v", err)
+	}
+
+	storeFrom := func(fetched ManifestItem) (bool, string) {
+		t.Helper()
+		tmp := filepath.Join(cache.GetTaskDir(meta.ID), "."+fetched.Filename+".tmp")
+		if err := os.WriteFile(tmp, []byte("data-"+fetched.Filename), 0644); err != nil {
+			t.Fatalf("write temp file: %v", err)
+		}
+		stored, err := m.StoreProxiedFile(meta.ID, fetched, tmp)
+		if err != nil {
+			t.Fatalf("StoreProxiedFile(%s): %v", fetched.Filename, err)
+		}
+		return stored, tmp
+	}
+	urls := make(map[string]string, len(manifest.Items))
+	for _, item := range manifest.Items {
+		urls[item.Filename] = item.URL
+	}
+	store := func(filename string) (bool, string) {
+		t.Helper()
+		return storeFrom(ManifestItem{Filename: filename, URL: urls[filename]})
+	}
+	// Only the URL and byte range of the manifest item may be stored.
+	for _, fetched := range []ManifestItem{
+		{Filename: "00001.ts", URL: "https://evil.example.com/1.ts"},
+		{Filename: "00001.ts", URL: "https://example.com/2.ts"},
+		{Filename: "00001.ts", URL: "https://example.com/1.ts", Offset: 10, Length: 20},
+	} {
+		if stored, _ := storeFrom(fetched); stored {
+			t.Fatalf("%+v does not match the manifest and should not be stored", fetched)
+		}
+	}
+	if stored, _ := store("00001.ts"); !stored {
+		t.Fatal("a pending item should be stored")
+	}
+	if data, _ := os.ReadFile(cache.GetFilePath(meta.ID, "00001.ts")); string(data) != "data-00001.ts" {
+		t.Fatalf("stored file = %q", data)
+	}
+	for _, filename := range []string{"00001.ts", "00002.ts", "unknown.ts"} {
+		stored, tmp := store(filename)
+		if stored {
+			t.Fatalf("%s should not be stored", filename)
+		}
+		if _, err := os.Stat(tmp); err != nil {
+			t.Fatalf("temp file of %s should be left to the caller: %v", filename, err)
+		}
+	}
+
+	_, snapshot := rt.snapshot()
+	if snapshot.DoneItems != 1 || snapshot.DownloadedSegments != 1 {
+		t.Fatalf("snapshot = %+v, want the stored item done", snapshot)
+	}
+	if _, bound := rt.fileToGID["00001.ts"]; bound {
+		t.Fatal("the aria2 binding of the stored item should be dropped")
+	}
+
+	// A claimed item is not dispatched, and a failed store gives it back.
+	if _, claimed := rt.claimProxied("00003.ts"); !claimed {
+		t.Fatal("00003.ts should be claimable")
+	}
+	if claimed := rt.claimPending(10); !slices.Equal(claimed, []string{"00002.ts"}) {
+		t.Fatalf("claimPending = %v, want only 00002.ts", claimed)
+	}
+	rt.unclaimProxied("00003.ts")
+	if _, err := m.StoreProxiedFile(meta.ID, ManifestItem{Filename: "00003.ts", URL: "https://example.com/3.ts"}, filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("storing a missing temp file should fail")
+	}
+	if claimed := rt.claimPending(10); !slices.Equal(claimed, []string{"00003.ts"}) {
+		t.Fatalf("claimPending = %v, want 00003.ts back after the failed store", claimed)
+	}
+}
+
+func postAddRequest(t *testing.T, m *Manager, body string, trigger func(context.Context, AddTaskRequest) error) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/tasks", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	m.HandleAdd(rec, req, trigger)
+	return rec
+}
+
+func waitForTaskStatus(t *testing.T, m *Manager, taskID, status string) *TaskMetadata {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		meta, err := m.GetTask(taskID)
+		if err == nil && meta.Status == status {
+			return meta
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("task %s did not reach status %s: %+v, %v", taskID, status, meta, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHandleAddListsTaskAndRecordsCreationFailure(t *testing.T) {
+	m := newLiveTestManager(t)
+	const rawURL = "https://example.com/missing.m3u8"
+	release := make(chan struct{})
+	rec := postAddRequest(t, m, `{"url": "`+rawURL+`"}`, func(ctx context.Context, req AddTaskRequest) error {
+		<-release
+		return fmt.Errorf("bad status code: 404")
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d body = %s", rec.Code, rec.Body.String())
+	}
+	taskID := cache.GetTaskID(rawURL)
+	tasks, err := m.GetTasks()
+	if err != nil || len(tasks) != 1 || tasks[0].ID != taskID {
+		t.Fatalf("tasks = %+v, %v, want the submitted task listed", tasks, err)
+	}
+	if _, err := m.PauseTask(taskID); err == nil {
+		t.Fatal("pause should be rejected while the task is being created")
+	}
+	close(release)
+
+	meta := waitForTaskStatus(t, m, taskID, TaskStatusFailed)
+	if meta.Error != "bad status code: 404" {
+		t.Fatalf("error = %q, want the creation error", meta.Error)
+	}
+	if _, err := m.RetryTask(taskID); err == nil || !strings.Contains(err.Error(), "could not be created") {
+		t.Fatalf("retry error = %v, want a creation failure", err)
+	}
+	if rec := postAddRequest(t, m, `{"url": "`+rawURL+`"}`, nil); rec.Code != http.StatusConflict {
+		t.Fatalf("second add status = %d, want 409 while the failed task exists", rec.Code)
+	}
+}
+
+func TestDeleteCancelsTaskCreation(t *testing.T) {
+	m := newLiveTestManager(t)
+	const rawURL = "https://example.com/slow.m3u8"
+	started := make(chan struct{})
+	createErr := make(chan error, 1)
+	rec := postAddRequest(t, m, `{"url": "`+rawURL+`"}`, func(ctx context.Context, req AddTaskRequest) error {
+		close(started)
+		<-ctx.Done()
+		// A creation that finishes after the cancellation must not store the task.
+		_, err := m.CreateTaskWithItems(TaskMetadata{ID: req.TaskID, Name: req.Name, OriginalURL: req.URL, TotalSegments: 1},
+			[]playlist.DownloadItem{{URL: "https://example.com/1.ts", Filename: "00001.ts", Type: "ts"}})
+		createErr <- err
+		return err
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d body = %s", rec.Code, rec.Body.String())
+	}
+	<-started
+	taskID := cache.GetTaskID(rawURL)
+	waitForTaskStatus(t, m, taskID, TaskStatusParsing)
+
+	if err := m.DeleteTask(taskID); err != nil {
+		t.Fatalf("DeleteTask: %v", err)
+	}
+	if err := <-createErr; err == nil {
+		t.Fatal("creating a cancelled task should fail")
+	}
+	if _, err := m.GetTask(taskID); err != sql.ErrNoRows {
+		t.Fatalf("GetTask after cancel = %v, want no row", err)
+	}
+}
+
+func TestHandleAddCreatesTaskUnderReservedID(t *testing.T) {
+	m := newLiveTestManager(t)
+	const masterURL = "https://example.com/master.m3u8"
+	rec := postAddRequest(t, m, `{"url": "`+masterURL+`", "name": "Show"}`, func(ctx context.Context, req AddTaskRequest) error {
+		// Like a master playlist narrowed down to a variant with another URL.
+		created, err := m.CreateTaskWithItems(TaskMetadata{
+			ID:            req.TaskID,
+			Name:          req.Name,
+			OriginalURL:   "https://example.com/720p.m3u8",
+			TotalSegments: 1,
+		}, []playlist.DownloadItem{{URL: "https://example.com/1.ts", Filename: "00001.ts", Type: "ts"}})
+		if err == nil && !created {
+			err = fmt.Errorf("task already exists")
+		}
+		return err
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status = %d body = %s", rec.Code, rec.Body.String())
+	}
+	meta := waitForTaskStatus(t, m, cache.GetTaskID(masterURL), TaskStatusDownloading)
+	if meta.Name != "Show" || meta.TotalItems != 1 || meta.Error != "" {
+		t.Fatalf("task = %+v, want the created task in place of the pending row", meta)
+	}
+}
+
+// newHTTPDownloadTask creates a downloading task of segments 1.ts to n.ts on
+// origin, with the built-in HTTP downloader feeding its notifications back.
+func newHTTPDownloadTask(t *testing.T, id, origin string, segments int) (*Manager, *taskRuntime) {
+	t.Helper()
+	m := newTestManager(t)
+	m.runtimes = make(map[string]*taskRuntime)
+	m.dispatches = make(map[string]context.CancelFunc)
+	oldCacheDir := config.GlobalConfig.CacheDir
+	config.GlobalConfig.CacheDir = t.TempDir()
+	t.Cleanup(func() { config.GlobalConfig.CacheDir = oldCacheDir })
+
+	dl := downloader.NewHTTPDownloader(2)
+	m.downloader = dl
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() {
+		_ = dl.ListenNotifications(ctx, func(method, gid string) {
+			m.applyAria2Event(aria2NotificationEvent{Method: method, GID: gid})
+		})
+	}()
+
+	meta := TaskMetadata{
+		ID:            id,
+		OriginalURL:   origin + "/index.m3u8",
+		CreatedTime:   time.Now(),
+		UpdatedTime:   time.Now(),
+		TotalItems:    segments,
+		TotalSegments: segments,
+		Status:        TaskStatusDownloading,
+	}
+	if err := m.CreateTask(meta); err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	items := make([]playlist.DownloadItem, 0, segments)
+	for i := 1; i <= segments; i++ {
+		items = append(items, playlist.DownloadItem{Filename: fmt.Sprintf("0000%d.ts", i), URL: fmt.Sprintf("%s/%d.ts", origin, i), Type: "segment"})
+	}
+	manifest := buildManifest(meta.ID, meta.OriginalURL, items, segments)
+	if err := m.SaveTaskManifest(manifest); err != nil {
+		t.Fatalf("SaveTaskManifest: %v", err)
+	}
+	if err := writeJSONAtomic(taskProgressPath(meta.ID), buildInitialProgress(manifest)); err != nil {
+		t.Fatalf("write progress: %v", err)
+	}
+	rt, err := m.loadRuntime(meta.ID)
+	if err != nil {
+		t.Fatalf("loadRuntime: %v", err)
+	}
+	return m, rt
+}
+
+func waitRuntimeStatus(t *testing.T, rt *taskRuntime, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, _, _ := rt.stateForEviction()
+		if status == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("task status = %s, want %s", status, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDispatchWithHTTPDownloaderCompletesItems(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/3.ts" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte("segment " + r.URL.Path))
+	}))
+	t.Cleanup(origin.Close)
+	m, rt := newHTTPDownloadTask(t, "http-downloader", origin.URL, 3)
+
+	m.StartDispatch("http-downloader")
+	waitRuntimeStatus(t, rt, TaskStatusFailed)
+	for _, name := range []string{"00001.ts", "00002.ts"} {
+		if _, err := m.LocalFilePath("http-downloader", name); err != nil {
+			t.Fatalf("LocalFilePath(%s): %v", name, err)
+		}
+	}
+	rt.mu.Lock()
+	failure := rt.failures["00003.ts"]
+	rt.mu.Unlock()
+	if failure.ErrorCode != "3" || !strings.Contains(failure.Reason, "404") {
+		t.Fatalf("failure = %+v, want the not found error of the HTTP downloader", failure)
+	}
+}
+
+func TestLostDownloadIsDispatchedAgainWithoutFailure(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("segment " + r.URL.Path))
+	}))
+	t.Cleanup(origin.Close)
+	m, rt := newHTTPDownloadTask(t, "lost-download", origin.URL, 2)
+	// Both items are bound to downloads of an instance that went down.
+	rt.bindGID("00001.ts", "gone/1")
+	rt.bindGID("00002.ts", "gone/2")
+
+	m.applyAria2Event(aria2NotificationEvent{Method: downloader.EventDownloadLost, GID: "gone/1"})
+	m.applyAria2Event(aria2NotificationEvent{Method: downloader.EventDownloadLost, GID: "gone/2"})
+	waitRuntimeStatus(t, rt, TaskStatusCompleted)
+	rt.mu.Lock()
+	failures := len(rt.failures)
+	rt.mu.Unlock()
+	if failures != 0 {
+		t.Fatalf("failures = %d, a lost download is not a failed attempt", failures)
+	}
+}
+
+// restartedDownloader is a downloader after a restart whose queue holds the
+// queued GIDs; asking for single GIDs fails the test.
+type restartedDownloader struct {
+	downloader.Downloader
+	t      *testing.T
+	queued []string
+}
+
+func (d *restartedDownloader) QueueStatusesByDir(string) ([]downloader.StatusDetail, error) {
+	statuses := make([]downloader.StatusDetail, 0, len(d.queued))
+	for _, gid := range d.queued {
+		statuses = append(statuses, downloader.StatusDetail{Gid: gid, Status: "waiting"})
+	}
+	return statuses, nil
+}
+
+func (d *restartedDownloader) BatchTellStatus(gids []string) (map[string]downloader.StatusDetail, error) {
+	d.t.Errorf("BatchTellStatus(%v) after a session change", gids)
+	return d.Downloader.BatchTellStatus(gids)
+}
+
+func TestResyncAfterSessionChangeReleasesGIDsTheNewSessionLacks(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("segment " + r.URL.Path))
+	}))
+	t.Cleanup(origin.Close)
+	m, rt := newHTTPDownloadTask(t, "resync-session", origin.URL, 3)
+	m.downloader = &restartedDownloader{Downloader: m.downloader, t: t, queued: []string{"a/2"}}
+	// Instance a restarted and restored a/2 from its session file; b did not
+	// restart.
+	rt.bindGID("00001.ts", "a/1")
+	rt.bindGID("00002.ts", "a/2")
+	rt.bindGID("00003.ts", "b/3")
+
+	m.resyncBindings(aria2NotificationEvent{Method: downloader.EventSessionChanged, GID: "a/", SessionChanged: true})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rt.mu.Lock()
+		_, pending := rt.remaining["00001.ts"]
+		rt.mu.Unlock()
+		if !pending {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the download lost with the old session was not queued again")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.gidToFile["a/2"] != "00002.ts" || rt.gidToFile["b/3"] != "00003.ts" {
+		t.Fatalf("bindings = %v, want the restored and the other instance's downloads kept", rt.gidToFile)
+	}
+}
+
+// stoppedDownloader has the downloads of queued in its queue and reports
+// the others as complete.
+type stoppedDownloader struct {
+	downloader.Downloader
+	queued []string
+	asked  []string
+}
+
+func (d *stoppedDownloader) QueueStatusesByDir(string) ([]downloader.StatusDetail, error) {
+	statuses := make([]downloader.StatusDetail, 0, len(d.queued))
+	for _, gid := range d.queued {
+		statuses = append(statuses, downloader.StatusDetail{Gid: gid, Status: "active"})
+	}
+	return statuses, nil
+}
+
+func (d *stoppedDownloader) BatchTellStatus(gids []string) (map[string]downloader.StatusDetail, error) {
+	d.asked = append(d.asked, gids...)
+	statuses := make(map[string]downloader.StatusDetail, len(gids))
+	for _, gid := range gids {
+		statuses[gid] = downloader.StatusDetail{Gid: gid, Status: "complete"}
+	}
+	return statuses, nil
+}
+
+func TestReconcileSettlesDownloadsWhoseNotificationWasLost(t *testing.T) {
+	m, rt := newHTTPDownloadTask(t, "reconcile-lost-notification", "https://example.com", 2)
+	dl := &stoppedDownloader{Downloader: m.downloader, queued: []string{"running"}}
+	m.downloader = dl
+	rt.bindGID("00001.ts", "finished")
+	rt.bindGID("00002.ts", "running")
+
+	updated, err := m.ReconcileTask("reconcile-lost-notification")
+	if err != nil {
+		t.Fatalf("ReconcileTask: %v", err)
+	}
+	if updated != 1 || !slices.Equal(dl.asked, []string{"finished"}) {
+		t.Fatalf("updated = %d, asked for %v, want only the stopped download settled", updated, dl.asked)
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if _, ok := rt.remaining["00001.ts"]; ok {
+		t.Fatal("00001.ts should be completed")
+	}
+	if rt.gidToFile["running"] != "00002.ts" {
+		t.Fatalf("bindings = %v, want the running download kept", rt.gidToFile)
+	}
+}
+
+func TestResyncDispatchesDownloadsTheDownloaderForgot(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("segment " + r.URL.Path))
+	}))
+	t.Cleanup(origin.Close)
+	m, rt := newHTTPDownloadTask(t, "resync-download", origin.URL, 2)
+	// The GIDs were handed out by an aria2 that restarted without a session.
+	rt.bindGID("00001.ts", "2089b05ecca3d829")
+	rt.bindGID("00002.ts", "cca3d8292089b05e")
+
+	m.resyncBindings(aria2NotificationEvent{Method: downloader.EventResync})
+	waitRuntimeStatus(t, rt, TaskStatusCompleted)
+	rt.mu.Lock()
+	failures, bound := len(rt.failures), len(rt.gidToFile)
+	rt.mu.Unlock()
+	if failures != 0 || bound != 0 {
+		t.Fatalf("failures = %d, bound = %d, want the forgotten downloads queued again and finished", failures, bound)
+	}
+}
@@ -1,6 +1,10 @@
 package task
 
-import "time"
+import (
+	"time"
+
+	playlist "hls-accelerator/internal/m3u8"
+)
 
 const (
 	TaskStatusPending     = "pending"
@@ -27,7 +31,21 @@ type TaskMetadata struct {
 	UpdatedTime        time.Time  `json:"updated_time"`
 	FinishedTime       *time.Time `json:"finished_time,omitempty"`
 	Status             string     `json:"status"`
-	ProxiedContent     string     `json:"-"`
+	Live               bool       `json:"live,omitempty"`
+	ExportStatus       string     `json:"export_status,omitempty"`
+	ExportPath         string     `json:"export_path,omitempty"`
+	ExportError        string     `json:"export_error,omitempty"`
+	ExportFormat       string     `json:"export_format,omitempty"`
+	// Error says why the task could not be created from its playlist, or
+	// could not be resumed after a restart.
+	Error string `json:"error,omitempty"`
+	// Headers are sent with every request of the task on top of the configured
+	// headers; they may carry cookies, so they are not part of the API output.
+	Headers map[string]string `json:"-"`
+	// AdRanges are the segment ranges ad filters removed while rewriting; they
+	// are reported in the task detail.
+	AdRanges       []playlist.AdRange `json:"-"`
+	ProxiedContent string             `json:"-"`
 }
 
 type TaskManifest struct {
@@ -41,6 +59,11 @@ type ManifestItem struct {
 	Filename string `json:"f"`
 	URL      string `json:"u"`
 	Type     string `json:"t,omitempty"`
+	Offset   int64  `json:"o,omitempty"`
+	Length   int64  `json:"l,omitempty"`
+	// Group is empty for the main media playlist and names the audio or
+	// subtitle rendition the item belongs to otherwise.
+	Group string `json:"g,omitempty"`
 }
 
 type ManifestIndexItem struct {
@@ -50,29 +73,128 @@ type ManifestIndexItem struct {
 }
 
 type TaskProgressFile struct {
-	TaskID             string    `json:"tid"`
-	Failed             []string  `json:"f,omitempty"`
-	DownloadedSegments int       `json:"seg_done,omitempty"`
-	DoneItems          int       `json:"done,omitempty"`
-	UpdatedAt          time.Time `json:"u,omitempty"`
+	TaskID   string                 `json:"tid"`
+	Failed   []string               `json:"f,omitempty"`
+	Failures map[string]ItemFailure `json:"fi,omitempty"`
+	// RetryAt keeps the backoff of items waiting for an automatic retry
+	// across restarts.
+	RetryAt            map[string]time.Time `json:"ra,omitempty"`
+	DownloadedSegments int                  `json:"seg_done,omitempty"`
+	DoneItems          int                  `json:"done,omitempty"`
+	UpdatedAt          time.Time            `json:"u,omitempty"`
+}
+
+// ItemFailure is the last known failure of a manifest item. It is kept while the
+// item is still remaining so the attempt count survives manual retries.
+type ItemFailure struct {
+	Reason    string    `json:"r,omitempty"`
+	ErrorCode string    `json:"c,omitempty"`
+	Attempts  int       `json:"n,omitempty"`
+	FailedAt  time.Time `json:"t,omitempty"`
 }
 
 type TaskSummary struct {
-	ID                 string     `json:"id"`
-	Name               string     `json:"name"`
-	OriginalURL        string     `json:"original_url"`
-	Status             string     `json:"status"`
-	TotalSegments      int        `json:"total_segments"`
-	DownloadedSegments int        `json:"downloaded_segments"`
-	TotalItems         int        `json:"total_items"`
-	DoneItems          int        `json:"done_items"`
-	FailedItems        int        `json:"failed_items"`
-	CreatedTime        time.Time  `json:"created_time"`
-	UpdatedTime        time.Time  `json:"updated_time"`
-	FinishedTime       *time.Time `json:"finished_time,omitempty"`
-	OutputDir          string     `json:"output_dir"`
-	M3U8FilePath       string     `json:"m3u8_file_path"`
-	Progress           float64    `json:"progress"`
+	ID                 string      `json:"id"`
+	Name               string      `json:"name"`
+	OriginalURL        string      `json:"original_url"`
+	Status             string      `json:"status"`
+	TotalSegments      int         `json:"total_segments"`
+	DownloadedSegments int         `json:"downloaded_segments"`
+	TotalItems         int         `json:"total_items"`
+	DoneItems          int         `json:"done_items"`
+	FailedItems        int         `json:"failed_items"`
+	CreatedTime        time.Time   `json:"created_time"`
+	UpdatedTime        time.Time   `json:"updated_time"`
+	FinishedTime       *time.Time  `json:"finished_time,omitempty"`
+	OutputDir          string      `json:"output_dir"`
+	M3U8FilePath       string      `json:"m3u8_file_path"`
+	Progress           float64     `json:"progress"`
+	Live               bool        `json:"live,omitempty"`
+	Error              string      `json:"error,omitempty"`
+	Export             *TaskExport `json:"export,omitempty"`
+}
+
+const (
+	ExportStatusRunning   = "running"
+	ExportStatusCompleted = "completed"
+	ExportStatusFailed    = "failed"
+)
+
+// Export formats: ts concatenates the segments as they are, mp4 remuxes
+// MPEG-TS into a faststart MP4. fMP4 tasks are always exported as MP4.
+const (
+	ExportFormatTS  = "ts"
+	ExportFormatMP4 = "mp4"
+)
+
+// TaskExport is the state of the single-file export of a task. The segment
+// and byte counters are only known while the export is running.
+type TaskExport struct {
+	Status        string  `json:"status"`
+	Format        string  `json:"format,omitempty"`
+	Path          string  `json:"path,omitempty"`
+	Error         string  `json:"error,omitempty"`
+	Progress      float64 `json:"progress"`
+	DoneSegments  int     `json:"done_segments,omitempty"`
+	TotalSegments int     `json:"total_segments,omitempty"`
+	Bytes         int64   `json:"bytes,omitempty"`
+}
+
+const (
+	ItemStatePending     = "pending"
+	ItemStateDispatching = "dispatching"
+	ItemStateDone        = "done"
+	ItemStateFailed      = "failed"
+)
+
+type TaskItemState struct {
+	Seq       uint32     `json:"seq"`
+	Filename  string     `json:"filename"`
+	URL       string     `json:"url"`
+	Type      string     `json:"type"`
+	State     string     `json:"state"`
+	GID       string     `json:"gid,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	ErrorCode string     `json:"error_code,omitempty"`
+	Attempts  int        `json:"attempts,omitempty"`
+	FailedAt  *time.Time `json:"failed_at,omitempty"`
+	RetryAt   *time.Time `json:"retry_at,omitempty"`
+}
+
+type TaskDetail struct {
+	TaskSummary
+	Recording *LiveRecording `json:"recording,omitempty"`
+	// AdRanges lists what ad filtering removed, so a false positive can be
+	// undone by adding the task again with "ad_filter": false.
+	AdRanges []playlist.AdRange `json:"ad_ranges,omitempty"`
+	Items    []TaskItemState    `json:"items"`
+}
+
+const (
+	LiveStopEndList     = "endlist"
+	LiveStopMaxDuration = "max_duration"
+	LiveStopManual      = "manual"
+	LiveStopUnavailable = "playlist_unavailable"
+)
+
+// LiveRecording is the recorder state of a live task, stored as live.json next
+// to progress.json. NextMediaSeq is the first media sequence number not yet
+// taken into the manifest; NextIndex numbers the segment files across polls.
+type LiveRecording struct {
+	TaskID         string     `json:"tid"`
+	PlaylistURL    string     `json:"src"`
+	ProxyBase      string     `json:"proxy"`
+	NextMediaSeq   uint64     `json:"next_seq"`
+	NextIndex      int        `json:"next_idx"`
+	TargetDuration float64    `json:"target,omitempty"`
+	StartedAt      time.Time  `json:"started"`
+	Deadline       *time.Time `json:"deadline,omitempty"`
+	LastPollAt     time.Time  `json:"polled,omitempty"`
+	PollFailures   int        `json:"poll_failures,omitempty"`
+	Stopped        bool       `json:"stopped,omitempty"`
+	StopReason     string     `json:"stop_reason,omitempty"`
+	StoppedAt      *time.Time `json:"stopped_at,omitempty"`
+	NoAdFilter     bool       `json:"no_ad_filter,omitempty"`
 }
 
 type RuntimeMetrics struct {
@@ -86,4 +208,21 @@ type RuntimeMetrics struct {
 type AddTaskRequest struct {
 	Name string `json:"name"`
 	URL  string `json:"url"`
+	// MaxDurationSec bounds a live recording; 0 falls back to live_max_duration_sec.
+	MaxDurationSec int `json:"max_duration_sec,omitempty"`
+	// Variant overrides the configured variant policy for master playlists.
+	Variant *playlist.VariantPolicy `json:"variant,omitempty"`
+	// Languages overrides rendition_languages for the audio and subtitle renditions.
+	Languages []string `json:"languages,omitempty"`
+	// ExportFormat is "ts" or "mp4"; empty falls back to export_format.
+	ExportFormat string `json:"export_format,omitempty"`
+	// Headers such as Referer, Cookie or Origin override the configured
+	// headers for every request of this task.
+	Headers map[string]string `json:"headers,omitempty"`
+	// AdFilter set to false keeps every segment, for playlists the ad filters
+	// get wrong.
+	AdFilter *bool `json:"ad_filter,omitempty"`
+	// TaskID is the ID HandleAdd reserved for the request; it stays the same
+	// when a master playlist is narrowed down to one of its variants.
+	TaskID string `json:"-"`
 }
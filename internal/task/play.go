@@ -0,0 +1,77 @@
+package task
+
+import (
+	"database/sql"
+	"fmt"
+	"io/fs"
+
+	"hls-accelerator/internal/cache"
+	playlist "hls-accelerator/internal/m3u8"
+)
+
+// LocalPlaylist builds a playlist of a task whose URIs are names relative to
+// the task directory, so it plays from the local cache alone. name is
+// MediaPlaylistName for the entry playlist; a task with renditions also has
+// LocalVideoPlaylistName for the video and its rendition playlists.
+func (m *Manager) LocalPlaylist(taskID, name string) (string, error) {
+	meta, err := m.GetTask(taskID)
+	if err != nil {
+		return "", err
+	}
+	if meta.Status == TaskStatusDeleted {
+		return "", sql.ErrNoRows
+	}
+	if err := checkCreated(meta); err != nil {
+		return "", fmt.Errorf("%w: %v", fs.ErrNotExist, err)
+	}
+
+	master, err := m.GetTaskPlaylist(taskID, MasterPlaylistFileName)
+	hasMaster := err == nil && master != ""
+	var content string
+	switch {
+	case hasMaster && name == playlist.MediaPlaylistName:
+		return playlist.LocalizePlaylist(master, func(name string) (string, bool) {
+			if name == playlist.MediaPlaylistName {
+				return playlist.LocalVideoPlaylistName, true
+			}
+			return name, name != MasterPlaylistFileName && isTaskPlaylistName(name)
+		})
+	case hasMaster && name == playlist.LocalVideoPlaylistName, !hasMaster && name == playlist.MediaPlaylistName:
+		content, err = m.GetTaskProxiedContent(taskID)
+	case hasMaster && name != MasterPlaylistFileName && isTaskPlaylistName(name):
+		content, err = m.GetTaskPlaylist(taskID, name)
+	default:
+		return "", fmt.Errorf("%w: task has no playlist %q", fs.ErrNotExist, name)
+	}
+	if err != nil {
+		return "", err
+	}
+	if content == "" {
+		return "", fmt.Errorf("%w: task has no playlist %q", fs.ErrNotExist, name)
+	}
+
+	manifest, err := m.LoadTaskManifest(taskID, meta.OriginalURL, meta.TotalSegments)
+	if err != nil {
+		return "", err
+	}
+	filenames := make(map[string]bool, len(manifest.Items))
+	for _, item := range manifest.Items {
+		filenames[item.Filename] = true
+	}
+	return playlist.LocalizePlaylist(content, func(name string) (string, bool) {
+		return name, filenames[name]
+	})
+}
+
+// LocalFilePath returns the path of a downloaded file of a task. Files that are
+// not in the task manifest or not completely downloaded yet do not exist.
+func (m *Manager) LocalFilePath(taskID, filename string) (string, error) {
+	items, err := m.LoadManifestItemsByFilenames(taskID, []string{filename})
+	if err != nil {
+		return "", err
+	}
+	if _, ok := items[filename]; !ok || !cache.FileExists(taskID, filename) || cache.FileExists(taskID, filename+".aria2") {
+		return "", fmt.Errorf("%w: %s", fs.ErrNotExist, filename)
+	}
+	return cache.GetFilePath(taskID, filename), nil
+}
@@ -0,0 +1,109 @@
+package task
+
+import (
+	"errors"
+	"io/fs"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"hls-accelerator/internal/cache"
+	"hls-accelerator/internal/config"
+	playlist "hls-accelerator/internal/m3u8"
+
+	"github.com/grafov/m3u8"
+)
+
+func TestLocalPlaylistServesTaskFromCache(t *testing.T) {
+	m := newTestManager(t)
+	oldCacheDir := config.GlobalConfig.CacheDir
+	config.GlobalConfig.CacheDir = t.TempDir()
+	t.Cleanup(func() { config.GlobalConfig.CacheDir = oldCacheDir })
+
+	const taskID = "task-play"
+	origin, _ := url.Parse("https://cdn.example.com/vod/index.m3u8")
+	pl, _, err := playlist.Parse(strings.NewReader(`#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-KEY:METHOD=AES-128,URI="k.key"
+#EXTINF:4.0,
+a.ts
+#EXTINF:4.0,
+b.ts
+#EXT-X-ENDLIST
+`))
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	content, items, total := playlist.RewriteVariant(pl.(*m3u8.MediaPlaylist), "http://192.168.1.2:8084/proxy", taskID, origin)
+	audio := "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4.000,\nhttp://192.168.1.2:8084/proxy/seg/" + taskID + "/a00001.aac/https%3A%2F%2Fcdn.example.com%2Fa1.aac\n#EXT-X-ENDLIST\n"
+	items = append(items, playlist.DownloadItem{URL: "https://cdn.example.com/a1.aac", Filename: "a00001.aac", Type: "segment", Group: "audio0"})
+	meta := TaskMetadata{
+		ID:             taskID,
+		OriginalURL:    origin.String(),
+		TotalSegments:  total + 1,
+		CreatedTime:    time.Now(),
+		UpdatedTime:    time.Now(),
+		Status:         TaskStatusDownloading,
+		ProxiedContent: content,
+	}
+	if err := m.CreateTask(meta); err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	if err := m.SaveTaskManifest(buildManifest(taskID, meta.OriginalURL, items, meta.TotalSegments)); err != nil {
+		t.Fatalf("SaveTaskManifest: %v", err)
+	}
+	if err := cache.EnsureTaskDir(taskID); err != nil {
+		t.Fatalf("EnsureTaskDir: %v", err)
+	}
+	for _, name := range []string{"00001.ts", "00002.ts", "00002.ts.aria2"} {
+		if err := os.WriteFile(cache.GetFilePath(taskID, name), []byte(name), 0644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+	}
+
+	local, err := m.LocalPlaylist(taskID, playlist.MediaPlaylistName)
+	if err != nil {
+		t.Fatalf("LocalPlaylist: %v", err)
+	}
+	if strings.Contains(local, "http") || !strings.Contains(local, "\n00001.ts\n") || strings.Count(local, "#EXT-X-KEY") != 1 {
+		t.Fatalf("local playlist = \n%s", local)
+	}
+	if _, err := m.LocalPlaylist(taskID, "audio0.m3u8"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("rendition playlist of a task without master: err = %v", err)
+	}
+
+	if _, err := m.LocalFilePath(taskID, "00001.ts"); err != nil {
+		t.Fatalf("LocalFilePath of a downloaded file: %v", err)
+	}
+	for _, name := range []string{"00002.ts", "00002.ts.aria2", "a00001.aac", "../tasks.db"} {
+		if _, err := m.LocalFilePath(taskID, name); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("LocalFilePath(%q): err = %v, want not exist", name, err)
+		}
+	}
+
+	master := "#EXTM3U\n#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"aud\",NAME=\"en\",URI=\"http://192.168.1.2:8084/proxy/media/" + taskID + "/audio0.m3u8\"\n#EXT-X-STREAM-INF:BANDWIDTH=1000,AUDIO=\"aud\"\nhttp://192.168.1.2:8084/proxy/media/" + taskID + "/index.m3u8\n"
+	if err := m.SaveTaskPlaylist(taskID, MasterPlaylistFileName, master); err != nil {
+		t.Fatalf("SaveTaskPlaylist: %v", err)
+	}
+	if err := m.SaveTaskPlaylist(taskID, "audio0.m3u8", audio); err != nil {
+		t.Fatalf("SaveTaskPlaylist: %v", err)
+	}
+	local, err = m.LocalPlaylist(taskID, playlist.MediaPlaylistName)
+	if err != nil {
+		t.Fatalf("LocalPlaylist master: %v", err)
+	}
+	if !strings.Contains(local, `URI="audio0.m3u8"`) || !strings.Contains(local, "\n"+playlist.LocalVideoPlaylistName+"\n") {
+		t.Fatalf("local master = \n%s", local)
+	}
+	if local, err = m.LocalPlaylist(taskID, "audio0.m3u8"); err != nil || !strings.Contains(local, "\na00001.aac\n") {
+		t.Fatalf("local rendition = %q, err = %v", local, err)
+	}
+	if _, err := m.LocalPlaylist(taskID, playlist.LocalVideoPlaylistName); err != nil {
+		t.Fatalf("local video playlist: %v", err)
+	}
+	if _, err := m.LocalPlaylist(taskID, MasterPlaylistFileName); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("master.m3u8 should only be served as index.m3u8: err = %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package task
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"hls-accelerator/internal/config"
+)
+
+// PrioritizePlayback moves the item a player is waiting for and the items of
+// the next PlaybackPrefetchSegments segments to the front of the aria2 queue,
+// dispatching those that were not handed to aria2 yet. Only tasks with a
+// loaded runtime that is not paused are affected.
+func (m *Manager) PrioritizePlayback(taskID, filename string) {
+	window := config.GlobalConfig.PlaybackPrefetchSegments
+	if window <= 0 || m.downloader == nil {
+		return
+	}
+	m.runtimeMu.Lock()
+	rt := m.runtimes[taskID]
+	m.runtimeMu.Unlock()
+	if rt == nil {
+		return
+	}
+	order, claimed := rt.claimForPlayback(filename, window)
+	if len(order) == 0 {
+		return
+	}
+	if len(claimed) > 0 && !m.dispatchItems(taskID, rt, claimed, m.TaskRequestHeaders(taskID)) {
+		return
+	}
+	if err := m.downloader.MoveToFront(rt.gidsOf(order)); err != nil {
+		log.Printf("prioritize playback failed task=%s file=%s: %v", taskID, filename, err)
+	}
+}
+
+// claimForPlayback returns the remaining items from filename on, in manifest
+// order, up to the window segments that follow it. Items that are neither
+// bound to aria2 nor being dispatched are claimed for dispatching, also when
+// they wait for an automatic retry; items that failed for good are left out.
+func (rt *taskRuntime) claimForPlayback(filename string, window int) ([]string, []string) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.lastAccessAt = time.Now()
+	if rt.paused {
+		return nil, nil
+	}
+	start, ok := rt.remaining[filename]
+	if !ok {
+		return nil, nil
+	}
+	type entry struct {
+		seq      uint32
+		filename string
+	}
+	next := make([]entry, 0)
+	for name, seq := range rt.remaining {
+		if seq >= start {
+			next = append(next, entry{seq: seq, filename: name})
+		}
+	}
+	sort.Slice(next, func(i, j int) bool { return next[i].seq < next[j].seq })
+
+	var order, claimed []string
+	segments := 0
+	for _, e := range next {
+		if rt.isSegment(e.seq) {
+			if segments > window {
+				break
+			}
+			segments++
+		}
+		if _, failed := rt.failed[e.filename]; failed {
+			continue
+		}
+		order = append(order, e.filename)
+		if _, active := rt.fileToGID[e.filename]; active {
+			continue
+		}
+		if _, dispatching := rt.dispatching[e.filename]; dispatching {
+			continue
+		}
+		delete(rt.retryAt, e.filename)
+		rt.dispatching[e.filename] = struct{}{}
+		claimed = append(claimed, e.filename)
+	}
+	return order, claimed
+}
+
+// gidsOf returns the aria2 GIDs of the given items that are bound to one, in
+// the same order.
+func (rt *taskRuntime) gidsOf(filenames []string) []string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	gids := make([]string, 0, len(filenames))
+	for _, filename := range filenames {
+		if gid, ok := rt.fileToGID[filename]; ok {
+			gids = append(gids, gid)
+		}
+	}
+	return gids
+}
@@ -0,0 +1,117 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"hls-accelerator/internal/config"
+	"hls-accelerator/internal/downloader"
+	playlist "hls-accelerator/internal/m3u8"
+)
+
+func TestPrioritizePlaybackMovesPlayedItemsToFront(t *testing.T) {
+	m := newTestManager(t)
+	m.runtimes = make(map[string]*taskRuntime)
+	oldCacheDir, oldWindow := config.GlobalConfig.CacheDir, config.GlobalConfig.PlaybackPrefetchSegments
+	config.GlobalConfig.CacheDir = t.TempDir()
+	config.GlobalConfig.PlaybackPrefetchSegments = 2
+	t.Cleanup(func() {
+		config.GlobalConfig.CacheDir = oldCacheDir
+		config.GlobalConfig.PlaybackPrefetchSegments = oldWindow
+	})
+
+	var mu sync.Mutex
+	var calls []string
+	aria2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		var req downloader.JsonRpcRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode request: %v", err)
+			return
+		}
+		resp := downloader.JsonRpcResponse{ID: req.ID}
+		results := make([]interface{}, 0)
+		mu.Lock()
+		for _, call := range req.Params[0].([]interface{}) {
+			call := call.(map[string]interface{})
+			params := call["params"].([]interface{})
+			switch call["methodName"] {
+			case "aria2.addUri":
+				out := params[1].(map[string]interface{})["out"].(string)
+				calls = append(calls, "add "+out)
+				results = append(results, []interface{}{"gid-" + strings.TrimSuffix(out, ".ts")})
+			case "aria2.changePosition":
+				calls = append(calls, fmt.Sprintf("front %v", params[0]))
+				results = append(results, []interface{}{0})
+			default:
+				t.Errorf("unexpected method %v", call["methodName"])
+			}
+		}
+		mu.Unlock()
+		resp.Result = results
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(aria2.Close)
+	m.downloader = &downloader.Aria2Client{RPCUrl: aria2.URL, Client: &http.Client{Timeout: time.Second}}
+
+	meta := TaskMetadata{
+		ID:            "playback",
+		OriginalURL:   "https://example.com/playback.m3u8",
+		CreatedTime:   time.Now(),
+		UpdatedTime:   time.Now(),
+		TotalItems:    7,
+		TotalSegments: 6,
+		Status:        TaskStatusDownloading,
+	}
+	if err := m.CreateTask(meta); err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	items := make([]playlist.DownloadItem, 0, 7)
+	for i := 1; i <= 6; i++ {
+		if i == 4 {
+			items = append(items, playlist.DownloadItem{Filename: "k.key", URL: "https://example.com/k.key", Type: "key"})
+		}
+		items = append(items, playlist.DownloadItem{Filename: fmt.Sprintf("0000%d.ts", i), URL: fmt.Sprintf("https://example.com/%d.ts", i), Type: "segment"})
+	}
+	manifest := buildManifest(meta.ID, meta.OriginalURL, items, 6)
+	if err := m.SaveTaskManifest(manifest); err != nil {
+		t.Fatalf("SaveTaskManifest: %v", err)
+	}
+	if err := writeJSONAtomic(taskProgressPath(meta.ID), buildInitialProgress(manifest)); err != nil {
+		t.Fatalf("write progress: %v", err)
+	}
+	rt, err := m.loadRuntime(meta.ID)
+	if err != nil {
+		t.Fatalf("loadRuntime: %v", err)
+	}
+	// Items up to 00003.ts are queued in aria2 already, 00004.ts waits for a
+	// retry and 00005.ts failed for good.
+	for _, filename := range []string{"00001.ts", "00002.ts", "00003.ts"} {
+		rt.bindGID(filename, "gid-"+strings.TrimSuffix(filename, ".ts"))
+	}
+	rt.retryAt["00004.ts"] = time.Now().Add(time.Hour)
+	rt.failed["00005.ts"] = struct{}{}
+
+	m.PrioritizePlayback(meta.ID, "unknown.ts")
+	m.PrioritizePlayback(meta.ID, "00002.ts")
+	want := "add k.key,add 00004.ts,front gid-00004,front gid-k.key,front gid-00003,front gid-00002"
+	if got := strings.Join(calls, ","); got != want {
+		t.Fatalf("aria2 calls = %s, want %s", got, want)
+	}
+	if _, waiting := rt.retryAt["00004.ts"]; waiting {
+		t.Fatal("a played item should not wait for its retry")
+	}
+
+	calls = nil
+	rt.paused = true
+	m.PrioritizePlayback(meta.ID, "00006.ts")
+	if len(calls) != 0 {
+		t.Fatalf("paused task should not be reordered: %v", calls)
+	}
+}
@@ -2,6 +2,7 @@ package task
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -9,7 +10,9 @@ import (
 	"strings"
 	"time"
 
+	"hls-accelerator/internal/cache"
 	"hls-accelerator/internal/config"
+	playlist "hls-accelerator/internal/m3u8"
 )
 
 func isSQLiteUniqueConstraintError(err error) bool {
@@ -39,7 +42,15 @@ func (m *Manager) InitTable() error {
 		updated_time DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
 		finished_time DATETIME,
 		status TEXT NOT NULL DEFAULT 'pending',
-		proxied_content TEXT NOT NULL DEFAULT ''
+		proxied_content TEXT NOT NULL DEFAULT '',
+		live INTEGER NOT NULL DEFAULT 0,
+		export_status TEXT NOT NULL DEFAULT '',
+		export_path TEXT NOT NULL DEFAULT '',
+		export_error TEXT NOT NULL DEFAULT '',
+		export_format TEXT NOT NULL DEFAULT '',
+		headers TEXT NOT NULL DEFAULT '',
+		ad_ranges TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT ''
 	);
 
 	CREATE TABLE IF NOT EXISTS task_manifest (
@@ -48,23 +59,82 @@ func (m *Manager) InitTable() error {
 		filename TEXT NOT NULL,
 		url TEXT NOT NULL DEFAULT '',
 		item_type TEXT NOT NULL DEFAULT 'segment',
+		byte_offset INTEGER NOT NULL DEFAULT 0,
+		byte_length INTEGER NOT NULL DEFAULT 0,
+		item_group TEXT NOT NULL DEFAULT '',
 		PRIMARY KEY (task_id, filename)
 	);
 
 	CREATE INDEX IF NOT EXISTS idx_tasks_status ON tasks(status);
 	CREATE INDEX IF NOT EXISTS idx_task_manifest_task_seq ON task_manifest(task_id, seq);
 	`
-	_, err := m.db.Exec(query)
+	if _, err := m.db.Exec(query); err != nil {
+		return err
+	}
+	// Columns added after the first release; CREATE TABLE IF NOT EXISTS does not touch old databases.
+	if err := m.ensureColumn("tasks", "live", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	for _, column := range []string{"export_status", "export_path", "export_error", "export_format", "headers", "ad_ranges", "error"} {
+		if err := m.ensureColumn("tasks", column, "TEXT NOT NULL DEFAULT ''"); err != nil {
+			return err
+		}
+	}
+	if err := m.ensureColumn("task_manifest", "byte_offset", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	if err := m.ensureColumn("task_manifest", "byte_length", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return err
+	}
+	return m.ensureColumn("task_manifest", "item_group", "TEXT NOT NULL DEFAULT ''")
+}
+
+func (m *Manager) ensureColumn(table, column, definition string) error {
+	rows, err := m.db.Query(fmt.Sprintf(`PRAGMA table_info(%s)`, table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return err
+		}
+		if strings.EqualFold(name, column) {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = m.db.Exec(fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, column, definition))
 	return err
 }
 
+// sqlExecer is satisfied by both *sql.DB and *sql.Tx.
+type sqlExecer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
 func (m *Manager) CreateTask(meta TaskMetadata) error {
-	_, err := m.db.Exec(`
+	return insertTask(m.db, meta)
+}
+
+func insertTask(db sqlExecer, meta TaskMetadata) error {
+	_, err := db.Exec(`
 	INSERT INTO tasks (
 		id, name, original_url, total_segments, downloaded_segments,
 		total_items, done_items, failed_items, output_dir, m3u8_file_path,
-		created_time, updated_time, finished_time, status, proxied_content
-	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		created_time, updated_time, finished_time, status, proxied_content, live,
+		export_format, headers, ad_ranges, error
+	) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`,
 		meta.ID,
 		meta.Name,
@@ -81,10 +151,79 @@ func (m *Manager) CreateTask(meta TaskMetadata) error {
 		meta.FinishedTime,
 		defaultTaskStatus(meta.Status),
 		meta.ProxiedContent,
+		meta.Live,
+		meta.ExportFormat,
+		encodeHeaders(meta.Headers),
+		encodeAdRanges(meta.AdRanges),
+		meta.Error,
 	)
 	return err
 }
 
+// replaceTaskPlaceholder stores meta in place of the row HandleAdd inserted
+// for a task that is still being created. It reports false when that row is
+// gone or no longer pending or parsing, e.g. because the creation was cancelled.
+func (m *Manager) replaceTaskPlaceholder(meta TaskMetadata) (bool, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`DELETE FROM tasks WHERE id = ? AND status IN (?, ?)`, meta.ID, TaskStatusPending, TaskStatusParsing)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if err := insertTask(tx, meta); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// deleteTaskPlaceholder removes the row of a task that is still being created.
+func (m *Manager) deleteTaskPlaceholder(id string) (bool, error) {
+	res, err := m.db.Exec(`DELETE FROM tasks WHERE id = ? AND status IN (?, ?)`, id, TaskStatusPending, TaskStatusParsing)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// FailTaskCreation marks a task that is still being created as failed and
+// stores why; tasks that were created in the meantime are left alone.
+func (m *Manager) FailTaskCreation(id, message string) error {
+	_, err := m.db.Exec(`
+	UPDATE tasks
+	SET status = ?, error = ?, updated_time = datetime('now')
+	WHERE id = ? AND status IN (?, ?)
+	`, TaskStatusFailed, message, id, TaskStatusPending, TaskStatusParsing)
+	return err
+}
+
+// FailTask marks a task failed and stores why.
+func (m *Manager) FailTask(id, message string) error {
+	_, err := m.db.Exec(`
+	UPDATE tasks
+	SET status = ?, error = ?, updated_time = datetime('now')
+	WHERE id = ?
+	`, TaskStatusFailed, message, id)
+	return err
+}
+
+// failInterruptedCreations fails the tasks whose creation was cut short by a
+// restart; a created task is never pending or parsing.
+func (m *Manager) failInterruptedCreations() error {
+	_, err := m.db.Exec(`
+	UPDATE tasks
+	SET status = ?, error = ?, updated_time = datetime('now')
+	WHERE status IN (?, ?)
+	`, TaskStatusFailed, "interrupted by a restart before the playlist was parsed", TaskStatusPending, TaskStatusParsing)
+	return err
+}
+
 func (m *Manager) TryCreateTask(meta TaskMetadata) (bool, error) {
 	err := m.CreateTask(meta)
 	if err == nil {
@@ -99,10 +238,12 @@ func (m *Manager) TryCreateTask(meta TaskMetadata) (bool, error) {
 func (m *Manager) GetTask(id string) (*TaskMetadata, error) {
 	var meta TaskMetadata
 	var finished sql.NullTime
+	var headers, adRanges string
 	err := m.db.QueryRow(`
 	SELECT id, name, original_url, total_segments, downloaded_segments,
 		total_items, done_items, failed_items, output_dir, m3u8_file_path,
-		created_time, updated_time, finished_time, status
+		created_time, updated_time, finished_time, status, live,
+		export_status, export_path, export_error, export_format, headers, ad_ranges, error
 	FROM tasks
 	WHERE id = ?
 	`, id).Scan(
@@ -120,6 +261,14 @@ func (m *Manager) GetTask(id string) (*TaskMetadata, error) {
 		&meta.UpdatedTime,
 		&finished,
 		&meta.Status,
+		&meta.Live,
+		&meta.ExportStatus,
+		&meta.ExportPath,
+		&meta.ExportError,
+		&meta.ExportFormat,
+		&headers,
+		&adRanges,
+		&meta.Error,
 	)
 	if err != nil {
 		return nil, err
@@ -127,9 +276,86 @@ func (m *Manager) GetTask(id string) (*TaskMetadata, error) {
 	if finished.Valid {
 		meta.FinishedTime = &finished.Time
 	}
+	meta.Headers = decodeHeaders(headers)
+	meta.AdRanges = decodeAdRanges(adRanges)
 	return &meta, nil
 }
 
+// GetTaskHeaders returns the request headers stored with a task.
+func (m *Manager) GetTaskHeaders(id string) (map[string]string, error) {
+	var headers string
+	if err := m.db.QueryRow(`SELECT headers FROM tasks WHERE id = ?`, id).Scan(&headers); err != nil {
+		return nil, err
+	}
+	return decodeHeaders(headers), nil
+}
+
+func encodeHeaders(headers map[string]string) string {
+	if len(headers) == 0 {
+		return ""
+	}
+	data, err := json.Marshal(headers)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func decodeHeaders(value string) map[string]string {
+	if value == "" {
+		return nil
+	}
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(value), &headers); err != nil {
+		return nil
+	}
+	return headers
+}
+
+// AppendTaskAdRanges records ad ranges removed after the task was created,
+// such as those found in later windows of a live recording.
+func (m *Manager) AppendTaskAdRanges(id string, ranges []playlist.AdRange) error {
+	if len(ranges) == 0 {
+		return nil
+	}
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var value string
+	if err := tx.QueryRow(`SELECT ad_ranges FROM tasks WHERE id = ?`, id).Scan(&value); err != nil {
+		return err
+	}
+	all := append(decodeAdRanges(value), ranges...)
+	if _, err := tx.Exec(`UPDATE tasks SET ad_ranges = ? WHERE id = ?`, encodeAdRanges(all), id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func encodeAdRanges(ranges []playlist.AdRange) string {
+	if len(ranges) == 0 {
+		return ""
+	}
+	data, err := json.Marshal(ranges)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func decodeAdRanges(value string) []playlist.AdRange {
+	if value == "" {
+		return nil
+	}
+	var ranges []playlist.AdRange
+	if err := json.Unmarshal([]byte(value), &ranges); err != nil {
+		return nil
+	}
+	return ranges
+}
+
 func (m *Manager) GetTaskProxiedContent(id string) (string, error) {
 	var content string
 	err := m.db.QueryRow(`SELECT proxied_content FROM tasks WHERE id = ?`, id).Scan(&content)
@@ -141,6 +367,22 @@ func (m *Manager) UpdateTaskProxiedContent(id, content string) error {
 	return err
 }
 
+// UpdateTaskExport records the state of the last export of a task.
+func (m *Manager) UpdateTaskExport(taskID, status, path, errMsg string) error {
+	_, err := m.db.Exec(`
+	UPDATE tasks
+	SET export_status = ?, export_path = ?, export_error = ?, updated_time = datetime('now')
+	WHERE id = ?
+	`, status, path, errMsg, taskID)
+	return err
+}
+
+// UpdateTaskExportFormat changes the file format later exports of a task produce.
+func (m *Manager) UpdateTaskExportFormat(taskID, format string) error {
+	_, err := m.db.Exec(`UPDATE tasks SET export_format = ?, updated_time = datetime('now') WHERE id = ?`, format, taskID)
+	return err
+}
+
 func (m *Manager) UpdateTaskSnapshot(taskID, status string, doneItems, downloadedSegments, failedItems int) error {
 	_, err := m.db.Exec(`
 	UPDATE tasks
@@ -155,13 +397,23 @@ func (m *Manager) UpdateTaskSnapshot(taskID, status string, doneItems, downloade
 	return err
 }
 
+func (m *Manager) UpdateTaskTotals(taskID string, totalItems, totalSegments int) error {
+	_, err := m.db.Exec(`
+	UPDATE tasks
+	SET total_items = ?, total_segments = ?, updated_time = datetime('now')
+	WHERE id = ?
+	`, totalItems, totalSegments, taskID)
+	return err
+}
+
 func (m *Manager) UpdateTaskStatus(taskID, status string) error {
 	_, err := m.db.Exec(`
 	UPDATE tasks
 	SET status = ?, updated_time = datetime('now'),
-		finished_time = CASE WHEN ? = ? THEN COALESCE(finished_time, datetime('now')) ELSE finished_time END
+		finished_time = CASE WHEN ? = ? THEN COALESCE(finished_time, datetime('now')) ELSE finished_time END,
+		error = CASE WHEN ? = ? THEN error ELSE '' END
 	WHERE id = ?
-	`, status, status, TaskStatusCompleted, taskID)
+	`, status, status, TaskStatusCompleted, status, TaskStatusFailed, taskID)
 	return err
 }
 
@@ -169,7 +421,8 @@ func (m *Manager) ListTasksDB() ([]TaskMetadata, error) {
 	rows, err := m.db.Query(`
 	SELECT id, name, original_url, total_segments, downloaded_segments,
 		total_items, done_items, failed_items, output_dir, m3u8_file_path,
-		created_time, updated_time, finished_time, status
+		created_time, updated_time, finished_time, status, live,
+		export_status, export_path, export_error, export_format, error
 	FROM tasks
 	WHERE status != ?
 	ORDER BY created_time DESC
@@ -198,6 +451,12 @@ func (m *Manager) ListTasksDB() ([]TaskMetadata, error) {
 			&meta.UpdatedTime,
 			&finished,
 			&meta.Status,
+			&meta.Live,
+			&meta.ExportStatus,
+			&meta.ExportPath,
+			&meta.ExportError,
+			&meta.ExportFormat,
+			&meta.Error,
 		); err != nil {
 			return nil, err
 		}
@@ -225,8 +484,8 @@ func (m *Manager) SaveTaskManifest(manifest TaskManifest) error {
 	}
 
 	stmt, err := tx.Prepare(`
-	INSERT INTO task_manifest (task_id, seq, filename, url, item_type)
-	VALUES (?, ?, ?, ?, ?)
+	INSERT INTO task_manifest (task_id, seq, filename, url, item_type, byte_offset, byte_length, item_group)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
 	`)
 	if err != nil {
 		return err
@@ -234,7 +493,7 @@ func (m *Manager) SaveTaskManifest(manifest TaskManifest) error {
 	defer stmt.Close()
 
 	for index, item := range manifest.Items {
-		if _, err = stmt.Exec(manifest.TaskID, index, item.Filename, item.URL, normalizeManifestType(item.Type)); err != nil {
+		if _, err = stmt.Exec(manifest.TaskID, index, item.Filename, item.URL, normalizeManifestType(item.Type), item.Offset, item.Length, item.Group); err != nil {
 			return err
 		}
 	}
@@ -242,9 +501,65 @@ func (m *Manager) SaveTaskManifest(manifest TaskManifest) error {
 	return tx.Commit()
 }
 
+// AppendTaskManifestItems adds items after the current end of a task manifest.
+// Items whose filename is already in the manifest (e.g. a key shared by earlier
+// segments) are skipped; the returned index holds only the items actually added.
+func (m *Manager) AppendTaskManifestItems(taskID string, items []ManifestItem) ([]ManifestIndexItem, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = tx.Rollback()
+		}
+	}()
+
+	var nextSeq uint32
+	if err = tx.QueryRow(`SELECT COALESCE(MAX(seq) + 1, 0) FROM task_manifest WHERE task_id = ?`, taskID).Scan(&nextSeq); err != nil {
+		return nil, err
+	}
+
+	stmt, err := tx.Prepare(`
+	INSERT OR IGNORE INTO task_manifest (task_id, seq, filename, url, item_type, byte_offset, byte_length, item_group)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	added := make([]ManifestIndexItem, 0, len(items))
+	for _, item := range items {
+		itemType := normalizeManifestType(item.Type)
+		var res sql.Result
+		if res, err = stmt.Exec(taskID, nextSeq, item.Filename, item.URL, itemType, item.Offset, item.Length, item.Group); err != nil {
+			return nil, err
+		}
+		var affected int64
+		if affected, err = res.RowsAffected(); err != nil {
+			return nil, err
+		}
+		if affected == 0 {
+			continue
+		}
+		added = append(added, ManifestIndexItem{
+			Seq:       nextSeq,
+			Filename:  item.Filename,
+			IsSegment: itemType == "segment",
+		})
+		nextSeq++
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
 func (m *Manager) LoadTaskManifest(taskID, originalURL string, totalSegments int) (TaskManifest, error) {
 	rows, err := m.db.Query(`
-	SELECT filename, url, item_type
+	SELECT filename, url, item_type, byte_offset, byte_length, item_group
 	FROM task_manifest
 	WHERE task_id = ?
 	ORDER BY seq ASC
@@ -257,7 +572,7 @@ func (m *Manager) LoadTaskManifest(taskID, originalURL string, totalSegments int
 	items := make([]ManifestItem, 0)
 	for rows.Next() {
 		var item ManifestItem
-		if err := rows.Scan(&item.Filename, &item.URL, &item.Type); err != nil {
+		if err := rows.Scan(&item.Filename, &item.URL, &item.Type, &item.Offset, &item.Length, &item.Group); err != nil {
 			return TaskManifest{}, err
 		}
 		items = append(items, item)
@@ -299,7 +614,7 @@ func (m *Manager) LoadTaskManifestIndex(taskID string) ([]ManifestIndexItem, err
 		out = append(out, ManifestIndexItem{
 			Seq:       seq,
 			Filename:  filename,
-			IsSegment: normalizeManifestType(itemType) != "key",
+			IsSegment: normalizeManifestType(itemType) == "segment",
 		})
 	}
 	return out, rows.Err()
@@ -318,7 +633,7 @@ func (m *Manager) LoadManifestItemsByFilenames(taskID string, filenames []string
 	}
 
 	rows, err := m.db.Query(fmt.Sprintf(`
-	SELECT filename, url, item_type
+	SELECT filename, url, item_type, byte_offset, byte_length, item_group
 	FROM task_manifest
 	WHERE task_id = ? AND filename IN (%s)
 	`, strings.Join(placeholders, ",")), args...)
@@ -330,7 +645,7 @@ func (m *Manager) LoadManifestItemsByFilenames(taskID string, filenames []string
 	out := make(map[string]ManifestItem, len(filenames))
 	for rows.Next() {
 		var item ManifestItem
-		if err := rows.Scan(&item.Filename, &item.URL, &item.Type); err != nil {
+		if err := rows.Scan(&item.Filename, &item.URL, &item.Type, &item.Offset, &item.Length, &item.Group); err != nil {
 			return nil, err
 		}
 		item.Type = normalizeManifestType(item.Type)
@@ -385,7 +700,8 @@ func (m *Manager) GetTasksByStatuses(statuses ...string) ([]TaskMetadata, error)
 	query := fmt.Sprintf(`
 	SELECT id, name, original_url, total_segments, downloaded_segments,
 		total_items, done_items, failed_items, output_dir, m3u8_file_path,
-		created_time, updated_time, finished_time, status
+		created_time, updated_time, finished_time, status, live,
+		export_status, export_path, export_error, export_format, error
 	FROM tasks
 	WHERE status IN (%s)
 	ORDER BY created_time DESC
@@ -416,6 +732,12 @@ func (m *Manager) GetTasksByStatuses(statuses ...string) ([]TaskMetadata, error)
 			&meta.UpdatedTime,
 			&finished,
 			&meta.Status,
+			&meta.Live,
+			&meta.ExportStatus,
+			&meta.ExportPath,
+			&meta.ExportError,
+			&meta.ExportFormat,
+			&meta.Error,
 		); err != nil {
 			return nil, err
 		}
@@ -474,12 +796,110 @@ func (m *Manager) SaveTaskM3U8File(taskName, content string) (string, error) {
 		fileBase = fmt.Sprintf("%s(%d)", baseName, suffix)
 	}
 	fullPath := filepath.Join(storeDir, fileBase+".m3u8")
-	if err := os.WriteFile(fullPath, []byte(content), 0644); err != nil {
+	if err := os.WriteFile(fullPath, []byte(playlist.RenderProxyBase(content, M3U8FileProxyBase())), 0644); err != nil {
 		return "", err
 	}
 	return fullPath, nil
 }
 
+// UpdateTaskM3U8File rewrites a playlist previously stored by SaveTaskM3U8File.
+func (m *Manager) UpdateTaskM3U8File(path, content string) error {
+	if strings.TrimSpace(path) == "" {
+		return nil
+	}
+	return os.WriteFile(path, []byte(playlist.RenderProxyBase(content, M3U8FileProxyBase())), 0644)
+}
+
+// M3U8FileProxyBase is the proxy address written into the files in
+// M3U8StoreDir, which players open without asking the proxy first.
+func M3U8FileProxyBase() string {
+	if base := config.PublicBaseURL(); base != "" {
+		return base + playlist.ProxyPathPrefix
+	}
+	proxyHost := strings.TrimSpace(config.GlobalConfig.ProxyHost)
+	if proxyHost == "" {
+		proxyHost = "localhost"
+	}
+	return fmt.Sprintf("http://%s:%d%s", proxyHost, config.GlobalConfig.ProxyPort, playlist.ProxyPathPrefix)
+}
+
+// RefreshM3U8Files rewrites the files in M3U8StoreDir that point at another
+// proxy address than M3U8FileProxyBase, after the public address changed. Files
+// that were removed stay removed. It returns how many files were rewritten.
+func (m *Manager) RefreshM3U8Files() (int, error) {
+	tasks, err := m.ListTasksDB()
+	if err != nil {
+		return 0, err
+	}
+	base := M3U8FileProxyBase()
+	rewritten := 0
+	for _, meta := range tasks {
+		if meta.M3U8FilePath == "" || meta.Status == TaskStatusDeleted {
+			continue
+		}
+		current, err := os.ReadFile(meta.M3U8FilePath)
+		if err != nil {
+			continue
+		}
+		content, err := m.GetTaskPlaylist(meta.ID, MasterPlaylistFileName)
+		if err != nil || content == "" {
+			if content, err = m.GetTaskProxiedContent(meta.ID); err != nil {
+				return rewritten, err
+			}
+		}
+		rendered := playlist.RenderProxyBase(content, base)
+		if content == "" || rendered == string(current) {
+			continue
+		}
+		if err := os.WriteFile(meta.M3U8FilePath, []byte(rendered), 0644); err != nil {
+			return rewritten, err
+		}
+		rewritten++
+	}
+	return rewritten, nil
+}
+
+// MasterPlaylistFileName is the playlist in the task directory of a task with
+// audio or subtitle renditions that ties them to the video playlist.
+const MasterPlaylistFileName = "master.m3u8"
+
+// SaveTaskPlaylist stores a playlist in the task directory next to the files
+// it points at.
+func (m *Manager) SaveTaskPlaylist(taskID, name, content string) error {
+	if !isTaskDirName(taskID) {
+		return fmt.Errorf("invalid task id %q", taskID)
+	}
+	if !isTaskPlaylistName(name) {
+		return fmt.Errorf("invalid playlist name %q", name)
+	}
+	return os.WriteFile(cache.GetFilePath(taskID, name), []byte(content), 0644)
+}
+
+// GetTaskPlaylist reads a playlist stored by SaveTaskPlaylist.
+func (m *Manager) GetTaskPlaylist(taskID, name string) (string, error) {
+	if !isTaskDirName(taskID) {
+		return "", fmt.Errorf("invalid task id %q", taskID)
+	}
+	if !isTaskPlaylistName(name) {
+		return "", fmt.Errorf("invalid playlist name %q", name)
+	}
+	data, err := os.ReadFile(cache.GetFilePath(taskID, name))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// isTaskDirName reports whether taskID names a directory right inside the
+// cache directory.
+func isTaskDirName(taskID string) bool {
+	return taskID != "" && taskID != "." && taskID != ".." && !strings.ContainsAny(taskID, `/\`)
+}
+
+func isTaskPlaylistName(name string) bool {
+	return strings.HasSuffix(name, ".m3u8") && filepath.Base(name) == name && !strings.HasPrefix(name, ".")
+}
+
 func (m *Manager) listUsedM3U8Suffixes(storeDir, baseName string) (map[int]struct{}, error) {
 	prefixPath := filepath.Join(storeDir, baseName)
 	likePattern := prefixPath + "%.m3u8"
@@ -2,9 +2,15 @@ package task
 
 import (
 	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"hls-accelerator/internal/config"
+	playlist "hls-accelerator/internal/m3u8"
+
 	_ "modernc.org/sqlite"
 )
 
@@ -134,3 +140,187 @@ func TestSaveAndLoadTaskManifestIndexAndItems(t *testing.T) {
 		t.Fatalf("item url = %q, want %q", item.URL, "https://example.com/00001.ts")
 	}
 }
+
+func TestManifestStoresByteRangesAndExcludesMapsFromSegments(t *testing.T) {
+	m := newTestManager(t)
+	manifest := TaskManifest{
+		TaskID:        "task-map",
+		OriginalURL:   "https://example.com/fmp4.m3u8",
+		TotalSegments: 1,
+		Items: []ManifestItem{
+			{Filename: "init.mp4", URL: "https://example.com/init.mp4", Type: "map", Offset: 0, Length: 720},
+			{Filename: "00001.m4s", URL: "https://example.com/1.m4s", Type: "segment"},
+			{Filename: "audio0_00001.m4s", URL: "https://example.com/en/1.m4s", Type: "segment", Group: "audio0"},
+		},
+	}
+	if err := m.SaveTaskManifest(manifest); err != nil {
+		t.Fatalf("SaveTaskManifest: %v", err)
+	}
+
+	indexItems, err := m.LoadTaskManifestIndex(manifest.TaskID)
+	if err != nil {
+		t.Fatalf("LoadTaskManifestIndex: %v", err)
+	}
+	if indexItems[0].IsSegment {
+		t.Fatal("map item should not count as a segment")
+	}
+	if !indexItems[1].IsSegment {
+		t.Fatal("media item should count as a segment")
+	}
+
+	items, err := m.LoadManifestItemsByFilenames(manifest.TaskID, []string{"init.mp4"})
+	if err != nil {
+		t.Fatalf("LoadManifestItemsByFilenames: %v", err)
+	}
+	if item := items["init.mp4"]; item.Type != "map" || item.Length != 720 {
+		t.Fatalf("unexpected map item: %#v", item)
+	}
+
+	loaded, err := m.LoadTaskManifest(manifest.TaskID, manifest.OriginalURL, manifest.TotalSegments)
+	if err != nil {
+		t.Fatalf("LoadTaskManifest: %v", err)
+	}
+	if got := loaded.Items[2]; got.Group != "audio0" || !indexItems[2].IsSegment {
+		t.Fatalf("rendition segment should keep its group and count as a segment: %#v", got)
+	}
+}
+
+func TestInitTableAddsByteRangeColumnsToExistingManifest(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("open sqlite: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	if _, err := db.Exec(`CREATE TABLE task_manifest (
+		task_id TEXT NOT NULL,
+		seq INTEGER NOT NULL,
+		filename TEXT NOT NULL,
+		url TEXT NOT NULL DEFAULT '',
+		item_type TEXT NOT NULL DEFAULT 'segment',
+		PRIMARY KEY (task_id, filename)
+	)`); err != nil {
+		t.Fatalf("create legacy table: %v", err)
+	}
+
+	m := &Manager{db: db}
+	if err := m.InitTable(); err != nil {
+		t.Fatalf("InitTable: %v", err)
+	}
+	if err := m.InitTable(); err != nil {
+		t.Fatalf("InitTable second run: %v", err)
+	}
+	if _, err := db.Exec(`SELECT byte_offset, byte_length FROM task_manifest`); err != nil {
+		t.Fatalf("byte range columns missing: %v", err)
+	}
+	if _, err := db.Exec(`SELECT item_group FROM task_manifest`); err != nil {
+		t.Fatalf("item group column missing: %v", err)
+	}
+}
+
+func TestTaskHeadersArePersistedAndOverrideConfig(t *testing.T) {
+	m := newTestManager(t)
+	oldHeaders := config.GlobalConfig.Headers
+	config.GlobalConfig.Headers = map[string]string{"User-Agent": "config-agent", "Referer": "https://config.example/"}
+	t.Cleanup(func() { config.GlobalConfig.Headers = oldHeaders })
+
+	meta := TaskMetadata{
+		ID:          "task-headers",
+		Name:        "headers",
+		OriginalURL: "https://example.com/headers.m3u8",
+		Status:      TaskStatusDownloading,
+		Headers:     map[string]string{"referer": "https://site.example/", "Cookie": "session=1"},
+	}
+	if err := m.CreateTask(meta); err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	stored, err := m.GetTask(meta.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if stored.Headers["Cookie"] != "session=1" {
+		t.Fatalf("stored headers = %v", stored.Headers)
+	}
+
+	headers := m.TaskRequestHeaders(meta.ID)
+	want := map[string]string{"User-Agent": "config-agent", "Referer": "https://site.example/", "Cookie": "session=1"}
+	if len(headers) != len(want) {
+		t.Fatalf("headers = %v, want %v", headers, want)
+	}
+	for key, value := range want {
+		if headers[key] != value {
+			t.Fatalf("headers = %v, want %v", headers, want)
+		}
+	}
+	if got := m.TaskRequestHeaders("unknown")["Referer"]; got != "https://config.example/" {
+		t.Fatalf("unknown task Referer = %q, want the configured one", got)
+	}
+}
+
+func TestTaskAdRangesAreStoredAndAppended(t *testing.T) {
+	m := newTestManager(t)
+	meta := TaskMetadata{
+		ID:          "task-ads",
+		Name:        "ads",
+		OriginalURL: "https://example.com/ads.m3u8",
+		Status:      TaskStatusDownloading,
+		AdRanges:    []playlist.AdRange{{FirstSeq: 2, LastSeq: 3, Segments: 2, Source: "heuristic", Score: 0.8}},
+	}
+	if err := m.CreateTask(meta); err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	if err := m.AppendTaskAdRanges(meta.ID, []playlist.AdRange{{FirstSeq: 9, LastSeq: 9, Segments: 1, Source: "cdn"}}); err != nil {
+		t.Fatalf("AppendTaskAdRanges: %v", err)
+	}
+	stored, err := m.GetTask(meta.ID)
+	if err != nil {
+		t.Fatalf("GetTask: %v", err)
+	}
+	if len(stored.AdRanges) != 2 || stored.AdRanges[0].Score != 0.8 || stored.AdRanges[1].Source != "cdn" {
+		t.Fatalf("ad ranges = %+v", stored.AdRanges)
+	}
+}
+
+func TestRefreshM3U8FilesFollowsPublicAddress(t *testing.T) {
+	m := newTestManager(t)
+	oldStoreDir, oldPublic := config.GlobalConfig.M3U8StoreDir, config.GlobalConfig.PublicBaseURL
+	config.GlobalConfig.M3U8StoreDir = t.TempDir()
+	config.GlobalConfig.PublicBaseURL = "http://192.168.1.2:8084/"
+	t.Cleanup(func() {
+		config.GlobalConfig.M3U8StoreDir = oldStoreDir
+		config.GlobalConfig.PublicBaseURL = oldPublic
+	})
+
+	content := "#EXTM3U\n#EXTINF:4.000,\n/proxy/seg/task-file/00001.ts/https%3A%2F%2Fcdn.example.com%2Fa.ts\n#EXT-X-ENDLIST\n"
+	path, err := m.SaveTaskM3U8File("movie", content)
+	if err != nil {
+		t.Fatalf("SaveTaskM3U8File: %v", err)
+	}
+	meta := TaskMetadata{ID: "task-file", OriginalURL: "https://cdn.example.com/index.m3u8", M3U8FilePath: path, Status: TaskStatusCompleted, ProxiedContent: content}
+	if err := m.CreateTask(meta); err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	removed := meta
+	removed.ID, removed.M3U8FilePath = "task-removed", filepath.Join(config.GlobalConfig.M3U8StoreDir, "removed.m3u8")
+	if err := m.CreateTask(removed); err != nil {
+		t.Fatalf("CreateTask: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), "\nhttp://192.168.1.2:8084/proxy/seg/task-file/00001.ts/") {
+		t.Fatalf("m3u8 file = \n%s", data)
+	}
+
+	if rewritten, err := m.RefreshM3U8Files(); err != nil || rewritten != 0 {
+		t.Fatalf("RefreshM3U8Files = %d, %v, want nothing to rewrite", rewritten, err)
+	}
+	config.GlobalConfig.PublicBaseURL = "https://media.example.net"
+	if rewritten, err := m.RefreshM3U8Files(); err != nil || rewritten != 1 {
+		t.Fatalf("RefreshM3U8Files = %d, %v, want 1", rewritten, err)
+	}
+	data, _ = os.ReadFile(path)
+	if !strings.Contains(string(data), "\nhttps://media.example.net/proxy/seg/task-file/00001.ts/") {
+		t.Fatalf("refreshed m3u8 file = \n%s", data)
+	}
+	if _, err := os.Stat(removed.M3U8FilePath); !os.IsNotExist(err) {
+		t.Fatalf("a removed m3u8 file should stay removed: %v", err)
+	}
+}
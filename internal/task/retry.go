@@ -0,0 +1,104 @@
+package task
+
+import (
+	"math"
+	"math/rand"
+	"regexp"
+	"strings"
+	"time"
+
+	"hls-accelerator/internal/config"
+)
+
+const retryScanTick = time.Second
+
+type retryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Jitter      float64
+}
+
+func retryPolicyFromConfig() retryPolicy {
+	cfg := config.GlobalConfig
+	return retryPolicy{
+		MaxAttempts: cfg.RetryMaxAttempts,
+		BaseDelay:   time.Duration(cfg.RetryBaseDelayMs) * time.Millisecond,
+		MaxDelay:    time.Duration(cfg.RetryMaxDelayMs) * time.Millisecond,
+		Jitter:      cfg.RetryJitter,
+	}
+}
+
+// shouldRetry reports whether an item that has now failed `attempts` times may be
+// scheduled again.
+func (p retryPolicy) shouldRetry(attempts int, class failureClass) bool {
+	return class == failureTransient && attempts < p.MaxAttempts
+}
+
+// backoff returns the wait before the next attempt: BaseDelay doubled per failed
+// attempt, capped at MaxDelay and spread by ±Jitter so that a burst of failures
+// from one origin does not come back as a burst.
+func (p retryPolicy) backoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := float64(p.BaseDelay) * math.Pow(2, float64(attempts-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		delay *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+	if delay < 0 {
+		return 0
+	}
+	return time.Duration(delay)
+}
+
+type failureClass int
+
+const (
+	failureTransient failureClass = iota
+	failurePermanent
+)
+
+// aria2 exit codes, see the EXIT STATUS section of the aria2c manual.
+var (
+	permanentAria2Codes = map[string]struct{}{
+		"3":  {}, // resource not found
+		"9":  {}, // not enough disk space
+		"24": {}, // HTTP authorization failed
+	}
+	transientAria2Codes = map[string]struct{}{
+		"2":  {}, // timeout
+		"6":  {}, // network problem
+		"19": {}, // name resolution failed
+		"29": {}, // remote server temporarily unavailable
+	}
+)
+
+var httpStatusPattern = regexp.MustCompile(`\b([45]\d\d)\b`)
+
+// classifyFailure decides whether a failure is worth retrying automatically.
+// Unknown errors are treated as transient so they still get the retry budget.
+func classifyFailure(reason, errCode string) failureClass {
+	msg := strings.ToLower(reason)
+	if match := httpStatusPattern.FindStringSubmatch(msg); match != nil {
+		switch status := match[1]; {
+		case status == "404" || status == "410":
+			return failurePermanent
+		case status == "408" || status == "429" || status[0] == '5':
+			return failureTransient
+		}
+	}
+	if _, ok := permanentAria2Codes[errCode]; ok {
+		return failurePermanent
+	}
+	if _, ok := transientAria2Codes[errCode]; ok {
+		return failureTransient
+	}
+	if strings.Contains(msg, "not found") {
+		return failurePermanent
+	}
+	return failureTransient
+}
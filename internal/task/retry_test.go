@@ -0,0 +1,107 @@
+package task
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClassifyFailureSeparatesTransientFromPermanent(t *testing.T) {
+	cases := []struct {
+		reason string
+		code   string
+		want   failureClass
+	}{
+		{"Timeout.", "2", failureTransient},
+		{"The response status is not successful. status=503", "22", failureTransient},
+		{"connection reset by peer", "", failureTransient},
+		{"The response status is not successful. status=429", "22", failureTransient},
+		{"Resource not found", "3", failurePermanent},
+		{"The response status is not successful. status=404", "22", failurePermanent},
+		{"The response status is not successful. status=410", "22", failurePermanent},
+		{"manifest item not found", "", failurePermanent},
+		{"something odd happened", "1", failureTransient},
+	}
+	for _, tc := range cases {
+		if got := classifyFailure(tc.reason, tc.code); got != tc.want {
+			t.Fatalf("classifyFailure(%q, %q) = %v, want %v", tc.reason, tc.code, got, tc.want)
+		}
+	}
+}
+
+func TestRetryPolicyBackoffDoublesAndCaps(t *testing.T) {
+	policy := retryPolicy{MaxAttempts: 5, BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+	for i, expected := range want {
+		if got := policy.backoff(i + 1); got != expected {
+			t.Fatalf("backoff(%d) = %v, want %v", i+1, got, expected)
+		}
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		got := policy.backoff(1)
+		if got < 500*time.Millisecond || got > 1500*time.Millisecond {
+			t.Fatalf("jittered backoff = %v, want within ±50%% of 1s", got)
+		}
+	}
+}
+
+func TestMarkFailedSchedulesRetryUntilBudgetIsExhausted(t *testing.T) {
+	rt := newTaskRuntime("task-retry", 2, 2, []ManifestIndexItem{
+		{Seq: 0, Filename: "00001.ts", IsSegment: true},
+		{Seq: 1, Filename: "00002.ts", IsSegment: true},
+	}, TaskProgressFile{TaskID: "task-retry", Failed: []string{}}, false)
+	rt.retry = retryPolicy{MaxAttempts: 2, BaseDelay: time.Hour}
+
+	rt.markFailed("00001.ts", "Timeout.", "2")
+	if _, failed := rt.failed["00001.ts"]; failed {
+		t.Fatal("transient failure within budget should not mark item failed")
+	}
+	if _, waiting := rt.retryAt["00001.ts"]; !waiting {
+		t.Fatal("transient failure should schedule a retry")
+	}
+	for _, filename := range rt.claimPending(10) {
+		if filename == "00001.ts" {
+			t.Fatal("item waiting for backoff should not be claimed")
+		}
+	}
+	if rt.hasDueRetry(time.Now()) {
+		t.Fatal("retry should not be due before backoff elapses")
+	}
+	if !rt.hasDueRetry(time.Now().Add(2 * time.Hour)) {
+		t.Fatal("retry should be due after backoff elapses")
+	}
+
+	rt.markFailed("00001.ts", "Timeout.", "2")
+	if _, failed := rt.failed["00001.ts"]; !failed {
+		t.Fatal("item should be failed once its retry budget is exhausted")
+	}
+
+	rt.markFailed("00002.ts", "Resource not found", "3")
+	if _, failed := rt.failed["00002.ts"]; !failed {
+		t.Fatal("permanent failure should fail fast")
+	}
+	if _, waiting := rt.retryAt["00002.ts"]; waiting {
+		t.Fatal("permanent failure should not schedule a retry")
+	}
+}
+
+func TestPendingDispatchableCountSkipsItemsWaitingForBackoff(t *testing.T) {
+	rt := newTaskRuntime("task-backoff-count", 3, 3, []ManifestIndexItem{
+		{Seq: 0, Filename: "00001.ts", IsSegment: true},
+		{Seq: 1, Filename: "00002.ts", IsSegment: true},
+		{Seq: 2, Filename: "00003.ts", IsSegment: true},
+	}, TaskProgressFile{TaskID: "task-backoff-count", Failed: []string{}}, false)
+	rt.retry = retryPolicy{MaxAttempts: 3, BaseDelay: time.Hour}
+	rt.markFailed("00001.ts", "Timeout.", "2")
+	rt.bindGID("00002.ts", "gid-2")
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if n := rt.pendingDispatchableCountLocked(time.Now()); n != 1 {
+		t.Fatalf("dispatchable = %d, want only 00003.ts", n)
+	}
+	if n := rt.pendingDispatchableCountLocked(time.Now().Add(2 * time.Hour)); n != 2 {
+		t.Fatalf("dispatchable after the backoff = %d, want 00001.ts and 00003.ts", n)
+	}
+}
@@ -62,6 +62,16 @@ set -e
 
 ARIA2_CONF_PATH="${ARIA2_CONF_PATH:-/app/aria2.conf}"
 
+# With ARIA2_MANAGED=true hls-accel runs aria2c itself; it reads the same
+# variable over aria2_managed. Without it, aria2_managed in config.json decides.
+if [ -z "${ARIA2_MANAGED:-}" ] && grep -Eq '"aria2_managed"[[:space:]]*:[[:space:]]*true' /app/config.json 2>/dev/null; then
+    ARIA2_MANAGED=true
+fi
+if [ "${ARIA2_MANAGED:-}" = "true" ]; then
+    echo "Starting hls-accel with managed aria2c..."
+    exec /app/hls-accel
+fi
+
 echo "Starting Aria2 RPC server with config: ${ARIA2_CONF_PATH}"
 if [ -n "${ARIA2_SECRET:-}" ]; then
     aria2c \